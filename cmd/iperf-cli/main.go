@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"iperf-go/pkg/iperf"
@@ -32,16 +34,52 @@ func parseFlags() *iperf.Config {
 	var serverFlag = flag.Bool("s", false, "server side")
 	var clientFlag = flag.String("c", "", "client side (server address)")
 	var reverseFlag = flag.Bool("R", false, "reverse mode. client receive, server send")
+	var bidirFlag = flag.Bool("bidir", false, "bidirectional mode. client and server send and receive")
 	var portFlag = flag.Uint("p", 5201, "connect/listen port")
-	var protocolFlag = flag.String("proto", "tcp", "protocol under test")
+	var protocolFlag = flag.String("proto", "tcp", "protocol under test ("+strings.Join(iperf.Protocols(), ", ")+")")
 	var durFlag = flag.Uint("d", 10, "duration (s)")
+	var omitFlag = flag.Uint("O", 0, "omit the first n seconds from the results")
+	var rrFlag = flag.Bool("rr", false, "request/response mode, report transaction rate and latency")
+	var reqSizeFlag = flag.Uint("req", 1, "request size of the request/response and connection rate modes, 0 for no request with -crr")
+	var respSizeFlag = flag.Uint("resp", 1, "response size of the request/response and connection rate modes")
+	var crrFlag = flag.Bool("crr", false, "connection rate mode, report connections per second and connect latency")
+	var fileFlag = flag.String("F", "", "send the content of this file, or write the received data to it")
+	var fileLoopFlag = flag.Bool("Floop", false, "send the -F file over and over instead of ending the test at its end")
+	var zeroCopyFlag = flag.Bool("Z", false, "zero copy send with sendfile from a memfd (tcp, linux)")
+	var zeroCopyMsgFlag = flag.Bool("Zmsg", false, "zero copy send with MSG_ZEROCOPY instead of sendfile, implies -Z")
+	var patternFlag = flag.String("pattern", iperf.PATTERN_DEFAULT, "payload pattern ("+strings.Join(iperf.PatternList, ", ")+")")
+	var seedFlag = flag.Uint64("seed", 0, "seed of the seq payload pattern")
+	var verifyFlag = flag.Bool("verify", false, "the receiver checks every block for corrupted, missing and reordered bytes")
+	var owdFlag = flag.Bool("owd", false, "one-way delay mode, the sender stamps every block with its send time")
+	var profileFlag = flag.String("profile", "", "traffic profile of the senders, name[,key=value...] ("+strings.Join(iperf.ProfileList, ", ")+"), implies -owd")
+	var windowFlag = flag.String("w", "0", "socket buffer size of the tcp streams, SO_SNDBUF and SO_RCVBUF (K/M/G)")
+	var mssFlag = flag.Uint("M", 0, "maximum segment size of the tcp streams, TCP_MAXSEG")
+	var congestionFlag = flag.String("C", "", "congestion control algorithm of the tcp streams, TCP_CONGESTION")
+	var tosFlag = flag.String("S", "", "TOS byte or DSCP name (EF, AF41, CS1...) of the data packets, the receiver checks it survived")
+	var flowLabelFlag = flag.Uint("L", 0, "ipv6 flow label of the tcp and udp streams")
+	var bytesFlag = flag.String("n", "0", "number of bytes to transmit instead of -d (K/M/G)")
+	var blocksFlag = flag.String("k", "0", "number of blocks to transmit instead of -d (K/M/G)")
 	var intervalFlag = flag.Uint("i", 1000, "test interval (ms)")
 	var parallelFlag = flag.Uint("P", 1, "The number of simultaneous connections")
 	var blksizeFlag = flag.Uint("l", 4*1024, "send/read block size")
 	var bandwidthFlag = flag.String("b", "0", "bandwidth limit. (M/K), default MB/s")
+	var fqRateFlag = flag.String("fq-rate", "", "kernel pacing rate of the tcp and udp sender streams, SO_MAX_PACING_RATE (M/K, default MB/s)")
+	var udpBatchFlag = flag.Uint("udp-batch", 0, "udp messages per sendmmsg/recvmmsg, 0 for a syscall per datagram (linux)")
+	var gsoFlag = flag.Bool("gso", false, "udp segmentation offload, the kernel splits messages of several blocks into datagrams, UDP_SEGMENT (linux)")
+	var groFlag = flag.Bool("gro", false, "udp receive offload, the kernel coalesces the received datagrams, UDP_GRO (linux)")
 	var debugFlag = flag.Bool("debug", false, "debug mode")
 	var infoFlag = flag.Bool("info", false, "info mode")
+	var verboseFlag = flag.Bool("V", false, "verbose: print cwnd, ssthresh, windows, min rtt, delivery rate and limits from TCP_INFO of the tcp streams every interval (linux)")
 	var noDelayFlag = flag.Bool("D", false, "no delay option")
+	var ipv4Flag = flag.Bool("4", false, "only use IPv4")
+	var ipv6Flag = flag.Bool("6", false, "only use IPv6")
+	var bindFlag = flag.String("B", "", "bind the sockets to this local address")
+	var cportFlag = flag.String("cport", "", "source port of the client's data streams, counted up for each stream, or a range first-last")
+	var affinityFlag = flag.String("A", "", "pin the process to these cpus, n[,m][-k][/server cpus] such as 2-5/6-9 (linux)")
+	var pinStreamsFlag = flag.Bool("pin-streams", false, "give every stream a thread of its own pinned to one cpu of -A in turn (linux)")
+	var gomaxprocsFlag = flag.Uint("gomaxprocs", 0, "set GOMAXPROCS, 0 for the go default")
+	var bindDevFlag = flag.String("bind-dev", "", "bind the sockets to this network interface, SO_BINDTODEVICE (linux)")
+	var listenersFlag = flag.Uint("listeners", 1, "server: SO_REUSEPORT listeners on the port, each with an accept loop pinned to a cpu of its own in turn, 0 for one per cpu (linux)")
 
 	// RUDP 特定选项
 	var sndWndFlag = flag.Uint("sw", 10, "rudp send window size")
@@ -53,6 +91,13 @@ func parseFlags() *iperf.Config {
 	var fastResendFlag = flag.Uint("fr", 0, "rudp fast resend strategy. 0 indicate turn off fast resend")
 	var datashardsFlag = flag.Uint("data", 0, "rudp/kcp FEC dataShards option")
 	var parityshardsFlag = flag.Uint("parity", 0, "rudp/kcp FEC parityShards option")
+	var mtuFlag = flag.Uint("mtu", iperf.KCP_DEFAULT_MTU, "rudp/kcp session mtu (bytes)")
+	var ackNoDelayFlag = flag.Bool("ack-nodelay", false, "rudp/kcp ack at once instead of with the next flush")
+	var msgModeFlag = flag.Bool("msg-mode", false, "rudp/kcp message mode instead of stream mode")
+	var cryptFlag = flag.String("crypt", iperf.CRYPT_NONE, "kcp payload encryption ("+strings.Join(iperf.CryptList, ", ")+")")
+	var keyFlag = flag.String("key", iperf.CRYPT_DEFAULT_KEY, "kcp passphrase the crypt key is derived from, the same on both ends")
+	var kcpDeadlineFlag = flag.Uint("kcp-deadline", 0, "rudp/kcp session read/write deadline (s), 0 for the test duration plus a margin")
+	var sessionStatsFlag = flag.Bool("session-stats", false, "rudp/kcp count the statistics of every session on the wire with -P or --bidir, costs the batched socket io")
 
 	flag.Parse()
 
@@ -81,11 +126,79 @@ func parseFlags() *iperf.Config {
 	config.Protocol = *protocolFlag
 	config.Duration = time.Duration(*durFlag) * time.Second
 	config.Interval = time.Duration(*intervalFlag) * time.Millisecond
+	config.Omit = time.Duration(*omitFlag) * time.Second
+	config.RR = *rrFlag
+	config.ReqSize = *reqSizeFlag
+	config.RespSize = *respSizeFlag
+	config.CRR = *crrFlag
+	config.File = *fileFlag
+	config.FileLoop = *fileLoopFlag
+	config.ZeroCopy = *zeroCopyFlag
+	config.ZeroCopyMsg = *zeroCopyMsgFlag
+	config.Pattern = *patternFlag
+	config.Seed = *seedFlag
+	config.Verify = *verifyFlag
+	config.OWD = *owdFlag
+	config.Profile = *profileFlag
 	config.Reverse = *reverseFlag
+	config.Bidir = *bidirFlag
 	config.NoDelay = *noDelayFlag
+
+	if *ipv4Flag && *ipv6Flag {
+		fmt.Println("Error: -4 and -6 can not be used together")
+		return nil
+	} else if *ipv4Flag {
+		config.IPVersion = 4
+	} else if *ipv6Flag {
+		config.IPVersion = 6
+	}
+	config.BindAddr = *bindFlag
+	config.ClientPort = *cportFlag
+	config.BindDevice = *bindDevFlag
+	config.Listeners = *listenersFlag
+	if config.Listeners == 0 {
+		config.Listeners = uint(runtime.NumCPU())
+	}
+	config.PinStreams = *pinStreamsFlag
+	config.Verbose = *verboseFlag
+	config.GoMaxProcs = *gomaxprocsFlag
 	config.Parallel = *parallelFlag
 	config.Blksize = *blksizeFlag
 
+	var err error
+	if config.Bytes, err = iperf.ParseSize(*bytesFlag); err != nil {
+		fmt.Printf("Error: invalid -n %v\n", *bytesFlag)
+		return nil
+	}
+	if config.Blocks, err = iperf.ParseSize(*blocksFlag); err != nil {
+		fmt.Printf("Error: invalid -k %v\n", *blocksFlag)
+		return nil
+	}
+	if config.Affinity, config.ServerAffinity, err = iperf.ParseAffinity(*affinityFlag); err != nil {
+		fmt.Printf("Error: invalid -A %v\n", *affinityFlag)
+		return nil
+	}
+	window, err := iperf.ParseSize(*windowFlag)
+	if err != nil {
+		fmt.Printf("Error: invalid -w %v\n", *windowFlag)
+		return nil
+	}
+	config.Window = uint(window)
+	config.MSS = *mssFlag
+	config.Congestion = *congestionFlag
+	config.TOS = *tosFlag
+	config.FlowLabel = *flowLabelFlag
+	config.UDPBatch = *udpBatchFlag
+	config.GSO = *gsoFlag
+	config.GRO = *groFlag
+
+	if *fqRateFlag != "" {
+		if config.FQRate, err = iperf.ParseRate(*fqRateFlag); err != nil {
+			fmt.Printf("Error: invalid -fq-rate %v\n", *fqRateFlag)
+			return nil
+		}
+	}
+
 	// 解析带宽限制
 	if *bandwidthFlag != "0" {
 		bwStr := *bandwidthFlag
@@ -121,6 +234,13 @@ func parseFlags() *iperf.Config {
 	config.FastResend = *fastResendFlag
 	config.DataShards = *datashardsFlag
 	config.ParityShards = *parityshardsFlag
+	config.MTU = *mtuFlag
+	config.AckNoDelay = *ackNoDelayFlag
+	config.MessageMode = *msgModeFlag
+	config.Deadline = time.Duration(*kcpDeadlineFlag) * time.Second
+	config.Crypt = *cryptFlag
+	config.CryptKey = *keyFlag
+	config.SessionStats = *sessionStatsFlag
 
 	// 日志级别
 	if *debugFlag {
@@ -6,6 +6,7 @@ require (
 	github.com/damao33/rudp-go v0.2.1
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
 	github.com/xtaci/kcp-go/v5 v5.6.2
+	golang.org/x/crypto v0.22.0
 	golang.org/x/sys v0.30.0
 	gotest.tools/v3 v3.5.2
 )
@@ -18,6 +19,5 @@ require (
 	github.com/templexxx/cpu v0.1.1 // indirect
 	github.com/templexxx/xorsimd v0.4.3 // indirect
 	github.com/tjfoc/gmsm v1.4.1 // indirect
-	golang.org/x/crypto v0.22.0 // indirect
 	golang.org/x/net v0.23.0 // indirect
 )
@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// getAffinity returns the cpus the calling thread may run on, the ones of the process unless it was pinned
+func getAffinity() ([]int, error) {
+	var set unix.CPUSet
+
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, os.NewSyscallError("sched_getaffinity", err)
+	}
+
+	var cpus []int
+
+	for cpu := 0; cpu < CPU_SET_SIZE; cpu++ {
+		if set.IsSet(cpu) {
+			cpus = append(cpus, cpu)
+		}
+	}
+
+	return cpus, nil
+}
+
+// acceptThreads holds the threads of the accept loops pinned by pinAcceptThread, setProcessAffinity leaves them
+// on their cpu
+var acceptThreads sync.Map
+
+// setProcessAffinity pins every thread of the process to cpus, threads started later inherit the mask of the
+// thread starting them. A thread started during a pass is caught by the next one.
+func setProcessAffinity(cpus []int) error {
+	set := cpuSet(cpus)
+	done := make(map[int]bool)
+
+	acceptThreads.Range(func(tid, _ interface{}) bool {
+		done[tid.(int)] = true
+
+		return true
+	})
+
+	for {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+
+		pinned := 0
+
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil || done[tid] {
+				continue
+			}
+
+			if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+				return os.NewSyscallError("sched_setaffinity", err)
+			}
+
+			done[tid] = true
+			pinned++
+		}
+
+		if pinned == 0 {
+			return nil
+		}
+	}
+}
+
+// pinThread locks the calling goroutine to its thread and pins the thread to cpu. The thread exits together
+// with the goroutine, no other goroutine runs on it.
+func pinThread(cpu int) error {
+	runtime.LockOSThread()
+
+	set := cpuSet([]int{cpu})
+
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return os.NewSyscallError("sched_setaffinity", err)
+	}
+
+	return nil
+}
+
+// pinAcceptThread pins the calling goroutine like pinThread, the thread keeps its cpu when -A of a test moves
+// the process. The returned func releases the thread before the goroutine exits.
+func pinAcceptThread(cpu int) (func(), error) {
+	if err := pinThread(cpu); err != nil {
+		return nil, err
+	}
+
+	tid := unix.Gettid()
+	acceptThreads.Store(tid, true)
+
+	return func() { acceptThreads.Delete(tid) }, nil
+}
+
+// setIncomingCPU sets SO_INCOMING_CPU of a listening socket, the kernel prefers the SO_REUSEPORT listener of the
+// cpu a connection request is processed on
+func setIncomingCPU(fd uintptr, cpu int) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_INCOMING_CPU, cpu); err != nil {
+		return os.NewSyscallError("setsockopt SO_INCOMING_CPU", err)
+	}
+
+	return nil
+}
+
+func cpuSet(cpus []int) unix.CPUSet {
+	var set unix.CPUSet
+
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+
+	return set
+}
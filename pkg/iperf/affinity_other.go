@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"errors"
+)
+
+func getAffinity() ([]int, error) {
+	return nil, errors.New("cpu affinity not supported on this platform")
+}
+
+func setProcessAffinity(cpus []int) error {
+	return errors.New("cpu affinity not supported on this platform")
+}
+
+func pinThread(cpu int) error {
+	return errors.New("cpu affinity not supported on this platform")
+}
+
+func pinAcceptThread(cpu int) (func(), error) {
+	return nil, errors.New("cpu affinity not supported on this platform")
+}
+
+func setIncomingCPU(fd uintptr, cpu int) error {
+	return errors.New("SO_INCOMING_CPU not supported on this platform")
+}
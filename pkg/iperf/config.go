@@ -1,6 +1,9 @@
 package iperf
 
 import (
+	"fmt"
+	"math"
+	"net"
 	"time"
 )
 
@@ -10,31 +13,106 @@ type Config struct {
 	Role       Role          // 角色：客户端或服务器
 	ServerAddr string        // 服务器地址（客户端模式需要）
 	Port       uint          // 端口号
-	Protocol   string        // 协议类型: tcp, udp, rudp, kcp
+	Protocol   string        // 协议类型: tcp, udp, rudp, kcp, mptcp
 	Duration   time.Duration // 测试持续时间
 	Interval   time.Duration // 报告间隔
+	Omit       time.Duration // 忽略开始阶段的统计时长 (秒)
 	Reverse    bool          // 反向模式
+	Bidir      bool          // 双向模式，客户端和服务器同时发送和接收
 	NoDelay    bool          // TCP no delay 选项
+	IPVersion  uint          // IP 版本: 0 自动, 4 仅 IPv4, 6 仅 IPv6
 
 	// 连接配置
-	Parallel uint // 并行连接数
-	Blksize  uint // 块大小
-	Burst    bool // 突发模式
-	Rate     uint // 带宽限制 (bits per second)
+	Parallel uint   // 并行连接数
+	Blksize  uint   // 块大小
+	Burst    bool   // 突发模式
+	Rate     uint   // 带宽限制 (bits per second)
+	Bytes    uint64 // 传输字节数限制，设置后忽略 Duration
+	Blocks   uint64 // 传输块数限制，设置后忽略 Duration
+
+	// 请求/响应模式配置
+	RR       bool // 请求/响应模式，报告事务速率和延迟
+	ReqSize  uint // 请求大小 (bytes)
+	RespSize uint // 响应大小 (bytes)
+	CRR      bool // 连接速率模式，每个流反复建立连接、可选请求/响应后关闭，ReqSize 为 0 时不交换数据
+
+	// 文件配置，仅作用于本端
+	File     string // 发送端发送该文件的内容，接收端将收到的数据写入该文件
+	FileLoop bool   // 循环发送文件，否则发送到文件末尾时结束测试
+
+	// TCP 零拷贝发送配置（仅 Linux）
+	ZeroCopy    bool // 使用 sendfile 从 memfd 发送
+	ZeroCopyMsg bool // 使用 MSG_ZEROCOPY 代替 sendfile，隐含 ZeroCopy
+
+	// 负载与数据校验配置
+	Pattern string // 负载模式: default, random, repeat, zeros, seq，空值等同 default
+	Seed    uint64 // seq 模式的随机种子
+	Verify  bool   // 接收端校验每个数据块，报告损坏、丢失和乱序的字节数
+
+	// 单向时延配置
+	OWD bool // 发送端在每个数据块中写入发送时间，接收端报告单向时延（时钟偏差通过控制连接估算）
+
+	// 流量模型配置
+	Profile string // 发送端流量模型 name[,key=value...]: onoff, voip, video, custom，隐含 OWD
+
+	// TCP 套接字配置
+	Window uint // 数据流的 SO_SNDBUF 和 SO_RCVBUF (bytes)，0 使用内核默认值
+	MSS    uint // 数据流的 TCP_MAXSEG (bytes)，0 使用内核默认值
+
+	// TCP 拥塞控制配置
+	Congestion string // 数据流的拥塞控制算法 (TCP_CONGESTION)，如 cubic、bbr、reno，空值使用内核默认值
+
+	// 服务类型标记配置
+	TOS       string // 数据包的 TOS 字节或 DSCP 名称 (EF、AF41、CS1...)，接收端检查标记是否保留；空值使用协议默认值
+	FlowLabel uint   // TCP/UDP 数据流的 IPv6 流标签，0 不设置
+
+	// 内核 pacing 配置
+	FQRate uint64 // 发送数据流的 SO_MAX_PACING_RATE (bits per second)，由 fq 队列或 TCP 自身均匀发送，仅 TCP/UDP，0 不设置
+
+	// UDP 批量收发配置 (仅 Linux)
+	UDPBatch uint // 每次 sendmmsg/recvmmsg 收发的消息数，0 每个数据报一次系统调用
+	GSO      bool // UDP_SEGMENT，一个消息携带多个数据块，由内核拆分为数据报
+	GRO      bool // UDP_GRO，接收端内核合并收到的数据报
+
+	// CPU 亲和性配置
+	Affinity       string // 本端进程绑定的 CPU 列表，如 0-3,8 (仅 Linux)，空值不绑定
+	ServerAffinity string // 客户端请求服务器进程绑定的 CPU 列表，空值使用服务器自身的配置
+	PinStreams     bool   // 每个数据流的收发协程独占一个线程，依次绑定到 CPU 列表中的一个 CPU
+	GoMaxProcs     uint   // 设置 GOMAXPROCS，0 保持 Go 默认值
+
+	// 本地绑定配置
+	BindAddr   string // 套接字绑定的本地地址 (IP)，未设置 IPVersion 时同时决定地址族
+	ClientPort string // 客户端数据流的源端口：单个端口时每个流依次加一，或范围 first-last
+	BindDevice string // 套接字绑定的网络接口 (SO_BINDTODEVICE，仅 Linux)
+
+	// 服务器监听配置
+	Listeners uint // 服务器在同一端口上打开的 SO_REUSEPORT 监听器数量，每个监听器的 accept 协程依次绑定到进程的一个 CPU (仅 Linux)，0 或 1 使用单个监听器
 
 	// RUDP/KCP 特定配置
-	SndWnd        uint // 发送窗口大小
-	RcvWnd        uint // 接收窗口大小
-	ReadBufSize   uint // 读缓冲区大小 (bytes)
-	WriteBufSize  uint // 写缓冲区大小 (bytes)
-	FlushInterval uint // 刷新间隔 (ms)
-	NoCong        bool // 禁用拥塞控制
-	FastResend    uint // 快速重传策略
-	DataShards    uint // FEC 数据分片
-	ParityShards  uint // FEC 校验分片
+	SndWnd        uint          // 发送窗口大小
+	RcvWnd        uint          // 接收窗口大小
+	ReadBufSize   uint          // 读缓冲区大小 (bytes)
+	WriteBufSize  uint          // 写缓冲区大小 (bytes)
+	FlushInterval uint          // 刷新间隔 (ms)
+	NoCong        bool          // 禁用拥塞控制
+	FastResend    uint          // 快速重传策略
+	DataShards    uint          // FEC 数据分片
+	ParityShards  uint          // FEC 校验分片
+	MTU           uint          // 会话 MTU (bytes)，0 使用默认值 1400
+	AckNoDelay    bool          // 收到数据立即回复 ACK，不等下一次刷新
+	MessageMode   bool          // 消息模式，默认流模式
+	Deadline      time.Duration // 会话读写截止时间，0 为测试时长加余量（按字节数或块数限制时不设置）
+
+	// KCP 加密配置
+	Crypt    string // KCP 负载加密方式 (aes、aes-128、aes-192、salsa20、sm4、xor...)，空值或 none 不加密
+	CryptKey string // 派生加密密钥的口令，两端需一致，空值使用默认口令
+
+	// RUDP/KCP 统计配置
+	SessionStats bool // 多个会话时在线路上按会话统计重传、丢包等，会关闭库的批量收发，加密时每个包多解密一次；默认由第一个流报告整个进程的计数
 
 	// 日志配置
 	LogLevel LogLevel // 日志级别
+	Verbose  bool     // 每个间隔打印 TCP 数据流的 TCP_INFO：cwnd、ssthresh、窗口、min rtt、投递速率和受限时间 (仅 Linux)
 	Logger   Logger   // 自定义日志记录器（可选）
 }
 
@@ -80,12 +158,15 @@ func DefaultConfig() *Config {
 		Parallel:      1,
 		Blksize:       DEFAULT_TCP_BLKSIZE,
 		Burst:         true,
+		ReqSize:       1,
+		RespSize:      1,
 		SndWnd:        10,
 		RcvWnd:        512,
 		ReadBufSize:   4 * 1024 * 1024,
 		WriteBufSize:  4 * 1024 * 1024,
 		FlushInterval: 10,
 		NoCong:        true,
+		MTU:           KCP_DEFAULT_MTU,
 		LogLevel:      LogLevelError,
 	}
 }
@@ -110,5 +191,169 @@ func ClientConfig(serverAddr string, port uint) *Config {
 // Validate 验证配置的有效性
 func (c *Config) Validate() error {
 	// TODO: 添加配置验证逻辑
+	if c.Reverse && c.Bidir {
+		return fmt.Errorf("reverse and bidir can not be used together")
+	}
+
+	if c.RR && (c.ReqSize == 0 || c.RespSize == 0) {
+		return fmt.Errorf("request and response size must not be 0")
+	}
+
+	if c.CRR && (c.RR || c.Reverse || c.Bidir || c.Bytes != 0) {
+		return fmt.Errorf("crr can not be used together with rr, reverse, bidir or bytes")
+	}
+
+	if c.CRR && crrUnsupported(c.Protocol) {
+		return fmt.Errorf("crr needs a connection oriented protocol, %s has no connection setup", c.Protocol)
+	}
+
+	if c.File != "" && (c.RR || c.CRR || c.Bidir) {
+		return fmt.Errorf("file can not be used together with rr, crr or bidir")
+	}
+
+	if (c.ZeroCopy || c.ZeroCopyMsg) && (c.Protocol != TCP_NAME && c.Protocol != MPTCP_NAME || c.File != "") {
+		return fmt.Errorf("zero copy needs tcp or mptcp and can not be used together with file")
+	}
+
+	if (c.Window != 0 || c.MSS != 0 || c.Congestion != "") && c.Protocol != TCP_NAME && c.Protocol != MPTCP_NAME {
+		return fmt.Errorf("window, mss and congestion control need tcp or mptcp")
+	}
+
+	if c.Congestion != "" {
+		if err := checkCongestion(c.Congestion); err != nil {
+			return err
+		}
+	}
+
+	if c.TOS != "" {
+		if _, err := ParseTOS(c.TOS); err != nil {
+			return err
+		}
+	}
+
+	if c.FlowLabel > FLOW_LABEL_MAX {
+		return fmt.Errorf("invalid flow label: %d, expect up to %d", c.FlowLabel, FLOW_LABEL_MAX)
+	}
+
+	if c.FQRate != 0 && c.Protocol != TCP_NAME && c.Protocol != UDP_NAME {
+		return fmt.Errorf("fq rate needs tcp or udp")
+	}
+
+	if c.FlowLabel != 0 && c.Protocol != TCP_NAME && c.Protocol != UDP_NAME {
+		return fmt.Errorf("flow label needs tcp or udp")
+	}
+
+	if c.UDPBatch > UDP_MAX_BATCH {
+		return fmt.Errorf("invalid udp batch: %d, expect up to %d", c.UDPBatch, UDP_MAX_BATCH)
+	}
+
+	if (c.UDPBatch != 0 || c.GSO || c.GRO) && (c.Protocol != UDP_NAME || c.File != "" || c.Profile != "" || c.RR || c.CRR) {
+		return fmt.Errorf("udp batch, gso and gro need udp and can not be used with file, profile, rr or crr")
+	}
+
+	if c.MTU != 0 && (c.MTU < KCP_MIN_MTU || c.MTU > KCP_MAX_MTU) {
+		return fmt.Errorf("invalid mtu: %d, expect %d to %d", c.MTU, KCP_MIN_MTU, KCP_MAX_MTU)
+	}
+
+	if c.Deadline != 0 && c.Deadline < time.Second {
+		return fmt.Errorf("invalid deadline: %v, expect at least 1s", c.Deadline)
+	}
+
+	if c.Deadline != 0 && c.Bytes == 0 && c.Blocks == 0 && c.Deadline <= c.Duration+c.Omit {
+		return fmt.Errorf("invalid deadline: %v, expect longer than the test", c.Deadline)
+	}
+
+	if c.Window > math.MaxInt32 || c.MSS > math.MaxInt32 {
+		return fmt.Errorf("invalid window or mss: %d, %d", c.Window, c.MSS)
+	}
+
+	for _, cpus := range []string{c.Affinity, c.ServerAffinity} {
+		if cpus == "" {
+			continue
+		}
+
+		if _, err := parseCPUList(cpus); err != nil {
+			return err
+		}
+	}
+
+	if c.Crypt != "" && !IsCryptValid(c.Crypt) {
+		return fmt.Errorf("invalid crypt: %s", c.Crypt)
+	}
+
+	if c.Crypt != "" && c.Crypt != CRYPT_NONE && c.Protocol != KCP_NAME {
+		return fmt.Errorf("crypt needs kcp")
+	}
+
+	if c.Pattern != "" && !IsPatternValid(c.Pattern) {
+		return fmt.Errorf("invalid payload pattern: %s", c.Pattern)
+	}
+
+	// the one-way delay and burst headers come first in a block
+	var headerSize uint
+	if c.Profile != "" {
+		headerSize = OWD_HEADER_SIZE + BURST_HEADER_SIZE
+	} else if c.OWD {
+		headerSize = OWD_HEADER_SIZE
+	}
+
+	if c.Verify && c.Blksize <= headerSize+VERIFY_HEADER_SIZE {
+		return fmt.Errorf("block size must be larger than %d bytes to verify", headerSize+VERIFY_HEADER_SIZE)
+	}
+
+	if headerSize > 0 && c.Blksize < headerSize {
+		return fmt.Errorf("block size must be at least %d bytes to carry the send time", headerSize)
+	}
+
+	if (c.Verify || c.Pattern != "" && c.Pattern != PATTERN_DEFAULT) && (c.RR || c.CRR || c.File != "") {
+		return fmt.Errorf("pattern and verify can not be used together with rr, crr or file")
+	}
+
+	if (c.ZeroCopy || c.ZeroCopyMsg) && (c.Verify || c.Pattern == PATTERN_RANDOM || c.Pattern == PATTERN_SEQ) {
+		return fmt.Errorf("zero copy can not be used together with verify or a changing pattern")
+	}
+
+	if (c.OWD || c.Profile != "") && (c.RR || c.CRR || c.File != "" || c.ZeroCopy || c.ZeroCopyMsg) {
+		return fmt.Errorf("one-way delay can not be used together with rr, crr, file or zero copy")
+	}
+
+	if c.Profile != "" {
+		if c.Verify {
+			return fmt.Errorf("profile can not be used together with verify")
+		}
+
+		if _, err := newTrafficProfile(c.Profile, c.Rate, int(c.Blksize), nil); err != nil {
+			return err
+		}
+	}
+
+	if c.IPVersion != 0 && c.IPVersion != 4 && c.IPVersion != 6 {
+		return fmt.Errorf("invalid ip version: %d", c.IPVersion)
+	}
+
+	if err := (&IperfTest{ipVersion: c.IPVersion}).setBindAddr(c.BindAddr); err != nil {
+		return err
+	}
+
+	if c.ClientPort != "" {
+		if c.CRR {
+			return fmt.Errorf("client port can not be used together with crr")
+		}
+
+		if _, _, err := ParsePortRange(c.ClientPort); err != nil {
+			return err
+		}
+	}
+
+	if c.BindDevice != "" {
+		if _, err := net.InterfaceByName(c.BindDevice); err != nil {
+			return fmt.Errorf("invalid bind device %v: %w", c.BindDevice, err)
+		}
+	}
+
+	if c.Listeners > LISTENERS_MAX {
+		return fmt.Errorf("invalid listeners: %d, expect up to %d", c.Listeners, LISTENERS_MAX)
+	}
+
 	return nil
 }
@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuTime returns the user and system cpu time the process has used
+func cpuTime() (user, sys time.Duration) {
+	var ru unix.Rusage
+
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano())
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"time"
+)
+
+func cpuTime() (user, sys time.Duration) {
+	return 0, 0
+}
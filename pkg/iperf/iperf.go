@@ -3,10 +3,16 @@ package iperf
 import (
 	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"sync"
 	"time"
 )
 
-var ProtocolList = []string{"tcp", "udp", "rudp", "kcp"}
+// ProtocolList holds the names of the built-in protocols.
+//
+// Deprecated: use Protocols, which includes the protocols registered with RegisterProtocol.
+var ProtocolList []string
 
 const (
 	IPERF_START           = 1
@@ -15,6 +21,7 @@ const (
 	IPERF_EXCHANGE_PARAMS = 4
 	IPERF_EXCHANGE_RESULT = 5
 	IPERF_DISPLAY_RESULT  = 6
+	IPERF_CLOCK_SYNC      = 7 // the server accepted the params, the clock probes of -owd follow
 
 	STREAM_CLOSE = 10
 
@@ -28,16 +35,21 @@ const (
 	/* unexpected situation */
 	CLIENT_TERMINATE = 50
 	SERVER_TERMINATE = 51
+	SERVER_ERROR     = 52 // the server refused the test, the length and text of its error follow
+
+	SERVER_ERROR_MAX = 1024      // bytes of the error text
+	PARAMS_MAX       = 64 * 1024 // bytes of the params the server accepts
 
 	IPERF_SENDER   = true
 	IPERF_RECEIVER = false
 )
 
 const (
-	TCP_NAME  = "tcp"
-	UDP_NAME  = "udp"
-	RUDP_NAME = "rudp"
-	KCP_NAME  = "kcp"
+	TCP_NAME   = "tcp"
+	UDP_NAME   = "udp"
+	RUDP_NAME  = "rudp"
+	KCP_NAME   = "kcp"
+	MPTCP_NAME = "mptcp"
 )
 
 const (
@@ -50,11 +62,19 @@ const (
 	DEFAULT_WRITE_BUF_SIZE = 4 * 1024 * 1024 // rudp write buffer size
 	DEFAULT_READ_BUF_SIZE  = 4 * 1024 * 1024 // rudp read buffer size
 	DEFAULT_FLUSH_INTERVAL = 10              // rudp flush interval 10 ms default
+	KCP_DEFAULT_MTU        = 1400            // rudp / kcp session mtu
+	KCP_MIN_MTU            = 128             // room for the fec header and a few bytes of payload
+	KCP_MAX_MTU            = 1500            // the sessions refuse larger ones
 	MS_TO_NS               = 1000000
 	S_TO_NS                = 1000000000
 	MB_TO_B                = 1024 * 1024
 	KB_TO_B                = 1024
-	ACCEPT_SIGNAL          = 1
+	GB_TO_B                = 1024 * 1024 * 1024
+	ACCEPT_SIGNAL          = 1          // opens a kcp, rudp or udp stream, the server echoes it on udp streams
+	UDP_ACCEPT_MAGIC       = 0x736f6f6e // follows ACCEPT_SIGNAL on udp streams, tells a repeated signal from a small block
+	UDP_ACCEPT_TIMEOUT     = 5          // sec, wait for the server to acknowledge a udp stream
+	UDP_ACCEPT_RETRY       = 500        // ms, send the accept signal of a udp stream again if no echo came
+	UDP_RECV_TIMEOUT       = -3         // receive result of a udp stream after its read deadline
 )
 
 const (
@@ -62,37 +82,117 @@ const (
 	TCP_RESULT_HEADER         = "[ ID]    Interval        Transfer        Bandwidth        RTT        Retrans   Retrans(%%)\n"
 	RUDP_INTERVAL_HEADER      = "[ ID]    Interval        Transfer        Bandwidth        RTT        Retrans   Retrans(%%)  Lost(%%)  Early(%%)  Fast(%%)\n"
 	RUDP_RESULT_HEADER        = "[ ID]    Interval        Transfer        Bandwidth        RTT        Retrans   Retrans(%%)  Lost(%%)  Early(%%)  Fast(%%)  Recover(%%)  PktsLost(%%)  SegsLost(%%)\n"
-	TCP_REPORT_SINGLE_STREAM  = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\n"
-	RUDP_REPORT_SINGLE_STREAM = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%\n"
+	TCP_REPORT_SINGLE_STREAM  = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v%s\n"
+	RUDP_REPORT_SINGLE_STREAM = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%%s\n"
 	TCP_REPORT_SINGLE_RESULT  = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%2.2f%%\t[%s]\n"
 	RUDP_REPORT_SINGLE_RESULT = "[  %v] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%\t%2.2f%%\t[%s]\n"
-	REPORT_SUM_STREAM         = "[SUM] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t\n"
-	REPORT_SEPERATOR          = "- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -\n"
-	SUMMARY_SEPERATOR         = "- - - - - - - - - - - - - - - - SUMMARY - - - - - - - - - - - - - - - -\n"
+	MPTCP_REPORT_SUBFLOW      = "[  %v.%v] subflow\tcwnd:%v\t\t\t%6.1fms\t%4v\n"
+	REPORT_SUM_STREAM         = "[SUM] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%s\n"
+	REPORT_SUM_DIRECTION      = "[SUM][%s] %4.2f-%4.2f sec\t%5.2f MB\t%5.2f Mb/s\t%6.1fms\t%4v\t%s\n"
+	REPORT_OMITTED            = "  (omitted)"
+	/* request/response mode, latency in micro sec */
+	RR_INTERVAL_HEADER      = "[ ID]    Interval        Trans       Trans/s     Lost        Min       Mean        P50        P90        P99      P99.9  (us)\n"
+	RR_RESULT_HEADER        = "[ ID]    Interval        Trans       Trans/s     Lost        Min       Mean        P50        P90        P99      P99.9  (us)\n"
+	RR_REPORT_SINGLE_STREAM = "[  %v] %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s%s\n"
+	RR_REPORT_SINGLE_RESULT = "[  %v] %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s\t[%s]\n"
+	RR_REPORT_SUM           = "%s %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s%s\n"
+	RR_LATENCY_COLUMNS      = " %10.1f %10.1f %10.1f %10.1f %10.1f %10.1f"
+	RR_LATENCY_COLUMNS_NONE = " %10s %10s %10s %10s %10s %10s"
+	REPORT_SEPERATOR        = "- - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -\n"
+	SUMMARY_SEPERATOR       = "- - - - - - - - - - - - - - - - SUMMARY - - - - - - - - - - - - - - - -\n"
+
+	/* connection rate mode, latency of the connect in micro sec */
+	CRR_INTERVAL_HEADER      = "[ ID]    Interval        Conns       Conns/s     Fail        Min       Mean        P50        P90        P99      P99.9  (us)\n"
+	CRR_RESULT_HEADER        = "[ ID]    Interval        Conns       Conns/s     Fail        Min       Mean        P50        P90        P99      P99.9  (us)\n"
+	CRR_REPORT_SINGLE_STREAM = "[  %v] %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s%s\n"
+	CRR_REPORT_SINGLE_RESULT = "[  %v] %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s\t[%s]\n"
+	CRR_REPORT_SUM           = "%s %4.2f-%4.2f sec\t%8v\t%10.1f\t%5v%s%s\n"
+
+	FILE_REPORT     = "[  %v] file %s\t%5.2f MB\tdisk time %4.2f sec (%.1f%% of the test)\t%5.2f MB/s\n"
+	ZEROCOPY_REPORT = "[  %v] zero copy: %v\n"
+	VERIFY_REPORT   = "[  %v] verify: %v blocks\tcorrupted %v B\tmissing %v B\treordered %v B\n"
+	CPU_REPORT      = "CPU usage (%s): %.1f%% of one core (%.1f%% user, %.1f%% sys)\n"
+
+	/* one-way delay mode, in milli sec */
+	OWD_REPORT           = "[  %v] owd: %v blocks\tmin %.3f  avg %.3f  p50 %.3f  p90 %.3f  p99 %.3f  max %.3f  ipdv %.3f ms%s\n"
+	OWD_CLOCK_REPORT     = "Clock offset to the peer %+.3f ms, +/- %.3f ms (NTP style estimate over the control connection, best of %v probes). Clock drift during the test shows as a trend in the delays.\n"
+	OWD_CAVEAT_NEGATIVE  = "Warning: negative one-way delays, the clocks drifted or the control path is asymmetric. Use PTP or a common clock source for exact values.\n"
+	OWD_CAVEAT_UNCERTAIN = "Warning: the smallest one-way delay is within the clock offset uncertainty, take the absolute values with care.\n"
+
+	/* traffic profile, delay in milli sec */
+	BURST_REPORT   = "[  %v] bursts: %v\tdamaged %v\tlost %v\tpkts lost %v/%v (%.2f%%)\tlate %v\tdelay p50 %.3f  p90 %.3f  p99 %.3f  max %.3f ms%s\n"
+	PROFILE_REPORT = "Traffic profile: %v\n"
+
+	/* -w, -M and -C, as granted by the kernel */
+	WINDOW_REPORT            = "[  %v] socket buffer: snd %v B  rcv %v B (requested %v)\tmss %v B (requested %v)\n"
+	CONGESTION_REPORT        = "[  %v] congestion control: %v (requested %v)\n"
+	CONGESTION_RESULT_REPORT = "[  %v] congestion control: sender %v, receiver %v\n"
+
+	/* -S, as seen by the receiver */
+	TOS_REPORT        = "[  %v] tos %v: kept in %v of %v %v%s\n"
+	TOS_UNSEEN_REPORT = "[  %v] tos %v: not observed by the receiver\n"
+
+	/* -fq-rate, per interval */
+	PACING_REPORT = "[  %v] pacing: max %5.2f Mb/s (requested %5.2f)%s%s\n"
+
+	/* -crypt, kcp only */
+	CRYPT_REPORT = "Payload encryption: %v (key fingerprint %v), included in the cpu usage\n"
+
+	/* -A and -pin-streams, when the test starts */
+	AFFINITY_REPORT = "CPU affinity (%s): cpus %v%s, GOMAXPROCS %v\n"
+
+	/* -udp-batch, -gso and -gro */
+	UDP_BATCH_REPORT = "[  %v] %v packets (%.0f pkt/s) in %v syscalls, %.1f packets per syscall%s\n"
+
+	/* -listeners, server only */
+	LISTENERS_REPORT = "Connections accepted by the %v listeners: %v\n"
+
+	/* -V, tcp and mptcp, per interval */
+	TCP_INFO_REPORT = "[  %v] cwnd %v  ssthresh %v  unacked %v\tsnd_wnd %v KB  rcv_space %v KB\tmin_rtt %.3f ms  delivery %5.2f Mb/s\tbusy %.0f ms  rwnd_limited %.1f%%  sndbuf_limited %.1f%%%s\n"
 )
 
 type IperfTest struct {
 	isServer  bool
 	mode      bool // true for sender. false for receiver
 	reverse   bool // server send?
+	bidir     bool // both sides send and receive, streamNum streams in each direction
+	rr        bool // request/response mode, see iperf_rr.go
+	crr       bool // connection rate mode, see iperf_crr.go
 	addr      string
 	port      uint
+	ipVersion uint       // 4 or 6 to force the address family, 0 for any
+	bindAddr  netip.Addr // -B, local address of the sockets, invalid for any
+	bindDev   string     // --bind-dev, interface of the sockets (SO_BINDTODEVICE)
+	cport     portRange  // --cport, source ports of the client's data streams
+	cportNext uint       // ports of cport taken so far
 	state     uint
-	duration  uint // sec
+	duration  uint // sec, 0 if the test is limited by bytes or blocks
+	omit      uint // sec, left out of the results at the beginning of the test
+	omitting  bool // in the omit period
 	noDelay   bool
+	verbose   bool // -V, print the TCP_INFO of the tcp streams every interval
 	interval  uint // ms
-	proto     protocol
-	protocols []protocol
+	proto     Protocol
+	protocols []Protocol
 
 	/* stream */
 
 	listener      net.Listener
+	listeners     uint   // -listeners, SO_REUSEPORT listeners of the server, 0 or 1 for a plain one
+	cookie        uint32 // identifies the data streams of the test, 0 if they do not, see iperf_listeners.go
 	protoListener net.Listener
 	ctrlConn      net.Conn
 	ctrlChan      chan uint
+	serverError   error // why the server refused the test, client only
 	setting       *iperfSetting
 	streamNum     uint
 	streams       []*iperfStream
+	crrAccepts    *crr_accept_results // connections accepted by the server in connection rate mode
+	packetConns   []net.PacketConn    // sockets under the kcp / rudp sessions, see iperf_tos.go
+	sessionConns  []*sessionStatsConn // the same sockets counting several sessions, see iperf_session_stats.go
+	snmpBase      session_counters    // DefaultSnmp before the streams of the test were created
+	savedAffinity []int               // cpus of the process before -A, see iperf_affinity.go
+	streamCPUs    []int               // -pin-streams, cpus the streams take in turn
 
 	/* test statistics */
 	bytesReceived  uint64
@@ -101,6 +201,21 @@ type IperfTest struct {
 	blocksSent     uint64
 	done           bool
 
+	/* test statistics at the end of the omit period, the results count from there */
+	bytesReceivedOmit  uint64
+	blocksReceivedOmit uint64
+	bytesSentOmit      uint64
+	blocksSentOmit     uint64
+
+	/* cpu time used by the process at the test start */
+	cpuStartUser time.Duration
+	cpuStartSys  time.Duration
+	cpuStartWall time.Time
+
+	/* clock offset estimated for the one-way delay mode, see iperf_owd.go */
+	clockOffset time.Duration // peer clock minus the local clock
+	clockRTT    time.Duration // control round trip of the probe the offset was taken from
+
 	/* timer */
 	timer ITimer
 	//omit_timer 		ITimer  // not used yet
@@ -124,22 +239,33 @@ type IperfTest struct {
 //type on_connect_callback func(test *iperf_test)
 //type on_test_finish_callback func(test *iperf_test)
 
-type protocol interface {
-	//name string
-	name() string
-	accept(test *IperfTest) (net.Conn, error)
-	listen(test *IperfTest) (net.Listener, error)
-	connect(test *IperfTest) (net.Conn, error)
-	send(test *iperfStream) int
-	recv(test *iperfStream) int
-	// init will be called before send/recv data
-	init(test *IperfTest) int
-	// teardown will be called before send/recv data
-	teardown(test *IperfTest) int
-	// statsCallback will be invoked intervally, please get some other statistics in this function
-	statsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int
+// Protocol is the transport under test. Built-in protocols are tcp, udp, rudp, kcp and mptcp, others can be
+// added with RegisterProtocol.
+type Protocol interface {
+	Name() string
+	// Accept returns the next data stream on the server side, usually from test.ProtoListener()
+	Accept(test *IperfTest) (net.Conn, error)
+	// Listen is called once on the server side after the params exchange
+	Listen(test *IperfTest) (net.Listener, error)
+	Connect(test *IperfTest) (net.Conn, error)
+	// Send/Recv return the size sent/received, -1 if the stream is closed, other negative values on error.
+	// They should account the size with sp.RecordSent / sp.RecordReceived
+	Send(sp *Stream) int
+	Recv(sp *Stream) int
+	// Init will be called before send/recv data
+	Init(test *IperfTest) int
+	// Teardown will be called after the test
+	Teardown(test *IperfTest) int
+	// StatsCallback will be invoked intervally, please get some other statistics in this function
+	StatsCallback(test *IperfTest, sp *Stream, tempResult *IntervalStats) int
 }
 
+// Stream is a data stream of a test, handed to Protocol implementations.
+type Stream = iperfStream
+
+// IntervalStats holds the statistics of a stream for one report interval.
+type IntervalStats = iperf_interval_results
+
 type iperfStream struct {
 	role       int //SENDER_STREAM or RECEIVE_STREAM
 	test       *IperfTest
@@ -147,21 +273,58 @@ type iperfStream struct {
 	canSend    bool
 	conn       net.Conn
 	sendTicker ITicker
+	file       *os.File      // -F, see iperf_file.go
+	fileMu     sync.Mutex    // guards the hand over of the file to the stream goroutine
+	fileOwned  bool          // the stream goroutine owns the file and closes it when it quits
+	fileDone   chan struct{} // closed once the owning goroutine closed the file
+	zc         *zeroCopy     // -Z, tcp sender streams only
+	payload    *payloadState // pattern and verify state, see iperf_payload.go
+	tosOOB     []byte        // -S, control messages of the udp receiver streams
+	batch      *udpBatch     // -udp-batch, -gso and -gro, see iperf_udp_batch.go
+	received   [1][]byte     // the block of the last receive without a batch
+	rrMu       sync.Mutex    // guards the request/response counters shared with the stats callback
 
 	buffer []byte //buffer to send
 
 	rcv func(sp *iperfStream) int // return recv size. -1 represent EOF.
 	snd func(sp *iperfStream) int // return send size. -1 represent socket close.
 
+	profile trafficProfile // -profile, sender streams only, see iperf_profile.go
+
 }
 
 type iperfSetting struct {
-	blksize    uint
-	burst      bool // burst & rate & pacingTime should be set at the same time
-	rate       uint // bit per second
-	pacingTime uint // ms
-	bytes      uint64
-	blocks     uint64
+	blksize     uint
+	burst       bool   // burst & rate & pacingTime should be set at the same time
+	rate        uint   // bit per second
+	pacingTime  uint   // ms
+	bytes       uint64 // stop after sending / receiving this many bytes, 0 for no limit
+	blocks      uint64 // stop after sending / receiving this many blocks, 0 for no limit
+	reqSize     uint   // request size of the request/response mode
+	respSize    uint   // response size of the request/response mode
+	file        string // -F, local to each side and not exchanged
+	fileLoop    bool   // send the file over and over
+	zeroCopy    bool   // tcp sender streams send with sendfile or MSG_ZEROCOPY, see zerocopy_linux.go
+	zeroCopyMsg bool   // MSG_ZEROCOPY instead of sendfile
+	pattern     string // payload pattern, see iperf_payload.go
+	seed        uint64 // seed of PATTERN_SEQ
+	verify      bool   // the receiver checks the integrity of every block
+	owd         bool   // the sender stamps every block with its send time, the receiver reports one-way delay
+	profile     string // traffic profile spec of the sender streams, see iperf_profile.go
+	window      uint   // -w, SO_SNDBUF and SO_RCVBUF of the tcp streams in bytes, 0 for the kernel default
+	mss         uint   // -M, TCP_MAXSEG of the tcp streams, 0 for the kernel default
+	congestion  string // -C, TCP_CONGESTION of the tcp streams, empty for the kernel default
+	tos         int    // -S, TOS byte of the data sockets, TOS_DEFAULT for the protocol default
+	flowLabel   uint   // -L, ipv6 flow label of the tcp and udp streams, 0 for none
+	fqRate      uint64 // -fq-rate, SO_MAX_PACING_RATE of the sender streams in bits/s, 0 for none
+
+	affinity       string // -A, cpu list of this end, "" for no pinning
+	serverAffinity string // -A after the slash, cpu list the client requests for the server
+	pinStreams     bool   // -pin-streams, a pinned thread for every stream
+
+	udpBatch uint // -udp-batch, messages of a sendmmsg or recvmmsg, 0 for a syscall per datagram
+	gso      bool // -gso, the kernel splits messages of several blocks into datagrams
+	gro      bool // -gro, the kernel coalesces the received datagrams
 
 	// rudp only
 	sndWnd        uint
@@ -173,6 +336,13 @@ type iperfSetting struct {
 	fastResend    uint
 	dataShards    uint // for fec
 	parityShards  uint
+	mtu           uint   // -mtu, 0 for KCP_DEFAULT_MTU
+	ackNoDelay    bool   // ack at once instead of with the next flush
+	msgMode       bool   // message mode instead of stream mode
+	deadline      uint   // s, read/write deadline of the sessions, 0 for the test duration plus a margin
+	crypt         string // -crypt, payload encryption of the kcp sessions, "" or CRYPT_NONE for none
+	cryptKey      string // -key, passphrase the key is derived from, "" for CRYPT_DEFAULT_KEY
+	sessionStats  bool   // -session-stats, count several sessions on the wire, see iperf_session_stats.go
 }
 
 // params to exchange
@@ -180,6 +350,7 @@ type iperfSetting struct {
 type stream_params struct {
 	ProtoName     string
 	Reverse       bool
+	Bidir         bool
 	Duration      uint
 	NoDelay       bool
 	Interval      uint
@@ -197,11 +368,44 @@ type stream_params struct {
 	Burst         bool
 	Rate          uint
 	PacingTime    uint
+	Omit          uint
+	RR            bool
+	ReqSize       uint
+	RespSize      uint
+	CRR           bool
+	ZeroCopy      bool
+	ZeroCopyMsg   bool
+	Pattern       string
+	Seed          uint64
+	Verify        bool
+	OWD           bool
+	Profile       string
+	Window        uint
+	MSS           uint
+	Congestion    string
+	TOS           int
+	FlowLabel     uint
+	FQRate        uint64
+	Affinity      string // cpu list of the server
+	PinStreams    bool
+	MTU           uint
+	AckNoDelay    bool
+	MsgMode       bool
+	Deadline      uint
+	Crypt         string
+	KeyCheck      string // fingerprint of the crypt key, the key itself stays on each end
+	SessionStats  bool
+	UDPBatch      uint
+	GSO           bool
+	GRO           bool
+	Cookie        uint32 // the tcp and mptcp data streams send it first
+	Bytes         uint64
+	Blocks        uint64
 }
 
 func (p stream_params) String() string {
-	s := fmt.Sprintf("name:%v\treverse:%v\tdur:%v\tno_delay:%v\tinterval:%v\tstream_num:%v\tBlkSize:%v\tSndWnd:%v\tRcvWnd:%v\tNoCong:%v\tBurst:%v\tDataShards:%v\tParityShards:%v\t",
-		p.ProtoName, p.Reverse, p.Duration, p.NoDelay, p.Interval, p.StreamNum, p.Blksize, p.SndWnd, p.RcvWnd, p.NoCong, p.Burst, p.DataShards, p.ParityShards)
+	s := fmt.Sprintf("name:%v\treverse:%v\tbidir:%v\tdur:%v\tno_delay:%v\tinterval:%v\tstream_num:%v\tBlkSize:%v\tSndWnd:%v\tRcvWnd:%v\tNoCong:%v\tBurst:%v\tDataShards:%v\tParityShards:%v\t",
+		p.ProtoName, p.Reverse, p.Bidir, p.Duration, p.NoDelay, p.Interval, p.StreamNum, p.Blksize, p.SndWnd, p.RcvWnd, p.NoCong, p.Burst, p.DataShards, p.ParityShards)
 	return s
 }
 
@@ -210,9 +414,11 @@ type iperf_stream_results struct {
 	bytes_sent                      uint64
 	bytes_received_this_interval    uint64
 	bytes_sent_this_interval        uint64
-	bytes_sent_omit                 uint64
+	bytes_sent_omit                 uint64 // bytes sent during the omit period
+	bytes_received_omit             uint64 // bytes received during the omit period
 	stream_retrans                  uint
 	stream_prev_total_retrans       uint
+	subflow_prev_total_retrans      []uint // mptcp, by subflow index
 	stream_lost                     uint
 	stream_prev_total_lost          uint
 	stream_early_retrans            uint
@@ -229,10 +435,56 @@ type iperf_stream_results struct {
 	stream_sum_rtt                  uint // micro sec
 	stream_cnt_rtt                  uint
 	stream_repeat_segs              uint
+	mptcp_negotiated                bool
 	start_time                      time.Time
 	end_time                        time.Time
 	start_time_fixed                time.Time
 	interval_results                []iperf_interval_results
+	/* absolute counters at the end of the omit period, for protocols reporting totals */
+	stream_omit_recovers    uint
+	stream_omit_in_pkts     uint
+	stream_omit_out_pkts    uint
+	stream_omit_in_segs     uint
+	stream_omit_out_segs    uint
+	stream_omit_repeat_segs uint
+	/* request/response mode */
+	rr_transactions_this_interval uint64
+	rr_interval_hist              latency_histogram
+	rr_peer_hist                  latency_histogram // reported by the sender in the results exchange
+	rr_peer_failures              uint64            // lost udp transactions, reported by the sender
+	/* connection rate mode, lost transactions of udp request/response too */
+	rr_failures_this_interval uint64
+	crr_connections           uint64 // reported by the client in the results exchange
+	crr_failures              uint64
+	/* file mode */
+	file_bytes uint64
+	file_time  time.Duration // spent in disk reads or writes
+	/* integrity check */
+	verify verify_results // found by the receiver, exchanged to the sender
+	/* one-way delay mode */
+	owd_interval_hist          latency_histogram
+	owd_ipdv_sum_this_interval time.Duration
+	owd_ipdv_cnt_this_interval uint64
+	owd                        owd_results // reported by the receiver in the results exchange
+	/* traffic profile */
+	burst_this_interval burst_results
+	burst_interval_hist latency_histogram
+	bursts              burst_results // reported by the receiver in the results exchange
+	/* udp batching, datagrams and the syscalls they took */
+	udp_packets                uint64
+	udp_syscalls               uint64
+	udp_packets_this_interval  uint64
+	udp_syscalls_this_interval uint64
+	/* cumulative TCP_INFO counters at the last interval, see iperf_tcpinfo.go */
+	tcp_prev_busy_time      time.Duration
+	tcp_prev_rwnd_limited   time.Duration
+	tcp_prev_sndbuf_limited time.Duration
+	tcp_prev_bytes_acked    uint64
+	/* tcp congestion control in use, read back from the socket */
+	congestion      string
+	peer_congestion string // of the other end of the stream, from the results exchange
+	/* marking seen by the receiver */
+	tos tos_results
 }
 
 type stream_results_array []stream_results_exchange
@@ -249,8 +501,24 @@ type stream_results_exchange struct {
 	InSegs    uint
 	OutSegs   uint
 	Recovered uint
+	Trans     uint64
+	Latency   histogram_exchange
+	Failures  uint64
 	StartTime time.Time
 	EndTime   time.Time
+	/* integrity errors found by the receiver, in bytes */
+	VerifyBlocks uint64
+	Corrupted    uint64
+	Missing      uint64
+	Reordered    uint64
+	/* one-way delay measured by the receiver */
+	OWD owd_results
+	/* traffic profile bursts seen by the receiver */
+	Bursts burst_results
+	/* tcp congestion control of this end of the stream */
+	Congestion string
+	/* marking seen by the receiver */
+	TOS tos_results
 }
 
 func (r stream_results_exchange) String() string {
@@ -271,6 +539,46 @@ type iperf_interval_results struct {
 	interval_fast_retrans  uint
 	interval_retrans       uint // segs num
 	/* for udp */
-	interval_packet_cnt uint
-	omitted             uint
+	interval_packet_cnt  uint
+	interval_syscall_cnt uint
+	omitted              uint // 1 if the interval is in the omit period
+	/* for mptcp */
+	mptcp_subflows  uint
+	subflow_results []mptcp_subflow_results
+	/* request/response mode */
+	rr_transactions uint64
+	rr_hist         latency_histogram // latency of the transactions, sender side only
+	rr_failures     uint64            // failed connections, lost transactions with udp
+	/* one-way delay mode, receiver side only */
+	owd_hist     latency_histogram
+	owd_ipdv_sum time.Duration // variation between consecutive blocks
+	owd_ipdv_cnt uint64
+	/* traffic profile, receiver side only */
+	bursts     burst_results
+	burst_hist latency_histogram // from the first packet of a burst sent to the last one received
+	/* kernel pacing, sender side only, bytes/s */
+	pacing_rate     uint64 // tcp, from TCP_INFO
+	max_pacing_rate uint64
+	/* tcp, from TCP_INFO, see iperf_tcpinfo.go */
+	tcp_info TCPInfo
+}
+
+// latency summary of a request/response stream
+// tips: exchanged with the results, all the members should be visible
+type rr_latency_results struct {
+	Samples uint64
+	Min     time.Duration
+	Mean    time.Duration
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	P999    time.Duration
+}
+
+type mptcp_subflow_results struct {
+	rtt              uint // us
+	rto              uint // us
+	snd_cwnd         uint // segs
+	total_retrans    uint
+	interval_retrans uint // what the interval added to total_retrans
 }
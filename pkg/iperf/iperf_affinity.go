@@ -0,0 +1,168 @@
+package iperf
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// cpu affinity: -A pins the process of each end to a cpu list, the part after the slash is requested from the
+// server with the params. -pin-streams gives the goroutine of every stream a thread of its own, pinned to one
+// cpu of the list in turn. Both ends restore the affinity they had when the test ends.
+
+const CPU_SET_SIZE = 1024 // cpus a sched_setaffinity mask holds
+
+// parseCPUList parses a cpu list such as 0-3,8,10-11
+func parseCPUList(s string) ([]int, error) {
+	seen := make(map[int]bool)
+
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		if !isRange {
+			last = first
+		}
+
+		lo, err1 := strconv.Atoi(first)
+		hi, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || lo < 0 || hi < lo || hi >= CPU_SET_SIZE {
+			return nil, fmt.Errorf("invalid cpu list %v, expect cpus or ranges such as 0-3,8", s)
+		}
+
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+
+	sort.Ints(cpus)
+
+	return cpus, nil
+}
+
+// ParseAffinity parses the -A value, the cpu list of the client and optionally the one of the server after a
+// slash: 2-5 or 2-5/6-9
+func ParseAffinity(s string) (client, server string, err error) {
+	client, server, _ = strings.Cut(s, "/")
+
+	if client != "" {
+		if _, err = parseCPUList(client); err != nil {
+			return "", "", err
+		}
+	}
+
+	if server != "" {
+		if _, err = parseCPUList(server); err != nil {
+			return "", "", err
+		}
+	}
+
+	return client, server, nil
+}
+
+// applyAffinity pins the process to a cpu list and picks the cpus of the streams, the ones of the process
+// without a list. It keeps the affinity before for restoreAffinity.
+func (test *IperfTest) applyAffinity(affinity string, pinStreams bool) error {
+	if affinity == "" && !pinStreams {
+		return nil
+	}
+
+	cpus, err := getAffinity()
+	if err != nil {
+		return err
+	}
+
+	if affinity != "" {
+		saved := cpus
+
+		if cpus, err = parseCPUList(affinity); err != nil {
+			return err
+		}
+
+		if err = setProcessAffinity(cpus); err != nil {
+			return fmt.Errorf("pin to cpus %v: %w", affinity, err)
+		}
+
+		test.savedAffinity = saved
+	}
+
+	test.streamCPUs = nil
+	if pinStreams {
+		test.streamCPUs = cpus
+	}
+
+	role := "client"
+	if test.isServer {
+		role = "server"
+	}
+
+	pinned := ""
+	if pinStreams {
+		pinned = ", one pinned thread per stream"
+	}
+
+	fmt.Printf(AFFINITY_REPORT, role, formatCPUList(cpus), pinned, runtime.GOMAXPROCS(0))
+
+	return nil
+}
+
+// restoreAffinity gives the process the affinity it had before applyAffinity
+func (test *IperfTest) restoreAffinity() {
+	if test.savedAffinity == nil {
+		return
+	}
+
+	if err := setProcessAffinity(test.savedAffinity); err != nil {
+		Log.Errorf("restore cpu affinity err = %v", err)
+	}
+
+	test.savedAffinity = nil
+	test.streamCPUs = nil
+}
+
+// pinThread pins the goroutine of a stream with -pin-streams, the streams take the cpus in turn
+func (sp *iperfStream) pinThread() {
+	cpus := sp.test.streamCPUs
+	if len(cpus) == 0 {
+		return
+	}
+
+	for i, s := range sp.test.streams {
+		if s != sp {
+			continue
+		}
+
+		if err := pinThread(cpus[i%len(cpus)]); err != nil {
+			Log.Errorf("pin stream %v err = %v", i, err)
+		}
+
+		return
+	}
+}
+
+// formatCPUList folds a sorted cpu list into ranges
+func formatCPUList(cpus []int) string {
+	var parts []string
+
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+
+		if j == i {
+			parts = append(parts, strconv.Itoa(cpus[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%v-%v", cpus[i], cpus[j]))
+		}
+
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,99 @@
+package iperf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCPUList(t *testing.T) {
+	cases := []struct {
+		s     string
+		want  []int
+		fails bool
+	}{
+		{s: "0", want: []int{0}},
+		{s: "0-3", want: []int{0, 1, 2, 3}},
+		{s: "8,0-2,10-11", want: []int{0, 1, 2, 8, 10, 11}},
+		{s: "2,2,1-3", want: []int{1, 2, 3}},
+		{s: "1023", want: []int{1023}},
+		{s: "1024", fails: true},
+		{s: "3-1", fails: true},
+		{s: "-1", fails: true},
+		{s: "1-", fails: true},
+		{s: "0,,1", fails: true},
+		{s: "a", fails: true},
+		{s: "", fails: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseCPUList(c.s)
+		if c.fails {
+			if err == nil {
+				t.Errorf("parseCPUList(%q) should fail", c.s)
+			}
+
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseCPUList(%q) = %v, %v, want %v", c.s, got, err, c.want)
+		}
+	}
+}
+
+func TestFormatCPUList(t *testing.T) {
+	cases := []struct {
+		cpus []int
+		want string
+	}{
+		{cpus: nil, want: ""},
+		{cpus: []int{3}, want: "3"},
+		{cpus: []int{0, 1, 2, 3}, want: "0-3"},
+		{cpus: []int{0, 2, 4}, want: "0,2,4"},
+		{cpus: []int{0, 1, 2, 8, 10, 11}, want: "0-2,8,10-11"},
+	}
+
+	for _, c := range cases {
+		if got := formatCPUList(c.cpus); got != c.want {
+			t.Errorf("formatCPUList(%v) = %q, want %q", c.cpus, got, c.want)
+		}
+
+		// the list folded reads back the same
+		if c.want != "" {
+			if cpus, err := parseCPUList(c.want); err != nil || !reflect.DeepEqual(cpus, c.cpus) {
+				t.Errorf("parseCPUList(%q) = %v, %v, want %v", c.want, cpus, err, c.cpus)
+			}
+		}
+	}
+}
+
+func TestParseAffinity(t *testing.T) {
+	cases := []struct {
+		s              string
+		client, server string
+		fails          bool
+	}{
+		{s: "2-5", client: "2-5"},
+		{s: "2-5/6-9", client: "2-5", server: "6-9"},
+		{s: "/6", server: "6"},
+		{s: "0,2/", client: "0,2"},
+		{s: "2-5/x", fails: true},
+		{s: "x/6-9", fails: true},
+		{s: "5-2", fails: true},
+	}
+
+	for _, c := range cases {
+		client, server, err := ParseAffinity(c.s)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParseAffinity(%q) should fail", c.s)
+			}
+
+			continue
+		}
+
+		if err != nil || client != c.client || server != c.server {
+			t.Errorf("ParseAffinity(%q) = %q, %q, %v, want %q, %q", c.s, client, server, err, c.client, c.server)
+		}
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/op/go-logging"
@@ -19,6 +22,7 @@ func NewIperfTest() (test *IperfTest) {
 
 	test.ctrlChan = make(chan uint, 5)
 	test.setting = new(iperfSetting)
+	test.setting.tos = TOS_DEFAULT
 	test.reporterCallback = iperfReporterCallback
 	test.statsCallback = iperfStatsCallback
 	test.chStats = make(chan bool, 1)
@@ -28,13 +32,21 @@ func NewIperfTest() (test *IperfTest) {
 
 func (test *IperfTest) setProtocol(protoName string) int {
 	for _, proto := range test.protocols {
-		if protoName == proto.name() {
+		if protoName == proto.Name() {
 			test.proto = proto
 
 			return 0
 		}
 	}
 
+	// registered after Init
+	if proto := newProtocol(protoName); proto != nil {
+		test.protocols = append(test.protocols, proto)
+		test.proto = proto
+
+		return 0
+	}
+
 	return -1
 }
 
@@ -58,6 +70,43 @@ func (test *IperfTest) setSendState(state uint) int {
 	return 0
 }
 
+// sendServerError tells the client why the server refuses the test, the client quits with the error
+func (test *IperfTest) sendServerError(err error) {
+	msg := err.Error()
+	if len(msg) > SERVER_ERROR_MAX {
+		msg = msg[:SERVER_ERROR_MAX]
+	}
+
+	bs := make([]byte, 8+len(msg))
+	binary.LittleEndian.PutUint32(bs[0:4], SERVER_ERROR)
+	binary.LittleEndian.PutUint32(bs[4:8], uint32(len(msg)))
+	copy(bs[8:], msg)
+
+	if _, werr := test.ctrlConn.Write(bs); werr != nil {
+		Log.Errorf("Send the error to the client failed. err = %v", werr)
+	}
+}
+
+// readServerError reads the error text after SERVER_ERROR
+func (test *IperfTest) readServerError() error {
+	bs := make([]byte, 4)
+	if _, err := io.ReadFull(test.ctrlConn, bs); err != nil {
+		return fmt.Errorf("server error, reading it failed: %w", err)
+	}
+
+	size := binary.LittleEndian.Uint32(bs)
+	if size > SERVER_ERROR_MAX {
+		return fmt.Errorf("server error of %v bytes", size)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(test.ctrlConn, msg); err != nil {
+		return fmt.Errorf("server error, reading it failed: %w", err)
+	}
+
+	return fmt.Errorf("server error: %s", msg)
+}
+
 func (test *IperfTest) newStream(conn net.Conn, sender_flag int) *iperfStream {
 	sp := new(iperfStream)
 	sp.role = sender_flag
@@ -66,14 +115,17 @@ func (test *IperfTest) newStream(conn net.Conn, sender_flag int) *iperfStream {
 
 	// mark, set sp.buffer
 	sp.result = new(iperf_stream_results)
-	sp.snd = test.proto.send
-	sp.rcv = test.proto.recv
-	sp.buffer = make([]byte, test.setting.blksize)
+	sp.snd = test.proto.Send
+	sp.rcv = test.proto.Recv
+	if test.rr || test.crr {
+		reqSize, respSize := test.rrSizes()
+		sp.buffer = make([]byte, maxInt(reqSize, respSize))
+	} else {
+		sp.buffer = make([]byte, test.setting.blksize)
+	}
 
-	copy(sp.buffer[:], "hello world!")
+	sp.initPayload()
 
-	// initialize stream
-	// set tos bit. undo
 	return sp
 }
 
@@ -87,6 +139,9 @@ func (test *IperfTest) closeAllStreams() int {
 
 			return -1
 		}
+
+		// after the conn, so the stream goroutine quits and writes out what it got
+		sp.closeFile()
 	}
 
 	return 0
@@ -100,7 +155,7 @@ func (test *IperfTest) checkThrottle(sp *iperfStream, now time.Time) {
 	dur := now.Sub(sp.result.start_time)
 	sec := dur.Seconds()
 
-	bitsPerSecond := float64(sp.result.bytes_sent*8) / sec
+	bitsPerSecond := float64(sp.BytesSent()*8) / sec
 	if bitsPerSecond < float64(sp.test.setting.rate) && sp.canSend == false {
 		sp.canSend = true
 
@@ -123,9 +178,16 @@ func (test *IperfTest) sendParams() int {
 		return -1
 	}
 
+	// a new cookie for every test, the data streams send it to the server
+	test.cookie = 0
+	if test.identifiesStreams() {
+		test.cookie = newCookie()
+	}
+
 	params := stream_params{
-		ProtoName:     test.proto.name(),
+		ProtoName:     test.proto.Name(),
 		Reverse:       test.reverse,
+		Bidir:         test.bidir,
 		Duration:      test.duration,
 		NoDelay:       test.noDelay,
 		Interval:      test.interval,
@@ -143,6 +205,39 @@ func (test *IperfTest) sendParams() int {
 		Burst:         test.setting.burst,
 		Rate:          test.setting.rate,
 		PacingTime:    test.setting.pacingTime,
+		Omit:          test.omit,
+		RR:            test.rr,
+		ReqSize:       test.setting.reqSize,
+		RespSize:      test.setting.respSize,
+		CRR:           test.crr,
+		ZeroCopy:      test.setting.zeroCopy,
+		ZeroCopyMsg:   test.setting.zeroCopyMsg,
+		Pattern:       test.setting.pattern,
+		Seed:          test.setting.seed,
+		Verify:        test.setting.verify,
+		OWD:           test.setting.owd,
+		Profile:       test.setting.profile,
+		Congestion:    test.setting.congestion,
+		TOS:           test.setting.tos,
+		FlowLabel:     test.setting.flowLabel,
+		FQRate:        test.setting.fqRate,
+		Affinity:      test.setting.serverAffinity,
+		PinStreams:    test.setting.pinStreams,
+		MTU:           test.setting.mtu,
+		AckNoDelay:    test.setting.ackNoDelay,
+		MsgMode:       test.setting.msgMode,
+		Deadline:      test.setting.deadline,
+		Crypt:         test.setting.crypt,
+		KeyCheck:      test.cryptFingerprint(),
+		SessionStats:  test.setting.sessionStats,
+		UDPBatch:      test.setting.udpBatch,
+		GSO:           test.setting.gso,
+		GRO:           test.setting.gro,
+		Cookie:        test.cookie,
+		Window:        test.setting.window,
+		MSS:           test.setting.mss,
+		Bytes:         test.setting.bytes,
+		Blocks:        test.setting.blocks,
 	}
 
 	bytes, err := json.Marshal(&params)
@@ -152,14 +247,19 @@ func (test *IperfTest) sendParams() int {
 		return -1
 	}
 
-	n, err := test.ctrlConn.Write(bytes)
+	// Prefix with length, the affinity lists leave no upper bound on the size
+	buf := make([]byte, 4+len(bytes))
+	binary.LittleEndian.PutUint32(buf, uint32(len(bytes)))
+	copy(buf[4:], bytes)
+
+	_, err = test.ctrlConn.Write(buf)
 	if err != nil {
 		Log.Error("Write failed. %v", err)
 
 		return -1
 	}
 
-	Log.Debugf("send params %v bytes: %v", n, params.String())
+	Log.Debugf("send params %v bytes: %v", len(bytes), params.String())
 
 	return 0
 }
@@ -168,27 +268,75 @@ func (test *IperfTest) getParams() int {
 	Log.Debugf("Enter get_params")
 	var params stream_params
 
-	buf := make([]byte, 1024)
+	// Read length prefix
+	lengthBuf := make([]byte, 4)
 
-	n, err := test.ctrlConn.Read(buf)
+	_, err := io.ReadFull(test.ctrlConn, lengthBuf)
+	if err != nil {
+		Log.Errorf("Read length failed. %v", err)
+
+		return -1
+	}
+
+	length := binary.LittleEndian.Uint32(lengthBuf)
+	if length > PARAMS_MAX {
+		Log.Errorf("Params of %v bytes, at most %v accepted", length, PARAMS_MAX)
+		test.sendServerError(fmt.Errorf("params of %v bytes, the server accepts at most %v", length, PARAMS_MAX))
+
+		return -1
+	}
+
+	buf := make([]byte, length)
+
+	_, err = io.ReadFull(test.ctrlConn, buf)
 	if err != nil {
 		Log.Errorf("Read failed. %v", err)
 
 		return -1
 	}
 
-	err = json.Unmarshal(buf[:n], &params)
+	err = json.Unmarshal(buf, &params)
 	if err != nil {
 		Log.Errorf("Decode failed. %v", err)
+		test.sendServerError(fmt.Errorf("decode params failed: %w", err))
 
 		return -1
 	}
 
-	Log.Debugf("get params %v bytes: %v", n, params.String())
+	Log.Debugf("get params %v bytes: %v", length, params.String())
+
+	if test.setProtocol(params.ProtoName) < 0 {
+		Log.Errorf("Protocol %v is not registered.", params.ProtoName)
+		test.sendServerError(fmt.Errorf("protocol %v is not registered on the server", params.ProtoName))
+
+		return -1
+	}
 
-	test.setProtocol(params.ProtoName)
 	test.setTestReverse(params.Reverse)
+	test.bidir = params.Bidir
 	test.duration = params.Duration
+	test.omit = params.Omit
+	test.rr = params.RR
+	test.setting.reqSize = params.ReqSize
+	test.setting.respSize = params.RespSize
+	test.crr = params.CRR
+	test.setting.zeroCopy = params.ZeroCopy
+	test.setting.zeroCopyMsg = params.ZeroCopyMsg
+	test.setting.pattern = params.Pattern
+	test.setting.seed = params.Seed
+	test.setting.verify = params.Verify
+	test.setting.owd = params.OWD
+	test.setting.profile = params.Profile
+	test.setting.window = params.Window
+	test.setting.mss = params.MSS
+	test.setting.congestion = params.Congestion
+	test.setting.tos = params.TOS
+	test.setting.flowLabel = params.FlowLabel
+	test.setting.fqRate = params.FQRate
+	test.setting.udpBatch = params.UDPBatch
+	test.setting.gso = params.GSO
+	test.setting.gro = params.GRO
+	test.cookie = params.Cookie
 	test.noDelay = params.NoDelay
 	test.interval = params.Interval
 	test.streamNum = params.StreamNum
@@ -196,6 +344,8 @@ func (test *IperfTest) getParams() int {
 	test.setting.burst = params.Burst
 	test.setting.rate = params.Rate
 	test.setting.pacingTime = params.PacingTime
+	test.setting.bytes = params.Bytes
+	test.setting.blocks = params.Blocks
 
 	// rudp/kcp only
 	test.setting.sndWnd = params.SndWnd
@@ -207,6 +357,43 @@ func (test *IperfTest) getParams() int {
 	test.setting.fastResend = params.FastResend
 	test.setting.dataShards = params.DataShards
 	test.setting.parityShards = params.ParityShards
+	test.setting.mtu = params.MTU
+	test.setting.ackNoDelay = params.AckNoDelay
+	test.setting.msgMode = params.MsgMode
+	test.setting.deadline = params.Deadline
+	test.setting.crypt = params.Crypt
+	test.setting.sessionStats = params.SessionStats
+
+	// the listeners accept the streams in any order, a client without the stream identification cannot be told apart
+	if test.listeners > 1 && test.cookie == 0 && test.identifiesStreams() {
+		err := fmt.Errorf("the server runs %v listeners, the client needs to identify its data streams (a newer version)",
+			test.listeners)
+		Log.Errorf("%v", err)
+		test.sendServerError(err)
+
+		return -1
+	}
+
+	if err := test.checkCryptKey(params.KeyCheck); err != nil {
+		Log.Errorf("%v", err)
+		test.sendServerError(err)
+
+		return -1
+	}
+
+	// the client may ask for other cpus than the ones of the server's own -A
+	affinity := test.setting.affinity
+	if params.Affinity != "" {
+		affinity = params.Affinity
+	}
+
+	if err := test.applyAffinity(affinity, test.setting.pinStreams || params.PinStreams); err != nil {
+		Log.Errorf("cpu affinity err = %v", err)
+		test.sendServerError(fmt.Errorf("cpu affinity: %w", err))
+
+		return -1
+	}
+
 	return 0
 }
 
@@ -221,19 +408,23 @@ func (test *IperfTest) exchangeParams() int {
 		}
 	}
 
+	if test.setting.owd && test.syncClock() < 0 {
+		return -1
+	}
+
 	return 0
 }
 
 func (test *IperfTest) sendResults() int {
 	Log.Debugf("Send Results")
 
-	var results = make(stream_results_array, test.streamNum)
+	var results = make(stream_results_array, len(test.streams))
 	for i, sp := range test.streams {
 		var bytesTransfer uint64
-		if test.mode == IPERF_RECEIVER {
-			bytesTransfer = sp.result.bytes_received
+		if sp.role == RECEIVER_STREAM {
+			bytesTransfer = sp.BytesReceived()
 		} else {
-			bytesTransfer = sp.result.bytes_sent
+			bytesTransfer = sp.BytesSent()
 		}
 
 		rp := sp.result
@@ -249,6 +440,33 @@ func (test *IperfTest) sendResults() int {
 			Recovered: rp.stream_recovers,
 			StartTime: sp.result.start_time,
 			EndTime:   sp.result.end_time,
+
+			Congestion: rp.congestion,
+		}
+
+		if test.setting.verify && sp.role == RECEIVER_STREAM {
+			spResult.VerifyBlocks = rp.verify.blocks
+			spResult.Corrupted = rp.verify.corrupted
+			spResult.Missing = rp.verify.missing
+			spResult.Reordered = rp.verify.reordered
+		}
+
+		if test.setting.owd && sp.role == RECEIVER_STREAM {
+			spResult.OWD = sp.owdResults()
+		}
+
+		if test.setting.profile != "" && sp.role == RECEIVER_STREAM {
+			spResult.Bursts = sp.burstResults()
+		}
+
+		if test.checkTOS() && sp.role == RECEIVER_STREAM {
+			spResult.TOS = sp.tosResults()
+		}
+
+		if test.rr || test.crr {
+			spResult.Trans = sp.rrTransactions()
+			spResult.Latency = sp.rrHistogram().exchange()
+			spResult.Failures = sp.rrFailures()
 		}
 
 		results[i] = spResult
@@ -287,7 +505,7 @@ func (test *IperfTest) sendResults() int {
 func (test *IperfTest) getResults() int {
 	Log.Debugf("Enter get_results")
 
-	var results = make(stream_results_array, test.streamNum)
+	var results stream_results_array
 
 	// Read length prefix
 	lengthBuf := make([]byte, 4)
@@ -318,19 +536,61 @@ func (test *IperfTest) getResults() int {
 
 	Log.Debugf("Received %d bytes of results", len(buf))
 
+	if len(results) != len(test.streams) {
+		Log.Errorf("Results of %v streams received, %v streams expected", len(results), len(test.streams))
+
+		return -1
+	}
+
 	for i, result := range results {
 		sp := test.streams[i]
-		if test.mode == IPERF_RECEIVER {
+		sp.result.peer_congestion = result.Congestion
+
+		// the peer left its omit period out already
+		if sp.role == RECEIVER_STREAM {
 			sp.result.bytes_sent = result.Bytes
+			sp.result.bytes_sent_omit = 0
 			sp.result.stream_retrans = result.Retrans
 			sp.result.stream_out_segs = result.OutSegs
 			sp.result.stream_out_pkts = result.OutPkts
 		} else {
 			sp.result.bytes_received = result.Bytes
+			sp.result.bytes_received_omit = 0
 			sp.result.stream_in_segs = result.InSegs
 			sp.result.stream_in_pkts = result.InPkts
 			sp.result.stream_recovers = result.Recovered
 		}
+
+		if (test.rr || test.crr) && sp.role == RECEIVER_STREAM {
+			sp.result.rr_peer_hist = result.Latency.histogram()
+			sp.result.rr_peer_failures = result.Failures
+		}
+
+		if test.setting.verify && sp.role == SENDER_STREAM {
+			sp.result.verify = verify_results{
+				blocks:    result.VerifyBlocks,
+				corrupted: result.Corrupted,
+				missing:   result.Missing,
+				reordered: result.Reordered,
+			}
+		}
+
+		if test.setting.owd && sp.role == SENDER_STREAM {
+			sp.result.owd = result.OWD
+		}
+
+		if test.setting.profile != "" && sp.role == SENDER_STREAM {
+			sp.result.bursts = result.Bursts
+		}
+
+		if test.checkTOS() && sp.role == SENDER_STREAM {
+			sp.result.tos = result.TOS
+		}
+
+		if test.crr && sp.role == RECEIVER_STREAM {
+			sp.result.crr_connections = result.Trans
+			sp.result.crr_failures = result.Failures
+		}
 	}
 
 	return 0
@@ -358,7 +618,7 @@ func (test *IperfTest) exchangeResults() int {
 }
 
 func (test *IperfTest) initTest() int {
-	test.proto.init(test)
+	test.proto.Init(test)
 
 	now := time.Now()
 
@@ -367,11 +627,26 @@ func (test *IperfTest) initTest() int {
 		sp.result.start_time_fixed = now
 	}
 
+	if test.crr {
+		test.crrAccepts = new(crr_accept_results)
+	}
+
+	if test.openFiles() < 0 {
+		return -1
+	}
+
+	if test.initProfiles() < 0 {
+		return -1
+	}
+
+	test.cpuStartUser, test.cpuStartSys = cpuTime()
+	test.cpuStartWall = now
+
 	return 0
 }
 
 func (test *IperfTest) Init() {
-	test.protocols = append(test.protocols, new(TCPProto), new(UDPProto), new(rudpProto), new(kcpProto))
+	test.protocols = newProtocols()
 }
 
 func (test *IperfTest) ParseArguments() int {
@@ -381,16 +656,52 @@ func (test *IperfTest) ParseArguments() int {
 	var serverFlag = flag.Bool("s", false, "server side")
 	var clientFlag = flag.String("c", "127.0.0.1", "client side")
 	var reverseFlag = flag.Bool("R", false, "reverse mode. client receive, server send")
+	var bidirFlag = flag.Bool("bidir", false, "bidirectional mode. client and server send and receive")
 	var portFlag = flag.Uint("p", 5201, "connect/listen port")
-	var protocolFlag = flag.String("proto", TCP_NAME, "protocol under test")
+	var protocolFlag = flag.String("proto", TCP_NAME, "protocol under test ("+strings.Join(Protocols(), ", ")+")")
 	var durFlag = flag.Uint("d", 10, "duration (s)")
+	var omitFlag = flag.Uint("O", 0, "omit the first n seconds from the results")
+	var rrFlag = flag.Bool("rr", false, "request/response mode, report transaction rate and latency")
+	var reqSizeFlag = flag.Uint("req", 1, "request size of the request/response and connection rate modes, 0 for no request with -crr")
+	var respSizeFlag = flag.Uint("resp", 1, "response size of the request/response and connection rate modes")
+	var crrFlag = flag.Bool("crr", false, "connection rate mode, report connections per second and connect latency")
+	var fileFlag = flag.String("F", "", "send the content of this file, or write the received data to it")
+	var fileLoopFlag = flag.Bool("Floop", false, "send the -F file over and over instead of ending the test at its end")
+	var zeroCopyFlag = flag.Bool("Z", false, "zero copy send with sendfile from a memfd (tcp, linux)")
+	var zeroCopyMsgFlag = flag.Bool("Zmsg", false, "zero copy send with MSG_ZEROCOPY instead of sendfile, implies -Z")
+	var patternFlag = flag.String("pattern", PATTERN_DEFAULT, "payload pattern ("+strings.Join(PatternList, ", ")+")")
+	var seedFlag = flag.Uint64("seed", 0, "seed of the seq payload pattern")
+	var verifyFlag = flag.Bool("verify", false, "the receiver checks every block for corrupted, missing and reordered bytes")
+	var owdFlag = flag.Bool("owd", false, "one-way delay mode, the sender stamps every block with its send time")
+	var profileFlag = flag.String("profile", "", "traffic profile of the senders, name[,key=value...] ("+strings.Join(ProfileList, ", ")+"), implies -owd")
+	var windowFlag = flag.String("w", "", "socket buffer size of the tcp streams, SO_SNDBUF and SO_RCVBUF (K/M/G)")
+	var mssFlag = flag.Uint("M", 0, "maximum segment size of the tcp streams, TCP_MAXSEG")
+	var congestionFlag = flag.String("C", "", "congestion control algorithm of the tcp streams, TCP_CONGESTION")
+	var tosFlag = flag.String("S", "", "TOS byte or DSCP name (EF, AF41, CS1...) of the data packets, the receiver checks it survived")
+	var flowLabelFlag = flag.Uint("L", 0, "ipv6 flow label of the tcp and udp streams")
+	var bytesFlag = flag.String("n", "", "number of bytes to transmit instead of -d (K/M/G)")
+	var blocksFlag = flag.String("k", "", "number of blocks to transmit instead of -d (K/M/G)")
 	var intervalFlag = flag.Uint("i", 1000, "test interval (ms)")
 	var parallelFlag = flag.Uint("P", 1, "The number of simultaneous connections")
 	var blksizeFlag = flag.Uint("l", 4*1024, "send/read block size")
 	var bandwidthFlag = flag.String("b", "0", "bandwidth limit. (M/K), default MB/s")
+	var fqRateFlag = flag.String("fq-rate", "", "kernel pacing rate of the tcp and udp sender streams, SO_MAX_PACING_RATE (M/K, default MB/s)")
 	var debugFlag = flag.Bool("debug", false, "debug mode")
 	var infoFlag = flag.Bool("info", false, "info mode")
+	var verboseFlag = flag.Bool("V", false, "verbose: print cwnd, ssthresh, windows, min rtt, delivery rate and limits from TCP_INFO of the tcp streams every interval (linux)")
 	var noDelayFlag = flag.Bool("D", false, "no delay option")
+	var ipv4Flag = flag.Bool("4", false, "only use IPv4")
+	var ipv6Flag = flag.Bool("6", false, "only use IPv6")
+	var bindFlag = flag.String("B", "", "bind the sockets to this local address")
+	var cportFlag = flag.String("cport", "", "source port of the client's data streams, counted up for each stream, or a range first-last")
+	var affinityFlag = flag.String("A", "", "pin the process to these cpus, n[,m][-k][/server cpus] such as 2-5/6-9 (linux)")
+	var pinStreamsFlag = flag.Bool("pin-streams", false, "give every stream a thread of its own pinned to one cpu of -A in turn (linux)")
+	var gomaxprocsFlag = flag.Uint("gomaxprocs", 0, "set GOMAXPROCS, 0 for the go default")
+	var bindDevFlag = flag.String("bind-dev", "", "bind the sockets to this network interface, SO_BINDTODEVICE (linux)")
+	var listenersFlag = flag.Uint("listeners", 1, "server: SO_REUSEPORT listeners on the port, each with an accept loop pinned to a cpu of its own in turn, 0 for one per cpu (linux)")
+	var udpBatchFlag = flag.Uint("udp-batch", 0, "udp messages per sendmmsg/recvmmsg, 0 for a syscall per datagram (linux)")
+	var gsoFlag = flag.Bool("gso", false, "udp segmentation offload, the kernel splits messages of several blocks into datagrams, UDP_SEGMENT (linux)")
+	var groFlag = flag.Bool("gro", false, "udp receive offload, the kernel coalesces the received datagrams, UDP_GRO (linux)")
 
 	// RUDP specific option
 	var sndWndFlag = flag.Uint("sw", 10, "rudp send window size")
@@ -402,6 +713,13 @@ func (test *IperfTest) ParseArguments() int {
 	var fastResendFlag = flag.Uint("fr", 0, "rudp fast resend strategy. 0 indicate turn off fast resend")
 	var datashardsFlag = flag.Uint("data", 0, "rudp/kcp FEC dataShards option")
 	var parityshardsFlag = flag.Uint("parity", 0, "rudp/kcp FEC parityShards option")
+	var mtuFlag = flag.Uint("mtu", KCP_DEFAULT_MTU, "rudp/kcp session mtu (bytes)")
+	var ackNoDelayFlag = flag.Bool("ack-nodelay", false, "rudp/kcp ack at once instead of with the next flush")
+	var msgModeFlag = flag.Bool("msg-mode", false, "rudp/kcp message mode instead of stream mode")
+	var cryptFlag = flag.String("crypt", CRYPT_NONE, "kcp payload encryption ("+strings.Join(CryptList, ", ")+"), aes is aes-256")
+	var keyFlag = flag.String("key", CRYPT_DEFAULT_KEY, "kcp passphrase the crypt key is derived from, the same on both ends")
+	var kcpDeadlineFlag = flag.Uint("kcp-deadline", 0, "rudp/kcp session read/write deadline (s), 0 for the test duration plus a margin")
+	var sessionStatsFlag = flag.Bool("session-stats", false, "rudp/kcp count the statistics of every session on the wire with -P or --bidir, costs the batched socket io")
 	// parse argument
 	flag.Parse()
 
@@ -420,20 +738,160 @@ func (test *IperfTest) ParseArguments() int {
 		}
 	}
 
-	validProtocol := false
-	for _, proto := range ProtocolList {
-		if *protocolFlag == proto {
-			validProtocol = true
+	if IsProtocolRegistered(*protocolFlag) == false {
+		return -2
+	}
+
+	if *reverseFlag && *bidirFlag {
+		Log.Errorf("-R and -bidir can not be used together")
+
+		return -4
+	}
+
+	if *crrFlag && (*rrFlag || *reverseFlag || *bidirFlag || flagset["n"]) {
+		Log.Errorf("-crr can not be used together with -rr, -R, -bidir or -n")
+
+		return -4
+	}
+
+	if *crrFlag && crrUnsupported(*protocolFlag) {
+		Log.Errorf("-crr needs a connection oriented protocol, %v has no connection setup", *protocolFlag)
+
+		return -4
+	}
+
+	if *fileFlag != "" && (*rrFlag || *crrFlag || *bidirFlag) {
+		Log.Errorf("-F can not be used together with -rr, -crr or -bidir")
+
+		return -4
+	}
+
+	if (*zeroCopyFlag || *zeroCopyMsgFlag) && (*protocolFlag != TCP_NAME && *protocolFlag != MPTCP_NAME || *fileFlag != "") {
+		Log.Errorf("-Z needs tcp or mptcp and can not be used together with -F")
+
+		return -4
+	}
+
+	if !IsPatternValid(*patternFlag) {
+		Log.Errorf("Unknown payload pattern %v", *patternFlag)
+
+		return -4
+	}
+
+	if !IsCryptValid(*cryptFlag) {
+		Log.Errorf("Unknown crypt %v", *cryptFlag)
+
+		return -4
+	}
+
+	if *cryptFlag != CRYPT_NONE && *protocolFlag != KCP_NAME {
+		// rudp-go takes a BlockCrypt but does not decrypt yet
+		Log.Errorf("-crypt needs kcp")
+
+		return -4
+	}
+
+	if (*verifyFlag || *patternFlag != PATTERN_DEFAULT) && (*rrFlag || *crrFlag || *fileFlag != "") {
+		Log.Errorf("-pattern and -verify can not be used together with -rr, -crr or -F")
+
+		return -4
+	}
+
+	if (*zeroCopyFlag || *zeroCopyMsgFlag) && (*verifyFlag || *patternFlag == PATTERN_RANDOM || *patternFlag == PATTERN_SEQ) {
+		Log.Errorf("-Z sends the same block over and over, it can not be used together with -verify or a changing pattern")
+
+		return -4
+	}
+
+	if *profileFlag != "" {
+		// the bursts are reported with their delay
+		*owdFlag = true
+	}
+
+	if *profileFlag != "" && *verifyFlag {
+		Log.Errorf("-profile can not be used together with -verify")
+
+		return -4
+	}
+
+	if *owdFlag && (*rrFlag || *crrFlag || *fileFlag != "" || *zeroCopyFlag || *zeroCopyMsgFlag) {
+		Log.Errorf("-owd can not be used together with -rr, -crr, -F or -Z")
+
+		return -4
+	}
+
+	if (flagset["w"] || flagset["M"] || flagset["C"]) && *protocolFlag != TCP_NAME && *protocolFlag != MPTCP_NAME {
+		Log.Errorf("-w, -M and -C need tcp or mptcp")
+
+		return -4
+	}
+
+	if flagset["fq-rate"] && *protocolFlag != TCP_NAME && *protocolFlag != UDP_NAME {
+		// the kernel does not take SO_MAX_PACING_RATE on mptcp sockets
+		Log.Errorf("-fq-rate needs tcp or udp")
+
+		return -4
+	}
+
+	if flagset["L"] && *protocolFlag != TCP_NAME && *protocolFlag != UDP_NAME {
+		Log.Errorf("-L needs tcp or udp")
+
+		return -4
+	}
+
+	if (flagset["udp-batch"] || *gsoFlag || *groFlag) &&
+		(*protocolFlag != UDP_NAME || *fileFlag != "" || *profileFlag != "" || *rrFlag || *crrFlag) {
+		Log.Errorf("-udp-batch, -gso and -gro need udp and can not be used together with -F, -profile, -rr or -crr")
+
+		return -4
+	}
+
+	if *ipv4Flag && *ipv6Flag {
+		Log.Errorf("-4 and -6 can not be used together")
+
+		return -4
+	} else if *ipv4Flag {
+		test.ipVersion = 4
+	} else if *ipv6Flag {
+		test.ipVersion = 6
+	}
+
+	if err := test.setBindAddr(*bindFlag); err != nil {
+		Log.Errorf("%v", err)
+
+		return -5
+	}
+
+	if *cportFlag != "" {
+		if *crrFlag {
+			Log.Errorf("-cport can not be used together with -crr")
+
+			return -4
+		}
+
+		first, last, err := ParsePortRange(*cportFlag)
+		if err != nil {
+			Log.Errorf("%v", err)
+
+			return -5
 		}
+
+		test.cport = portRange{first: first, last: last}
 	}
 
-	if validProtocol == false {
-		return -2
+	if *bindDevFlag != "" {
+		if _, err := net.InterfaceByName(*bindDevFlag); err != nil {
+			Log.Errorf("Error bind-dev flag %v. err = %v", *bindDevFlag, err)
+
+			return -5
+		}
+
+		test.bindDev = *bindDevFlag
 	}
 
 	// set block size
 	if flagset["l"] == false {
-		if *protocolFlag == TCP_NAME {
+		if *protocolFlag == TCP_NAME || *protocolFlag == MPTCP_NAME {
 			test.setting.blksize = DEFAULT_TCP_BLKSIZE
 		} else if *protocolFlag == UDP_NAME {
 			test.setting.blksize = DEFAULT_UDP_BLKSIZE
@@ -491,20 +949,63 @@ func (test *IperfTest) ParseArguments() int {
 	} else {
 		test.isServer = false
 
+		addr := normalizeHost(*clientFlag)
+
 		var err error
-		_, err = net.ResolveIPAddr("ip", *clientFlag)
+		_, err = net.ResolveIPAddr(test.network("ip"), addr)
 
 		if err != nil {
 			return -3
 		}
-		test.addr = *clientFlag
+		test.addr = addr
 	}
 
 	test.setTestReverse(*reverseFlag)
+	test.bidir = *bidirFlag
 	test.port = *portFlag
 	test.state = 0
 	test.interval = *intervalFlag
 	test.duration = *durFlag // 10s
+	test.omit = *omitFlag
+	test.rr = *rrFlag
+	test.setting.reqSize = *reqSizeFlag
+	test.setting.respSize = *respSizeFlag
+	test.crr = *crrFlag
+	test.setting.file = *fileFlag
+	test.setting.fileLoop = *fileLoopFlag
+	test.setting.zeroCopy = *zeroCopyFlag || *zeroCopyMsgFlag
+	test.setting.zeroCopyMsg = *zeroCopyMsgFlag
+	test.setting.pattern = *patternFlag
+	test.setting.seed = *seedFlag
+	test.setting.verify = *verifyFlag
+	test.setting.owd = *owdFlag
+	test.setting.profile = *profileFlag
+
+	if test.setting.verify && test.setting.blksize <= uint(test.payloadOffset()+VERIFY_HEADER_SIZE) {
+		Log.Errorf("block size must be larger than %v bytes to verify", test.payloadOffset()+VERIFY_HEADER_SIZE)
+
+		return -5
+	}
+
+	if test.setting.owd && test.setting.blksize < uint(test.payloadOffset()) {
+		Log.Errorf("block size must be at least %v bytes to carry the send time", test.payloadOffset())
+
+		return -5
+	}
+
+	if test.setting.profile != "" {
+		if _, err := newTrafficProfile(test.setting.profile, test.setting.rate, int(test.setting.blksize), nil); err != nil {
+			Log.Errorf("%v", err)
+
+			return -5
+		}
+	}
+
+	if test.rr && (test.setting.reqSize == 0 || test.setting.respSize == 0) {
+		Log.Errorf("request and response size must not be 0")
+
+		return -5
+	}
 	test.streamNum = *parallelFlag
 
 	// rudp only
@@ -517,11 +1018,163 @@ func (test *IperfTest) ParseArguments() int {
 	test.setting.fastResend = *fastResendFlag
 	test.setting.dataShards = *datashardsFlag
 	test.setting.parityShards = *parityshardsFlag
+	test.setting.ackNoDelay = *ackNoDelayFlag
+	test.setting.msgMode = *msgModeFlag
+	test.setting.deadline = *kcpDeadlineFlag
+	test.setting.crypt = *cryptFlag
+	test.setting.cryptKey = *keyFlag
+	test.setting.sessionStats = *sessionStatsFlag
+
+	if *mtuFlag < KCP_MIN_MTU || *mtuFlag > KCP_MAX_MTU {
+		Log.Errorf("Error mtu flag %v, expect %v to %v", *mtuFlag, KCP_MIN_MTU, KCP_MAX_MTU)
+
+		return -5
+	}
+
+	test.setting.mtu = *mtuFlag
+
+	if flagset["w"] {
+		window, err := ParseSize(*windowFlag)
+		if err != nil || window == 0 || window > math.MaxInt32 {
+			Log.Errorf("Error window flag %v", *windowFlag)
+
+			return -5
+		}
+
+		test.setting.window = uint(window)
+	}
+
+	if *mssFlag > math.MaxInt32 {
+		Log.Errorf("Error mss flag %v", *mssFlag)
+
+		return -5
+	}
+
+	test.setting.mss = *mssFlag
+
+	if *congestionFlag != "" {
+		if err := checkCongestion(*congestionFlag); err != nil {
+			Log.Errorf("%v", err)
+
+			return -5
+		}
+	}
+
+	test.setting.congestion = *congestionFlag
+
+	if flagset["S"] {
+		tos, err := ParseTOS(*tosFlag)
+		if err != nil {
+			Log.Errorf("%v", err)
+
+			return -5
+		}
+
+		test.setting.tos = tos
+	}
+
+	if flagset["fq-rate"] {
+		rate, err := ParseRate(*fqRateFlag)
+		if err != nil || rate == 0 {
+			Log.Errorf("Error fq-rate flag %v", *fqRateFlag)
+
+			return -5
+		}
+
+		test.setting.fqRate = rate
+	}
+
+	if flagset["A"] {
+		client, server, err := ParseAffinity(*affinityFlag)
+		if err != nil {
+			Log.Errorf("%v", err)
+
+			return -5
+		}
+
+		test.setting.affinity = client
+		test.setting.serverAffinity = server
+	}
+
+	test.setting.pinStreams = *pinStreamsFlag
+	test.verbose = *verboseFlag
+
+	if *gomaxprocsFlag != 0 {
+		runtime.GOMAXPROCS(int(*gomaxprocsFlag))
+	}
+
+	if flagset["listeners"] && !*serverFlag {
+		Log.Errorf("-listeners is an option of the server")
+
+		return -4
+	}
+
+	if *listenersFlag > LISTENERS_MAX {
+		Log.Errorf("Error listeners flag %v, expect up to %v", *listenersFlag, LISTENERS_MAX)
+
+		return -5
+	}
 
-	if test.interval > test.duration*1000 {
+	test.listeners = *listenersFlag
+	if test.listeners == 0 {
+		test.listeners = uint(runtime.NumCPU())
+	}
+
+	if *flowLabelFlag > FLOW_LABEL_MAX {
+		Log.Errorf("Error flow label flag %v, expect up to %v", *flowLabelFlag, FLOW_LABEL_MAX)
+
+		return -5
+	}
+
+	test.setting.flowLabel = *flowLabelFlag
+
+	if *udpBatchFlag > UDP_MAX_BATCH {
+		Log.Errorf("Error udp-batch flag %v, expect up to %v", *udpBatchFlag, UDP_MAX_BATCH)
+
+		return -5
+	}
+
+	test.setting.udpBatch = *udpBatchFlag
+	test.setting.gso = *gsoFlag
+	test.setting.gro = *groFlag
+
+	if flagset["n"] {
+		bytes, err := ParseSize(*bytesFlag)
+		if err != nil || bytes == 0 {
+			Log.Errorf("Error bytes flag %v", *bytesFlag)
+
+			return -5
+		}
+
+		test.setting.bytes = bytes
+	}
+
+	if flagset["k"] {
+		blocks, err := ParseSize(*blocksFlag)
+		if err != nil || blocks == 0 {
+			Log.Errorf("Error blocks flag %v", *blocksFlag)
+
+			return -5
+		}
+
+		test.setting.blocks = blocks
+	}
+
+	if test.setting.bytes != 0 || test.setting.blocks != 0 {
+		test.duration = 0 // run until the limit is reached
+	}
+
+	if test.duration != 0 && test.interval > test.duration*1000 {
 		Log.Errorf("interval must smaller than duration")
 	}
 
+	if test.setting.deadline != 0 && test.setting.deadline <= test.duration+test.omit {
+		// a session past its deadline fails the stream, the test would never end
+		Log.Errorf("Error kcp-deadline flag %v, expect longer than the test", test.setting.deadline)
+
+		return -5
+	}
+
 	test.noDelay = *noDelayFlag
 	if test.isServer == false {
 		test.setProtocol(*protocolFlag)
@@ -532,6 +1185,64 @@ func (test *IperfTest) ParseArguments() int {
 	return 0
 }
 
+func maxUint(a, b uint) uint {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// ParseSize parses a byte or block count with an optional K/M/G suffix, in powers of 1024
+func ParseSize(s string) (uint64, error) {
+	var unit uint64 = 1
+
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			unit = KB_TO_B
+		case 'M', 'm':
+			unit = MB_TO_B
+		case 'G', 'g':
+			unit = GB_TO_B
+		}
+
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > math.MaxUint64/unit {
+		return 0, &strconv.NumError{Func: "ParseSize", Num: s, Err: strconv.ErrRange}
+	}
+
+	return n * unit, nil
+}
+
+// ParseRate parses a rate the way -b takes it, bytes per second with an optional K/M/G suffix and MB/s without
+// one, and returns bits per second
+func ParseRate(s string) (uint64, error) {
+	if s != "" && s[len(s)-1] >= '0' && s[len(s)-1] <= '9' {
+		s += "M"
+	}
+
+	n, err := ParseSize(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > math.MaxUint64/8 {
+		return 0, &strconv.NumError{Func: "ParseRate", Num: s, Err: strconv.ErrRange}
+	}
+
+	return n * 8, nil
+}
+
 func (test *IperfTest) RunTest() int {
 	// server
 	if test.isServer == true {
@@ -571,6 +1282,109 @@ func (test *IperfTest) setTestReverse(reverse bool) {
 	}
 }
 
+// limitReached reports whether a test limited by bytes or blocks has transferred enough. Only the client checks
+// the limit, the server keeps its streams running until the client ends the test.
+func (test *IperfTest) limitReached(bytes, blocks uint64) bool {
+	if test.isServer {
+		return false
+	}
+
+	return (test.setting.bytes != 0 && bytes >= test.setting.bytes) ||
+		(test.setting.blocks != 0 && blocks >= test.setting.blocks)
+}
+
+// sentTotals returns the bytes and blocks the test sent after the omit period
+func (test *IperfTest) sentTotals() (uint64, uint64) {
+	return test.bytesSent - test.bytesSentOmit, test.blocksSent - test.blocksSentOmit
+}
+
+// receivedTotals returns the bytes and blocks the test received after the omit period
+func (test *IperfTest) receivedTotals() (uint64, uint64) {
+	return test.bytesReceived - test.bytesReceivedOmit, test.blocksReceived - test.blocksReceivedOmit
+}
+
+// streamDeadline returns the deadline of the client streams, no deadline if the test is limited by bytes or blocks
+func (test *IperfTest) streamDeadline() time.Time {
+	if test.duration == 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(time.Duration(test.duration+test.omit+5) * time.Second)
+}
+
+// reportTimes returns how many times the stats and report tickers fire, unlimited without a duration
+func (test *IperfTest) reportTimes() uint {
+	if test.duration == 0 {
+		return ^uint(0)
+	}
+
+	return (test.duration+test.omit)*1000/test.interval - 1
+}
+
+// elapsed returns how long the streams have been running
+func (test *IperfTest) elapsed() time.Duration {
+	for _, sp := range test.streams {
+		return sp.result.end_time.Sub(sp.result.start_time)
+	}
+
+	return 0
+}
+
+// streamCount returns the number of data streams, a bidirectional test has streamNum streams in each direction
+func (test *IperfTest) streamCount() uint {
+	if test.bidir {
+		return test.streamNum * 2
+	}
+
+	return test.streamNum
+}
+
+// streamRole returns the role of the i-th stream. In a bidirectional test the client creates its sender streams
+// first, so they pair up with the receiver streams the server accepts first.
+func (test *IperfTest) streamRole(i uint) int {
+	if !test.bidir {
+		if test.mode == IPERF_SENDER {
+			return SENDER_STREAM
+		}
+
+		return RECEIVER_STREAM
+	}
+
+	if (i < test.streamNum) != test.isServer {
+		return SENDER_STREAM
+	}
+
+	return RECEIVER_STREAM
+}
+
+// hasSender reports whether this side sends on any of its streams
+func (test *IperfTest) hasSender() bool {
+	return test.bidir || test.mode == IPERF_SENDER
+}
+
+// directionLabel tags the reports of a bidirectional test, e.g. TX-C for the streams the client sends on
+func (test *IperfTest) directionLabel(role int) string {
+	dir := "RX"
+	if role == SENDER_STREAM {
+		dir = "TX"
+	}
+
+	if test.isServer {
+		return dir + "-S"
+	}
+
+	return dir + "-C"
+}
+
+// streamLabel returns the id of a stream shown in the reports
+func (test *IperfTest) streamLabel(i int, sp *iperfStream) string {
+	if !test.bidir {
+		return strconv.Itoa(i)
+	}
+
+	return fmt.Sprintf("%v][%v", i, test.directionLabel(sp.role))
+}
+
 func (test *IperfTest) FreeTest() int {
 	return 0
 }
@@ -586,27 +1400,55 @@ func (test *IperfTest) Print() {
 	}
 
 	fmt.Printf("Iperf started:\n")
-	if test.proto.name() == TCP_NAME {
+	if test.proto.Name() == TCP_NAME || test.proto.Name() == MPTCP_NAME {
 		fmt.Printf("addr:%v\tport:%v\tproto:%v\tinterval:%v\tduration:%v\tNoDelay:%v\tburst:%v\tBlockSize:%v\tStreamNum:%v\n",
-			test.addr, test.port, test.proto.name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum)
-	} else if test.proto.name() == RUDP_NAME {
+			test.addr, test.port, test.proto.Name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum)
+	} else if test.proto.Name() == RUDP_NAME {
 		fmt.Printf("addr:%v\tport:%v\tproto:%v\tinterval:%v\tduration:%v\tNoDelay:%v\tburst:%v\tBlockSize:%v\tStreamNum:%v\tfr:%v\n"+
-			"RUDP settting: sndWnd:%v\trcvWnd:%v\twriteBufSize:%vKb\treadBufSize:%vKb\tnoCongestion:%v\tflushInterval:%v\tdataShards:%v\tparityShards:%v\n",
-			test.addr, test.port, test.proto.name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum, test.setting.fastResend,
+			"RUDP settting: sndWnd:%v\trcvWnd:%v\twriteBufSize:%vKb\treadBufSize:%vKb\tnoCongestion:%v\tflushInterval:%v\tdataShards:%v\tparityShards:%v\n"+
+			"RUDP session: mtu:%v\tackNoDelay:%v\tmode:%v\tdeadline:%v\tstats:%v\n",
+			test.addr, test.port, test.proto.Name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum, test.setting.fastResend,
 			test.setting.sndWnd, test.setting.rcvWnd, test.setting.writeBufSize/1024, test.setting.readBufSize/1024, test.setting.noCong,
-			test.setting.flushInterval, test.setting.dataShards, test.setting.parityShards)
-	} else if test.proto.name() == KCP_NAME {
-		fmt.Printf("addr:%v\tport:%v\tproto:%v\tinterval:%v\tduration:%v\tNoDelay:%v\tburst:%v\tBlockSize:%v\tStreamNum:%v\n"+
-			"KCP settting: sndWnd:%v\trcvWnd:%v\twriteBufSize:%vKb\treadBufSize:%vKb\tnoCongestion:%v\tflushInterval:%v\tdataShards:%v\tparityShards:%v\n",
-			test.addr, test.port, test.proto.name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum,
+			test.setting.flushInterval, test.setting.dataShards, test.setting.parityShards,
+			test.kcpMTU(), test.setting.ackNoDelay, test.sessionModeName(), test.sessionDeadlineName(), test.sessionStatsName())
+	} else if test.proto.Name() == KCP_NAME {
+		fmt.Printf("addr:%v\tport:%v\tproto:%v\tinterval:%v\tduration:%v\tNoDelay:%v\tburst:%v\tBlockSize:%v\tStreamNum:%v\tfr:%v\n"+
+			"KCP settting: sndWnd:%v\trcvWnd:%v\twriteBufSize:%vKb\treadBufSize:%vKb\tnoCongestion:%v\tflushInterval:%v\tdataShards:%v\tparityShards:%v\n"+
+			"KCP session: mtu:%v\tackNoDelay:%v\tmode:%v\tdeadline:%v\tcrypt:%v\tstats:%v\n",
+			test.addr, test.port, test.proto.Name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum, test.setting.fastResend,
 			test.setting.sndWnd, test.setting.rcvWnd, test.setting.writeBufSize/1024, test.setting.readBufSize/1024, test.setting.noCong,
-			test.setting.flushInterval, test.setting.dataShards, test.setting.parityShards)
+			test.setting.flushInterval, test.setting.dataShards, test.setting.parityShards,
+			test.kcpMTU(), test.setting.ackNoDelay, test.sessionModeName(), test.sessionDeadlineName(), test.cryptName(),
+			test.sessionStatsName())
+	} else {
+		fmt.Printf("addr:%v\tport:%v\tproto:%v\tinterval:%v\tduration:%v\tNoDelay:%v\tburst:%v\tBlockSize:%v\tStreamNum:%v\n",
+			test.addr, test.port, test.proto.Name(), test.interval, test.duration, test.noDelay, test.setting.burst, test.setting.blksize, test.streamNum)
+	}
+
+	if test.udpBatching() {
+		fmt.Printf("UDP batch: %v\n", test.batchName())
+	}
+
+	if test.rr {
+		fmt.Printf("RR setting: reqSize:%v\trespSize:%v\n", test.setting.reqSize, test.setting.respSize)
+	} else if test.crr {
+		fmt.Printf("CRR setting: reqSize:%v\trespSize:%v\n", test.setting.reqSize, test.setting.respSize)
 	}
 }
 
 // iperf_stream
 
 func (sp *iperfStream) iperfRecv(test *IperfTest) {
+	sp.pinThread()
+
+	if sp.ownFile() {
+		defer sp.releaseFile()
+	}
+
+	// a stream writing to a file keeps receiving after the end of the test until the stream is closed,
+	// so the blocks still in flight make it to the file
+	ended := false
+
 	// travel all the stream and start receive
 	for {
 		var n int
@@ -622,41 +1464,115 @@ func (sp *iperfStream) iperfRecv(test *IperfTest) {
 			return
 		}
 
+		blocks := sp.receivedBlocks(n)
+
 		if test.state == TEST_RUNNING {
 			test.bytesReceived += uint64(n)
-			test.blocksReceived += 1
+			test.blocksReceived += uint64(len(blocks))
 
 			Log.Debugf("Stream receive data %v bytes of total %v bytes", n, test.bytesReceived)
 		}
 
-		if test.done {
+		for _, block := range blocks {
+			if test.setting.verify || test.setting.owd {
+				sp.receiveData(block)
+			}
+
+			if sp.file != nil && sp.writeFile(block) < 0 {
+				// keep the test running, only stop writing
+				sp.dropFile()
+			}
+		}
+
+		if !ended && (test.done || test.limitReached(test.receivedTotals())) {
 			test.ctrlChan <- TEST_END
-			Log.Debugf("Stream quit receiving. test done.")
+			ended = true
 
-			return
+			if sp.file == nil {
+				Log.Debugf("Stream quit receiving. test done.")
+
+				return
+			}
+
+			Log.Debugf("Stream keeps writing the file until it is closed.")
 		}
 	}
 }
 
 // iperfSend -- called by multi streams
 func (sp *iperfStream) iperfSend(test *IperfTest) {
+	sp.pinThread()
+
 	// defaultRate := uint64(1000 * 1000 * 1000) // 1 Gb/s in bits (1000 Mbps)
 	sendInterval := time.Duration(1000000) // 1 ms for exactly 1000 sends/s
 	if !test.setting.burst && test.setting.rate != 0 {
-		sendInterval = time.Duration(uint64(sp.bufferSize()) * 8 * 1000000000 / uint64(test.setting.rate)) // ns
+		size := uint64(sp.bufferSize())
+		if sp.batch != nil {
+			size *= uint64(len(sp.batch.bufs) * sp.batch.perMsg)
+		}
+
+		sendInterval = time.Duration(size * 8 * 1000000000 / uint64(test.setting.rate)) // ns
 	}
 
 	Log.Debugf("Send interval set to %v", sendInterval)
 
+	if sp.ownFile() {
+		defer sp.releaseFile()
+	}
+
 	ticker := time.NewTicker(sendInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case t := <-ticker.C:
-			if sp.canSend {
+			if sp.canSend && sp.batch != nil {
+				n, blocks := sp.sendBatch()
+				if n < 0 {
+					if n == -1 {
+						Log.Debugf("Iperf send stream closed.")
+
+						return
+					}
+
+					Log.Errorf("Iperf streams send failed. %v", n)
+
+					return
+				}
+
+				test.bytesSent += uint64(n)
+				test.blocksSent += uint64(blocks)
+
+				Log.Debugf("Stream sent %v blocks of %v bytes at %v, total %v bytes", blocks, n, t, test.bytesSent)
+			} else if sp.canSend {
+				buf := sp.buffer
+
+				if sp.file != nil {
+					size := sp.readFile(buf)
+					if size <= 0 {
+						// the end of the file ends the test on the client, the server only stops sending
+						Log.Debugf("Stream reached the end of the file")
+
+						if !test.isServer {
+							test.ctrlChan <- TEST_END
+						}
+
+						return
+					}
+
+					sp.buffer = buf[:size]
+				} else if test.patternPerBlock() {
+					sp.nextBlock(buf)
+				}
+
+				if test.setting.owd {
+					sp.stampBlock(buf)
+				}
+
 				n := sp.snd(sp)
 
+				sp.buffer = buf
+
 				if n < 0 {
 					if n == -1 {
 						Log.Debugf("Iperf send stream closed.")
@@ -680,9 +1596,7 @@ func (sp *iperfStream) iperfSend(test *IperfTest) {
 			test.checkThrottle(sp, time.Now())
 		}
 
-		if (test.duration != 0 && test.done) ||
-			(test.setting.bytes != 0 && test.bytesSent >= test.setting.bytes) ||
-			(test.setting.blocks != 0 && test.blocksSent >= test.setting.blocks) {
+		if (test.duration != 0 && test.done) || test.limitReached(test.sentTotals()) {
 
 			test.ctrlChan <- TEST_END
 
@@ -699,6 +1613,10 @@ func (sp *iperfStream) bufferSize() int {
 
 func (test *IperfTest) createSenderTicker() int {
 	for _, sp := range test.streams {
+		if sp.role != SENDER_STREAM {
+			continue
+		}
+
 		sp.canSend = true
 
 		if test.setting.rate != 0 {
@@ -730,20 +1648,71 @@ func iperfReporterCallback(test *IperfTest) {
 
 		test.iperfPrintIntermediate()
 		test.iperfPrintResults()
+		test.printCPUUsage()
+		test.printListeners()
 	} else {
 		Log.Errorf("Unexpected state = %v, role = %v", test.state, test.isServer)
 	}
 }
 
+// reportSum accumulates the streams of one direction for the [SUM] lines
+type reportSum struct {
+	bytes   uint64
+	rtt     float64 // ms
+	retrans uint
+	streams uint
+}
+
+func (s *reportSum) add(bytes uint64, rtt float64, retrans uint) {
+	s.bytes += bytes
+	s.rtt += rtt
+	s.retrans += retrans
+	s.streams++
+}
+
+// printSums prints one [SUM] line per direction for a bidirectional test, otherwise a single one for parallel streams
+func (test *IperfTest) printSums(sums map[int]*reportSum, start, end, dur float64, mark string) {
+	printSum := func(format string, args []interface{}, sum *reportSum) {
+		displayBytesTransfer := float64(sum.bytes) / MB_TO_B
+		args = append(args, start, end, displayBytesTransfer, displayBytesTransfer/dur*8, sum.rtt/float64(sum.streams), sum.retrans, mark)
+
+		fmt.Printf(format, args...)
+	}
+
+	if test.bidir {
+		for _, role := range []int{SENDER_STREAM, RECEIVER_STREAM} {
+			if sum := sums[role]; sum.streams > 0 {
+				printSum(REPORT_SUM_DIRECTION, []interface{}{test.directionLabel(role)}, sum)
+			}
+		}
+	} else if test.streamNum > 1 {
+		for _, sum := range sums {
+			if sum.streams > 0 {
+				printSum(REPORT_SUM_STREAM, nil, sum)
+			}
+		}
+	}
+}
+
 func (test *IperfTest) iperfPrintIntermediate() {
-	var sumBytesTransfer, sumRtt uint64
-	var sumRetrans uint
+	if test.rr {
+		test.printRRIntermediate()
+
+		return
+	} else if test.crr {
+		test.printCRRIntermediate()
+
+		return
+	}
+
+	sums := map[int]*reportSum{SENDER_STREAM: {}, RECEIVER_STREAM: {}}
 	var displayStartTime, displayEndTime float64
+	var mark string
 
 	for i, sp := range test.streams {
 		if i == 0 && len(sp.result.interval_results) == 1 {
 			// first time to print result, print header
-			if test.proto.name() == TCP_NAME {
+			if !test.sessionStyleReport() {
 				fmt.Printf(TCP_INTERVAL_HEADER)
 			} else {
 				fmt.Printf(RUDP_INTERVAL_HEADER)
@@ -754,8 +1723,9 @@ func (test *IperfTest) iperfPrintIntermediate() {
 		rp := sp.result.interval_results[intervalSeq] // get the last one
 
 		supposedStartTime := time.Duration(uint(intervalSeq)*test.interval) * time.Millisecond
-		realStartTime := rp.interval_start_time.Sub(sp.result.start_time)
-		realEndTime := rp.interval_end_time.Sub(sp.result.start_time)
+		// start_time moves to the end of the omit period, intervals are shown from the very start of the test
+		realStartTime := rp.interval_start_time.Sub(sp.result.start_time_fixed)
+		realEndTime := rp.interval_end_time.Sub(sp.result.start_time_fixed)
 
 		if durNotSame(supposedStartTime, realStartTime) {
 			Log.Errorf("Start time differ from expected. supposed = %v, real = %v",
@@ -763,21 +1733,29 @@ func (test *IperfTest) iperfPrintIntermediate() {
 			//return
 		}
 
-		sumBytesTransfer += rp.bytes_transfered
-		sumRetrans += rp.interval_retrans
-		sumRtt += uint64(rp.rtt)
+		sums[sp.role].add(rp.bytes_transfered, float64(rp.rtt)/1000, rp.interval_retrans)
 
 		displayStartTime = float64(realStartTime.Nanoseconds()) / S_TO_NS
 		displayEndTime = float64(realEndTime.Nanoseconds()) / S_TO_NS
 
 		displayBytesTransfer := float64(rp.bytes_transfered) / MB_TO_B
-		displayBandwidth := displayBytesTransfer / float64(test.interval) * 1000 * 8 // Mb/s
+		// the last interval of a test ended early is shorter
+		displayBandwidth := displayBytesTransfer / (realEndTime - realStartTime).Seconds() * 8 // Mb/s
+
+		mark = ""
+		if rp.omitted != 0 {
+			mark = REPORT_OMITTED
+		}
 
 		// output single stream interval report
-		if test.proto.name() == TCP_NAME {
+		if !test.sessionStyleReport() {
 			//display_retrans_rate :=  float64(rp.interval_retrans) / (float64(rp.bytes_transfered) / TCP_MSS) * 100
-			fmt.Printf(TCP_REPORT_SINGLE_STREAM, i, displayStartTime, displayEndTime,
-				displayBytesTransfer, displayBandwidth, float64(rp.rtt)/1000, rp.interval_retrans)
+			fmt.Printf(TCP_REPORT_SINGLE_STREAM, test.streamLabel(i, sp), displayStartTime, displayEndTime,
+				displayBytesTransfer, displayBandwidth, float64(rp.rtt)/1000, rp.interval_retrans, mark)
+
+			for j, sf := range rp.subflow_results {
+				fmt.Printf(MPTCP_REPORT_SUBFLOW, test.streamLabel(i, sp), j, sf.snd_cwnd, float64(sf.rtt)/1000, sf.interval_retrans)
+			}
 		} else {
 			totalSegs := float64(rp.bytes_transfered)/RUDP_MSS + float64(rp.interval_retrans)
 
@@ -786,23 +1764,41 @@ func (test *IperfTest) iperfPrintIntermediate() {
 			displayEarlyRetransRate := float64(rp.interval_early_retrans) / totalSegs * 100
 			displayFastRetransRate := float64(rp.interval_fast_retrans) / totalSegs * 100
 
-			fmt.Printf(RUDP_REPORT_SINGLE_STREAM, i, displayStartTime, displayEndTime, displayBytesTransfer,
+			fmt.Printf(RUDP_REPORT_SINGLE_STREAM, test.streamLabel(i, sp), displayStartTime, displayEndTime, displayBytesTransfer,
 				displayBandwidth, float64(rp.rtt)/1000, rp.interval_retrans, displayRetransRate,
-				displayLostRate, displayEarlyRetransRate, displayFastRetransRate)
+				displayLostRate, displayEarlyRetransRate, displayFastRetransRate, mark)
 		}
-	}
 
-	if test.streamNum > 1 {
-		displaySumBytesTransfer := float64(sumBytesTransfer) / MB_TO_B
-		displayBandwidth := displaySumBytesTransfer / float64(test.interval) * 1000 * 8
+		test.printOWD(i, sp, owdSummary(&rp.owd_hist, rp.owd_ipdv_sum, rp.owd_ipdv_cnt), mark)
+		test.printBursts(i, sp, burstSummary(rp.bursts, &rp.burst_hist), mark)
+		test.printTCPInfo(i, sp, &rp.tcp_info, mark)
+		test.printPacing(i, sp, &rp, mark)
+		test.printBatch(i, sp, rp.interval_packet_cnt, rp.interval_syscall_cnt, rp.interval_dur.Seconds(), mark)
+	}
 
-		fmt.Printf(REPORT_SUM_STREAM, displayStartTime, displayEndTime, displaySumBytesTransfer,
-			displayBandwidth, float64(sumRtt)/1000/float64(test.streamNum), sumRetrans)
+	if test.bidir || test.streamNum > 1 {
+		test.printSums(sums, displayStartTime, displayEndTime, displayEndTime-displayStartTime, mark)
 
 		fmt.Printf(REPORT_SEPERATOR)
 	}
 }
 
+// tcpStyleReport reports whether the streams have the kernel TCP statistics
+func (test *IperfTest) tcpStyleReport() bool {
+	return test.proto.Name() == TCP_NAME || test.proto.Name() == MPTCP_NAME
+}
+
+// sessionStyleReport reports whether the session statistics layout of the built-in datagram protocols is used for
+// output, registered protocols share the one of tcp, with the rtt and retransmissions they set
+func (test *IperfTest) sessionStyleReport() bool {
+	switch test.proto.Name() {
+	case UDP_NAME, RUDP_NAME, KCP_NAME:
+		return true
+	}
+
+	return false
+}
+
 func durNotSame(d time.Duration, d2 time.Duration) bool {
 	// if deviation exceed 1ms, there might be problems
 	var diffInMs int = int(d.Nanoseconds()/MS_TO_NS - d2.Nanoseconds()/MS_TO_NS)
@@ -814,8 +1810,18 @@ func durNotSame(d time.Duration, d2 time.Duration) bool {
 }
 
 func (test *IperfTest) iperfPrintResults() {
+	if test.rr {
+		test.printRRResults()
+
+		return
+	} else if test.crr {
+		test.printCRRResults()
+
+		return
+	}
+
 	fmt.Printf(SUMMARY_SEPERATOR)
-	if test.proto.name() == TCP_NAME {
+	if !test.sessionStyleReport() {
 		fmt.Printf(TCP_RESULT_HEADER)
 	} else {
 		fmt.Printf(RUDP_RESULT_HEADER)
@@ -827,30 +1833,23 @@ func (test *IperfTest) iperfPrintResults() {
 		return
 	}
 
-	var sumBytesTransfer uint64
-	var sumRetrans uint
-	var avgRtt float64
+	sums := map[int]*reportSum{SENDER_STREAM: {}, RECEIVER_STREAM: {}}
 	var displayStartTime, displayEndTime float64
 
 	for i, sp := range test.streams {
 		displayStartTime = float64(0)
 		displayEndTime = float64(sp.result.end_time.Sub(sp.result.start_time).Nanoseconds()) / S_TO_NS
 
-		var displayBytesTransfer float64
-
-		if test.mode == IPERF_RECEIVER {
-			displayBytesTransfer = float64(sp.result.bytes_received) / MB_TO_B
-			sumBytesTransfer += sp.result.bytes_received
-		} else {
-			displayBytesTransfer = float64(sp.result.bytes_sent) / MB_TO_B
-			sumBytesTransfer += sp.result.bytes_sent
+		bytesTransfer := sp.BytesSent()
+		if sp.role == RECEIVER_STREAM {
+			bytesTransfer = sp.BytesReceived()
 		}
 
+		displayBytesTransfer := float64(bytesTransfer) / MB_TO_B
 		displayRtt := float64(sp.result.stream_sum_rtt) / float64(sp.result.stream_cnt_rtt) / 1000
-		avgRtt += displayRtt
-		displayBandwidth := displayBytesTransfer / float64(test.duration) * 8 // Mb/s
+		displayBandwidth := displayBytesTransfer / displayEndTime * 8 // Mb/s
 
-		sumRetrans += sp.result.stream_retrans
+		sums[sp.role].add(bytesTransfer, displayRtt, sp.result.stream_retrans)
 
 		var role string
 
@@ -861,11 +1860,26 @@ func (test *IperfTest) iperfPrintResults() {
 		}
 
 		// output single stream final report
-		if test.proto.name() == TCP_NAME {
+		if !test.sessionStyleReport() {
+			if test.proto.Name() == MPTCP_NAME && !sp.result.mptcp_negotiated {
+				role += ", TCP fallback"
+			}
+
 			totalSegs := (displayBytesTransfer * MB_TO_B / TCP_MSS) + float64(sp.result.stream_retrans)
 			displayRetransRate := float64(sp.result.stream_retrans) / totalSegs * 100
-			fmt.Printf(TCP_REPORT_SINGLE_RESULT, i, displayStartTime, displayEndTime, displayBytesTransfer,
+			fmt.Printf(TCP_REPORT_SINGLE_RESULT, test.streamLabel(i, sp), displayStartTime, displayEndTime, displayBytesTransfer,
 				displayBandwidth, displayRtt, sp.result.stream_retrans, displayRetransRate, role)
+			test.printFileResult(i, sp)
+			test.printVerifyResult(i, sp)
+			test.printOWD(i, sp, sp.owdResults(), "")
+			test.printBursts(i, sp, sp.burstResults(), "")
+			test.printTOS(i, sp)
+
+			if sp.zc != nil {
+				fmt.Printf(ZEROCOPY_REPORT, test.streamLabel(i, sp), sp.zc)
+			}
+
+			test.printCongestion(i, sp)
 		} else {
 			totalSegs := float64(sp.result.stream_out_segs)
 
@@ -878,22 +1892,47 @@ func (test *IperfTest) iperfPrintResults() {
 			pktsLostRate := (1 - float64(sp.result.stream_in_pkts)/float64(sp.result.stream_out_pkts)) * 100
 			segsLostRate := (1 - float64(sp.result.stream_in_segs)/float64(sp.result.stream_out_segs)) * 100
 
-			fmt.Printf(RUDP_REPORT_SINGLE_RESULT, i, displayStartTime, displayEndTime, displayBytesTransfer,
+			fmt.Printf(RUDP_REPORT_SINGLE_RESULT, test.streamLabel(i, sp), displayStartTime, displayEndTime, displayBytesTransfer,
 				displayBandwidth, displayRtt, sp.result.stream_retrans, displayRetransRate,
 				displayLostRate, displayEarlyRetransRate, displayFastRetransRate,
 				recoverRate, pktsLostRate, segsLostRate, role)
 			fmt.Printf("total_segs = %v, out_segs = %v, in_segs = %v, out_pkts = %v, in_pkts = %v, recovery = %v\n, repeat = %v\n",
 				totalSegs, sp.result.stream_out_segs, sp.result.stream_in_segs, sp.result.stream_out_pkts, sp.result.stream_in_pkts, sp.result.stream_recovers, sp.result.stream_repeat_segs)
+			test.printFileResult(i, sp)
+			test.printVerifyResult(i, sp)
+			test.printOWD(i, sp, sp.owdResults(), "")
+			test.printBursts(i, sp, sp.burstResults(), "")
+			test.printTOS(i, sp)
+			test.printBatch(i, sp, uint(sp.result.udp_packets+sp.result.udp_packets_this_interval),
+				uint(sp.result.udp_syscalls+sp.result.udp_syscalls_this_interval), displayEndTime, "")
 		}
 	}
 
-	if test.streamNum > 1 {
-		displaySumBytesTransfer := float64(sumBytesTransfer) / MB_TO_B
-		displayBandwidth := displaySumBytesTransfer / float64(test.duration) * 1000 * 8
+	test.printSums(sums, displayStartTime, displayEndTime, displayEndTime-displayStartTime, "")
+	test.printProfile()
+	test.printCrypt()
+	test.printClockOffset()
+}
+
+// printCPUUsage prints the cpu time the process used during the test, relative to one core
+func (test *IperfTest) printCPUUsage() {
+	user, sys := cpuTime()
+	if user == 0 && sys == 0 {
+		return
+	}
+
+	wall := time.Since(test.cpuStartWall).Seconds()
+	userPercent := (user - test.cpuStartUser).Seconds() / wall * 100
+	sysPercent := (sys - test.cpuStartSys).Seconds() / wall * 100
 
-		fmt.Printf(REPORT_SUM_STREAM, displayStartTime, displayEndTime,
-			displaySumBytesTransfer, displayBandwidth, avgRtt/float64(test.streamNum), sumRetrans)
+	role := "receiver"
+	if test.bidir {
+		role = "sender and receiver"
+	} else if test.mode == IPERF_SENDER {
+		role = "sender"
 	}
+
+	fmt.Printf(CPU_REPORT, role, userPercent+sysPercent, userPercent, sysPercent)
 }
 
 // Gather statistics during a test.
@@ -914,8 +1953,24 @@ func iperfStatsCallback(test *IperfTest) {
 		tempResult.interval_end_time = rp.end_time
 		tempResult.interval_dur = tempResult.interval_end_time.Sub(tempResult.interval_start_time)
 
-		test.proto.statsCallback(test, sp, &tempResult) // write temp_result differ from proto to proto
-		if test.mode == IPERF_RECEIVER {
+		if test.omitting {
+			tempResult.omitted = 1
+		}
+
+		test.proto.StatsCallback(test, sp, &tempResult) // write temp_result differ from proto to proto
+		if test.rr || test.crr {
+			sp.rrInterval(&tempResult)
+		}
+
+		if test.setting.owd {
+			sp.owdInterval(&tempResult)
+		}
+
+		if test.setting.profile != "" {
+			sp.burstInterval(&tempResult)
+		}
+
+		if sp.role == RECEIVER_STREAM {
 			tempResult.bytes_transfered = rp.bytes_received_this_interval
 		} else {
 			tempResult.bytes_transfered = rp.bytes_sent_this_interval
@@ -925,5 +1980,51 @@ func iperfStatsCallback(test *IperfTest) {
 		rp.bytes_sent_this_interval = 0
 		rp.bytes_received_this_interval = 0
 	}
+
+	if test.crr && test.isServer {
+		test.crrAccepts.interval(test.omitting)
+	}
+
+	if test.omitting && len(test.streams) > 0 {
+		// end the omit period at the interval boundary nearest to it, so no interval is partly omitted
+		sp := test.streams[0]
+		if sp.result.end_time.Sub(sp.result.start_time_fixed)+time.Duration(test.interval)*time.Millisecond/2 >=
+			time.Duration(test.omit)*time.Second {
+			test.endOmit()
+		}
+	}
+
 	test.chStats <- true
 }
+
+// endOmit drops everything accumulated during the omit period, the results start over from now. The stream
+// goroutines keep adding to the byte and block counters, those are left alone and the results subtract what they
+// held here.
+func (test *IperfTest) endOmit() {
+	Log.Debugf("Omit period ends")
+
+	test.omitting = false
+
+	test.bytesSentOmit = test.bytesSent
+	test.bytesReceivedOmit = test.bytesReceived
+	test.blocksSentOmit = test.blocksSent
+	test.blocksReceivedOmit = test.blocksReceived
+
+	for _, sp := range test.streams {
+		rp := sp.result
+
+		rp.bytes_sent_omit = rp.bytes_sent
+		rp.bytes_received_omit = rp.bytes_received
+		rp.stream_retrans = 0
+		rp.stream_lost = 0
+		rp.stream_early_retrans = 0
+		rp.stream_fast_retrans = 0
+		rp.stream_max_rtt = 0
+		rp.stream_min_rtt = 0
+		rp.stream_sum_rtt = 0
+		rp.stream_cnt_rtt = 0
+		rp.udp_packets = 0
+		rp.udp_syscalls = 0
+		rp.start_time = rp.end_time
+	}
+}
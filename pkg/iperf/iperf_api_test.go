@@ -1,6 +1,14 @@
 package iperf
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,3 +57,272 @@ func TestServer(t *testing.T) {
 
 	t.Log("Server test completed successfully")
 }
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"1000": 1000,
+		"4K":   4 * KB_TO_B,
+		"10G":  10 * GB_TO_B,
+		"2m":   2 * MB_TO_B,
+	}
+
+	for s, want := range cases {
+		got, err := ParseSize(s)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"1T", "18446744073709551616", "17179869184G", "18014398509481984K"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("ParseSize(%q) should fail", s)
+		}
+	}
+
+	if _, err := ParseRate("9007199254740992K"); err == nil {
+		t.Errorf("ParseRate(%q) should fail", "9007199254740992K")
+	}
+}
+
+func TestExchangeParams(t *testing.T) {
+	client := NewIperfTest()
+	client.Init()
+	client.setProtocol(TCP_NAME)
+	client.setting.profile = "custom" + strings.Repeat(",size=1000", 300) // well over one read of the old 1024 bytes
+
+	server := NewIperfTest()
+	server.Init()
+	server.isServer = true
+
+	client.ctrlConn, server.ctrlConn = net.Pipe()
+	defer client.ctrlConn.Close()
+	defer server.ctrlConn.Close()
+
+	go client.sendParams()
+
+	if server.getParams() < 0 || server.setting.profile != client.setting.profile {
+		t.Fatalf("getParams of %v bytes of profile failed", len(client.setting.profile))
+	}
+
+	// params over PARAMS_MAX are refused with an error the client reads
+	go func() {
+		bs := make([]byte, 4)
+		binary.LittleEndian.PutUint32(bs, PARAMS_MAX+1)
+		client.ctrlConn.Write(bs)
+	}()
+
+	errc := make(chan error, 1)
+	go func() {
+		bs := make([]byte, 4)
+		if _, err := client.ctrlConn.Read(bs); err != nil || binary.LittleEndian.Uint32(bs) != SERVER_ERROR {
+			errc <- errors.New("no SERVER_ERROR")
+
+			return
+		}
+
+		errc <- client.readServerError()
+	}()
+
+	if server.getParams() == 0 {
+		t.Fatalf("getParams over PARAMS_MAX should fail")
+	}
+
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "params of") {
+		t.Fatalf("client got %v, want the refusal of the params", err)
+	}
+}
+
+func TestContinuousServerFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	data := make([]byte, 300*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+
+	sconfig := ServerConfig(port)
+	sconfig.File = dst
+
+	server, err := NewContinuousServer(sconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = server.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// the client sends the file to its end, the server writes what it receives to its own -F
+	cconfig := ClientConfig("127.0.0.1", port)
+	cconfig.File = src
+	cconfig.Duration = 5 * time.Second
+
+	client, err := NewClient(cconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = client.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server closes the file when its end of the test is over
+	var got []byte
+	for i := 0; i < 50; i++ {
+		if got, err = os.ReadFile(dst); err == nil && len(got) == len(data) {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("the server wrote %v bytes, %v bytes sent, err = %v", len(got), len(data), err)
+	}
+}
+
+func TestEndOmit(t *testing.T) {
+	test := NewIperfTest()
+	test.Init()
+	test.setProtocol(UDP_NAME)
+	test.interval = 1000
+	test.omit = 2
+	test.omitting = true
+	test.setting.blocks = 5
+
+	sp := test.newStream(nil, SENDER_STREAM)
+	test.streams = []*iperfStream{sp}
+
+	// what the stream goroutine adds for every block
+	send := func(blocks int) {
+		for i := 0; i < blocks; i++ {
+			sp.RecordSent(100)
+			test.bytesSent += 100
+			test.blocksSent++
+		}
+	}
+
+	// the stats callback runs at the interval ends, the test started that long ago
+	stats := func(elapsed time.Duration) {
+		sp.result.start_time_fixed = time.Now().Add(-elapsed)
+		if len(sp.result.interval_results) == 0 {
+			sp.result.start_time = sp.result.start_time_fixed
+		}
+
+		iperfStatsCallback(test)
+		<-test.chStats
+	}
+
+	send(3)
+	stats(time.Second)
+
+	if !test.omitting {
+		t.Fatalf("the omit period ended after 1 of 2 s")
+	}
+
+	send(1)
+	stats(1990 * time.Millisecond) // a little early, the boundary is within half an interval
+
+	if test.omitting {
+		t.Fatalf("the omit period did not end after 1.99 of 2 s")
+	}
+
+	// the counters of the stream goroutines keep running, the totals leave the omit period out
+	if sp.result.bytes_sent != 400 || test.blocksSent != 4 {
+		t.Errorf("counters reset to %v bytes, %v blocks", sp.result.bytes_sent, test.blocksSent)
+	}
+
+	if bytes, blocks := test.sentTotals(); bytes != 0 || blocks != 0 || sp.BytesSent() != 0 {
+		t.Errorf("totals after the omit period = %v bytes, %v blocks, stream %v bytes", bytes, blocks, sp.BytesSent())
+	}
+
+	send(4)
+	if test.limitReached(test.sentTotals()) {
+		t.Errorf("-k 5 reached after 4 blocks past the omit period")
+	}
+
+	send(1)
+	if !test.limitReached(test.sentTotals()) {
+		t.Errorf("-k 5 not reached after 5 blocks past the omit period")
+	}
+
+	stats(3 * time.Second)
+
+	var omitted, counted uint64
+	for _, rp := range sp.result.interval_results {
+		if rp.omitted != 0 {
+			omitted += rp.bytes_transfered
+		} else {
+			counted += rp.bytes_transfered
+		}
+	}
+
+	if len(sp.result.interval_results) != 3 || omitted != 400 || counted != 500 || sp.BytesSent() != 500 {
+		t.Errorf("%v intervals, %v bytes omitted, %v counted, stream total %v, want 400 omitted and 500 counted",
+			len(sp.result.interval_results), omitted, counted, sp.BytesSent())
+	}
+}
+
+func TestBidirLoopback(t *testing.T) {
+	for _, proto := range []string{TCP_NAME, UDP_NAME} {
+		t.Run(proto, func(t *testing.T) {
+			port := freePort(t)
+
+			server, err := NewContinuousServer(ServerConfig(port))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = server.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Stop()
+
+			time.Sleep(100 * time.Millisecond)
+
+			config := ClientConfig("127.0.0.1", port)
+			config.Protocol = proto
+			config.Bidir = true
+			config.Blksize = 1400
+			config.Duration = 2 * time.Second
+			config.LogLevel = LogLevelError
+
+			client, err := NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = client.Run(); err != nil {
+				t.Fatal(err)
+			}
+
+			streams := client.test.streams
+			if len(streams) != 2 || streams[0].role != SENDER_STREAM || streams[1].role != RECEIVER_STREAM {
+				t.Fatalf("%v streams, want a sender and a receiver", len(streams))
+			}
+
+			// each end counts what it sent or received, the results exchange brings in the other end
+			for _, sp := range streams {
+				if sp.BytesSent() == 0 || sp.BytesReceived() == 0 {
+					t.Errorf("role %v: %v bytes sent, %v received, want both directions", sp.role,
+						sp.BytesSent(), sp.BytesReceived())
+				}
+
+				if sp.BytesReceived() > sp.BytesSent() {
+					t.Errorf("role %v: %v bytes received of %v sent", sp.role, sp.BytesReceived(), sp.BytesSent())
+				}
+			}
+		})
+	}
+}
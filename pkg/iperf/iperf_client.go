@@ -3,28 +3,33 @@ package iperf
 import (
 	"encoding/binary"
 	"fmt"
-	"net"
-	"strconv"
 	"time"
 )
 
 func (test *IperfTest) createStreams() int {
-	for i := uint(0); i < test.streamNum; i++ {
-		conn, err := test.proto.connect(test)
+	test.cportNext = 0
+	test.snmpBase = test.snmpCounters()
+
+	for i := uint(0); i < test.streamCount(); i++ {
+		conn, err := test.proto.Connect(test)
 		if err != nil {
 			Log.Errorf("Connect failed. err = %v", err)
 
 			return -1
 		}
 
-		var sp *iperfStream
+		if test.cookie != 0 {
+			if err = test.writeStreamID(conn, i); err != nil {
+				Log.Errorf("Identify stream %v failed. err = %v", i, err)
 
-		if test.mode == IPERF_SENDER {
-			sp = test.newStream(conn, SENDER_STREAM)
-		} else {
-			sp = test.newStream(conn, RECEIVER_STREAM)
+				conn.Close()
+
+				return -1
+			}
 		}
 
+		sp := test.newStream(conn, test.streamRole(i))
+
 		test.streams = append(test.streams, sp)
 	}
 
@@ -35,13 +40,15 @@ func (test *IperfTest) createClientTimer() int {
 	now := time.Now()
 	cd := TimerClientData{p: test}
 
-	test.timer = timerCreate(now, clientTimerProc, cd, test.duration*1000) // convert sec to ms
-	times := test.duration * 1000 / test.interval
+	// a test limited by bytes or blocks ends when the streams reach the limit
+	if test.duration != 0 {
+		test.timer = timerCreate(now, clientTimerProc, cd, (test.duration+test.omit)*1000) // convert sec to ms
+	}
 
-	test.statsTicker = tickerCreate(now, clientStatsTickerProc, cd, test.interval, times-1)
-	test.reportTicker = tickerCreate(now, clientReportTickerProc, cd, test.interval, times-1)
+	test.statsTicker = tickerCreate(now, clientStatsTickerProc, cd, test.interval, test.reportTimes())
+	test.reportTicker = tickerCreate(now, clientReportTickerProc, cd, test.interval, test.reportTimes())
 
-	if test.timer.timer == nil || test.statsTicker.ticker == nil || test.reportTicker.ticker == nil {
+	if (test.duration != 0 && test.timer.timer == nil) || test.statsTicker.ticker == nil || test.reportTicker.ticker == nil {
 		Log.Error("timer create failed.")
 	}
 
@@ -85,7 +92,9 @@ func clientReportTickerProc(data TimerClientData, now time.Time) {
 }
 
 func (test *IperfTest) createClientOmitTimer() int {
-	// undo, depend on which kind of timer
+	// no timer of its own, the stats callback ends the omit period at an interval boundary
+	test.omitting = test.omit != 0
+
 	return 0
 }
 
@@ -103,13 +112,16 @@ func (test *IperfTest) clientEnd() {
 
 			return
 		}
+
+		// after the conn, so the stream goroutine quits and writes out what it got
+		sp.closeFile()
 	}
 
 	if test.reporterCallback != nil {
 		test.reporterCallback(test)
 	}
 
-	test.proto.teardown(test)
+	test.proto.Teardown(test)
 	if test.setSendState(IPERF_DONE) < 0 {
 		Log.Errorf("set_send_state failed")
 	}
@@ -137,6 +149,17 @@ func (test *IperfTest) handleClientCtrlMsg() {
 
 			Log.Debugf("Client Ctrl conn receive n = %v state = [%v]", n, state)
 
+			if state == SERVER_ERROR {
+				test.serverError = test.readServerError()
+
+				Log.Errorf("%v", test.serverError)
+
+				test.ctrlConn.Close()
+				test.ctrlChan <- SERVER_ERROR
+
+				return
+			}
+
 			test.state = uint(state)
 
 			Log.Infof("Client Enter %v state...", test.state)
@@ -153,6 +176,15 @@ func (test *IperfTest) handleClientCtrlMsg() {
 		case IPERF_EXCHANGE_PARAMS:
 			if rtn := test.exchangeParams(); rtn < 0 {
 				Log.Errorf("exchange_params failed. rtn = %v", rtn)
+
+				// refused by the server before the clock probes of -owd
+				if test.serverError != nil {
+					test.ctrlConn.Close()
+					test.ctrlChan <- SERVER_ERROR
+
+					return
+				}
+
 				test.ctrlChan <- IPERF_DONE
 
 				return
@@ -183,7 +215,7 @@ func (test *IperfTest) handleClientCtrlMsg() {
 
 				return
 			}
-			if test.mode == IPERF_SENDER {
+			if test.hasSender() {
 				if rtn := test.createSenderTicker(); rtn < 0 {
 					Log.Errorf("create_sender_ticker failed. rtn = %v", rtn)
 					test.ctrlChan <- IPERF_DONE
@@ -223,27 +255,34 @@ func (test *IperfTest) handleClientCtrlMsg() {
 }
 
 func (test *IperfTest) ConnectServer() int {
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", test.addr+":"+strconv.Itoa(int(test.port)))
+	laddr, err := test.localAddr(false)
 	if err != nil {
-		Log.Errorf("Resolve TCP Addr failed. err = %v, addr = %v", err, test.addr+strconv.Itoa(int(test.port)))
+		Log.Errorf("%v", err)
 
 		return -1
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	conn, err := test.dialTCP(laddr, nil)
 	if err != nil {
-		Log.Errorf("Connect TCP Addr failed. err = %v, addr = %v", err, test.addr+strconv.Itoa(int(test.port)))
+		Log.Errorf("Connect TCP Addr failed. err = %v, addr = %v", err, test.serverAddr())
 
 		return -1
 	}
 
 	test.ctrlConn = conn
-	fmt.Printf("Connect to server %v succeed.\n", test.addr+":"+strconv.Itoa(int(test.port)))
+	fmt.Printf("Connect to server %v succeed.\n", conn.RemoteAddr())
 
 	return 0
 }
 
 func (test *IperfTest) runClient() int {
+	if err := test.applyAffinity(test.setting.affinity, test.setting.pinStreams); err != nil {
+		Log.Errorf("cpu affinity err = %v", err)
+
+		return -1
+	}
+
+	defer test.restoreAffinity()
 
 	rtn := test.ConnectServer()
 	if rtn < 0 {
@@ -266,12 +305,26 @@ func (test *IperfTest) runClient() int {
 				// Regular mode. Client sends.
 				Log.Info("Client enter Test Running state...")
 				for i, sp := range test.streams {
-					if sp.role == SENDER_STREAM {
-						go sp.iperfSend(test)
+					if test.crr {
+						go sp.iperfConnect(test)
+
+						Log.Infof("Client Stream %v start connecting.", i)
+					} else if sp.role == SENDER_STREAM {
+						if test.rr {
+							go sp.iperfRequest(test)
+						} else if test.setting.profile != "" {
+							go sp.iperfProfileSend(test)
+						} else {
+							go sp.iperfSend(test)
+						}
 
 						Log.Infof("Client Stream %v start sending.", i)
 					} else {
-						go sp.iperfRecv(test)
+						if test.rr {
+							go sp.iperfRespond(test)
+						} else {
+							go sp.iperfRecv(test)
+						}
 
 						Log.Infof("Client Stream %v start receiving.", i)
 					}
@@ -281,9 +334,9 @@ func (test *IperfTest) runClient() int {
 			} else if state == TEST_END {
 				testEndNum++
 
-				if testEndNum < test.streamNum || testEndNum == test.streamNum+1 { // redundant TEST_END signal generate by set_send_state
+				if testEndNum < test.streamCount() || testEndNum == test.streamCount()+1 { // redundant TEST_END signal generate by set_send_state
 					continue
-				} else if testEndNum > test.streamNum+1 {
+				} else if testEndNum > test.streamCount()+1 {
 					Log.Errorf("Receive more TEST_END signal than expected")
 
 					return -1
@@ -307,6 +360,8 @@ func (test *IperfTest) runClient() int {
 				Log.Info("Client Enter Test End State.")
 			} else if state == IPERF_DONE {
 				isIperfDone = true
+			} else if state == SERVER_ERROR {
+				return -1
 			} else {
 				Log.Debugf("Channel Unhandle state [%v]", state)
 			}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -154,10 +155,12 @@ func (s *ContinuousServer) runLoop() {
 				fmt.Printf("[测试 #%d] 测试成功完成 (耗时: %.2f秒)\n", testNum, duration.Seconds())
 
 				// 创建测试结果
+				bytesReceived, _ := test.receivedTotals()
+				bytesSent, _ := test.sentTotals()
 				result := &TestResult{
-					TotalBytes: test.bytesReceived + test.bytesSent,
+					TotalBytes: bytesReceived + bytesSent,
 					Duration:   duration,
-					Bandwidth:  float64((test.bytesReceived+test.bytesSent)*8) / duration.Seconds() / 1000000, // Mbps
+					Bandwidth:  float64((bytesReceived+bytesSent)*8) / duration.Seconds() / 1000000, // Mbps
 				}
 
 				s.emitEvent(Event{
@@ -185,10 +188,16 @@ func (s *ContinuousServer) runLoop() {
 func (s *ContinuousServer) applyConfig(test *IperfTest) {
 	test.isServer = true
 	test.port = s.config.Port
+	test.ipVersion = s.config.IPVersion
+	test.bindDev = s.config.BindDevice
+	test.listeners = s.config.Listeners
+	_ = test.setBindAddr(s.config.BindAddr) // checked by Validate
 	test.duration = uint(s.config.Duration.Seconds())
 	test.interval = uint(s.config.Interval.Milliseconds())
 	test.reverse = s.config.Reverse
+	test.bidir = s.config.Bidir
 	test.noDelay = s.config.NoDelay
+	test.verbose = s.config.Verbose
 
 	// 应用设置
 	if test.setting != nil {
@@ -204,6 +213,19 @@ func (s *ContinuousServer) applyConfig(test *IperfTest) {
 		test.setting.fastResend = s.config.FastResend
 		test.setting.dataShards = s.config.DataShards
 		test.setting.parityShards = s.config.ParityShards
+		test.setting.mtu = s.config.MTU
+		test.setting.ackNoDelay = s.config.AckNoDelay
+		test.setting.msgMode = s.config.MessageMode
+		test.setting.deadline = uint(s.config.Deadline / time.Second)
+		test.setting.cryptKey = s.config.CryptKey
+		test.setting.affinity = s.config.Affinity
+		test.setting.pinStreams = s.config.PinStreams
+		test.setting.file = s.config.File
+		test.setting.fileLoop = s.config.FileLoop
+
+		if s.config.GoMaxProcs != 0 {
+			runtime.GOMAXPROCS(int(s.config.GoMaxProcs))
+		}
 	}
 
 	// 设置模式
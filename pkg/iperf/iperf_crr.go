@@ -0,0 +1,313 @@
+package iperf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connection rate mode: every client stream opens a new data connection, does an optional request/response on
+// it and closes it, over and over. The streams created at the test start stay idle, they only carry the results.
+// Latency is the time the connect took, measured on the client.
+
+// crr_accept_results counts the connections the server accepts. The server can not tell which client stream
+// opened a connection, so they are counted for the whole test.
+type crr_accept_results struct {
+	mu                     sync.Mutex
+	accepted_this_interval uint64
+	failures_this_interval uint64
+	interval_accepted      uint64 // of the last interval
+	interval_failures      uint64
+	accepted               uint64 // omit period excluded
+	failures               uint64
+}
+
+// crrUnsupported reports whether a protocol has no connection setup to measure
+func crrUnsupported(name string) bool {
+	return name == UDP_NAME || name == KCP_NAME || name == RUDP_NAME
+}
+
+// iperfConnect -- the client side of a connection rate stream
+func (sp *iperfStream) iperfConnect(test *IperfTest) {
+	sp.pinThread()
+
+	reqSize := int(test.setting.reqSize)
+	respSize := int(test.setting.respSize)
+
+	for {
+		start := time.Now()
+
+		conn, err := test.proto.Connect(test)
+
+		latency := time.Since(start)
+
+		if err == nil {
+			err = crrExchange(conn, sp.buffer, reqSize, respSize, true)
+
+			if cerr := conn.Close(); err == nil {
+				err = cerr
+			}
+		}
+
+		if test.state == TEST_RUNNING && !test.done {
+			if err != nil {
+				Log.Debugf("Connection failed. err = %v", err)
+
+				sp.rrFail()
+			} else {
+				sp.rrRecord(latency, true)
+
+				test.bytesSent += uint64(reqSize)
+				test.blocksSent += 1
+			}
+		}
+
+		if test.done || test.limitReached(test.sentTotals()) {
+			test.ctrlChan <- TEST_END
+
+			Log.Debugf("Stream quit connecting")
+
+			return
+		}
+	}
+}
+
+// crrExchange sends the request and waits for the response, nothing is exchanged if the request size is 0. The
+// client sends the request, the server answers it.
+func crrExchange(conn net.Conn, buf []byte, reqSize, respSize int, client bool) error {
+	if reqSize == 0 {
+		return nil
+	}
+
+	if client {
+		if _, err := conn.Write(buf[:reqSize]); err != nil {
+			return err
+		}
+
+		_, err := io.ReadFull(conn, buf[:respSize])
+
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:reqSize]); err != nil {
+		return err
+	}
+
+	_, err := conn.Write(buf[:respSize])
+
+	return err
+}
+
+// crrAccept accepts the connections of a connection rate test on the server until the listener is closed. A
+// failed accept waits like the accept loops of the listeners and counts once per wait.
+func (test *IperfTest) crrAccept() {
+	var delay time.Duration
+
+	for {
+		conn, err := test.proto.Accept(test)
+		if err != nil {
+			if test.done || errors.Is(err, net.ErrClosed) {
+				Log.Debugf("Quit accepting. err = %v", err)
+
+				return
+			}
+
+			delay = acceptDelay(delay)
+
+			Log.Debugf("Accept failed, retry in %v. err = %v", delay, err)
+
+			test.crrAccepts.record(false)
+
+			time.Sleep(delay)
+
+			continue
+		}
+
+		delay = 0
+
+		if test.done {
+			conn.Close()
+
+			return
+		}
+
+		go test.crrServe(conn)
+	}
+}
+
+// crrServe answers the request on a connection and waits for the client to close it
+func (test *IperfTest) crrServe(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(test.streamDeadline()); err != nil {
+		Log.Errorf("SetDeadline err: %v", err)
+	}
+
+	buf := make([]byte, maxUint(test.setting.reqSize, test.setting.respSize)+1)
+
+	err := crrExchange(conn, buf, int(test.setting.reqSize), int(test.setting.respSize), false)
+	if err == nil {
+		// the client closes first, anything else it sends is ignored
+		for err == nil {
+			_, err = conn.Read(buf)
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+	}
+
+	if test.state == TEST_RUNNING && !test.done {
+		test.crrAccepts.record(err == nil)
+	}
+}
+
+func (r *crr_accept_results) record(ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if ok {
+		r.accepted_this_interval++
+	} else {
+		r.failures_this_interval++
+	}
+}
+
+// interval moves the counters of the finished interval into the report, omitted intervals are not totalled
+func (r *crr_accept_results) interval(omitted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.interval_accepted = r.accepted_this_interval
+	r.interval_failures = r.failures_this_interval
+
+	if !omitted {
+		r.accepted += r.interval_accepted
+		r.failures += r.interval_failures
+	}
+
+	r.accepted_this_interval = 0
+	r.failures_this_interval = 0
+}
+
+// rrFail accounts a failed connection, or a udp transaction lost on the way
+func (sp *iperfStream) rrFail() {
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	sp.result.rr_failures_this_interval++
+}
+
+// rrFailures returns the failed connections or lost transactions of the stream, omitted intervals excluded
+func (sp *iperfStream) rrFailures() uint64 {
+	var failures uint64
+
+	for _, rp := range sp.result.interval_results {
+		if rp.omitted == 0 {
+			failures += rp.rr_failures
+		}
+	}
+
+	return failures
+}
+
+// crrConnections returns the connections and failures of the stream. The server shows what the client reported
+// in the results exchange.
+func (sp *iperfStream) crrConnections() (uint64, uint64) {
+	if sp.test.isServer {
+		return sp.result.crr_connections, sp.result.crr_failures
+	}
+
+	return sp.rrTransactions(), sp.rrFailures()
+}
+
+func (test *IperfTest) printCRRIntermediate() {
+	if len(test.streams) == 0 {
+		return
+	}
+
+	if len(test.streams[0].result.interval_results) == 1 {
+		fmt.Printf(CRR_INTERVAL_HEADER)
+	}
+
+	var displayStartTime, displayEndTime float64
+	var mark string
+	var sumConns, sumFailures uint64
+	var sumHist latency_histogram
+
+	for i, sp := range test.streams {
+		rp := sp.result.interval_results[len(sp.result.interval_results)-1]
+
+		displayStartTime = float64(rp.interval_start_time.Sub(sp.result.start_time_fixed).Nanoseconds()) / S_TO_NS
+		displayEndTime = float64(rp.interval_end_time.Sub(sp.result.start_time_fixed).Nanoseconds()) / S_TO_NS
+
+		mark = ""
+		if rp.omitted != 0 {
+			mark = REPORT_OMITTED
+		}
+
+		if test.isServer {
+			// the streams are idle on the server, only the accepted connections are reported
+			continue
+		}
+
+		sumConns += rp.rr_transactions
+		sumFailures += rp.rr_failures
+		sumHist.merge(&rp.rr_hist)
+
+		fmt.Printf(CRR_REPORT_SINGLE_STREAM, test.streamLabel(i, sp), displayStartTime, displayEndTime, rp.rr_transactions,
+			float64(rp.rr_transactions)/rp.interval_dur.Seconds(), rp.rr_failures, latencyColumns(rp.rr_hist.results()), mark)
+	}
+
+	dur := displayEndTime - displayStartTime
+
+	if test.isServer {
+		accepts := test.crrAccepts
+
+		fmt.Printf(CRR_REPORT_SUM, "[ACC]", displayStartTime, displayEndTime, accepts.interval_accepted,
+			float64(accepts.interval_accepted)/dur, accepts.interval_failures, latencyColumns(rr_latency_results{}), mark)
+	} else if test.streamNum > 1 {
+		fmt.Printf(CRR_REPORT_SUM, "[SUM]", displayStartTime, displayEndTime, sumConns, float64(sumConns)/dur, sumFailures,
+			latencyColumns(sumHist.results()), mark)
+
+		fmt.Printf(REPORT_SEPERATOR)
+	}
+}
+
+func (test *IperfTest) printCRRResults() {
+	fmt.Printf(SUMMARY_SEPERATOR)
+	fmt.Printf(CRR_RESULT_HEADER)
+
+	var displayEndTime float64
+	var sumConns, sumFailures uint64
+	var sumHist latency_histogram
+
+	for i, sp := range test.streams {
+		displayEndTime = float64(sp.result.end_time.Sub(sp.result.start_time).Nanoseconds()) / S_TO_NS
+
+		conns, failures := sp.crrConnections()
+
+		sumConns += conns
+		sumFailures += failures
+		sumHist.merge(sp.rrHistogram())
+
+		fmt.Printf(CRR_REPORT_SINGLE_RESULT, test.streamLabel(i, sp), 0.0, displayEndTime, conns,
+			float64(conns)/displayEndTime, failures, latencyColumns(sp.rrLatency()), "CLIENT")
+	}
+
+	if test.streamNum > 1 {
+		// the server sums the histograms the client reported
+		fmt.Printf(CRR_REPORT_SUM, "[SUM]", 0.0, displayEndTime, sumConns, float64(sumConns)/displayEndTime, sumFailures,
+			latencyColumns(sumHist.results()), "")
+	}
+
+	if test.isServer {
+		accepts := test.crrAccepts
+
+		fmt.Printf(CRR_REPORT_SUM, "[ACC]", 0.0, displayEndTime, accepts.accepted, float64(accepts.accepted)/displayEndTime,
+			accepts.failures, latencyColumns(rr_latency_results{}), "\t[SERVER]")
+	}
+}
@@ -0,0 +1,52 @@
+package iperf
+
+import (
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// emfileProto fails every accept like a server out of file descriptors
+type emfileProto struct {
+	TCPProto
+	accepts int64
+}
+
+func (p *emfileProto) Accept(test *IperfTest) (net.Conn, error) {
+	atomic.AddInt64(&p.accepts, 1)
+
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+}
+
+func TestCRRAcceptBackoff(t *testing.T) {
+	proto := new(emfileProto)
+
+	test := NewIperfTest()
+	test.proto = proto
+	test.crrAccepts = new(crr_accept_results)
+
+	done := make(chan struct{})
+	go func() {
+		test.crrAccept()
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	test.crrAccepts.interval(false)
+
+	// quits at the next failure
+	test.done = true
+	<-done
+
+	// 5, 10, 20 and 40 ms fit in 100 ms, every wait counts once
+	accepts := atomic.LoadInt64(&proto.accepts)
+	if accepts < 2 || accepts > 6 {
+		t.Errorf("%v accepts in 100 ms", accepts)
+	}
+
+	if r := test.crrAccepts; r.failures < 2 || r.failures > uint64(accepts) || r.accepted != 0 {
+		t.Errorf("%v failures of %v accepts", r.failures, accepts)
+	}
+}
@@ -0,0 +1,143 @@
+package iperf
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	KCP "github.com/xtaci/kcp-go/v5"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// payload encryption of the kcp sessions: -crypt picks the BlockCrypt, -key the passphrase both ends derive the
+// key from. The client sends the method and a fingerprint of its key with the params, the server refuses a key
+// that does not match rather than dropping every packet. rudp-go leaves the decryption unimplemented, rudp
+// sessions run without.
+
+const (
+	CRYPT_NONE        = "none"
+	CRYPT_DEFAULT_KEY = "iperf-go" // both ends use it without -key
+	CRYPT_SALT        = "iperf-go kcp"
+	CRYPT_ITER        = 4096 // pbkdf2 iterations
+	CRYPT_KEY_SIZE    = 32
+)
+
+// CryptList holds the methods for -crypt, aes is aes-256
+var CryptList = []string{CRYPT_NONE, "aes", "aes-256", "aes-128", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des",
+	"tea", "xtea", "xor", "sm4"}
+
+// IsCryptValid reports whether name is one of CryptList
+func IsCryptValid(name string) bool {
+	for _, c := range CryptList {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cryptKey derives the key of the sessions from the passphrase
+func cryptKey(pass string) []byte {
+	if pass == "" {
+		pass = CRYPT_DEFAULT_KEY
+	}
+
+	return pbkdf2.Key([]byte(pass), []byte(CRYPT_SALT), CRYPT_ITER, CRYPT_KEY_SIZE, sha1.New)
+}
+
+// keyFingerprint identifies a key in the params without giving it away
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+
+	return hex.EncodeToString(sum[:4])
+}
+
+// newBlockCrypt returns the BlockCrypt of a method, nil for none
+func newBlockCrypt(name string, key []byte) (KCP.BlockCrypt, error) {
+	switch name {
+	case "", CRYPT_NONE:
+		return nil, nil
+	case "aes", "aes-256":
+		return KCP.NewAESBlockCrypt(key)
+	case "aes-128":
+		return KCP.NewAESBlockCrypt(key[:16])
+	case "aes-192":
+		return KCP.NewAESBlockCrypt(key[:24])
+	case "salsa20":
+		return KCP.NewSalsa20BlockCrypt(key)
+	case "blowfish":
+		return KCP.NewBlowfishBlockCrypt(key)
+	case "twofish":
+		return KCP.NewTwofishBlockCrypt(key)
+	case "cast5":
+		return KCP.NewCast5BlockCrypt(key[:16])
+	case "3des":
+		return KCP.NewTripleDESBlockCrypt(key[:24])
+	case "tea":
+		return KCP.NewTEABlockCrypt(key[:16])
+	case "xtea":
+		return KCP.NewXTEABlockCrypt(key[:16])
+	case "xor":
+		return KCP.NewSimpleXORBlockCrypt(key)
+	case "sm4":
+		return KCP.NewSM4BlockCrypt(key[:16])
+	}
+
+	return nil, fmt.Errorf("unknown crypt %v", name)
+}
+
+// encrypted reports whether the sessions encrypt their payload
+func (test *IperfTest) encrypted() bool {
+	return test.setting.crypt != "" && test.setting.crypt != CRYPT_NONE
+}
+
+// cryptName returns the method for the banner
+func (test *IperfTest) cryptName() string {
+	if !test.encrypted() {
+		return CRYPT_NONE
+	}
+
+	return test.setting.crypt
+}
+
+// blockCrypt returns the BlockCrypt of a kcp listener or session
+func (test *IperfTest) blockCrypt() (KCP.BlockCrypt, error) {
+	if !test.encrypted() {
+		return nil, nil
+	}
+
+	return newBlockCrypt(test.setting.crypt, cryptKey(test.setting.cryptKey))
+}
+
+// checkCryptKey compares the fingerprint the client sent with the key of this end
+func (test *IperfTest) checkCryptKey(fingerprint string) error {
+	if !test.encrypted() {
+		return nil
+	}
+
+	if fingerprint != keyFingerprint(cryptKey(test.setting.cryptKey)) {
+		return fmt.Errorf("crypt key of the client does not match, both ends need the same -key")
+	}
+
+	return nil
+}
+
+// cryptFingerprint returns the fingerprint of the key for the params, empty without encryption
+func (test *IperfTest) cryptFingerprint() string {
+	if !test.encrypted() {
+		return ""
+	}
+
+	return keyFingerprint(cryptKey(test.setting.cryptKey))
+}
+
+// printCrypt prints the encryption the results were measured with
+func (test *IperfTest) printCrypt() {
+	if !test.encrypted() || test.proto.Name() != KCP_NAME {
+		return
+	}
+
+	fmt.Printf(CRYPT_REPORT, test.setting.crypt, test.cryptFingerprint())
+}
@@ -0,0 +1,128 @@
+package iperf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBlockCrypt(t *testing.T) {
+	key := cryptKey("secret")
+	other := cryptKey("another secret")
+
+	if len(key) != CRYPT_KEY_SIZE || bytes.Equal(key, other) || !bytes.Equal(cryptKey(""), cryptKey(CRYPT_DEFAULT_KEY)) {
+		t.Fatalf("cryptKey derives %x", key)
+	}
+
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+
+	// every method takes the 32 byte key, the ones with shorter keys a slice of it
+	for _, name := range CryptList {
+		block, err := newBlockCrypt(name, key)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+
+			continue
+		}
+
+		if name == CRYPT_NONE {
+			if block != nil {
+				t.Errorf("%v: a BlockCrypt without encryption", name)
+			}
+
+			continue
+		}
+
+		if block == nil {
+			t.Errorf("%v: no BlockCrypt", name)
+
+			continue
+		}
+
+		encrypted := make([]byte, len(plain))
+		block.Encrypt(encrypted, plain)
+
+		decrypted := make([]byte, len(plain))
+		block.Decrypt(decrypted, encrypted)
+
+		if bytes.Equal(encrypted, plain) || !bytes.Equal(decrypted, plain) {
+			t.Errorf("%v: encrypted %x, decrypted %x", name, encrypted[:8], decrypted[:8])
+		}
+
+		otherBlock, _ := newBlockCrypt(name, other)
+		otherEncrypted := make([]byte, len(plain))
+		otherBlock.Encrypt(otherEncrypted, plain)
+
+		if bytes.Equal(otherEncrypted, encrypted) {
+			t.Errorf("%v: another key encrypts the same", name)
+		}
+	}
+
+	if _, err := newBlockCrypt("rot13", key); err == nil {
+		t.Errorf("newBlockCrypt of an unknown method should fail")
+	}
+}
+
+func TestCryptKeyMismatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		key     string
+		refused bool
+	}{
+		{name: "same key", key: "secret"},
+		{name: "another key", key: "guess", refused: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			port := freePort(t)
+
+			sconfig := ServerConfig(port)
+			sconfig.CryptKey = "secret"
+
+			server, err := NewContinuousServer(sconfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = server.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			defer server.Stop()
+
+			time.Sleep(100 * time.Millisecond)
+
+			config := ClientConfig("127.0.0.1", port)
+			config.Protocol = KCP_NAME
+			config.Blksize = 1024
+			config.Duration = time.Second
+			config.Crypt = "aes-128"
+			config.CryptKey = c.key
+			config.LogLevel = LogLevelError
+
+			client, err := NewClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Run()
+			if !c.refused {
+				if err != nil || client.test.streams[0].BytesSent() == 0 {
+					t.Errorf("the test with the same key failed, err = %v", err)
+				}
+
+				return
+			}
+
+			// the client tells why instead of timing out on packets it can not decrypt
+			if err == nil || !strings.Contains(err.Error(), "does not match") {
+				t.Errorf("client error = %v, want the refusal of the server", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package iperf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// file mode: sender streams send the content of a file instead of the constant buffer, receiver streams write
+// what they receive to a file. The time spent in disk reads and writes is accounted per stream, so a slow disk
+// can be told apart from a slow network.
+
+// openFiles opens the -F file for every stream. Every sender stream sends the whole file, receiver stream i
+// writes to <file>.<i>, stream 0 to the file itself.
+func (test *IperfTest) openFiles() int {
+	if test.setting.file == "" {
+		return 0
+	}
+
+	for i, sp := range test.streams {
+		var err error
+
+		if sp.role == SENDER_STREAM {
+			sp.file, err = os.Open(test.setting.file)
+		} else {
+			name := test.setting.file
+			if i > 0 {
+				name = fmt.Sprintf("%v.%v", name, i)
+			}
+
+			sp.file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		}
+
+		if err != nil {
+			Log.Errorf("Open file failed. err = %v", err)
+
+			return -1
+		}
+	}
+
+	return 0
+}
+
+// readFile fills the buffer from the file for the next send and returns the size read. It returns 0 at the end
+// of the file unless the file is looped, a negative value on error.
+func (sp *iperfStream) readFile(buf []byte) int {
+	start := time.Now()
+
+	n, err := io.ReadFull(sp.file, buf)
+	if err == io.EOF && sp.test.setting.fileLoop {
+		if _, err = sp.file.Seek(0, io.SeekStart); err == nil {
+			n, err = io.ReadFull(sp.file, buf)
+		}
+	}
+
+	sp.result.file_time += time.Since(start)
+	sp.result.file_bytes += uint64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n
+	} else if err != nil {
+		Log.Errorf("Read file failed. err = %v", err)
+
+		return -1
+	}
+
+	return n
+}
+
+// writeFile writes the data received on the stream to the file
+func (sp *iperfStream) writeFile(data []byte) int {
+	start := time.Now()
+
+	n, err := sp.file.Write(data)
+
+	sp.result.file_time += time.Since(start)
+	sp.result.file_bytes += uint64(n)
+
+	if err != nil {
+		Log.Errorf("Write file failed. err = %v", err)
+
+		return -1
+	}
+
+	return n
+}
+
+// ownFile hands the file to the calling stream goroutine, which then is the only one to touch it until it quits
+// and calls releaseFile. It returns false if the stream has no file (any more).
+func (sp *iperfStream) ownFile() bool {
+	sp.fileMu.Lock()
+	defer sp.fileMu.Unlock()
+
+	if sp.file == nil {
+		return false
+	}
+
+	sp.fileOwned = true
+	sp.fileDone = make(chan struct{})
+
+	return true
+}
+
+// releaseFile closes the file when its owning goroutine quits
+func (sp *iperfStream) releaseFile() {
+	sp.fileMu.Lock()
+	defer sp.fileMu.Unlock()
+
+	sp.dropFile()
+	close(sp.fileDone)
+}
+
+// closeFile closes the file of a closed stream. A stream goroutine that owns the file still writes what it
+// received before the close, so closeFile waits for it to quit and close the file instead.
+func (sp *iperfStream) closeFile() {
+	sp.fileMu.Lock()
+
+	if sp.fileOwned {
+		done := sp.fileDone
+		sp.fileMu.Unlock()
+
+		<-done
+
+		return
+	}
+
+	defer sp.fileMu.Unlock()
+
+	sp.dropFile()
+}
+
+// dropFile closes the file, the caller owns it or holds fileMu
+func (sp *iperfStream) dropFile() {
+	if sp.file == nil {
+		return
+	}
+
+	if err := sp.file.Close(); err != nil {
+		Log.Errorf("Close file failed. err = %v", err)
+	}
+
+	sp.file = nil
+}
+
+// printFileResult prints the disk side of a stream next to its network result
+func (test *IperfTest) printFileResult(i int, sp *iperfStream) {
+	if test.setting.file == "" {
+		return
+	}
+
+	rp := sp.result
+
+	op := "read"
+	if sp.role == RECEIVER_STREAM {
+		op = "write"
+	}
+
+	elapsed := rp.end_time.Sub(rp.start_time_fixed).Seconds()
+	diskTime := rp.file_time.Seconds()
+
+	var diskRate float64
+	if diskTime > 0 {
+		diskRate = float64(rp.file_bytes) / MB_TO_B / diskTime
+	}
+
+	fmt.Printf(FILE_REPORT, test.streamLabel(i, sp), op, float64(rp.file_bytes)/MB_TO_B, diskTime,
+		diskTime/elapsed*100, diskRate)
+}
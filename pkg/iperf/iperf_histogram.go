@@ -0,0 +1,187 @@
+package iperf
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// latency histograms: the latency modes count their samples in log-linear buckets instead of keeping every one of
+// them, so a long test holds a bounded amount per interval. Every power of two is split into HIST_SUB_BUCKETS
+// buckets and a percentile is reported as the middle of its bucket, off by 1/(2*HIST_SUB_BUCKETS) of its value at
+// most. Min, max and mean stay exact. Negative values, one-way delays with a clock offset, get the mirrored
+// buckets below 0. The buckets only span the range recorded, the histograms of intervals and streams merge by adding
+// them up.
+
+const (
+	HIST_SUB_BITS    = 5
+	HIST_SUB_BUCKETS = 1 << HIST_SUB_BITS
+)
+
+// latency_histogram counts latencies in log-linear buckets
+type latency_histogram struct {
+	base    int      // bucket of counts[0]
+	counts  []uint64 // from the lowest to the highest bucket recorded
+	samples uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+// histBucket returns the bucket of d, the values within 2*HIST_SUB_BUCKETS ns of 0 have a bucket each
+func histBucket(d time.Duration) int {
+	if d < 0 {
+		return -histBucket(-d)
+	}
+
+	v := uint64(d)
+
+	shift := bits.Len64(v) - HIST_SUB_BITS - 1
+	if shift <= 0 {
+		return int(v)
+	}
+
+	return (shift+1)<<HIST_SUB_BITS + int(v>>uint(shift)) - HIST_SUB_BUCKETS
+}
+
+// histValue returns the middle of a bucket
+func histValue(b int) time.Duration {
+	if b < 0 {
+		return -histValue(-b)
+	}
+
+	if b < 2*HIST_SUB_BUCKETS {
+		return time.Duration(b)
+	}
+
+	shift := b>>HIST_SUB_BITS - 1
+	low := uint64(b-shift<<HIST_SUB_BITS) << uint(shift)
+
+	return time.Duration(low + uint64(1)<<uint(shift)/2)
+}
+
+func (h *latency_histogram) add(d time.Duration) {
+	b := histBucket(d)
+	h.span(b, b)
+	h.counts[b-h.base]++
+
+	if h.samples == 0 || d < h.min {
+		h.min = d
+	}
+
+	if h.samples == 0 || d > h.max {
+		h.max = d
+	}
+
+	h.samples++
+	h.sum += d
+}
+
+// merge adds the samples of o
+func (h *latency_histogram) merge(o *latency_histogram) {
+	if o.samples == 0 {
+		return
+	}
+
+	h.span(o.base, o.base+len(o.counts)-1)
+
+	for i, c := range o.counts {
+		h.counts[o.base-h.base+i] += c
+	}
+
+	if h.samples == 0 || o.min < h.min {
+		h.min = o.min
+	}
+
+	if h.samples == 0 || o.max > h.max {
+		h.max = o.max
+	}
+
+	h.samples += o.samples
+	h.sum += o.sum
+}
+
+// span grows the buckets to cover lo to hi
+func (h *latency_histogram) span(lo, hi int) {
+	if len(h.counts) == 0 {
+		h.base = lo
+		h.counts = make([]uint64, hi-lo+1)
+
+		return
+	}
+
+	if lo < h.base {
+		counts := make([]uint64, len(h.counts)+h.base-lo)
+		copy(counts[h.base-lo:], h.counts)
+
+		h.base = lo
+		h.counts = counts
+	}
+
+	if top := h.base + len(h.counts) - 1; hi > top {
+		h.counts = append(h.counts, make([]uint64, hi-top)...)
+	}
+}
+
+// percentile returns the latency the fraction p of the samples do not exceed
+func (h *latency_histogram) percentile(p float64) time.Duration {
+	rank := uint64(math.Ceil(p * float64(h.samples)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+
+	for i, c := range h.counts {
+		if seen += c; seen < rank {
+			continue
+		}
+
+		d := histValue(h.base + i)
+		if d < h.min {
+			d = h.min
+		} else if d > h.max {
+			d = h.max
+		}
+
+		return d
+	}
+
+	return h.max
+}
+
+// histogram_exchange carries a histogram in the results exchange
+// tips: all the members should be visible, or json decoder cannot encode it
+type histogram_exchange struct {
+	Base    int
+	Counts  []uint64
+	Samples uint64
+	Sum     time.Duration
+	Min     time.Duration
+	Max     time.Duration
+}
+
+func (h *latency_histogram) exchange() histogram_exchange {
+	return histogram_exchange{Base: h.base, Counts: h.counts, Samples: h.samples, Sum: h.sum, Min: h.min, Max: h.max}
+}
+
+func (e histogram_exchange) histogram() latency_histogram {
+	return latency_histogram{base: e.Base, counts: e.Counts, samples: e.Samples, sum: e.Sum, min: e.Min, max: e.Max}
+}
+
+// results returns the latency summary of the histogram
+func (h *latency_histogram) results() rr_latency_results {
+	if h.samples == 0 {
+		return rr_latency_results{}
+	}
+
+	return rr_latency_results{
+		Samples: h.samples,
+		Min:     h.min,
+		Mean:    h.sum / time.Duration(h.samples),
+		P50:     h.percentile(0.50),
+		P90:     h.percentile(0.90),
+		P99:     h.percentile(0.99),
+		P999:    h.percentile(0.999),
+	}
+}
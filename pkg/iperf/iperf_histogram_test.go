@@ -0,0 +1,139 @@
+package iperf
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistBucket(t *testing.T) {
+	maxErr := 1.0 / (2 * HIST_SUB_BUCKETS)
+
+	for _, d := range []time.Duration{0, 1, 63, 64, 65, 127, 128, 1000, 999999, time.Second, time.Hour, math.MaxInt64,
+		-1, -64, -1000, -time.Second} {
+		got := histValue(histBucket(d))
+
+		if diff := math.Abs(float64(got)-float64(d)) / math.Max(math.Abs(float64(d)), 1); diff > maxErr {
+			t.Errorf("histValue(histBucket(%v)) = %v, off by %.4f", int64(d), int64(got), diff)
+		}
+	}
+
+	// the buckets follow each other without gaps
+	prev := histBucket(-1 << 20)
+	for d := time.Duration(-1<<20 + 1); d < 1<<20; d++ {
+		b := histBucket(d)
+		if b != prev && b != prev+1 {
+			t.Fatalf("histBucket(%v) = %v after %v", int64(d), b, prev)
+		}
+
+		prev = b
+	}
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	var samples []time.Duration
+	var parts [3]latency_histogram
+
+	for i := 0; i < 10000; i++ {
+		d := time.Duration(rng.ExpFloat64() * float64(200*time.Microsecond))
+		samples = append(samples, d)
+		parts[i%3].add(d)
+	}
+
+	// the histograms of the intervals merge into the one of the whole test
+	var h latency_histogram
+	for i := range parts {
+		h.merge(&parts[i])
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	var sum time.Duration
+	for _, d := range samples {
+		sum += d
+	}
+
+	r := h.results()
+	if r.Samples != uint64(len(samples)) || r.Min != samples[0] || r.Mean != sum/time.Duration(len(samples)) {
+		t.Fatalf("results = %+v, want %v samples, min %v, mean %v", r, len(samples), samples[0], sum/time.Duration(len(samples)))
+	}
+
+	cases := []struct {
+		p   float64
+		got time.Duration
+	}{
+		{0.50, r.P50},
+		{0.90, r.P90},
+		{0.99, r.P99},
+		{0.999, r.P999},
+	}
+
+	for _, c := range cases {
+		want := samples[int(math.Ceil(c.p*float64(len(samples))))-1]
+
+		if diff := math.Abs(float64(c.got-want)) / float64(want); diff > 1.0/HIST_SUB_BUCKETS {
+			t.Errorf("P%v = %v, want %v", c.p*100, c.got, want)
+		}
+	}
+
+	// one-way delays corrected by a clock offset may be negative
+	var neg latency_histogram
+	for _, d := range []time.Duration{-3 * time.Millisecond, -2 * time.Millisecond, -time.Millisecond} {
+		neg.add(d)
+	}
+
+	r = neg.results()
+	if r.Min != -3*time.Millisecond || neg.max != -time.Millisecond || (r.P50+2*time.Millisecond).Abs() > 2*time.Millisecond/HIST_SUB_BUCKETS {
+		t.Errorf("negative results = %+v, max %v", r, neg.max)
+	}
+
+	if r := (&latency_histogram{}).results(); r != (rr_latency_results{}) {
+		t.Errorf("empty histogram results = %+v", r)
+	}
+}
+
+func TestHistogramExchange(t *testing.T) {
+	// the requester streams of two responders, as the results exchange hands them over
+	var sum latency_histogram
+	streams := make([]*iperfStream, 2)
+
+	for i := range streams {
+		var h latency_histogram
+		for d := time.Duration(i+1) * 10 * time.Microsecond; d < time.Millisecond; d += 7 * time.Microsecond {
+			h.add(d)
+		}
+
+		sum.merge(&h)
+
+		bs, err := json.Marshal(stream_results_exchange{Latency: h.exchange()})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result stream_results_exchange
+		if err = json.Unmarshal(bs, &result); err != nil {
+			t.Fatal(err)
+		}
+
+		streams[i] = &iperfStream{role: RECEIVER_STREAM, result: &iperf_stream_results{rr_peer_hist: result.Latency.histogram()}}
+
+		if got := streams[i].rrLatency(); got != h.results() {
+			t.Errorf("stream %v: rrLatency = %+v, want %+v", i, got, h.results())
+		}
+	}
+
+	// the responder [SUM] merges what the requesters measured
+	var merged latency_histogram
+	for _, sp := range streams {
+		merged.merge(sp.rrHistogram())
+	}
+
+	if got := merged.results(); got != sum.results() || got.Samples == 0 {
+		t.Errorf("merged = %+v, want %+v", got, sum.results())
+	}
+}
@@ -3,8 +3,8 @@ package iperf
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
-	"strconv"
 	"time"
 
 	KCP "github.com/xtaci/kcp-go/v5"
@@ -13,11 +13,11 @@ import (
 type kcpProto struct {
 }
 
-func (*kcpProto) name() string {
+func (*kcpProto) Name() string {
 	return KCP_NAME
 }
 
-func (*kcpProto) accept(test *IperfTest) (net.Conn, error) {
+func (*kcpProto) Accept(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter KCP accept")
 
 	conn, err := test.protoListener.Accept()
@@ -39,8 +39,36 @@ func (*kcpProto) accept(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (*kcpProto) listen(test *IperfTest) (net.Listener, error) {
-	listener, err := KCP.ListenWithOptions(":"+strconv.Itoa(int(test.port)), nil, int(test.setting.dataShards), int(test.setting.parityShards))
+func (*kcpProto) Listen(test *IperfTest) (net.Listener, error) {
+	conn, err := test.listenUDP(false)
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := test.markPacketConn(conn)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	block, err := test.blockCrypt()
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	listener, err := KCP.ServeConn(block, int(test.setting.dataShards), int(test.setting.parityShards),
+		test.countSessions(pc, block, true))
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	test.packetConns = append(test.packetConns, pc)
+
 	err = listener.SetReadBuffer(int(test.setting.readBufSize))
 	if err != nil {
 		return nil, err
@@ -51,11 +79,27 @@ func (*kcpProto) listen(test *IperfTest) (net.Listener, error) {
 		return nil, err
 	}
 
-	return listener, nil
+	return &packetListener{Listener: listener, conn: conn}, nil
 }
 
-func (*kcpProto) connect(test *IperfTest) (net.Conn, error) {
-	conn, err := KCP.DialWithOptions(test.addr+":"+strconv.Itoa(int(test.port)), nil, int(test.setting.dataShards), int(test.setting.parityShards))
+func (*kcpProto) Connect(test *IperfTest) (net.Conn, error) {
+	udpAddr, err := test.resolveUDPAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := test.blockCrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := test.sessionConn()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := KCP.NewConn2(udpAddr, block, int(test.setting.dataShards), int(test.setting.parityShards),
+		test.countSessions(pc, block, true))
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +117,7 @@ func (*kcpProto) connect(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (*kcpProto) send(sp *iperfStream) int {
+func (*kcpProto) Send(sp *iperfStream) int {
 	n, err := sp.conn.(*KCP.UDPSession).Write(sp.buffer)
 	if err != nil {
 		var serr *net.OpError
@@ -101,7 +145,7 @@ func (*kcpProto) send(sp *iperfStream) int {
 	return n
 }
 
-func (*kcpProto) recv(sp *iperfStream) int {
+func (*kcpProto) Recv(sp *iperfStream) int {
 	// recv is blocking
 	n, err := sp.conn.(*KCP.UDPSession).Read(sp.buffer)
 
@@ -132,123 +176,152 @@ func (*kcpProto) recv(sp *iperfStream) int {
 	return n
 }
 
-func (*kcpProto) init(test *IperfTest) int {
+func (*kcpProto) Init(test *IperfTest) int {
 	for _, sp := range test.streams {
-		err := sp.conn.(*KCP.UDPSession).SetReadBuffer(int(test.setting.readBufSize))
-		if err != nil {
-			Log.Errorf("SetReadBuffer err = %v", err)
+		if err := test.initSession(sp.conn.(*KCP.UDPSession)); err != nil {
+			Log.Errorf("KCP session init err = %v", err)
 
-			return 0
+			return -1
 		}
+	}
 
-		err = sp.conn.(*KCP.UDPSession).SetWriteBuffer(int(test.setting.writeBufSize))
-		if err != nil {
-			Log.Errorf("SetWriteBuffer err = %v", err)
+	return 0
+}
 
-			return 0
-		}
+func (*kcpProto) StatsCallback(_ *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
+	rp := sp.result
 
-		sp.conn.(*KCP.UDPSession).SetWindowSize(int(test.setting.sndWnd), int(test.setting.rcvWnd))
-		sp.conn.(*KCP.UDPSession).SetStreamMode(true)
+	sp.saveSessionStats(sp.sessionCounters(), tempResult)
 
-		err = sp.conn.(*KCP.UDPSession).SetDSCP(46)
-		if err != nil {
-			Log.Errorf("SetDSCP err = %v", err)
+	tempResult.rtt = uint(sp.conn.(*KCP.UDPSession).GetSRTTVar() * 1000) // ms to micro sec
+	if rp.stream_min_rtt == 0 || tempResult.rtt < rp.stream_min_rtt {
+		rp.stream_min_rtt = tempResult.rtt
+	}
 
-			return 0
-		}
+	if rp.stream_max_rtt == 0 || tempResult.rtt > rp.stream_max_rtt {
+		rp.stream_max_rtt = tempResult.rtt
+	}
 
-		sp.conn.(*KCP.UDPSession).SetMtu(1400)
-		sp.conn.(*KCP.UDPSession).SetACKNoDelay(false)
+	rp.stream_sum_rtt += tempResult.rtt
+	rp.stream_cnt_rtt++
 
-		err = sp.conn.(*KCP.UDPSession).SetDeadline(time.Now().Add(time.Minute))
-		if err != nil {
-			Log.Errorf("SetDeadline err = %v", err)
+	return 0
+}
 
-			return 0
-		}
+// kcpSnmp returns the counters kcp-go keeps for the whole process
+func kcpSnmp() session_counters {
+	snmp := KCP.DefaultSnmp.Copy()
+
+	return session_counters{
+		retrans:       uint(snmp.RetransSegs),
+		lost:          uint(snmp.LostSegs),
+		early_retrans: uint(snmp.EarlyRetransSegs),
+		fast_retrans:  uint(snmp.FastRetransSegs),
+		recovered:     uint(snmp.FECRecovered),
+		in_pkts:       uint(snmp.InPkts),
+		out_pkts:      uint(snmp.OutPkts),
+		in_segs:       uint(snmp.InSegs),
+		out_segs:      uint(snmp.OutSegs),
+		repeat_segs:   uint(snmp.RepeatSegs),
+	}
+}
+
+func (*kcpProto) Teardown(test *IperfTest) int {
+	test.closePacketConns()
+
+	return 0
+}
 
-		var noDelay, resend, nc int
+// kcpSession holds the knobs kcp and rudp sessions have in common
+type kcpSession interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+	SetWindowSize(sndwnd, rcvwnd int)
+	SetStreamMode(enable bool)
+	SetMtu(mtu int) bool
+	SetACKNoDelay(nodelay bool)
+	SetDeadline(t time.Time) error
+	SetNoDelay(nodelay, interval, resend, nc int)
+}
 
-		if test.noDelay {
-			noDelay = 1
-		} else {
-			noDelay = 0
+// initSession applies the session settings, both ends take them from the params. The sessions a listener
+// accepts share its socket and its buffers, the listener set them already.
+func (test *IperfTest) initSession(s kcpSession) error {
+	if !test.isServer {
+		if err := s.SetReadBuffer(int(test.setting.readBufSize)); err != nil {
+			return fmt.Errorf("set read buffer: %w", err)
 		}
 
-		if test.setting.noCong {
-			nc = 1
-		} else {
-			nc = 0
+		if err := s.SetWriteBuffer(int(test.setting.writeBufSize)); err != nil {
+			return fmt.Errorf("set write buffer: %w", err)
 		}
+	}
 
-		resend = int(test.setting.fastResend)
+	s.SetWindowSize(int(test.setting.sndWnd), int(test.setting.rcvWnd))
+	s.SetStreamMode(!test.setting.msgMode)
 
-		sp.conn.(*KCP.UDPSession).SetNoDelay(noDelay, int(test.setting.flushInterval), resend, nc)
+	if !s.SetMtu(int(test.kcpMTU())) {
+		return fmt.Errorf("mtu %v refused", test.kcpMTU())
 	}
 
-	return 0
-}
+	s.SetACKNoDelay(test.setting.ackNoDelay)
 
-func (*kcpProto) statsCallback(_ *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
-	rp := sp.result
+	if err := s.SetDeadline(test.sessionDeadline()); err != nil {
+		return fmt.Errorf("set deadline: %w", err)
+	}
 
-	totalRetrans := uint(KCP.DefaultSnmp.RetransSegs)
-	totalLost := uint(KCP.DefaultSnmp.LostSegs)
-	totalEarlyRetrans := uint(KCP.DefaultSnmp.EarlyRetransSegs)
-	totalFastRetrans := uint(KCP.DefaultSnmp.FastRetransSegs)
-	totalRecovers := uint(KCP.DefaultSnmp.FECRecovered)
-	totalInPkts := uint(KCP.DefaultSnmp.InPkts)
-	totalInSegs := uint(KCP.DefaultSnmp.InSegs)
-	totalOutPkts := uint(KCP.DefaultSnmp.OutPkts)
-	totalOutSegs := uint(KCP.DefaultSnmp.OutSegs)
-
-	// retrans
-	tempResult.interval_retrans = totalRetrans - rp.stream_prev_total_retrans
-	rp.stream_retrans += tempResult.interval_retrans
-	rp.stream_prev_total_retrans = totalRetrans
-
-	// lost
-	tempResult.interval_lost = totalLost - rp.stream_prev_total_lost
-	rp.stream_lost += tempResult.interval_lost
-	rp.stream_prev_total_lost = totalLost
-
-	// early retrans
-	tempResult.interval_early_retrans = totalEarlyRetrans - rp.stream_prev_total_early_retrans
-	rp.stream_early_retrans += tempResult.interval_early_retrans
-	rp.stream_prev_total_early_retrans = totalEarlyRetrans
-
-	// fast retrans
-	tempResult.interval_fast_retrans = totalFastRetrans - rp.stream_prev_total_fast_retrans
-	rp.stream_fast_retrans += tempResult.interval_fast_retrans
-	rp.stream_prev_total_fast_retrans = totalFastRetrans
-
-	// recover
-	rp.stream_recovers = totalRecovers
-
-	// packets receive
-	rp.stream_in_pkts = totalInPkts
-	rp.stream_out_pkts = totalOutPkts
-
-	// segs receive
-	rp.stream_in_segs = totalInSegs
-	rp.stream_out_segs = totalOutSegs
+	var noDelay, nc int
 
-	tempResult.rtt = uint(sp.conn.(*KCP.UDPSession).GetSRTTVar() * 1000) // ms to micro sec
-	if rp.stream_min_rtt == 0 || tempResult.rtt < rp.stream_min_rtt {
-		rp.stream_min_rtt = tempResult.rtt
+	if test.noDelay {
+		noDelay = 1
 	}
 
-	if rp.stream_max_rtt == 0 || tempResult.rtt > rp.stream_max_rtt {
-		rp.stream_max_rtt = tempResult.rtt
+	if test.setting.noCong {
+		nc = 1
 	}
 
-	rp.stream_sum_rtt += tempResult.rtt
-	rp.stream_cnt_rtt++
+	s.SetNoDelay(noDelay, int(test.setting.flushInterval), int(test.setting.fastResend), nc)
 
-	return 0
+	return nil
 }
 
-func (*kcpProto) teardown(_ *IperfTest) int {
-	return 0
+// kcpMTU returns the mtu of the sessions, a peer without -mtu sends none
+func (test *IperfTest) kcpMTU() uint {
+	if test.setting.mtu == 0 {
+		return KCP_DEFAULT_MTU
+	}
+
+	return test.setting.mtu
+}
+
+// sessionDeadline returns the read/write deadline of the sessions, by default the one of the tcp and udp streams.
+// Tests limited by -n or -k run without.
+func (test *IperfTest) sessionDeadline() time.Time {
+	if test.setting.deadline != 0 {
+		return time.Now().Add(time.Duration(test.setting.deadline) * time.Second)
+	}
+
+	return test.streamDeadline()
+}
+
+// sessionModeName returns stream or message for Print
+func (test *IperfTest) sessionModeName() string {
+	if test.setting.msgMode {
+		return "message"
+	}
+
+	return "stream"
+}
+
+// sessionDeadlineName describes the deadline of the sessions for Print
+func (test *IperfTest) sessionDeadlineName() string {
+	if test.setting.deadline != 0 {
+		return fmt.Sprintf("%vs", test.setting.deadline)
+	}
+
+	if test.duration == 0 {
+		return "none"
+	}
+
+	return fmt.Sprintf("%vs", test.duration+test.omit+5)
 }
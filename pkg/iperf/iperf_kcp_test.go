@@ -0,0 +1,50 @@
+package iperf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionDeadline(t *testing.T) {
+	cases := []struct {
+		name     string
+		duration uint
+		omit     uint
+		deadline uint
+		bytes    uint64
+		blocks   uint64
+		want     time.Duration // from now, 0 for no deadline
+		wantName string
+	}{
+		{name: "duration", duration: 10, want: 15 * time.Second, wantName: "15s"},
+		{name: "duration and omit", duration: 10, omit: 3, want: 18 * time.Second, wantName: "18s"},
+		{name: "-n", bytes: 1 << 20, want: 0, wantName: "none"},
+		{name: "-k", blocks: 1000, want: 0, wantName: "none"},
+		{name: "-kcp-deadline", duration: 10, omit: 3, deadline: 60, want: time.Minute, wantName: "60s"},
+		{name: "-kcp-deadline with -n", bytes: 1 << 20, deadline: 30, want: 30 * time.Second, wantName: "30s"},
+	}
+
+	for _, c := range cases {
+		test := NewIperfTest()
+		test.duration = c.duration // -n and -k leave it 0
+		test.omit = c.omit
+		test.setting.deadline = c.deadline
+		test.setting.bytes = c.bytes
+		test.setting.blocks = c.blocks
+
+		now := time.Now()
+		got := test.sessionDeadline()
+
+		if c.want == 0 {
+			if !got.IsZero() {
+				t.Errorf("%v: sessionDeadline() = %v, want none", c.name, got)
+			}
+		} else if d := got.Sub(now); d < c.want || d > c.want+time.Second {
+			t.Errorf("%v: sessionDeadline() in %v, want %v", c.name, d, c.want)
+		}
+
+		if name := test.sessionDeadlineName(); name != c.wantName {
+			t.Errorf("%v: sessionDeadlineName() = %q, want %q", c.name, name, c.wantName)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package iperf
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reuseport listeners: -listeners opens several SO_REUSEPORT listeners on the server port, the kernel spreads the
+// incoming connections over them by their address hash and every listener has an accept loop of its own. Where
+// the affinity of the threads can be set (linux), the listeners take the cpus of the process in turn: the accept
+// loop runs on a thread pinned to the cpu and the listening socket has SO_INCOMING_CPU set to it, which newer
+// kernels (6.2 on) honour over the hash. The connections meet in one queue the test accepts from. As they no longer arrive in the order the client opened
+// them, the client identifies its tcp and mptcp data streams with the cookie of the test and their index, the
+// server refuses connections of another test and gives every stream the role of its index.
+
+const (
+	STREAM_ID_SIZE    = 8 // cookie and index of a data stream
+	STREAM_ID_TIMEOUT = 5 // sec, wait for a new data stream to identify itself
+	LISTENERS_MAX     = 1024
+	ACCEPT_DELAY_MIN  = 5 * time.Millisecond // first wait after a failed accept, doubled on every failure in a row
+	ACCEPT_DELAY_MAX  = time.Second
+)
+
+// reusePortListener accepts from several listeners sharing the port with SO_REUSEPORT
+type reusePortListener struct {
+	listeners []net.Listener
+	cpus      []int    // cpu of every listener, nil if they are not pinned
+	accepted  []uint64 // connections of every listener, atomic
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// listenReusePort opens n listeners on the same address, each with an accept loop, IPPROTO_MPTCP ones if mptcp
+// is set
+func (test *IperfTest) listenReusePort(n uint, mptcp bool) (*reusePortListener, error) {
+	l := &reusePortListener{accepted: make([]uint64, n), conns: make(chan net.Conn, n), done: make(chan struct{})}
+
+	if cpus, err := getAffinity(); err == nil && len(cpus) > 0 {
+		for i := uint(0); i < n; i++ {
+			l.cpus = append(l.cpus, cpus[int(i)%len(cpus)])
+		}
+	}
+
+	listen := func(i uint) (net.Listener, error) {
+		setup := func(fd uintptr) error {
+			if err := setReusePort(fd); err != nil {
+				return err
+			}
+
+			if l.cpus != nil {
+				if err := setIncomingCPU(fd, l.cpus[i]); err != nil {
+					return err
+				}
+			}
+
+			return test.bindDevice(fd)
+		}
+
+		if mptcp {
+			return mptcpListen(test.network("tcp"), test.listenAddr(), setup)
+		}
+
+		control := func(network, address string, c syscall.RawConn) error {
+			var err error
+
+			cerr := c.Control(func(fd uintptr) {
+				err = setup(fd)
+			})
+			if cerr != nil {
+				return cerr
+			}
+
+			return err
+		}
+
+		lc := net.ListenConfig{Control: control}
+
+		return lc.Listen(context.Background(), test.network("tcp"), test.listenAddr())
+	}
+
+	for i := uint(0); i < n; i++ {
+		ln, err := listen(i)
+		if err != nil {
+			l.Close()
+
+			return nil, err
+		}
+
+		l.listeners = append(l.listeners, ln)
+	}
+
+	for i, ln := range l.listeners {
+		go l.acceptLoop(i, ln)
+	}
+
+	return l, nil
+}
+
+func (l *reusePortListener) acceptLoop(i int, ln net.Listener) {
+	var delay time.Duration
+
+	if l.cpus != nil {
+		release, err := pinAcceptThread(l.cpus[i])
+		if err != nil {
+			Log.Errorf("Listener %v pin to cpu %v failed. err = %v", i, l.cpus[i], err)
+		} else {
+			defer release()
+		}
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			delay = acceptDelay(delay)
+
+			Log.Errorf("Listener %v accept failed, retry in %v. err = %v", i, delay, err)
+
+			select {
+			case <-time.After(delay):
+			case <-l.done:
+				return
+			}
+
+			continue
+		}
+
+		delay = 0
+
+		atomic.AddUint64(&l.accepted[i], 1)
+
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+
+			return
+		}
+	}
+}
+
+func (l *reusePortListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *reusePortListener) Close() error {
+	var err error
+
+	l.closeOnce.Do(func() {
+		close(l.done)
+
+		for _, ln := range l.listeners {
+			if cerr := ln.Close(); err == nil {
+				err = cerr
+			}
+		}
+
+		// connections accepted but not taken by the test
+		for {
+			select {
+			case conn := <-l.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+
+	return err
+}
+
+func (l *reusePortListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
+
+// acceptDelay returns the wait after a failed accept, the last one doubled, so a lasting error such as EMFILE
+// does not spin the accept loop
+func acceptDelay(last time.Duration) time.Duration {
+	if last == 0 {
+		return ACCEPT_DELAY_MIN
+	}
+
+	if last*2 > ACCEPT_DELAY_MAX {
+		return ACCEPT_DELAY_MAX
+	}
+
+	return last * 2
+}
+
+// listenerSockets returns the listening sockets of the server, several with -listeners
+func (test *IperfTest) listenerSockets() []net.Listener {
+	if l, ok := test.listener.(*reusePortListener); ok {
+		return l.listeners
+	}
+
+	return []net.Listener{test.listener}
+}
+
+// printListeners prints the connections every listener accepted during the test, control and data streams
+// together
+func (test *IperfTest) printListeners() {
+	l, ok := test.listener.(*reusePortListener)
+	if !ok {
+		return
+	}
+
+	counts := make([]string, len(l.accepted))
+	for i := range l.accepted {
+		if l.cpus != nil {
+			counts[i] = fmt.Sprintf("#%v (cpu %v) %v", i, l.cpus[i], atomic.LoadUint64(&l.accepted[i]))
+		} else {
+			counts[i] = fmt.Sprintf("#%v %v", i, atomic.LoadUint64(&l.accepted[i]))
+		}
+	}
+
+	fmt.Printf(LISTENERS_REPORT, len(l.listeners), strings.Join(counts, "  "))
+}
+
+// identifiesStreams reports whether the data streams identify themselves, they are accepted from the control
+// listener with tcp and mptcp
+func (test *IperfTest) identifiesStreams() bool {
+	return test.proto.Name() == TCP_NAME || test.proto.Name() == MPTCP_NAME
+}
+
+// newCookie returns the cookie of a test, never 0 which stands for streams without identification
+func newCookie() uint32 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Uint32() | 1
+}
+
+// writeStreamID identifies a new data stream of the client to the server
+func (test *IperfTest) writeStreamID(conn net.Conn, index uint) error {
+	buf := make([]byte, STREAM_ID_SIZE)
+	binary.LittleEndian.PutUint32(buf[0:4], test.cookie)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(index))
+
+	_, err := conn.Write(buf)
+
+	return err
+}
+
+// readStreamID returns the index of a new data stream, or an error if it belongs to no stream of this test
+func (test *IperfTest) readStreamID(conn net.Conn) (uint, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(STREAM_ID_TIMEOUT * time.Second)); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, STREAM_ID_SIZE)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return 0, fmt.Errorf("read stream id: %w", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return 0, err
+	}
+
+	if binary.LittleEndian.Uint32(buf[0:4]) != test.cookie {
+		return 0, fmt.Errorf("cookie of another test")
+	}
+
+	index := uint(binary.LittleEndian.Uint32(buf[4:8]))
+	if index >= test.streamCount() {
+		return 0, fmt.Errorf("stream index %v out of %v streams", index, test.streamCount())
+	}
+
+	return index, nil
+}
@@ -0,0 +1,264 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadStreamID(t *testing.T) {
+	id := func(cookie, index uint32) []byte {
+		b := make([]byte, STREAM_ID_SIZE)
+		binary.LittleEndian.PutUint32(b[0:4], cookie)
+		binary.LittleEndian.PutUint32(b[4:8], index)
+
+		return b
+	}
+
+	cases := []struct {
+		name  string
+		bidir bool
+		data  []byte
+		want  uint
+		fails bool
+	}{
+		{name: "first", data: id(0x1235, 0), want: 0},
+		{name: "last", data: id(0x1235, 1), want: 1},
+		{name: "bidir", bidir: true, data: id(0x1235, 3), want: 3},
+		{name: "out of range", data: id(0x1235, 2), fails: true},
+		{name: "another test", data: id(0x4321, 0), fails: true},
+		{name: "short", data: id(0x1235, 0)[:5], fails: true},
+	}
+
+	for _, c := range cases {
+		test := NewIperfTest()
+		test.cookie = 0x1235
+		test.streamNum = 2
+		test.bidir = c.bidir
+
+		client, server := net.Pipe()
+
+		go func(data []byte) {
+			client.Write(data)
+			client.Close()
+		}(c.data)
+
+		got, err := test.readStreamID(server)
+		server.Close()
+
+		if c.fails {
+			if err == nil {
+				t.Errorf("%v: readStreamID should fail", c.name)
+			}
+
+			continue
+		}
+
+		if err != nil || got != c.want {
+			t.Errorf("%v: readStreamID = %v, %v, want %v", c.name, got, err, c.want)
+		}
+	}
+
+	// what writeStreamID sends reads back
+	test := NewIperfTest()
+	test.cookie = newCookie()
+	test.streamNum = 4
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		test.writeStreamID(client, 3)
+		client.Close()
+	}()
+
+	if got, err := test.readStreamID(server); err != nil || got != 3 {
+		t.Errorf("readStreamID of writeStreamID(3) = %v, %v", got, err)
+	}
+}
+
+// failingListener fails every accept like a process out of file descriptors
+type failingListener struct {
+	net.Listener
+	accepts int64
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	atomic.AddInt64(&l.accepts, 1)
+
+	return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+}
+
+func TestAcceptDelay(t *testing.T) {
+	var delays []time.Duration
+	for d := time.Duration(0); len(delays) < 10; {
+		d = acceptDelay(d)
+		delays = append(delays, d)
+	}
+
+	if delays[0] != ACCEPT_DELAY_MIN || delays[1] != 2*ACCEPT_DELAY_MIN || delays[9] != ACCEPT_DELAY_MAX {
+		t.Errorf("acceptDelay backs off %v", delays)
+	}
+
+	// a lasting accept error is retried a few times, not in a spin
+	ln := new(failingListener)
+	l := &reusePortListener{accepted: make([]uint64, 1), conns: make(chan net.Conn), done: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		l.acceptLoop(0, ln)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	close(l.done)
+	<-done
+
+	// 5, 10, 20 and 40 ms fit in 100 ms
+	if n := atomic.LoadInt64(&ln.accepts); n < 2 || n > 6 {
+		t.Errorf("%v accepts in 100 ms", n)
+	}
+}
+
+// freePort returns a port the kernel just handed out on the loopback, free for tcp and udp
+func freePort(t *testing.T) uint {
+	for i := 0; i < 10; i++ {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		if pc, err := net.ListenPacket("udp4", ln.Addr().String()); err == nil {
+			pc.Close()
+
+			return uint(port)
+		}
+	}
+
+	t.Fatalf("no free port")
+
+	return 0
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the listeners are pinned on linux only")
+	}
+
+	cpus, err := getAffinity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := NewIperfTest()
+	test.port = freePort(t)
+	test.ipVersion = 4
+
+	l, err := test.listenReusePort(3, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// the listeners take the cpus of the process in turn
+	for i, cpu := range l.cpus {
+		if cpu != cpus[i%len(cpus)] {
+			t.Errorf("listener %v on cpu %v, want %v", i, cpu, cpus[i%len(cpus)])
+		}
+	}
+
+	if len(l.cpus) != 3 {
+		t.Fatalf("cpus of the listeners = %v", l.cpus)
+	}
+
+	for i := 0; i < 6; i++ {
+		conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", fmt.Sprint(test.port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer conn.Close()
+
+		if conn, err := l.Accept(); err != nil {
+			t.Fatal(err)
+		} else {
+			conn.Close()
+		}
+	}
+
+	var accepted uint64
+	for i := range l.accepted {
+		accepted += atomic.LoadUint64(&l.accepted[i])
+	}
+
+	if accepted != 6 {
+		t.Errorf("%v connections accepted, want 6", accepted)
+	}
+}
+
+func TestRefuseUnidentifiedStreams(t *testing.T) {
+	cases := []struct {
+		name      string
+		listeners uint
+		proto     string
+		cookie    uint32
+		refused   bool
+	}{
+		{name: "identified", listeners: 2, proto: TCP_NAME, cookie: 0x1235},
+		{name: "older client", listeners: 2, proto: TCP_NAME, refused: true},
+		{name: "older client, one listener", listeners: 1, proto: TCP_NAME},
+		{name: "older client, udp", listeners: 2, proto: UDP_NAME},
+	}
+
+	for _, c := range cases {
+		server := NewIperfTest()
+		server.Init()
+		server.isServer = true
+		server.listeners = c.listeners
+
+		client, conn := net.Pipe()
+		server.ctrlConn = conn
+
+		// the params of a client as old as its cookie
+		go func(params stream_params) {
+			bs, _ := json.Marshal(&params)
+
+			length := make([]byte, 4)
+			binary.LittleEndian.PutUint32(length, uint32(len(bs)))
+			client.Write(append(length, bs...))
+		}(stream_params{ProtoName: c.proto, Cookie: c.cookie, StreamNum: 2})
+
+		reply := make(chan []byte, 1)
+		go func() {
+			bs, _ := io.ReadAll(client)
+			reply <- bs
+		}()
+
+		rtn := server.getParams()
+		conn.Close()
+
+		bs := <-reply
+		client.Close()
+
+		if refused := rtn < 0; refused != c.refused {
+			t.Errorf("%v: getParams = %v", c.name, rtn)
+		}
+
+		if c.refused && (len(bs) < 8 || binary.LittleEndian.Uint32(bs) != SERVER_ERROR ||
+			!strings.Contains(string(bs[8:]), "listeners")) {
+			t.Errorf("%v: the client got %q, want the refusal", c.name, bs)
+		}
+	}
+}
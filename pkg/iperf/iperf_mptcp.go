@@ -0,0 +1,123 @@
+package iperf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var errMPTCPUnavailable = errors.New("mptcp is not available")
+
+// MPTCPProto runs the test over Multipath TCP. Data streams are TCP streams opened with IPPROTO_MPTCP,
+// they fall back to plain TCP if either end does not support MPTCP.
+type MPTCPProto struct {
+	TCPProto
+}
+
+func (m *MPTCPProto) Name() string {
+	return MPTCP_NAME
+}
+
+// Listen opens the server port again with an MPTCP listener for the data streams. The server listens with plain
+// TCP until the parameters of the control connection ask for mptcp, the client connects the data streams only
+// after that.
+func (m *MPTCPProto) Listen(test *IperfTest) (net.Listener, error) {
+	Log.Debugf("Enter MPTCP listen")
+
+	if err := test.listener.Close(); err != nil {
+		Log.Errorf("Close the TCP listener failed. err = %v", err)
+
+		return nil, err
+	}
+
+	listener, err := test.listenTCP(true)
+	if errors.Is(err, errMPTCPUnavailable) {
+		Log.Warningf("MPTCP listen failed, the streams fall back to TCP. err = %v", err)
+
+		listener, err = test.listenTCP(false)
+	}
+
+	if err != nil {
+		Log.Errorf("Listen on %v failed. err = %v", test.listenAddr(), err)
+
+		return nil, err
+	}
+
+	test.listener = listener
+
+	return m.TCPProto.Listen(test)
+}
+
+func (m *MPTCPProto) Connect(test *IperfTest) (net.Conn, error) {
+	Log.Debugf("Enter MPTCP connect")
+
+	laddr, err := test.localAddr(true)
+	if err != nil {
+		return nil, err
+	}
+
+	setup := func(fd uintptr) error {
+		if err := test.bindDevice(fd); err != nil || !test.tcpSockopts() {
+			return err
+		}
+
+		return test.setTCPSockopts(fd)
+	}
+
+	conn, err := mptcpDial(test.network("tcp"), test.serverAddr(), laddr, setup)
+	if errors.Is(err, errMPTCPUnavailable) {
+		Log.Warningf("MPTCP socket create failed, fall back to TCP. err = %v", err)
+
+		return m.TCPProto.dial(test, laddr)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetDeadline(test.streamDeadline())
+	if err != nil {
+		Log.Errorf("SetDeadline err: %v", err)
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (m *MPTCPProto) Init(test *IperfTest) int {
+	if rtn := m.TCPProto.Init(test); rtn < 0 {
+		return rtn
+	}
+
+	for i, sp := range test.streams {
+		sp.result.mptcp_negotiated = mptcpNegotiated(sp.conn)
+
+		if sp.result.mptcp_negotiated {
+			fmt.Printf("[  %v] MPTCP negotiated with %v\n", i, sp.conn.RemoteAddr())
+		} else {
+			fmt.Printf("[  %v] Warning: MPTCP not negotiated with %v, stream fell back to TCP\n", i, sp.conn.RemoteAddr())
+		}
+	}
+
+	return 0
+}
+
+func (m *MPTCPProto) StatsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
+	rp := sp.result
+
+	if rp.mptcp_negotiated {
+		saveMPTCPInfo(sp, tempResult)
+	} else {
+		saveTCPInfo(sp, tempResult)
+	}
+
+	if tempResult.interval_retrans < rp.stream_prev_total_retrans {
+		// a subflow was closed and its retrans counter went away with it
+		rp.stream_prev_total_retrans = tempResult.interval_retrans
+	}
+
+	updateTCPStats(sp, tempResult)
+
+	return 0
+}
@@ -0,0 +1,111 @@
+package iperf
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMPTCPLoopback(t *testing.T) {
+	if ln, err := mptcpListen("tcp4", "127.0.0.1:0", nil); errors.Is(err, errMPTCPUnavailable) {
+		t.Skipf("no mptcp in this kernel: %v", err)
+	} else if err != nil {
+		t.Fatal(err)
+	} else {
+		ln.Close()
+	}
+
+	// an mptcp server negotiates it, a plain tcp one makes the stream fall back
+	cases := []struct {
+		name       string
+		server     string
+		negotiated bool
+		printed    string
+	}{
+		{name: "negotiated", server: MPTCP_NAME, negotiated: true, printed: "MPTCP negotiated"},
+		{name: "fallback", server: TCP_NAME, printed: "fell back to TCP"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := NewIperfTest()
+			server.Init()
+			server.setProtocol(c.server)
+			server.isServer = true
+			server.port = freePort(t)
+			server.ipVersion = 4
+
+			// the control listener, the mptcp protocol opens the port again
+			ln, err := net.Listen("tcp4", server.listenAddr())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			server.listener = ln
+			if server.protoListener, err = server.proto.Listen(server); err != nil {
+				ln.Close()
+				t.Fatal(err)
+			}
+
+			defer server.listener.Close()
+
+			client := NewIperfTest()
+			client.Init()
+			client.setProtocol(MPTCP_NAME)
+			client.addr = "127.0.0.1"
+			client.port = server.port
+			client.ipVersion = 4
+
+			cconn, err := client.proto.Connect(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer cconn.Close()
+
+			sconn, err := server.proto.Accept(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer sconn.Close()
+
+			go io.Copy(io.Discard, sconn)
+
+			sp := client.newStream(cconn, SENDER_STREAM)
+			client.streams = []*iperfStream{sp}
+
+			if out := captureStdout(t, func() { client.proto.Init(client) }); !strings.Contains(out, c.printed) {
+				t.Errorf("Init printed %q, want %q", out, c.printed)
+			}
+
+			if sp.result.mptcp_negotiated != c.negotiated || mptcpNegotiated(sconn) != c.negotiated {
+				t.Errorf("negotiated: client %v, server %v, want %v", sp.result.mptcp_negotiated,
+					mptcpNegotiated(sconn), c.negotiated)
+			}
+
+			if _, err = cconn.Write(make([]byte, 1<<20)); err != nil {
+				t.Fatal(err)
+			}
+
+			rp := iperf_interval_results{}
+			client.proto.StatsCallback(client, sp, &rp)
+
+			// the subflows are reported with mptcp, the tcp info of the stream after a fallback
+			if c.negotiated {
+				if rp.mptcp_subflows < 1 || len(rp.subflow_results) != int(rp.mptcp_subflows) ||
+					rp.subflow_results[0].snd_cwnd == 0 {
+					t.Errorf("%v subflows, results %+v", rp.mptcp_subflows, rp.subflow_results)
+				}
+			} else if rp.mptcp_subflows != 0 || rp.subflow_results != nil {
+				t.Errorf("a tcp stream with %v subflows, results %+v", rp.mptcp_subflows, rp.subflow_results)
+			}
+
+			if rp.rtt == 0 {
+				t.Errorf("no rtt reported")
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package iperf
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// network appends the address family forced by -4 / -6 to a network name, e.g. "tcp" -> "tcp6"
+func (test *IperfTest) network(network string) string {
+	switch test.ipVersion {
+	case 4:
+		return network + "4"
+	case 6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// serverAddr returns host:port of the server, ipv6 literals are bracketed
+func (test *IperfTest) serverAddr() string {
+	return net.JoinHostPort(test.addr, strconv.Itoa(int(test.port)))
+}
+
+// listenAddr returns the address the server listens on, the -B address if given. Without -4 / -6 the wildcard
+// address is dual stack.
+func (test *IperfTest) listenAddr() string {
+	host := ""
+
+	switch {
+	case test.bindAddr.IsValid():
+		host = test.bindAddr.String()
+	case test.ipVersion == 4:
+		host = net.IPv4zero.String()
+	case test.ipVersion == 6:
+		host = net.IPv6unspecified.String()
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(test.port)))
+}
+
+// normalizeHost strips the brackets of an ipv6 literal given as [::1]
+func normalizeHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+
+	return host
+}
+
+// parseBindAddr parses the -B address, an ip literal with an optional ipv6 zone
+func parseBindAddr(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(normalizeHost(s))
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid bind address %v, expect an ip address", s)
+	}
+
+	return addr.Unmap(), nil
+}
+
+// setBindAddr sets the -B address. Unless -4 / -6 is given a specific address forces its family, so that the
+// server is resolved to an address the sockets can reach from it.
+func (test *IperfTest) setBindAddr(s string) error {
+	if s == "" {
+		return nil
+	}
+
+	addr, err := parseBindAddr(s)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case test.ipVersion == 4 && !addr.Is4(), test.ipVersion == 6 && addr.Is4():
+		return fmt.Errorf("bind address %v does not match -%v", s, test.ipVersion)
+	case test.ipVersion == 0 && addr.Is4():
+		test.ipVersion = 4
+	case test.ipVersion == 0 && !addr.IsUnspecified():
+		test.ipVersion = 6
+	}
+
+	test.bindAddr = addr
+
+	return nil
+}
+
+// portRange is the --cport range of the source ports of the client's data streams
+type portRange struct {
+	first uint // 0 for none
+	last  uint
+}
+
+// ParsePortRange parses --cport, a port the data streams count up from or a range first-last they take their
+// ports from
+func ParsePortRange(s string) (first, last uint, err error) {
+	firstStr, lastStr, isRange := strings.Cut(s, "-")
+
+	f, err := strconv.ParseUint(firstStr, 10, 16)
+	if err != nil || f == 0 {
+		return 0, 0, fmt.Errorf("invalid client port %v, expect a port or a range first-last", s)
+	}
+
+	if !isRange {
+		return uint(f), math.MaxUint16, nil
+	}
+
+	l, err := strconv.ParseUint(lastStr, 10, 16)
+	if err != nil || l < f {
+		return 0, 0, fmt.Errorf("invalid client port range %v, expect first-last", s)
+	}
+
+	return uint(f), uint(l), nil
+}
+
+// localAddr returns the address a client socket binds to: the -B address, and the next --cport port for a data
+// stream. The zero AddrPort leaves both to the kernel.
+func (test *IperfTest) localAddr(stream bool) (netip.AddrPort, error) {
+	var port uint
+
+	if stream && test.cport.first != 0 {
+		port = test.cport.first + test.cportNext
+		if port > test.cport.last {
+			return netip.AddrPort{}, fmt.Errorf("client port range %v-%v has no port left for stream %v",
+				test.cport.first, test.cport.last, test.cportNext+1)
+		}
+
+		test.cportNext++
+	}
+
+	if !test.bindAddr.IsValid() && port == 0 {
+		return netip.AddrPort{}, nil
+	}
+
+	return netip.AddrPortFrom(test.bindAddr, uint16(port)), nil
+}
+
+// bindDevice binds a socket to the --bind-dev interface, if given
+func (test *IperfTest) bindDevice(fd uintptr) error {
+	if test.bindDev == "" {
+		return nil
+	}
+
+	return bindToDevice(fd, test.bindDev)
+}
+
+// bindControl returns control preceded by binding the socket to the --bind-dev interface
+func (test *IperfTest) bindControl(control func(network, address string, c syscall.RawConn) error) func(network,
+	address string, c syscall.RawConn) error {
+	if test.bindDev == "" {
+		return control
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+
+		cerr := c.Control(func(fd uintptr) {
+			err = test.bindDevice(fd)
+		})
+		if cerr != nil {
+			return cerr
+		}
+
+		if err != nil || control == nil {
+			return err
+		}
+
+		return control(network, address, c)
+	}
+}
+
+// dialTCP connects to the server from laddr, trying every resolved address of the forced family. The dial gives
+// up at the stream deadline. control, if not nil, sets socket options before the connect.
+func (test *IperfTest) dialTCP(laddr netip.AddrPort, control func(network, address string, c syscall.RawConn) error) (*net.TCPConn, error) {
+	dialer := net.Dialer{Deadline: test.streamDeadline(), Control: test.bindControl(control)}
+
+	if laddr != (netip.AddrPort{}) {
+		dialer.LocalAddr = net.TCPAddrFromAddrPort(laddr)
+	}
+
+	conn, err := dialer.DialContext(context.Background(), test.network("tcp"), test.serverAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.TCPConn), nil
+}
+
+// tcpSockopts reports whether any of -w, -M, -C, -S and -L is set
+func (test *IperfTest) tcpSockopts() bool {
+	return test.setting.window != 0 || test.setting.mss != 0 || test.setting.congestion != "" ||
+		test.setting.tos != TOS_DEFAULT || test.setting.flowLabel != 0
+}
+
+// tcpSockoptControl returns the dialer hook applying -w, -M, -C, -S and -L to a data stream, nil if none is set.
+// With -L the hook binds the socket to laddr and connects it itself, the dialer then waits for the connect in
+// progress.
+func (test *IperfTest) tcpSockoptControl(laddr netip.AddrPort) func(network, address string, c syscall.RawConn) error {
+	if !test.tcpSockopts() {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+
+		cerr := c.Control(func(fd uintptr) {
+			if err = test.setTCPSockopts(fd); err != nil || test.setting.flowLabel == 0 {
+				return
+			}
+
+			if laddr != (netip.AddrPort{}) {
+				if err = bindFd(fd, laddr); err != nil {
+					return
+				}
+			}
+
+			var addr netip.AddrPort
+			if addr, err = netip.ParseAddrPort(address); err == nil {
+				err = connectFlowLabel(fd, addr, uint32(test.setting.flowLabel))
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+
+		return err
+	}
+}
+
+// setTCPSockopts applies -w, -M, -C and -S to a socket
+func (test *IperfTest) setTCPSockopts(fd uintptr) error {
+	if err := setTCPWindowMSS(fd, int(test.setting.window), int(test.setting.mss)); err != nil {
+		return err
+	}
+
+	if test.setting.congestion != "" {
+		if err := setTCPCongestion(fd, test.setting.congestion); err != nil {
+			return err
+		}
+	}
+
+	if test.setting.tos != TOS_DEFAULT {
+		return setTOS(fd, test.setting.tos)
+	}
+
+	return nil
+}
+
+// setListenerSockopts applies -w, -M, -C and -S to the tcp listener, the streams accepted from it inherit them.
+// With -L they are asked to reflect the flow label of the client.
+func (test *IperfTest) setListenerSockopts() error {
+	for _, ln := range test.listenerSockets() {
+		sc, ok := ln.(syscall.Conn)
+		if !ok {
+			return fmt.Errorf("listener %T does not expose its file descriptor", ln)
+		}
+
+		rc, err := sc.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		cerr := rc.Control(func(fd uintptr) {
+			if err = test.setTCPSockopts(fd); err != nil || test.setting.flowLabel == 0 {
+				return
+			}
+
+			if rerr := reflectFlowLabel(fd); rerr != nil {
+				Log.Warningf("The server side of the streams sends without flow label. err = %v", rerr)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// controlFd runs fn with the file descriptor of a TCP/UDP conn.
+func controlFd(conn net.Conn, fn func(fd int) error) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("conn %T does not expose its file descriptor", conn)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+
+	err = rc.Control(func(fd uintptr) {
+		fnErr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// resolveUDPAddr resolves the server address for the udp based protocols
+func (test *IperfTest) resolveUDPAddr() (*net.UDPAddr, error) {
+	return net.ResolveUDPAddr(test.network("udp"), test.serverAddr())
+}
+
+// dialUDP connects a udp data stream socket of the client to raddr, bound to -B, --cport and --bind-dev
+func (test *IperfTest) dialUDP(raddr *net.UDPAddr) (*net.UDPConn, error) {
+	laddr, err := test.localAddr(true)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Control: test.bindControl(nil)}
+
+	if laddr != (netip.AddrPort{}) {
+		dialer.LocalAddr = net.UDPAddrFromAddrPort(laddr)
+	}
+
+	conn, err := dialer.Dial(test.network("udp"), raddr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// openUDP opens the unconnected socket of a kcp or rudp client session, bound like dialUDP
+func (test *IperfTest) openUDP() (*net.UDPConn, error) {
+	laddr, err := test.localAddr(true)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := net.ListenConfig{Control: test.bindControl(nil)}
+
+	conn, err := lc.ListenPacket(context.Background(), test.network("udp"), net.UDPAddrFromAddrPort(laddr).String())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// listenUDP opens the server side packet conn of the udp based protocols. reusePort is needed if connected
+// sockets will be bound to the same port.
+func (test *IperfTest) listenUDP(reusePort bool) (*net.UDPConn, error) {
+	var lc net.ListenConfig
+
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+
+	lc.Control = test.bindControl(lc.Control)
+
+	conn, err := lc.ListenPacket(context.Background(), test.network("udp"), test.listenAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// packetListener closes the packet conn it serves on together with the listener
+type packetListener struct {
+	net.Listener
+	conn net.PacketConn
+}
+
+func (l *packetListener) Close() error {
+	err := l.Listener.Close()
+
+	if cerr := l.conn.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,69 @@
+package iperf
+
+import (
+	"math"
+	"net/netip"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		s           string
+		first, last uint
+		fails       bool
+	}{
+		{s: "5000", first: 5000, last: math.MaxUint16},
+		{s: "65535", first: 65535, last: math.MaxUint16},
+		{s: "5000-5010", first: 5000, last: 5010},
+		{s: "5000-5000", first: 5000, last: 5000},
+		{s: "0", fails: true},
+		{s: "65536", fails: true},
+		{s: "5010-5000", fails: true},
+		{s: "5000-", fails: true},
+		{s: "-5000", fails: true},
+		{s: "5000-70000", fails: true},
+		{s: "port", fails: true},
+		{s: "", fails: true},
+	}
+
+	for _, c := range cases {
+		first, last, err := ParsePortRange(c.s)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParsePortRange(%q) should fail", c.s)
+			}
+
+			continue
+		}
+
+		if err != nil || first != c.first || last != c.last {
+			t.Errorf("ParsePortRange(%q) = %v, %v, %v, want %v, %v", c.s, first, last, err, c.first, c.last)
+		}
+	}
+}
+
+func TestLocalAddr(t *testing.T) {
+	test := NewIperfTest()
+	test.cport = portRange{first: 5000, last: 5001}
+	test.bindAddr = netip.MustParseAddr("10.0.0.1")
+
+	// the control connection keeps an ephemeral port
+	if addr, err := test.localAddr(false); err != nil || addr != netip.MustParseAddrPort("10.0.0.1:0") {
+		t.Errorf("localAddr(false) = %v, %v", addr, err)
+	}
+
+	for _, want := range []string{"10.0.0.1:5000", "10.0.0.1:5001"} {
+		if addr, err := test.localAddr(true); err != nil || addr != netip.MustParseAddrPort(want) {
+			t.Errorf("localAddr(true) = %v, %v, want %v", addr, err, want)
+		}
+	}
+
+	if _, err := test.localAddr(true); err == nil {
+		t.Errorf("localAddr(true) should fail past the end of the range")
+	}
+
+	// neither -B nor --cport leaves the address to the kernel
+	if addr, err := NewIperfTest().localAddr(true); err != nil || addr.IsValid() {
+		t.Errorf("localAddr(true) without -B and --cport = %v, %v", addr, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -27,6 +28,7 @@ type IntervalResult struct {
 	Bandwidth   float64 // Mbps
 	RTT         time.Duration
 	Retransmits uint
+	TCPInfo     []TCPInfo // 每个数据流的 TCP_INFO，仅 TCP/MPTCP (Linux)，协商成功的 MPTCP 连接为零值
 }
 
 // EventType 定义事件类型
@@ -115,12 +117,22 @@ func (c *Client) initTest() error {
 // applyConfig 应用配置到测试对象
 func (c *Client) applyConfig() error {
 	c.test.isServer = (c.config.Role == RoleServer)
-	c.test.addr = c.config.ServerAddr
+	c.test.addr = normalizeHost(c.config.ServerAddr)
 	c.test.port = c.config.Port
+	c.test.ipVersion = c.config.IPVersion
+	c.test.bindDev = c.config.BindDevice
+	_ = c.test.setBindAddr(c.config.BindAddr) // checked by Validate
+
+	if c.config.ClientPort != "" {
+		c.test.cport.first, c.test.cport.last, _ = ParsePortRange(c.config.ClientPort)
+	}
 	c.test.duration = uint(c.config.Duration.Seconds())
+	c.test.omit = uint(c.config.Omit.Seconds())
 	c.test.interval = uint(c.config.Interval.Milliseconds())
 	c.test.reverse = c.config.Reverse
+	c.test.bidir = c.config.Bidir
 	c.test.noDelay = c.config.NoDelay
+	c.test.verbose = c.config.Verbose
 	c.test.streamNum = c.config.Parallel
 
 	// 设置协议
@@ -132,6 +144,38 @@ func (c *Client) applyConfig() error {
 	c.test.setting.blksize = c.config.Blksize
 	c.test.setting.burst = c.config.Burst
 	c.test.setting.rate = c.config.Rate
+	c.test.setting.bytes = c.config.Bytes
+	c.test.setting.blocks = c.config.Blocks
+	c.test.rr = c.config.RR
+	c.test.setting.reqSize = c.config.ReqSize
+	c.test.setting.respSize = c.config.RespSize
+	c.test.crr = c.config.CRR
+	c.test.setting.file = c.config.File
+	c.test.setting.fileLoop = c.config.FileLoop
+	c.test.setting.zeroCopy = c.config.ZeroCopy || c.config.ZeroCopyMsg
+	c.test.setting.zeroCopyMsg = c.config.ZeroCopyMsg
+	c.test.setting.pattern = c.config.Pattern
+	c.test.setting.seed = c.config.Seed
+	c.test.setting.verify = c.config.Verify
+	c.test.setting.owd = c.config.OWD || c.config.Profile != ""
+	c.test.setting.profile = c.config.Profile
+	c.test.setting.window = c.config.Window
+	c.test.setting.mss = c.config.MSS
+	c.test.setting.congestion = c.config.Congestion
+	c.test.setting.tos = TOS_DEFAULT
+	c.test.setting.flowLabel = c.config.FlowLabel
+	c.test.setting.fqRate = c.config.FQRate
+	c.test.setting.udpBatch = c.config.UDPBatch
+	c.test.setting.gso = c.config.GSO
+	c.test.setting.gro = c.config.GRO
+
+	if c.config.TOS != "" {
+		c.test.setting.tos, _ = ParseTOS(c.config.TOS) // checked by Validate
+	}
+
+	if c.config.Bytes != 0 || c.config.Blocks != 0 {
+		c.test.duration = 0 // 达到字节数或块数限制时结束
+	}
 	c.test.setting.sndWnd = c.config.SndWnd
 	c.test.setting.rcvWnd = c.config.RcvWnd
 	c.test.setting.readBufSize = c.config.ReadBufSize
@@ -141,6 +185,20 @@ func (c *Client) applyConfig() error {
 	c.test.setting.fastResend = c.config.FastResend
 	c.test.setting.dataShards = c.config.DataShards
 	c.test.setting.parityShards = c.config.ParityShards
+	c.test.setting.mtu = c.config.MTU
+	c.test.setting.ackNoDelay = c.config.AckNoDelay
+	c.test.setting.msgMode = c.config.MessageMode
+	c.test.setting.deadline = uint(c.config.Deadline / time.Second)
+	c.test.setting.crypt = c.config.Crypt
+	c.test.setting.cryptKey = c.config.CryptKey
+	c.test.setting.sessionStats = c.config.SessionStats
+	c.test.setting.affinity = c.config.Affinity
+	c.test.setting.serverAffinity = c.config.ServerAffinity
+	c.test.setting.pinStreams = c.config.PinStreams
+
+	if c.config.GoMaxProcs != 0 {
+		runtime.GOMAXPROCS(int(c.config.GoMaxProcs))
+	}
 
 	// 设置模式
 	c.test.setTestReverse(c.config.Reverse)
@@ -166,6 +224,9 @@ func (c *Client) Run() (*TestResult, error) {
 	// 运行测试
 	if rtn := c.test.RunTest(); rtn < 0 {
 		err := fmt.Errorf("test failed with code: %d", rtn)
+		if c.test.serverError != nil {
+			err = fmt.Errorf("test failed with code: %d: %w", rtn, c.test.serverError)
+		}
 		c.emitEvent(Event{
 			Type:      EventError,
 			Timestamp: time.Now(),
@@ -236,12 +297,19 @@ func (c *Client) reporterCallback(test *IperfTest) {
 
 // collectResults 收集最终结果
 func (c *Client) collectResults() {
+	bytesSent, _ := c.test.sentTotals()
+	bytesReceived, _ := c.test.receivedTotals()
 	c.result = &TestResult{
-		TotalBytes:      c.test.bytesSent + c.test.bytesReceived,
+		TotalBytes:      bytesSent + bytesReceived,
 		Duration:        time.Duration(c.test.duration) * time.Second,
 		IntervalResults: c.collectAllIntervalResults(),
 	}
 
+	// 字节数或块数限制的测试, 以及提前结束的测试 (如 -F 文件读完) 使用实际耗时
+	if elapsed := c.test.elapsed(); c.test.duration == 0 || elapsed < c.result.Duration {
+		c.result.Duration = elapsed
+	}
+
 	// 计算平均带宽
 	if c.result.Duration > 0 {
 		c.result.Bandwidth = float64(c.result.TotalBytes*8) / c.result.Duration.Seconds() / 1000000
@@ -250,14 +318,68 @@ func (c *Client) collectResults() {
 
 // collectIntervalResult 收集间隔结果
 func (c *Client) collectIntervalResult() *IntervalResult {
-	// TODO: 实现间隔结果收集
-	return &IntervalResult{}
+	if len(c.test.streams) == 0 || len(c.test.streams[0].result.interval_results) == 0 {
+		return &IntervalResult{}
+	}
+
+	result := c.intervalResult(len(c.test.streams[0].result.interval_results) - 1)
+
+	return &result
 }
 
 // collectAllIntervalResults 收集所有间隔结果
 func (c *Client) collectAllIntervalResults() []IntervalResult {
-	// TODO: 实现所有间隔结果收集
-	return []IntervalResult{}
+	if len(c.test.streams) == 0 {
+		return []IntervalResult{}
+	}
+
+	results := make([]IntervalResult, 0, len(c.test.streams[0].result.interval_results))
+	for k := range c.test.streams[0].result.interval_results {
+		results = append(results, c.intervalResult(k))
+	}
+
+	return results
+}
+
+// intervalResult 汇总所有数据流的第 k 个间隔，RTT 取各流平均值
+func (c *Client) intervalResult(k int) IntervalResult {
+	var result IntervalResult
+	var sumRTT, cntRTT uint
+
+	for _, sp := range c.test.streams {
+		if k >= len(sp.result.interval_results) {
+			continue
+		}
+
+		rp := &sp.result.interval_results[k]
+
+		if result.StartTime.IsZero() {
+			result.StartTime = rp.interval_start_time
+			result.EndTime = rp.interval_end_time
+		}
+
+		result.Bytes += rp.bytes_transfered
+		result.Retransmits += rp.interval_retrans
+
+		if rp.rtt != 0 {
+			sumRTT += rp.rtt
+			cntRTT++
+		}
+
+		if c.test.tcpStyleReport() {
+			result.TCPInfo = append(result.TCPInfo, rp.tcp_info)
+		}
+	}
+
+	if dur := result.EndTime.Sub(result.StartTime); dur > 0 {
+		result.Bandwidth = float64(result.Bytes*8) / dur.Seconds() / 1000000
+	}
+
+	if cntRTT > 0 {
+		result.RTT = time.Duration(sumRTT/cntRTT) * time.Microsecond
+	}
+
+	return result
 }
 
 // emitEvent 发送事件
@@ -335,9 +457,14 @@ func (s *Server) initTest() error {
 func (s *Server) applyConfig() error {
 	s.test.isServer = true
 	s.test.port = s.config.Port
+	s.test.ipVersion = s.config.IPVersion
+	s.test.bindDev = s.config.BindDevice
+	s.test.listeners = s.config.Listeners
+	_ = s.test.setBindAddr(s.config.BindAddr) // checked by Validate
 	s.test.duration = uint(s.config.Duration.Seconds())
 	s.test.interval = uint(s.config.Interval.Milliseconds())
 	s.test.reverse = s.config.Reverse
+	s.test.bidir = s.config.Bidir
 	s.test.noDelay = s.config.NoDelay
 
 	// 应用设置
@@ -353,6 +480,20 @@ func (s *Server) applyConfig() error {
 	s.test.setting.fastResend = s.config.FastResend
 	s.test.setting.dataShards = s.config.DataShards
 	s.test.setting.parityShards = s.config.ParityShards
+	s.test.setting.mtu = s.config.MTU
+	s.test.setting.ackNoDelay = s.config.AckNoDelay
+	s.test.setting.msgMode = s.config.MessageMode
+	s.test.setting.deadline = uint(s.config.Deadline / time.Second)
+	s.test.setting.cryptKey = s.config.CryptKey
+	s.test.setting.affinity = s.config.Affinity
+	s.test.setting.pinStreams = s.config.PinStreams
+	s.test.verbose = s.config.Verbose
+
+	if s.config.GoMaxProcs != 0 {
+		runtime.GOMAXPROCS(int(s.config.GoMaxProcs))
+	}
+	s.test.setting.file = s.config.File
+	s.test.setting.fileLoop = s.config.FileLoop
 
 	// 设置模式
 	s.test.setTestReverse(s.config.Reverse)
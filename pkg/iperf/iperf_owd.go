@@ -0,0 +1,270 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// one-way delay mode: the first OWD_HEADER_SIZE bytes of every block carry its sequence number and the wall
+// clock time it was sent at. The receiver takes the difference to its own clock, corrected by the offset between
+// the two clocks. The offset is estimated NTP style over the control connection before the streams are created,
+// its error is up to half the round trip of the best sample, more if the control path is asymmetric.
+
+const (
+	OWD_HEADER_SIZE = 16 // block sequence number, send time in unix nano sec
+	OWD_SYNC_ROUNDS = 8  // clock offset samples, the one with the shortest round trip is taken
+)
+
+// one-way delay summary of a receiver stream
+// tips: exchanged with the results, all the members should be visible
+type owd_results struct {
+	Delay rr_latency_results
+	Max   time.Duration
+	IPDV  time.Duration // mean delay variation between consecutive blocks, RFC 3393
+}
+
+// syncClock estimates the offset between the clocks of client and server, the server sends the probes
+func (test *IperfTest) syncClock() int {
+	var err error
+
+	if test.isServer {
+		err = test.measureClockOffset()
+	} else {
+		err = test.answerClockOffset()
+	}
+
+	if err != nil {
+		Log.Errorf("Clock offset exchange failed. err = %v", err)
+
+		return -1
+	}
+
+	Log.Debugf("Clock offset = %v, round trip = %v", test.clockOffset, test.clockRTT)
+
+	return 0
+}
+
+// measureClockOffset sends the probes and tells the client the result. The client answers every probe with the
+// time it received it and the time it answered, the offset of a probe is
+// ((t2 - t1) + (t3 - t4)) / 2 and its round trip (t4 - t1) - (t3 - t2).
+func (test *IperfTest) measureClockOffset() error {
+	buf := make([]byte, 16)
+
+	// tells the client the params are accepted, a refusal sends SERVER_ERROR instead
+	binary.LittleEndian.PutUint32(buf[0:4], IPERF_CLOCK_SYNC)
+	if _, err := test.ctrlConn.Write(buf[:4]); err != nil {
+		return err
+	}
+
+	for i := 0; i < OWD_SYNC_ROUNDS; i++ {
+		t1 := time.Now()
+
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(t1.UnixNano()))
+		if _, err := test.ctrlConn.Write(buf[:8]); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(test.ctrlConn, buf[:16]); err != nil {
+			return err
+		}
+
+		t4 := time.Now()
+		t2 := int64(binary.LittleEndian.Uint64(buf[0:8]))
+		t3 := int64(binary.LittleEndian.Uint64(buf[8:16]))
+
+		rtt := t4.Sub(t1) - time.Duration(t3-t2)
+		offset := time.Duration((t2-t1.UnixNano())+(t3-t4.UnixNano())) / 2
+
+		if i == 0 || rtt < test.clockRTT {
+			test.clockOffset = offset
+			test.clockRTT = rtt
+		}
+	}
+
+	// the client sees the offset the other way round
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(-test.clockOffset))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(test.clockRTT))
+
+	_, err := test.ctrlConn.Write(buf[:16])
+
+	return err
+}
+
+// answerClockOffset answers the probes of the server and reads the result
+func (test *IperfTest) answerClockOffset() error {
+	buf := make([]byte, 16)
+
+	if _, err := io.ReadFull(test.ctrlConn, buf[:4]); err != nil {
+		return err
+	}
+
+	switch state := binary.LittleEndian.Uint32(buf[0:4]); state {
+	case IPERF_CLOCK_SYNC:
+	case SERVER_ERROR:
+		test.serverError = test.readServerError()
+
+		return test.serverError
+	default:
+		return fmt.Errorf("state %v instead of the clock probes", state)
+	}
+
+	for i := 0; i < OWD_SYNC_ROUNDS; i++ {
+		if _, err := io.ReadFull(test.ctrlConn, buf[:8]); err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(time.Now().UnixNano()))
+		binary.LittleEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+
+		if _, err := test.ctrlConn.Write(buf[:16]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.ReadFull(test.ctrlConn, buf[:16]); err != nil {
+		return err
+	}
+
+	test.clockOffset = time.Duration(binary.LittleEndian.Uint64(buf[0:8]))
+	test.clockRTT = time.Duration(binary.LittleEndian.Uint64(buf[8:16]))
+
+	return nil
+}
+
+// stampBlock writes the sequence number and the send time to the block, right before it is sent
+func (sp *iperfStream) stampBlock(buf []byte) {
+	ps := sp.payload
+
+	binary.LittleEndian.PutUint64(buf[0:8], ps.owdSeq)
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+
+	ps.owdSeq++
+}
+
+// owdBlock accounts the one-way delay of a received block. It returns the sequence number of the block, the time
+// it was sent and received at in the local clock.
+func (sp *iperfStream) owdBlock(header []byte) (uint64, int64, int64) {
+	ps := sp.payload
+
+	seq := binary.LittleEndian.Uint64(header[0:8])
+	recv := time.Now().UnixNano()
+
+	// clockOffset is the peer clock minus ours, the send time is taken back to our clock
+	sent := int64(binary.LittleEndian.Uint64(header[8:16])) - int64(sp.test.clockOffset)
+	delay := time.Duration(recv - sent)
+
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	rp := sp.result
+	rp.owd_interval_hist.add(delay)
+
+	if ps.owdReceived && seq == ps.owdLastSeq+1 {
+		variation := delay - ps.owdLastDelay
+		if variation < 0 {
+			variation = -variation
+		}
+
+		rp.owd_ipdv_sum_this_interval += variation
+		rp.owd_ipdv_cnt_this_interval++
+	}
+
+	ps.owdReceived = true
+	ps.owdLastSeq = seq
+	ps.owdLastDelay = delay
+
+	return seq, sent, recv
+}
+
+// owdInterval moves the delays of the finished interval into its results
+func (sp *iperfStream) owdInterval(tempResult *iperf_interval_results) {
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	rp := sp.result
+
+	tempResult.owd_hist = rp.owd_interval_hist
+	tempResult.owd_ipdv_sum = rp.owd_ipdv_sum_this_interval
+	tempResult.owd_ipdv_cnt = rp.owd_ipdv_cnt_this_interval
+
+	rp.owd_interval_hist = latency_histogram{}
+	rp.owd_ipdv_sum_this_interval = 0
+	rp.owd_ipdv_cnt_this_interval = 0
+}
+
+// owdResults returns the one-way delay summary of the stream, omitted intervals excluded. The sender side has no
+// samples of its own, it shows the summary the receiver reported in the results exchange.
+func (sp *iperfStream) owdResults() owd_results {
+	if sp.role == SENDER_STREAM {
+		return sp.result.owd
+	}
+
+	var h latency_histogram
+	var ipdvSum time.Duration
+	var ipdvCnt uint64
+
+	for i := range sp.result.interval_results {
+		if rp := &sp.result.interval_results[i]; rp.omitted == 0 {
+			h.merge(&rp.owd_hist)
+			ipdvSum += rp.owd_ipdv_sum
+			ipdvCnt += rp.owd_ipdv_cnt
+		}
+	}
+
+	return owdSummary(&h, ipdvSum, ipdvCnt)
+}
+
+func owdSummary(h *latency_histogram, ipdvSum time.Duration, ipdvCnt uint64) owd_results {
+	r := owd_results{Delay: h.results(), Max: h.max}
+
+	if ipdvCnt > 0 {
+		r.IPDV = ipdvSum / time.Duration(ipdvCnt)
+	}
+
+	return r
+}
+
+// printOWD prints the one-way delays of a stream next to its interval or summary line
+func (test *IperfTest) printOWD(i int, sp *iperfStream, r owd_results, mark string) {
+	if !test.setting.owd || r.Delay.Samples == 0 {
+		return
+	}
+
+	ms := func(d time.Duration) float64 {
+		return float64(d.Nanoseconds()) / MS_TO_NS
+	}
+
+	fmt.Printf(OWD_REPORT, test.streamLabel(i, sp), r.Delay.Samples, ms(r.Delay.Min), ms(r.Delay.Mean), ms(r.Delay.P50),
+		ms(r.Delay.P90), ms(r.Delay.P99), ms(r.Max), ms(r.IPDV), mark)
+}
+
+// printClockOffset prints the clock offset the delays were corrected with and how far they can be trusted
+func (test *IperfTest) printClockOffset() {
+	if !test.setting.owd {
+		return
+	}
+
+	uncertainty := test.clockRTT / 2
+
+	fmt.Printf(OWD_CLOCK_REPORT, float64(test.clockOffset.Nanoseconds())/MS_TO_NS,
+		float64(uncertainty.Nanoseconds())/MS_TO_NS, OWD_SYNC_ROUNDS)
+
+	var minDelay time.Duration
+	var measured bool
+
+	for _, sp := range test.streams {
+		r := sp.owdResults()
+		if r.Delay.Samples > 0 && (!measured || r.Delay.Min < minDelay) {
+			minDelay = r.Delay.Min
+			measured = true
+		}
+	}
+
+	if measured && minDelay < 0 {
+		fmt.Printf(OWD_CAVEAT_NEGATIVE)
+	} else if measured && minDelay < uncertainty {
+		fmt.Printf(OWD_CAVEAT_UNCERTAIN)
+	}
+}
@@ -0,0 +1,104 @@
+package iperf
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOWDSummary(t *testing.T) {
+	ms := time.Millisecond
+
+	cases := []struct {
+		name    string
+		delays  []time.Duration
+		ipdvSum time.Duration
+		ipdvCnt uint64
+		want    owd_results // Delay.P50 and up are checked to their bucket
+	}{
+		{name: "empty", want: owd_results{}},
+		{name: "one block", delays: []time.Duration{2 * ms},
+			want: owd_results{Delay: rr_latency_results{Samples: 1, Min: 2 * ms, Mean: 2 * ms, P50: 2 * ms}, Max: 2 * ms}},
+		{name: "several blocks", delays: []time.Duration{1 * ms, 2 * ms, 3 * ms, 6 * ms}, ipdvSum: 6 * ms, ipdvCnt: 3,
+			want: owd_results{Delay: rr_latency_results{Samples: 4, Min: 1 * ms, Mean: 3 * ms, P50: 2 * ms}, Max: 6 * ms,
+				IPDV: 2 * ms}},
+		{name: "clock offset", delays: []time.Duration{-3 * ms, -1 * ms, 1 * ms}, ipdvSum: 4 * ms, ipdvCnt: 2,
+			want: owd_results{Delay: rr_latency_results{Samples: 3, Min: -3 * ms, Mean: -1 * ms, P50: -1 * ms}, Max: 1 * ms,
+				IPDV: 2 * ms}},
+	}
+
+	for _, c := range cases {
+		var h latency_histogram
+		for _, d := range c.delays {
+			h.add(d)
+		}
+
+		got := owdSummary(&h, c.ipdvSum, c.ipdvCnt)
+
+		if d := got.Delay.P50 - c.want.Delay.P50; d.Abs() > c.want.Delay.P50.Abs()/HIST_SUB_BUCKETS {
+			t.Errorf("%v: P50 = %v, want %v", c.name, got.Delay.P50, c.want.Delay.P50)
+		}
+
+		if got.Delay.Samples != c.want.Delay.Samples || got.Delay.Min != c.want.Delay.Min ||
+			got.Delay.Mean != c.want.Delay.Mean || got.Max != c.want.Max || got.IPDV != c.want.IPDV {
+			t.Errorf("%v: owdSummary = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestOWDResults(t *testing.T) {
+	interval := func(omitted uint, delays ...time.Duration) iperf_interval_results {
+		rp := iperf_interval_results{omitted: omitted, owd_ipdv_sum: time.Duration(len(delays)) * time.Millisecond,
+			owd_ipdv_cnt: uint64(len(delays))}
+		for _, d := range delays {
+			rp.owd_hist.add(d)
+		}
+
+		return rp
+	}
+
+	// the omitted interval is left out of the summary
+	sp := &iperfStream{role: RECEIVER_STREAM, result: &iperf_stream_results{interval_results: []iperf_interval_results{
+		interval(1, 50*time.Millisecond),
+		interval(0, 2*time.Millisecond, 4*time.Millisecond),
+		interval(0, 6*time.Millisecond),
+	}}}
+
+	r := sp.owdResults()
+	if r.Delay.Samples != 3 || r.Delay.Min != 2*time.Millisecond || r.Delay.Mean != 4*time.Millisecond ||
+		r.Max != 6*time.Millisecond || r.IPDV != time.Millisecond {
+		t.Errorf("owdResults = %+v", r)
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	client, server := NewIperfTest(), NewIperfTest()
+	server.isServer = true
+
+	client.ctrlConn, server.ctrlConn = net.Pipe()
+	defer client.ctrlConn.Close()
+	defer server.ctrlConn.Close()
+
+	done := make(chan int, 1)
+	go func() { done <- server.syncClock() }()
+
+	if client.syncClock() < 0 || <-done < 0 {
+		t.Fatalf("syncClock failed")
+	}
+
+	// both ends share the clock, the offset is within the round trip
+	if client.clockOffset != -server.clockOffset || client.clockRTT != server.clockRTT ||
+		client.clockOffset > server.clockRTT || -client.clockOffset > server.clockRTT {
+		t.Errorf("offset %v, round trip %v, server offset %v", client.clockOffset, client.clockRTT, server.clockOffset)
+	}
+
+	// a server refusing the params answers with its error instead of the probes
+	go server.sendServerError(errors.New("crypt key of the client does not match"))
+
+	if client.syncClock() == 0 || client.serverError == nil ||
+		!strings.Contains(client.serverError.Error(), "crypt key") {
+		t.Errorf("syncClock after a refusal, server error = %v", client.serverError)
+	}
+}
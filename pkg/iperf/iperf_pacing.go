@@ -0,0 +1,75 @@
+package iperf
+
+import (
+	"fmt"
+	"net"
+)
+
+// kernel pacing: -fq-rate sets SO_MAX_PACING_RATE of the sender streams, the fq qdisc spreads the packets of a
+// udp or tcp socket over time to stay below it, tcp paces itself without fq as well. Unlike the throttling of -b,
+// which stops and resumes the sender, the packets leave evenly spaced. Both can be used together. mptcp sockets do
+// not take the option.
+
+// setPacing sets the -fq-rate limit of the sender streams
+func (test *IperfTest) setPacing() int {
+	if test.setting.fqRate == 0 {
+		return 0
+	}
+
+	for i, sp := range test.streams {
+		if sp.role != SENDER_STREAM {
+			continue
+		}
+
+		err := controlFd(sp.conn, func(fd int) error {
+			return setMaxPacingRate(uintptr(fd), test.setting.fqRate/8)
+		})
+		if err != nil {
+			Log.Errorf("Stream %v set -fq-rate failed. err = %v", i, err)
+
+			return -1
+		}
+	}
+
+	return 0
+}
+
+// savePacing records the pacing limit of a udp sender stream, tcp streams take it from TCP_INFO together with the
+// rate they pace at
+func (sp *iperfStream) savePacing(rp *iperf_interval_results) {
+	if sp.test.setting.fqRate == 0 || sp.role != SENDER_STREAM {
+		return
+	}
+
+	if _, ok := sp.conn.(*net.UDPConn); !ok {
+		return
+	}
+
+	rate, err := maxPacingRate(sp.conn)
+	if err != nil {
+		Log.Debugf("Read SO_MAX_PACING_RATE failed. err = %v", err)
+
+		return
+	}
+
+	rp.max_pacing_rate = rate
+}
+
+// printPacing prints the pacing limit the kernel applies to a sender stream next to -fq-rate, and for tcp the
+// rate it paced at in the interval
+func (test *IperfTest) printPacing(i int, sp *iperfStream, rp *iperf_interval_results, mark string) {
+	if test.setting.fqRate == 0 || sp.role != SENDER_STREAM {
+		return
+	}
+
+	mbps := func(bytesPerSec uint64) float64 {
+		return float64(bytesPerSec) * 8 / MB_TO_B
+	}
+
+	paced := ""
+	if test.tcpStyleReport() {
+		paced = fmt.Sprintf("\tpacing_rate %5.2f Mb/s", mbps(rp.pacing_rate))
+	}
+
+	fmt.Printf(PACING_REPORT, test.streamLabel(i, sp), mbps(rp.max_pacing_rate), mbps(test.setting.fqRate/8), paced, mark)
+}
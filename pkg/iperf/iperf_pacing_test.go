@@ -0,0 +1,90 @@
+package iperf
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPacing(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_MAX_PACING_RATE is linux only")
+	}
+
+	const fqRate = 80 * 1000 * 1000 // bits/s
+
+	for _, name := range []string{TCP_NAME, UDP_NAME} {
+		t.Run(name, func(t *testing.T) {
+			client := NewIperfTest()
+			client.setting.fqRate = fqRate
+
+			var sender, receiver net.Conn
+
+			if name == TCP_NAME {
+				sender, receiver = tcpPair(t, client, NewIperfTest())
+				go io.Copy(io.Discard, receiver)
+			} else {
+				client.Init()
+				client.setProtocol(UDP_NAME)
+
+				peer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer peer.Close()
+
+				conn, err := net.DialUDP("udp4", nil, peer.LocalAddr().(*net.UDPAddr))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer conn.Close()
+
+				sender, receiver = conn, peer
+			}
+
+			// only the sender streams are paced
+			sp := client.newStream(sender, SENDER_STREAM)
+			client.streams = []*iperfStream{sp, client.newStream(receiver, RECEIVER_STREAM)}
+
+			if rtn := client.proto.Init(client); rtn < 0 {
+				t.Fatalf("Init() = %v", rtn)
+			}
+
+			if rate, err := maxPacingRate(sender); err != nil || rate != fqRate/8 {
+				t.Errorf("sender SO_MAX_PACING_RATE = %v, %v, want %v", rate, err, fqRate/8)
+			}
+
+			if rate, err := maxPacingRate(receiver); err != nil || rate != ^uint64(0) {
+				t.Errorf("receiver SO_MAX_PACING_RATE = %v, %v, want unlimited", rate, err)
+			}
+
+			if _, err := sender.Write(make([]byte, 1024)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the value read back is what the interval reports and prints
+			iperfStatsCallback(client)
+
+			rp := sp.result.interval_results[0]
+			if rp.max_pacing_rate != fqRate/8 {
+				t.Errorf("interval max_pacing_rate = %v, want %v", rp.max_pacing_rate, fqRate/8)
+			}
+
+			if name == TCP_NAME && (rp.pacing_rate == 0 || rp.pacing_rate > fqRate/8) {
+				t.Errorf("interval pacing_rate = %v, want at most %v", rp.pacing_rate, fqRate/8)
+			}
+
+			mbps := float64(fqRate) / MB_TO_B
+			want := fmt.Sprintf("max %5.2f Mb/s (requested %5.2f)", mbps, mbps)
+
+			if out := captureStdout(t, func() { client.printPacing(0, sp, &rp, "") }); !strings.Contains(out, want) {
+				t.Errorf("printed %q, want %q", out, want)
+			}
+		})
+	}
+}
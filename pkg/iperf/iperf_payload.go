@@ -0,0 +1,320 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// payload patterns of the blocks a sender stream sends. With verify the first VERIFY_HEADER_SIZE bytes of every
+// block, after the one-way delay header if any, carry its sequence number and the crc32 of the rest. The receiver
+// checks them and compares the payload with the expected pattern.
+
+const (
+	PATTERN_DEFAULT = "default" // "hello world!" followed by zeros
+	PATTERN_RANDOM  = "random"  // incompressible, different in every block
+	PATTERN_REPEAT  = "repeat"  // the bytes 0x00 to 0xff over and over
+	PATTERN_ZEROS   = "zeros"
+	PATTERN_SEQ     = "seq" // pseudo random sequence from -seed, the receiver can compute it
+
+	VERIFY_HEADER_SIZE = 16 // block sequence number, crc32, reserved
+)
+
+// PatternList holds the payload patterns for -pattern
+var PatternList = []string{PATTERN_DEFAULT, PATTERN_RANDOM, PATTERN_REPEAT, PATTERN_ZEROS, PATTERN_SEQ}
+
+// IsPatternValid reports whether name is one of PatternList
+func IsPatternValid(name string) bool {
+	for _, p := range PatternList {
+		if p == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitMix64 is a small and fast pseudo random generator, the same seed gives the same sequence on both ends
+type splitMix64 uint64
+
+func (s *splitMix64) next() uint64 {
+	*s += 0x9e3779b97f4a7c15
+
+	z := uint64(*s)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) fill(buf []byte) {
+	for len(buf) >= 8 {
+		binary.LittleEndian.PutUint64(buf, s.next())
+		buf = buf[8:]
+	}
+
+	if len(buf) > 0 {
+		var tail [8]byte
+
+		binary.LittleEndian.PutUint64(tail[:], s.next())
+		copy(buf, tail[:])
+	}
+}
+
+// verify_results counts the integrity errors a receiver stream found, in bytes
+type verify_results struct {
+	blocks    uint64
+	corrupted uint64
+	missing   uint64
+	reordered uint64
+}
+
+// payloadState is the per stream state of the payload generation and verification
+type payloadState struct {
+	random   splitMix64 // PATTERN_RANDOM source, not reproducible
+	blockSeq uint64     // sequence number of the next block sent
+	expected []byte     // expected payload of a received block
+	block    []byte     // reassembles blocks from a byte stream
+	blockLen int
+	nextSeq  uint64 // next block sequence number expected
+	blockEnd int    // size of the block being reassembled, as far as known
+	burst    burstState
+	/* one-way delay, see iperf_owd.go */
+	owdSeq       uint64 // sequence number of the next block stamped
+	owdReceived  bool
+	owdLastSeq   uint64
+	owdLastDelay time.Duration
+}
+
+// fillPattern writes the payload of block seq to buf
+func (test *IperfTest) fillPattern(ps *payloadState, buf []byte, seq uint64) {
+	switch test.setting.pattern {
+	case PATTERN_RANDOM:
+		ps.random.fill(buf)
+	case PATTERN_REPEAT:
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+	case PATTERN_SEQ:
+		s := splitMix64(test.setting.seed ^ (seq * 0x9e3779b97f4a7c15))
+		s.fill(buf)
+	default:
+		for i := range buf {
+			buf[i] = 0
+		}
+
+		if test.setting.pattern != PATTERN_ZEROS {
+			copy(buf, "hello world!")
+		}
+	}
+}
+
+// payloadOffset returns where the pattern starts in a block, after the one-way delay header
+func (test *IperfTest) payloadOffset() int {
+	if test.setting.profile != "" {
+		return OWD_HEADER_SIZE + BURST_HEADER_SIZE
+	} else if test.setting.owd {
+		return OWD_HEADER_SIZE
+	}
+
+	return 0
+}
+
+// patternPerBlock reports whether every block must be generated on its own, or one buffer can be sent again
+func (test *IperfTest) patternPerBlock() bool {
+	return test.setting.verify || test.setting.pattern == PATTERN_RANDOM || test.setting.pattern == PATTERN_SEQ
+}
+
+// initPayload fills the buffer of a new stream
+func (sp *iperfStream) initPayload() {
+	test := sp.test
+
+	sp.payload = new(payloadState)
+	sp.payload.random = splitMix64(time.Now().UnixNano())
+
+	test.fillPattern(sp.payload, sp.buffer, 0)
+
+	if sp.role != RECEIVER_STREAM {
+		return
+	}
+
+	if test.setting.verify || test.setting.owd {
+		sp.payload.block = make([]byte, len(sp.buffer))
+	}
+
+	if test.setting.verify {
+		sp.payload.expected = make([]byte, len(sp.buffer)-test.payloadOffset()-VERIFY_HEADER_SIZE)
+	}
+}
+
+// nextBlock generates the next block to send
+func (sp *iperfStream) nextBlock(buf []byte) {
+	test := sp.test
+	ps := sp.payload
+
+	buf = buf[test.payloadOffset():]
+
+	if !test.setting.verify {
+		test.fillPattern(ps, buf, ps.blockSeq)
+		ps.blockSeq++
+
+		return
+	}
+
+	payload := buf[VERIFY_HEADER_SIZE:]
+	test.fillPattern(ps, payload, ps.blockSeq)
+
+	binary.LittleEndian.PutUint64(buf[0:8], ps.blockSeq)
+	binary.LittleEndian.PutUint32(buf[8:12], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(buf[12:16], 0)
+
+	ps.blockSeq++
+}
+
+// receiveData checks received data. Datagram protocols deliver one block per read, on stream protocols the
+// blocks are reassembled first. Without verify only the headers of a block are kept. The packets of a traffic
+// profile differ in size, their size is taken from the header.
+func (sp *iperfStream) receiveData(data []byte) {
+	test := sp.test
+	ps := sp.payload
+
+	if test.proto.Name() == UDP_NAME {
+		sp.receiveBlock(data)
+
+		return
+	}
+
+	keep := len(ps.block)
+	if !test.setting.verify {
+		keep = test.payloadOffset()
+	}
+
+	for len(data) > 0 {
+		if ps.blockEnd == 0 {
+			ps.blockEnd = len(ps.block)
+			if test.setting.profile != "" {
+				ps.blockEnd = test.payloadOffset()
+			}
+		}
+
+		n := minInt(ps.blockEnd-ps.blockLen, len(data))
+
+		if ps.blockLen < keep {
+			copy(ps.block[ps.blockLen:keep], data[:n])
+		}
+
+		ps.blockLen += n
+		data = data[n:]
+
+		if ps.blockLen < ps.blockEnd {
+			continue
+		}
+
+		if test.setting.profile != "" && ps.blockEnd == test.payloadOffset() {
+			// the header is complete, the rest of the packet follows
+			if size := minInt(burstSize(ps.block), len(ps.block)); size > ps.blockEnd {
+				ps.blockEnd = size
+
+				continue
+			}
+		}
+
+		sp.receiveBlock(ps.block[:ps.blockLen])
+		ps.blockLen = 0
+		ps.blockEnd = 0
+	}
+}
+
+func (sp *iperfStream) receiveBlock(block []byte) {
+	test := sp.test
+
+	if test.setting.owd {
+		if len(block) < OWD_HEADER_SIZE {
+			// too short to carry a send time, verify counts it as corrupted
+			if test.setting.verify {
+				sp.verifyBlock(block)
+			}
+
+			return
+		}
+
+		seq, sent, recv := sp.owdBlock(block[:OWD_HEADER_SIZE])
+		block = block[OWD_HEADER_SIZE:]
+
+		if test.setting.profile != "" {
+			if len(block) < BURST_HEADER_SIZE {
+				return
+			}
+
+			sp.burstBlock(block[:BURST_HEADER_SIZE], seq, sent, recv)
+			block = block[BURST_HEADER_SIZE:]
+		}
+	}
+
+	if test.setting.verify {
+		sp.verifyBlock(block)
+	}
+}
+
+func (sp *iperfStream) verifyBlock(block []byte) {
+	test := sp.test
+	ps := sp.payload
+	vr := &sp.result.verify
+
+	vr.blocks++
+
+	if len(block) != len(ps.expected)+VERIFY_HEADER_SIZE {
+		// a datagram of the wrong size, count it as corrupted
+		vr.corrupted += uint64(len(block))
+
+		return
+	}
+
+	seq := binary.LittleEndian.Uint64(block[0:8])
+	crc := binary.LittleEndian.Uint32(block[8:12])
+	payload := block[VERIFY_HEADER_SIZE:]
+	size := uint64(len(ps.block))
+
+	switch {
+	case seq == ps.nextSeq:
+		ps.nextSeq++
+	case seq > ps.nextSeq:
+		vr.missing += (seq - ps.nextSeq) * size
+		ps.nextSeq = seq + 1
+	default:
+		// arrived after a later block, it was counted missing then
+		vr.reordered += size
+		if vr.missing >= size {
+			vr.missing -= size
+		}
+	}
+
+	if test.setting.pattern == PATTERN_RANDOM {
+		// not reproducible, only the checksum tells
+		if crc32.ChecksumIEEE(payload) != crc {
+			vr.corrupted += uint64(len(payload))
+		}
+
+		return
+	}
+
+	test.fillPattern(ps, ps.expected, seq)
+
+	for i := range payload {
+		if payload[i] != ps.expected[i] {
+			vr.corrupted++
+		}
+	}
+}
+
+// printVerifyResult prints the integrity errors of a stream next to its result
+func (test *IperfTest) printVerifyResult(i int, sp *iperfStream) {
+	if !test.setting.verify {
+		return
+	}
+
+	vr := sp.result.verify
+
+	fmt.Printf(VERIFY_REPORT, test.streamLabel(i, sp), vr.blocks, vr.corrupted, vr.missing, vr.reordered)
+}
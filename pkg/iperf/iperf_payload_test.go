@@ -0,0 +1,100 @@
+package iperf
+
+import (
+	"testing"
+)
+
+func TestSplitMix64(t *testing.T) {
+	// the reference outputs of splitmix64 from the seed 0
+	s := splitMix64(0)
+	for _, want := range []uint64{0xe220a8397b1dcdaf, 0x6e789e6aa1b965f4, 0x06c45d188009454f} {
+		if got := s.next(); got != want {
+			t.Errorf("next() = %#x, want %#x", got, want)
+		}
+	}
+
+	// fill takes a value for every 8 bytes, the tail gets a part of the next one
+	a, b := splitMix64(42), splitMix64(42)
+	buf := make([]byte, 12)
+	a.fill(buf)
+
+	want := make([]byte, 16)
+	b.fill(want)
+
+	if string(buf) != string(want[:12]) {
+		t.Errorf("fill(12 bytes) = %x, want %x", buf, want[:12])
+	}
+
+	if a.next() != b.next() {
+		t.Errorf("fill(12 bytes) did not take two values")
+	}
+}
+
+func TestVerifyBlock(t *testing.T) {
+	const blk = 64
+
+	cases := []struct {
+		name    string
+		pattern string
+		order   []int          // sequence numbers of the blocks received
+		damage  func(b []byte) // applied to the second block received
+		want    verify_results
+	}{
+		{name: "in order", pattern: PATTERN_SEQ, order: []int{0, 1, 2}, want: verify_results{blocks: 3}},
+		{name: "lost", pattern: PATTERN_SEQ, order: []int{0, 2, 3}, want: verify_results{blocks: 3, missing: blk}},
+		{name: "reordered", pattern: PATTERN_SEQ, order: []int{0, 2, 1}, want: verify_results{blocks: 3, reordered: blk}},
+		{name: "corrupted", pattern: PATTERN_REPEAT, order: []int{0, 1, 2},
+			damage: func(b []byte) { b[VERIFY_HEADER_SIZE+3] ^= 0xff; b[blk-1] ^= 0x01 },
+			want:   verify_results{blocks: 3, corrupted: 2}},
+		{name: "random corrupted", pattern: PATTERN_RANDOM, order: []int{0, 1, 2},
+			damage: func(b []byte) { b[blk-1] ^= 0x01 },
+			want:   verify_results{blocks: 3, corrupted: blk - VERIFY_HEADER_SIZE}},
+		{name: "random intact", pattern: PATTERN_RANDOM, order: []int{0, 1, 2}, want: verify_results{blocks: 3}},
+	}
+
+	for _, c := range cases {
+		test := NewIperfTest()
+		test.setting.verify = true
+		test.setting.pattern = c.pattern
+		test.setting.seed = 7
+
+		snd := &iperfStream{test: test, role: SENDER_STREAM, buffer: make([]byte, blk)}
+		snd.initPayload()
+
+		rcv := &iperfStream{test: test, role: RECEIVER_STREAM, buffer: make([]byte, blk),
+			result: new(iperf_stream_results)}
+		rcv.initPayload()
+
+		var blocks [][]byte
+		for i := 0; i < 4; i++ {
+			b := make([]byte, blk)
+			snd.nextBlock(b)
+			blocks = append(blocks, b)
+		}
+
+		for i, seq := range c.order {
+			b := blocks[seq]
+			if i == 1 && c.damage != nil {
+				c.damage(b)
+			}
+
+			rcv.verifyBlock(b)
+		}
+
+		if got := rcv.result.verify; got != c.want {
+			t.Errorf("%v: verify = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	// a block of the wrong size counts as corrupted as a whole
+	test := NewIperfTest()
+	test.setting.verify = true
+
+	rcv := &iperfStream{test: test, role: RECEIVER_STREAM, buffer: make([]byte, blk), result: new(iperf_stream_results)}
+	rcv.initPayload()
+	rcv.verifyBlock(make([]byte, blk/2))
+
+	if got, want := rcv.result.verify, (verify_results{blocks: 1, corrupted: blk / 2}); got != want {
+		t.Errorf("short block: verify = %+v, want %+v", got, want)
+	}
+}
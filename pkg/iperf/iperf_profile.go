@@ -0,0 +1,753 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traffic profiles: the sender streams send in bursts shaped like an application instead of a constant stream.
+// Every packet carries the one-way delay header followed by BURST_HEADER_SIZE bytes with its burst number, its
+// index in the burst, the packets in the burst and its own size, so stream protocols can split the packets again.
+// The receiver reports per burst how long it took from the first packet sent to the last one received and how
+// many of its packets were lost.
+
+const (
+	PROFILE_ONOFF  = "onoff"  // on=1s,off=1s: blocks flat out, or at -b, during on, nothing during off
+	PROFILE_VOIP   = "voip"   // codec=g711|g729|opus,ptime=20ms: one small packet per ptime
+	PROFILE_VIDEO  = "video"  // rate=4M,fps=30,gop=30,iframe=8: one burst per frame, a large I-frame per GOP
+	PROFILE_CUSTOM = "custom" // size=<dist>,gap=<dist>: one packet per burst, sizes and gaps drawn at random
+
+	BURST_HEADER_SIZE = 16 // burst number, index in the burst, packets in the burst, packet size
+)
+
+// ProfileList holds the traffic profiles for -profile
+var ProfileList = []string{PROFILE_ONOFF, PROFILE_VOIP, PROFILE_VIDEO, PROFILE_CUSTOM}
+
+// voice codecs of the voip profile, bit per second
+var voipCodecs = map[string]uint{
+	"g711": 64000,
+	"g729": 8000,
+	"opus": 32000,
+}
+
+// burst is what a sender stream sends at once
+type burst struct {
+	sizes  []int         // packet sizes, nil to send blocks flat out for the length of the burst
+	length time.Duration // the packets are paced over the length, sent back to back if 0
+	gap    time.Duration // from the start of the burst to the start of the next one
+}
+
+// trafficProfile generates the bursts of a sender stream
+type trafficProfile interface {
+	next() burst
+	String() string
+}
+
+// newTrafficProfile parses a -profile spec, name[,key=value...]. rate is the -b rate, blksize the largest packet.
+func newTrafficProfile(spec string, rate uint, blksize int, r *rand.Rand) (trafficProfile, error) {
+	name, params, err := splitProfile(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if rate != 0 && name != PROFILE_ONOFF {
+		return nil, fmt.Errorf("the bandwidth limit only sets the on rate of the %v profile", PROFILE_ONOFF)
+	}
+
+	var p trafficProfile
+
+	switch name {
+	case PROFILE_ONOFF:
+		o := &onoffProfile{on: time.Second, off: time.Second, rate: rate, blksize: blksize}
+		err = params.each(map[string]func(string) error{
+			"on":  durationParam(&o.on),
+			"off": durationParam(&o.off),
+		})
+		p = o
+	case PROFILE_VOIP:
+		v := &voipProfile{codec: "g711", ptime: 20 * time.Millisecond}
+		err = params.each(map[string]func(string) error{
+			"codec": func(s string) error {
+				if _, ok := voipCodecs[s]; !ok {
+					return fmt.Errorf("unknown codec %v", s)
+				}
+				v.codec = s
+
+				return nil
+			},
+			"ptime": durationParam(&v.ptime),
+		})
+		v.size = int(float64(voipCodecs[v.codec]) / 8 * v.ptime.Seconds())
+		p = v
+	case PROFILE_VIDEO:
+		v := &videoProfile{rate: 4000000, fps: 30, gop: 30, iframe: 8, blksize: blksize}
+		err = params.each(map[string]func(string) error{
+			"rate": func(s string) error {
+				n, err := parseBitRate(s)
+				v.rate = n
+
+				return err
+			},
+			"fps":    intParam(&v.fps),
+			"gop":    intParam(&v.gop),
+			"iframe": floatParam(&v.iframe),
+		})
+		p = v
+	case PROFILE_CUSTOM:
+		c := &customProfile{blksize: blksize, r: r}
+		c.size, _ = parseDistribution("const("+strconv.Itoa(blksize)+")", parseSizeValue)
+		c.gap, _ = parseDistribution("const(10ms)", parseDurationValue)
+		err = params.each(map[string]func(string) error{
+			"size": distributionParam(&c.size, parseSizeValue),
+			"gap":  distributionParam(&c.gap, parseDurationValue),
+		})
+		p = c
+	default:
+		return nil, fmt.Errorf("unknown traffic profile %v, use one of %v", name, strings.Join(ProfileList, ", "))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("traffic profile %v: %w", name, err)
+	}
+
+	return p, nil
+}
+
+type profileParams map[string]string
+
+// splitProfile splits name,key=value,... Commas inside parentheses belong to the value.
+func splitProfile(spec string) (string, profileParams, error) {
+	var fields []string
+
+	depth, start := 0, 0
+	for i, c := range spec {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				fields = append(fields, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	fields = append(fields, spec[start:])
+
+	params := make(profileParams)
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", nil, fmt.Errorf("traffic profile parameter %q is not key=value", f)
+		}
+
+		params[kv[0]] = kv[1]
+	}
+
+	return fields[0], params, nil
+}
+
+// each hands every parameter to its setter, unknown keys are an error
+func (p profileParams) each(setters map[string]func(string) error) error {
+	for k, v := range p {
+		set, ok := setters[k]
+		if !ok {
+			return fmt.Errorf("unknown parameter %v", k)
+		}
+
+		if err := set(v); err != nil {
+			return fmt.Errorf("parameter %v: %w", k, err)
+		}
+	}
+
+	return nil
+}
+
+func durationParam(d *time.Duration) func(string) error {
+	return func(s string) error {
+		v, err := time.ParseDuration(s)
+		if err == nil && v <= 0 {
+			err = fmt.Errorf("%v is not positive", s)
+		}
+		*d = v
+
+		return err
+	}
+}
+
+func intParam(n *int) func(string) error {
+	return func(s string) error {
+		v, err := strconv.Atoi(s)
+		if err == nil && v <= 0 {
+			err = fmt.Errorf("%v is not positive", s)
+		}
+		*n = v
+
+		return err
+	}
+}
+
+func floatParam(f *float64) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseFloat(s, 64)
+		if err == nil && v <= 0 {
+			err = fmt.Errorf("%v is not positive", s)
+		}
+		*f = v
+
+		return err
+	}
+}
+
+func distributionParam(d *distribution, value func(string) (float64, error)) func(string) error {
+	return func(s string) error {
+		v, err := parseDistribution(s, value)
+		*d = v
+
+		return err
+	}
+}
+
+// parseBitRate parses a rate in bit per second with an optional k, M or G suffix, in powers of 1000
+func parseBitRate(s string) (uint, error) {
+	mult := 1.0
+
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1e3
+	case strings.HasSuffix(s, "m"), strings.HasSuffix(s, "M"):
+		mult = 1e6
+	case strings.HasSuffix(s, "g"), strings.HasSuffix(s, "G"):
+		mult = 1e9
+	}
+
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err == nil && v <= 0 {
+		err = fmt.Errorf("%v is not positive", s)
+	}
+
+	return uint(v * mult), err
+}
+
+func parseSizeValue(s string) (float64, error) {
+	n, err := ParseSize(s)
+
+	return float64(n), err
+}
+
+func parseDurationValue(s string) (float64, error) {
+	d, err := time.ParseDuration(s)
+
+	return float64(d), err
+}
+
+// distribution draws packet sizes in bytes or gaps in nano sec: const(v), uniform(min,max), exp(mean) or
+// normal(mean,stddev). Values take the size suffixes or the time units of their parameter.
+type distribution struct {
+	kind string
+	a, b float64
+	spec string
+}
+
+func parseDistribution(s string, value func(string) (float64, error)) (distribution, error) {
+	d := distribution{spec: s}
+
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return d, fmt.Errorf("distribution %q is not kind(values)", s)
+	}
+
+	d.kind = s[:open]
+	args := strings.Split(s[open+1:len(s)-1], ",")
+
+	want := 1
+	if d.kind == "uniform" || d.kind == "normal" {
+		want = 2
+	} else if d.kind != "const" && d.kind != "exp" {
+		return d, fmt.Errorf("unknown distribution %v, use const, uniform, exp or normal", d.kind)
+	}
+
+	if len(args) != want {
+		return d, fmt.Errorf("distribution %v takes %v values", d.kind, want)
+	}
+
+	var err error
+
+	if d.a, err = value(strings.TrimSpace(args[0])); err != nil {
+		return d, err
+	}
+
+	if want == 2 {
+		if d.b, err = value(strings.TrimSpace(args[1])); err != nil {
+			return d, err
+		}
+	}
+
+	if d.kind == "uniform" && d.b < d.a {
+		return d, fmt.Errorf("uniform distribution with max %v below min %v", args[1], args[0])
+	}
+
+	return d, nil
+}
+
+func (d distribution) sample(r *rand.Rand) float64 {
+	var v float64
+
+	switch d.kind {
+	case "uniform":
+		v = d.a + r.Float64()*(d.b-d.a)
+	case "exp":
+		v = r.ExpFloat64() * d.a
+	case "normal":
+		v = r.NormFloat64()*d.b + d.a
+	default:
+		v = d.a
+	}
+
+	return math.Max(v, 0)
+}
+
+func (d distribution) String() string {
+	return d.spec
+}
+
+type onoffProfile struct {
+	on, off time.Duration
+	rate    uint
+	blksize int
+}
+
+func (p *onoffProfile) next() burst {
+	b := burst{length: p.on, gap: p.on + p.off}
+
+	if p.rate != 0 {
+		packets := int(float64(p.rate) / 8 * p.on.Seconds() / float64(p.blksize))
+		if packets < 1 {
+			packets = 1
+		}
+
+		b.sizes = make([]int, packets)
+		for i := range b.sizes {
+			b.sizes[i] = p.blksize
+		}
+	}
+
+	return b
+}
+
+func (p *onoffProfile) String() string {
+	rate := "flat out"
+	if p.rate != 0 {
+		rate = fmt.Sprintf("%.2f Mb/s", float64(p.rate)/1000000)
+	}
+
+	return fmt.Sprintf("%v, %v on (%v), %v off", PROFILE_ONOFF, p.on, rate, p.off)
+}
+
+type voipProfile struct {
+	codec string
+	ptime time.Duration
+	size  int
+}
+
+func (p *voipProfile) next() burst {
+	return burst{sizes: []int{p.size}, gap: p.ptime}
+}
+
+func (p *voipProfile) String() string {
+	return fmt.Sprintf("%v, %v, %v B every %v", PROFILE_VOIP, p.codec, p.size, p.ptime)
+}
+
+type videoProfile struct {
+	rate    uint // bit per second
+	fps     int
+	gop     int     // frames from one I-frame to the next
+	iframe  float64 // size of an I-frame relative to a P-frame
+	blksize int
+	frame   int // in the GOP, 0 for the I-frame
+}
+
+func (p *videoProfile) next() burst {
+	// the frames of a GOP add up to the rate
+	pframe := float64(p.rate) / 8 / float64(p.fps) * float64(p.gop) / (p.iframe + float64(p.gop-1))
+
+	size := int(pframe)
+	if p.frame == 0 {
+		size = int(pframe * p.iframe)
+	}
+
+	p.frame = (p.frame + 1) % p.gop
+
+	var sizes []int
+	for ; size > 0; size -= p.blksize {
+		sizes = append(sizes, minInt(size, p.blksize))
+	}
+
+	return burst{sizes: sizes, gap: time.Second / time.Duration(p.fps)}
+}
+
+func (p *videoProfile) String() string {
+	return fmt.Sprintf("%v, %.2f Mb/s, %v fps, GOP %v, I-frame %vx", PROFILE_VIDEO, float64(p.rate)/1000000, p.fps, p.gop,
+		p.iframe)
+}
+
+type customProfile struct {
+	size, gap distribution
+	blksize   int
+	r         *rand.Rand
+}
+
+func (p *customProfile) next() burst {
+	return burst{sizes: []int{int(p.size.sample(p.r))}, gap: time.Duration(p.gap.sample(p.r))}
+}
+
+func (p *customProfile) String() string {
+	return fmt.Sprintf("%v, size %v, gap %v", PROFILE_CUSTOM, p.size, p.gap)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// initProfiles gives every sender stream a traffic profile of its own
+func (test *IperfTest) initProfiles() int {
+	if test.setting.profile == "" {
+		return 0
+	}
+
+	for _, sp := range test.streams {
+		if sp.role != SENDER_STREAM {
+			continue
+		}
+
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+		p, err := newTrafficProfile(test.setting.profile, test.setting.rate, len(sp.buffer), r)
+		if err != nil {
+			Log.Errorf("Create traffic profile failed. err = %v", err)
+
+			return -1
+		}
+
+		sp.profile = p
+	}
+
+	return 0
+}
+
+// iperfProfileSend -- the sender side of a traffic profile stream
+func (sp *iperfStream) iperfProfileSend(test *IperfTest) {
+	sp.pinThread()
+
+	next := time.Now()
+
+	for id := uint32(0); ; id++ {
+		b := sp.profile.next()
+
+		if !test.sleepUntil(next) {
+			break
+		}
+
+		start := time.Now()
+
+		if b.sizes == nil {
+			for index := uint32(0); time.Since(start) < b.length && !test.done; index++ {
+				if !sp.sendBurstPacket(id, index, 0, len(sp.buffer)) {
+					return
+				}
+			}
+		} else {
+			for index, size := range b.sizes {
+				if b.length > 0 && !test.sleepUntil(start.Add(b.length*time.Duration(index)/time.Duration(len(b.sizes)))) {
+					break
+				}
+
+				if !sp.sendBurstPacket(id, uint32(index), uint32(len(b.sizes)), size) {
+					return
+				}
+			}
+		}
+
+		if (test.duration != 0 && test.done) || test.limitReached(test.sentTotals()) {
+			break
+		}
+
+		// keep the average rate, but do not catch up with a long backlog in one go
+		next = next.Add(b.gap)
+		if time.Since(next) > b.gap {
+			next = time.Now()
+		}
+	}
+
+	test.ctrlChan <- TEST_END
+
+	Log.Debugf("Stream quit sending profile")
+}
+
+// sleepUntil waits until t, it returns false as soon as the test is done
+func (test *IperfTest) sleepUntil(t time.Time) bool {
+	for !test.done {
+		d := time.Until(t)
+		if d <= 0 {
+			return true
+		}
+
+		if d > 100*time.Millisecond {
+			d = 100 * time.Millisecond
+		}
+
+		time.Sleep(d)
+	}
+
+	return false
+}
+
+// sendBurstPacket sends a packet of size bytes, it returns false when the stream can not send any more
+func (sp *iperfStream) sendBurstPacket(id, index, count uint32, size int) bool {
+	test := sp.test
+	buf := sp.buffer
+
+	size = maxInt(minInt(size, len(buf)), test.payloadOffset())
+
+	if test.patternPerBlock() {
+		sp.nextBlock(buf[:size])
+	}
+
+	h := buf[OWD_HEADER_SIZE : OWD_HEADER_SIZE+BURST_HEADER_SIZE]
+	binary.LittleEndian.PutUint32(h[0:4], id)
+	binary.LittleEndian.PutUint32(h[4:8], index)
+	binary.LittleEndian.PutUint32(h[8:12], count)
+	binary.LittleEndian.PutUint32(h[12:16], uint32(size))
+
+	sp.stampBlock(buf)
+
+	sp.buffer = buf[:size]
+	n := sp.snd(sp)
+	sp.buffer = buf
+
+	if n < 0 {
+		if n == -1 {
+			Log.Debugf("Iperf send stream closed.")
+		} else {
+			Log.Errorf("Iperf streams send failed. %v", n)
+		}
+
+		return false
+	}
+
+	test.bytesSent += uint64(n)
+	test.blocksSent += 1
+
+	return true
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// burstSize returns the size of a packet from its header, 0 if it does not carry one
+func burstSize(header []byte) int {
+	if len(header) < OWD_HEADER_SIZE+BURST_HEADER_SIZE {
+		return 0
+	}
+
+	return int(binary.LittleEndian.Uint32(header[OWD_HEADER_SIZE+12 : OWD_HEADER_SIZE+16]))
+}
+
+// burstState is the burst a receiver stream is receiving
+type burstState struct {
+	open      bool
+	id        uint32
+	count     uint32 // packets in the burst, 0 if the sender did not know, then the sequence numbers tell
+	received  uint32
+	firstSeq  uint64
+	lastSeq   uint64
+	firstSent int64 // unix nano sec, local clock
+	lastRecv  int64
+}
+
+// burst summary of a receiver stream of a traffic profile
+// tips: exchanged with the results, all the members should be visible
+type burst_results struct {
+	Bursts      uint64 // bursts received
+	Damaged     uint64 // bursts that lost packets
+	Lost        uint64 // bursts lost completely
+	Packets     uint64 // packets in the bursts received
+	PacketsLost uint64
+	Late        uint64             // packets arriving after a later burst
+	Delay       rr_latency_results // from the first packet sent to the last one received
+	Max         time.Duration
+}
+
+func (r *burst_results) add(o burst_results) {
+	r.Bursts += o.Bursts
+	r.Damaged += o.Damaged
+	r.Lost += o.Lost
+	r.Packets += o.Packets
+	r.PacketsLost += o.PacketsLost
+	r.Late += o.Late
+}
+
+// burstBlock accounts a received packet of a traffic profile, sent and recv are in the local clock
+func (sp *iperfStream) burstBlock(header []byte, seq uint64, sent, recv int64) {
+	id := binary.LittleEndian.Uint32(header[0:4])
+	count := binary.LittleEndian.Uint32(header[8:12])
+
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	bs := &sp.payload.burst
+	rp := sp.result
+
+	switch {
+	case !bs.open || id > bs.id:
+		if bs.open {
+			sp.closeBurst()
+			rp.burst_this_interval.Lost += uint64(id - bs.id - 1)
+		} else {
+			rp.burst_this_interval.Lost += uint64(id)
+		}
+
+		*bs = burstState{open: true, id: id, count: count, firstSeq: seq, lastSeq: seq, firstSent: sent, lastRecv: recv}
+	case id < bs.id:
+		rp.burst_this_interval.Late++
+
+		return
+	}
+
+	bs.received++
+
+	if seq < bs.firstSeq {
+		bs.firstSeq = seq
+	} else if seq > bs.lastSeq {
+		bs.lastSeq = seq
+	}
+
+	if sent < bs.firstSent {
+		bs.firstSent = sent
+	}
+
+	if recv > bs.lastRecv {
+		bs.lastRecv = recv
+	}
+}
+
+// closeBurst accounts the burst received so far, the caller holds rrMu
+func (sp *iperfStream) closeBurst() {
+	bs := &sp.payload.burst
+	rp := sp.result
+
+	expected := uint64(bs.count)
+	if expected == 0 {
+		expected = bs.lastSeq - bs.firstSeq + 1
+	}
+
+	r := &rp.burst_this_interval
+	r.Bursts++
+	r.Packets += expected
+
+	if lost := expected - uint64(bs.received); uint64(bs.received) < expected {
+		r.PacketsLost += lost
+		r.Damaged++
+	}
+
+	rp.burst_interval_hist.add(time.Duration(bs.lastRecv - bs.firstSent))
+
+	bs.open = false
+}
+
+// burstInterval moves the bursts of the finished interval into its results
+func (sp *iperfStream) burstInterval(tempResult *iperf_interval_results) {
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	rp := sp.result
+
+	// the last burst is only complete if the sender was not stopped in the middle of it
+	if bs := &sp.payload.burst; sp.test.done && bs.open && (bs.count == 0 || bs.received == bs.count) {
+		sp.closeBurst()
+	}
+
+	tempResult.bursts = rp.burst_this_interval
+	tempResult.burst_hist = rp.burst_interval_hist
+
+	rp.burst_this_interval = burst_results{}
+	rp.burst_interval_hist = latency_histogram{}
+}
+
+// burstResults returns the burst summary of the stream, omitted intervals excluded. The sender side shows the
+// summary the receiver reported in the results exchange.
+func (sp *iperfStream) burstResults() burst_results {
+	if sp.role == SENDER_STREAM {
+		return sp.result.bursts
+	}
+
+	var r burst_results
+	var h latency_histogram
+
+	for i := range sp.result.interval_results {
+		if rp := &sp.result.interval_results[i]; rp.omitted == 0 {
+			r.add(rp.bursts)
+			h.merge(&rp.burst_hist)
+		}
+	}
+
+	return burstSummary(r, &h)
+}
+
+func burstSummary(r burst_results, h *latency_histogram) burst_results {
+	r.Delay = h.results()
+	r.Max = h.max
+
+	return r
+}
+
+// printBursts prints how the receiver saw the bursts of a stream next to its interval or summary line
+func (test *IperfTest) printBursts(i int, sp *iperfStream, r burst_results, mark string) {
+	if test.setting.profile == "" || r.Bursts+r.Lost+r.Late == 0 {
+		return
+	}
+
+	ms := func(d time.Duration) float64 {
+		return float64(d.Nanoseconds()) / MS_TO_NS
+	}
+
+	var lostRate float64
+	if r.Packets > 0 {
+		lostRate = float64(r.PacketsLost) / float64(r.Packets) * 100
+	}
+
+	fmt.Printf(BURST_REPORT, test.streamLabel(i, sp), r.Bursts, r.Damaged, r.Lost, r.PacketsLost, r.Packets, lostRate,
+		r.Late, ms(r.Delay.P50), ms(r.Delay.P90), ms(r.Delay.P99), ms(r.Max), mark)
+}
+
+// printProfile prints the traffic profile the senders used
+func (test *IperfTest) printProfile() {
+	if test.setting.profile == "" {
+		return
+	}
+
+	p, err := newTrafficProfile(test.setting.profile, test.setting.rate, int(test.setting.blksize), nil)
+	if err == nil {
+		fmt.Printf(PROFILE_REPORT, p)
+	}
+}
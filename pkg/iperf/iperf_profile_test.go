@@ -0,0 +1,218 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitProfile(t *testing.T) {
+	cases := []struct {
+		spec   string
+		name   string
+		params profileParams
+		fails  bool
+	}{
+		{spec: "voip", name: "voip", params: profileParams{}},
+		{spec: "onoff,on=2s,off=500ms", name: "onoff", params: profileParams{"on": "2s", "off": "500ms"}},
+		{spec: "custom,size=uniform(64,1400),gap=exp(5ms)", name: "custom",
+			params: profileParams{"size": "uniform(64,1400)", "gap": "exp(5ms)"}},
+		{spec: "video,rate=", name: "video", params: profileParams{"rate": ""}},
+		{spec: "voip,codec", fails: true},
+		{spec: "voip,=g711", fails: true},
+		{spec: "voip,,ptime=20ms", fails: true},
+	}
+
+	for _, c := range cases {
+		name, params, err := splitProfile(c.spec)
+		if c.fails {
+			if err == nil {
+				t.Errorf("splitProfile(%q) should fail", c.spec)
+			}
+
+			continue
+		}
+
+		if err != nil || name != c.name || !reflect.DeepEqual(params, c.params) {
+			t.Errorf("splitProfile(%q) = %q, %v, %v, want %q, %v", c.spec, name, params, err, c.name, c.params)
+		}
+	}
+}
+
+func TestParseDistribution(t *testing.T) {
+	cases := []struct {
+		spec  string
+		value func(string) (float64, error)
+		want  distribution
+		fails bool
+	}{
+		{spec: "const(1K)", value: parseSizeValue, want: distribution{kind: "const", a: 1024}},
+		{spec: "uniform(64, 1400)", value: parseSizeValue, want: distribution{kind: "uniform", a: 64, b: 1400}},
+		{spec: "exp(5ms)", value: parseDurationValue, want: distribution{kind: "exp", a: float64(5 * time.Millisecond)}},
+		{spec: "normal(20ms,2ms)", value: parseDurationValue,
+			want: distribution{kind: "normal", a: float64(20 * time.Millisecond), b: float64(2 * time.Millisecond)}},
+		{spec: "const(64", value: parseSizeValue, fails: true},
+		{spec: "64", value: parseSizeValue, fails: true},
+		{spec: "pareto(64)", value: parseSizeValue, fails: true},
+		{spec: "uniform(64)", value: parseSizeValue, fails: true},
+		{spec: "exp(1,2)", value: parseSizeValue, fails: true},
+		{spec: "uniform(1400,64)", value: parseSizeValue, fails: true},
+		{spec: "const(1T)", value: parseSizeValue, fails: true},
+		{spec: "exp(5)", value: parseDurationValue, fails: true},
+	}
+
+	for _, c := range cases {
+		d, err := parseDistribution(c.spec, c.value)
+		if c.fails {
+			if err == nil {
+				t.Errorf("parseDistribution(%q) should fail", c.spec)
+			}
+
+			continue
+		}
+
+		c.want.spec = c.spec
+		if err != nil || d != c.want {
+			t.Errorf("parseDistribution(%q) = %+v, %v, want %+v", c.spec, d, err, c.want)
+		}
+	}
+}
+
+func TestParseBitRate(t *testing.T) {
+	cases := []struct {
+		s     string
+		want  uint
+		fails bool
+	}{
+		{s: "64000", want: 64000},
+		{s: "64k", want: 64000},
+		{s: "4M", want: 4000000},
+		{s: "2.5m", want: 2500000},
+		{s: "1G", want: 1000000000},
+		{s: "", fails: true},
+		{s: "M", fails: true},
+		{s: "0", fails: true},
+		{s: "-1M", fails: true},
+		{s: "4T", fails: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseBitRate(c.s)
+		if c.fails {
+			if err == nil {
+				t.Errorf("parseBitRate(%q) should fail", c.s)
+			}
+
+			continue
+		}
+
+		if err != nil || got != c.want {
+			t.Errorf("parseBitRate(%q) = %v, %v, want %v", c.s, got, err, c.want)
+		}
+	}
+}
+
+// profilePacket is a received packet of a traffic profile, times in ms
+type profilePacket struct {
+	id, count  uint32
+	seq        uint64
+	sent, recv int64
+}
+
+func TestBurstBlock(t *testing.T) {
+	ms := func(n int64) int64 {
+		return n * int64(time.Millisecond)
+	}
+
+	cases := []struct {
+		name    string
+		packets []profilePacket
+		want    burst_results
+		delays  []time.Duration // of the bursts received, in order
+	}{
+		{
+			name: "complete",
+			packets: []profilePacket{
+				{0, 2, 0, 0, 1}, {0, 2, 1, 0, 2},
+				{1, 2, 2, 10, 11}, {1, 2, 3, 10, 13},
+			},
+			want:   burst_results{Bursts: 2, Packets: 4},
+			delays: []time.Duration{2 * time.Millisecond, 3 * time.Millisecond},
+		},
+		{
+			name: "packet lost",
+			packets: []profilePacket{
+				{0, 3, 0, 0, 1}, {0, 3, 2, 0, 3},
+				{1, 1, 3, 10, 11},
+			},
+			want:   burst_results{Bursts: 2, Damaged: 1, Packets: 4, PacketsLost: 1},
+			delays: []time.Duration{3 * time.Millisecond, time.Millisecond},
+		},
+		{
+			name: "bursts lost",
+			packets: []profilePacket{
+				{2, 1, 4, 20, 21},
+				{5, 1, 7, 50, 52},
+			},
+			want:   burst_results{Bursts: 2, Lost: 4, Packets: 2},
+			delays: []time.Duration{time.Millisecond, 2 * time.Millisecond},
+		},
+		{
+			name: "late",
+			packets: []profilePacket{
+				{0, 2, 0, 0, 1},
+				{1, 1, 2, 10, 11},
+				{0, 2, 1, 0, 12},
+			},
+			want:   burst_results{Bursts: 2, Damaged: 1, Packets: 3, PacketsLost: 1, Late: 1},
+			delays: []time.Duration{time.Millisecond, time.Millisecond},
+		},
+		{
+			name: "reordered",
+			packets: []profilePacket{
+				{0, 3, 2, 2, 3}, {0, 3, 0, 0, 4}, {0, 3, 1, 1, 5},
+			},
+			want:   burst_results{Bursts: 1, Packets: 3},
+			delays: []time.Duration{5 * time.Millisecond},
+		},
+		{
+			// flat out bursts of onoff do not know their packets, the sequence numbers tell
+			name: "count unknown",
+			packets: []profilePacket{
+				{0, 0, 12, 2, 4}, {0, 0, 10, 0, 3},
+				{1, 0, 13, 10, 11}, {1, 0, 15, 12, 13},
+			},
+			want:   burst_results{Bursts: 2, Damaged: 2, Packets: 6, PacketsLost: 2},
+			delays: []time.Duration{4 * time.Millisecond, 3 * time.Millisecond},
+		},
+	}
+
+	for _, c := range cases {
+		sp := &iperfStream{payload: new(payloadState), result: new(iperf_stream_results)}
+
+		header := make([]byte, BURST_HEADER_SIZE)
+		for _, p := range c.packets {
+			binary.LittleEndian.PutUint32(header[0:4], p.id)
+			binary.LittleEndian.PutUint32(header[8:12], p.count)
+
+			sp.burstBlock(header, p.seq, ms(p.sent), ms(p.recv))
+		}
+
+		sp.closeBurst()
+
+		got := sp.result.burst_this_interval
+		if got != c.want {
+			t.Errorf("%v: bursts = %+v, want %+v", c.name, got, c.want)
+		}
+
+		var want latency_histogram
+		for _, d := range c.delays {
+			want.add(d)
+		}
+
+		if h := sp.result.burst_interval_hist; !reflect.DeepEqual(h, want) {
+			t.Errorf("%v: delays = %+v, want %+v", c.name, h, want)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package iperf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ProtocolFactory creates a new Protocol instance. Every test gets its own instances.
+type ProtocolFactory func() Protocol
+
+var (
+	registryMu       sync.RWMutex
+	protocolRegistry = make(map[string]ProtocolFactory)
+	protocolNames    []string // in registration order
+)
+
+func init() {
+	builtin := []ProtocolFactory{
+		func() Protocol { return new(TCPProto) },
+		func() Protocol { return new(UDPProto) },
+		func() Protocol { return new(rudpProto) },
+		func() Protocol { return new(kcpProto) },
+		func() Protocol { return new(MPTCPProto) },
+	}
+
+	for _, factory := range builtin {
+		if err := RegisterProtocol(factory); err != nil {
+			panic(err)
+		}
+	}
+
+	ProtocolList = Protocols()
+}
+
+// RegisterProtocol makes a protocol available by its name to the -proto flag and Config.Protocol.
+// Both client and server must register the protocol. Registering a name twice is an error.
+func RegisterProtocol(factory ProtocolFactory) error {
+	if factory == nil {
+		return errors.New("nil protocol factory")
+	}
+
+	proto := factory()
+	if proto == nil {
+		return errors.New("protocol factory returned nil")
+	}
+
+	name := proto.Name()
+	if name == "" {
+		return errors.New("protocol name is empty")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := protocolRegistry[name]; ok {
+		return fmt.Errorf("protocol %v already registered", name)
+	}
+
+	protocolRegistry[name] = factory
+	protocolNames = append(protocolNames, name)
+
+	return nil
+}
+
+// unregisterProtocol removes a registered protocol, for tests
+func unregisterProtocol(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	delete(protocolRegistry, name)
+
+	for i, n := range protocolNames {
+		if n == name {
+			protocolNames = append(protocolNames[:i:i], protocolNames[i+1:]...)
+
+			break
+		}
+	}
+}
+
+// Protocols returns the names of the registered protocols, in registration order
+func Protocols() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return append([]string(nil), protocolNames...)
+}
+
+// IsProtocolRegistered reports whether a protocol with this name has been registered
+func IsProtocolRegistered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, ok := protocolRegistry[name]
+
+	return ok
+}
+
+// newProtocol creates a new instance of a registered protocol, nil if the name is unknown
+func newProtocol(name string) Protocol {
+	registryMu.RLock()
+	factory, ok := protocolRegistry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	return factory()
+}
+
+// newProtocols creates an instance of every registered protocol
+func newProtocols() []Protocol {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	protocols := make([]Protocol, 0, len(protocolNames))
+	for _, name := range protocolNames {
+		protocols = append(protocols, protocolRegistry[name]())
+	}
+
+	return protocols
+}
+
+/* accessors for Protocol implementations */
+
+// Addr returns the server address, empty on the server side
+func (test *IperfTest) Addr() string {
+	return test.addr
+}
+
+// Port returns the connect/listen port
+func (test *IperfTest) Port() uint {
+	return test.port
+}
+
+// IsServer reports whether this is the server side of the test
+func (test *IperfTest) IsServer() bool {
+	return test.isServer
+}
+
+// Duration returns the test duration
+func (test *IperfTest) Duration() time.Duration {
+	return time.Duration(test.duration) * time.Second
+}
+
+// NoDelay reports whether the no delay option is set
+func (test *IperfTest) NoDelay() bool {
+	return test.noDelay
+}
+
+// Blksize returns the send/read block size
+func (test *IperfTest) Blksize() uint {
+	return test.setting.blksize
+}
+
+// StreamNum returns the number of parallel streams
+func (test *IperfTest) StreamNum() uint {
+	return test.streamNum
+}
+
+// Streams returns the data streams of the test
+func (test *IperfTest) Streams() []*Stream {
+	return test.streams
+}
+
+// ProtoListener returns the listener created by Protocol.Listen
+func (test *IperfTest) ProtoListener() net.Listener {
+	return test.protoListener
+}
+
+// CtrlListener returns the listener of the control connection. Stream based protocols may share it
+// for their data streams, as tcp does.
+func (test *IperfTest) CtrlListener() net.Listener {
+	return test.listener
+}
+
+// Conn returns the data connection of the stream
+func (sp *iperfStream) Conn() net.Conn {
+	return sp.conn
+}
+
+// Buffer returns the block which is sent from or received into
+func (sp *iperfStream) Buffer() []byte {
+	return sp.buffer
+}
+
+// Test returns the test the stream belongs to
+func (sp *iperfStream) Test() *IperfTest {
+	return sp.test
+}
+
+// IsSender reports whether the stream sends data
+func (sp *iperfStream) IsSender() bool {
+	return sp.role == SENDER_STREAM
+}
+
+// RecordSent accounts n bytes sent on the stream
+func (sp *iperfStream) RecordSent(n int) {
+	sp.result.bytes_sent += uint64(n)
+	sp.result.bytes_sent_this_interval += uint64(n)
+}
+
+// RecordReceived accounts n bytes received on the stream, data outside the running state is ignored
+func (sp *iperfStream) RecordReceived(n int) {
+	if sp.test.state != TEST_RUNNING {
+		return
+	}
+
+	sp.result.bytes_received += uint64(n)
+	sp.result.bytes_received_this_interval += uint64(n)
+}
+
+// BytesSent returns the total bytes sent on the stream, after the omit period
+func (sp *iperfStream) BytesSent() uint64 {
+	return sp.result.bytes_sent - sp.result.bytes_sent_omit
+}
+
+// BytesReceived returns the total bytes received on the stream, after the omit period
+func (sp *iperfStream) BytesReceived() uint64 {
+	return sp.result.bytes_received - sp.result.bytes_received_omit
+}
+
+// SetRTT sets the rtt of the interval, in micro sec
+func (r *iperf_interval_results) SetRTT(rtt uint) {
+	r.rtt = rtt
+}
+
+// SetRTO sets the rto of the interval, in micro sec
+func (r *iperf_interval_results) SetRTO(rto uint) {
+	r.rto = rto
+}
+
+// SetRetrans sets the number of segments retransmitted during the interval
+func (r *iperf_interval_results) SetRetrans(retrans uint) {
+	r.interval_retrans = retrans
+}
+
+// SetLost sets the number of segments lost during the interval
+func (r *iperf_interval_results) SetLost(lost uint) {
+	r.interval_lost = lost
+}
+
+// Duration returns the length of the interval
+func (r *iperf_interval_results) Duration() time.Duration {
+	return r.interval_dur
+}
@@ -0,0 +1,50 @@
+package iperf
+
+import (
+	"testing"
+)
+
+type customProto struct {
+	TCPProto
+}
+
+func (*customProto) Name() string {
+	return "custom-test"
+}
+
+func TestRegisterProtocol(t *testing.T) {
+	test := NewIperfTest()
+	test.Init()
+
+	err := RegisterProtocol(func() Protocol { return new(customProto) })
+	if err != nil {
+		t.Fatalf("Register protocol failed: %v", err)
+	}
+
+	t.Cleanup(func() { unregisterProtocol("custom-test") })
+
+	if !IsProtocolRegistered("custom-test") {
+		t.Fatalf("custom-test is not registered")
+	}
+
+	if names := Protocols(); names[len(names)-1] != "custom-test" {
+		t.Fatalf("Protocols() = %v, custom-test missing", names)
+	}
+
+	// registered after Init, setProtocol should still find it
+	if test.setProtocol("custom-test") < 0 {
+		t.Fatalf("setProtocol failed for custom-test")
+	}
+
+	if test.sessionStyleReport() {
+		t.Fatalf("custom-test should be reported in the tcp layout")
+	}
+
+	if err = RegisterProtocol(func() Protocol { return new(customProto) }); err == nil {
+		t.Fatalf("Register the same protocol twice should fail")
+	}
+
+	if err = RegisterProtocol(func() Protocol { return new(TCPProto) }); err == nil {
+		t.Fatalf("Register a built-in protocol again should fail")
+	}
+}
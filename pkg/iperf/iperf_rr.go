@@ -0,0 +1,367 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// request/response mode: the sender stream writes a request and waits for the response, the receiver stream
+// echoes a response to every request. Latency is measured on the sender from the request write to the last
+// byte of the response. Over udp a request or response may get lost: the request carries the sequence number of
+// the transaction in its first bytes, the response echoes it. Without a response after RR_UDP_TIMEOUT the
+// transaction counts as lost and the request is sent again, late responses of lost transactions are dropped.
+
+const (
+	RR_SEQ_SIZE    = 4    // udp requests and responses are at least this long to carry the sequence number
+	RR_UDP_TIMEOUT = 1000 // ms
+)
+
+// iperfRequest -- the sender side of a request/response stream
+func (sp *iperfStream) iperfRequest(test *IperfTest) {
+	sp.pinThread()
+
+	buf := sp.buffer
+	defer func() { sp.buffer = buf }()
+
+	reqSize, respSize := test.rrSizes()
+	udp := test.proto.Name() == UDP_NAME
+
+	var seq uint32
+
+	for {
+		start := time.Now()
+
+		seq++
+		if udp {
+			binary.LittleEndian.PutUint32(buf, seq)
+		}
+
+		sp.buffer = buf[:reqSize]
+		if n := sp.snd(sp); n < 0 {
+			sp.rrQuit(n, "send request")
+
+			return
+		}
+
+		var n int
+		if udp {
+			n = sp.rrReadUDP(buf, respSize, seq, start.Add(RR_UDP_TIMEOUT*time.Millisecond))
+		} else {
+			n = sp.rrRead(buf, respSize)
+		}
+
+		if n == UDP_RECV_TIMEOUT {
+			Log.Debugf("Transaction %v lost, send the request again", seq)
+
+			if test.state == TEST_RUNNING {
+				sp.rrFail()
+			}
+		} else if n < 0 {
+			sp.rrQuit(n, "receive response")
+
+			return
+		} else if test.state == TEST_RUNNING {
+			sp.rrRecord(time.Since(start), true)
+
+			test.bytesSent += uint64(reqSize)
+			test.blocksSent += 1
+		}
+
+		if (test.duration != 0 && test.done) || test.limitReached(test.sentTotals()) {
+			test.ctrlChan <- TEST_END
+
+			Log.Debugf("Stream quit requesting")
+
+			return
+		}
+	}
+}
+
+// iperfRespond -- the receiver side of a request/response stream
+func (sp *iperfStream) iperfRespond(test *IperfTest) {
+	sp.pinThread()
+
+	buf := sp.buffer
+	defer func() { sp.buffer = buf }()
+
+	// the response starts with the request, with udp its sequence number
+	reqSize, respSize := test.rrSizes()
+
+	for {
+		if n := sp.rrRead(buf, reqSize); n < 0 {
+			sp.rrQuit(n, "receive request")
+
+			return
+		}
+
+		sp.buffer = buf[:respSize]
+		if n := sp.snd(sp); n < 0 {
+			sp.rrQuit(n, "send response")
+
+			return
+		}
+
+		if test.state == TEST_RUNNING {
+			sp.rrRecord(0, false)
+
+			test.bytesReceived += uint64(reqSize)
+			test.blocksReceived += 1
+		}
+
+		if test.done || test.limitReached(test.receivedTotals()) {
+			test.ctrlChan <- TEST_END
+
+			Log.Debugf("Stream quit responding")
+
+			return
+		}
+	}
+}
+
+// rrRead receives exactly size bytes into buf, stream protocols may return a message in pieces
+func (sp *iperfStream) rrRead(buf []byte, size int) int {
+	for got := 0; got < size; {
+		sp.buffer = buf[got:size]
+
+		n := sp.rcv(sp)
+		if n < 0 {
+			return n
+		}
+
+		got += n
+	}
+
+	return size
+}
+
+// rrReadUDP receives the response to the request seq, it returns UDP_RECV_TIMEOUT if none came before deadline
+func (sp *iperfStream) rrReadUDP(buf []byte, size int, seq uint32, deadline time.Time) int {
+	if err := sp.conn.SetReadDeadline(deadline); err != nil {
+		Log.Errorf("SetReadDeadline err: %v", err)
+
+		return -2
+	}
+
+	for {
+		sp.buffer = buf[:size]
+
+		n := sp.rcv(sp)
+		if n < 0 {
+			return n
+		}
+
+		if n >= RR_SEQ_SIZE && binary.LittleEndian.Uint32(buf) == seq {
+			return n
+		}
+
+		Log.Debugf("Drop the late response of transaction %v", binary.LittleEndian.Uint32(buf))
+	}
+}
+
+// rrSizes returns the size of the requests and responses on the wire
+func (test *IperfTest) rrSizes() (int, int) {
+	reqSize, respSize := int(test.setting.reqSize), int(test.setting.respSize)
+
+	if test.proto.Name() == UDP_NAME {
+		reqSize = maxInt(reqSize, RR_SEQ_SIZE)
+		respSize = maxInt(respSize, RR_SEQ_SIZE)
+	}
+
+	return reqSize, respSize
+}
+
+func (sp *iperfStream) rrQuit(n int, op string) {
+	if n == -1 {
+		Log.Debugf("Stream closed, quit request/response. op = %v", op)
+	} else {
+		Log.Errorf("Request/response stream failed to %v. n = %v", op, n)
+	}
+}
+
+// rrRecord accounts a transaction, latency is only known on the sender side
+func (sp *iperfStream) rrRecord(latency time.Duration, measured bool) {
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	sp.result.rr_transactions_this_interval++
+
+	if measured {
+		sp.result.rr_interval_hist.add(latency)
+	}
+}
+
+// rrInterval moves the transactions of the finished interval into its results
+func (sp *iperfStream) rrInterval(tempResult *iperf_interval_results) {
+	sp.rrMu.Lock()
+	defer sp.rrMu.Unlock()
+
+	rp := sp.result
+
+	tempResult.rr_transactions = rp.rr_transactions_this_interval
+	tempResult.rr_hist = rp.rr_interval_hist
+	tempResult.rr_failures = rp.rr_failures_this_interval
+
+	rp.rr_transactions_this_interval = 0
+	rp.rr_interval_hist = latency_histogram{}
+	rp.rr_failures_this_interval = 0
+}
+
+// rrTransactions returns the transactions of the stream, omitted intervals excluded
+func (sp *iperfStream) rrTransactions() uint64 {
+	var trans uint64
+
+	for _, rp := range sp.result.interval_results {
+		if rp.omitted == 0 {
+			trans += rp.rr_transactions
+		}
+	}
+
+	return trans
+}
+
+// rrHistogram returns the latencies measured on the stream, omitted intervals excluded. The receiver side has no
+// samples of its own, it returns the histogram the sender reported in the results exchange.
+func (sp *iperfStream) rrHistogram() *latency_histogram {
+	if sp.role == RECEIVER_STREAM {
+		h := sp.result.rr_peer_hist
+
+		return &h
+	}
+
+	h := new(latency_histogram)
+
+	for i := range sp.result.interval_results {
+		if rp := &sp.result.interval_results[i]; rp.omitted == 0 {
+			h.merge(&rp.rr_hist)
+		}
+	}
+
+	return h
+}
+
+// rrLatency returns the latency summary of the stream
+func (sp *iperfStream) rrLatency() rr_latency_results {
+	return sp.rrHistogram().results()
+}
+
+// rrLost returns the lost transactions of a udp request/response stream, the receiver side shows what the
+// sender reported in the results exchange
+func (sp *iperfStream) rrLost() uint64 {
+	if sp.role == RECEIVER_STREAM {
+		return sp.result.rr_peer_failures
+	}
+
+	return sp.rrFailures()
+}
+
+// latencyColumns formats the latency columns in micro sec, "-" where nothing was measured
+func latencyColumns(l rr_latency_results) string {
+	if l.Samples == 0 {
+		return fmt.Sprintf(RR_LATENCY_COLUMNS_NONE, "-", "-", "-", "-", "-", "-")
+	}
+
+	us := func(d time.Duration) float64 {
+		return float64(d.Nanoseconds()) / 1000
+	}
+
+	return fmt.Sprintf(RR_LATENCY_COLUMNS, us(l.Min), us(l.Mean), us(l.P50), us(l.P90), us(l.P99), us(l.P999))
+}
+
+func (test *IperfTest) printRRIntermediate() {
+	var displayStartTime, displayEndTime float64
+	var mark string
+
+	sumTrans := make(map[int]uint64)
+	sumLost := make(map[int]uint64)
+	sumHist := map[int]*latency_histogram{SENDER_STREAM: {}, RECEIVER_STREAM: {}}
+
+	for i, sp := range test.streams {
+		if i == 0 && len(sp.result.interval_results) == 1 {
+			fmt.Printf(RR_INTERVAL_HEADER)
+		}
+
+		rp := sp.result.interval_results[len(sp.result.interval_results)-1]
+
+		displayStartTime = float64(rp.interval_start_time.Sub(sp.result.start_time_fixed).Nanoseconds()) / S_TO_NS
+		displayEndTime = float64(rp.interval_end_time.Sub(sp.result.start_time_fixed).Nanoseconds()) / S_TO_NS
+
+		mark = ""
+		if rp.omitted != 0 {
+			mark = REPORT_OMITTED
+		}
+
+		sumTrans[sp.role] += rp.rr_transactions
+		sumHist[sp.role].merge(&rp.rr_hist)
+
+		// the receiver side knows neither the latency nor the losses before the results exchange
+		lost := "-"
+		if sp.role == SENDER_STREAM {
+			sumLost[sp.role] += rp.rr_failures
+			lost = fmt.Sprint(rp.rr_failures)
+		}
+
+		fmt.Printf(RR_REPORT_SINGLE_STREAM, test.streamLabel(i, sp), displayStartTime, displayEndTime, rp.rr_transactions,
+			float64(rp.rr_transactions)/rp.interval_dur.Seconds(), lost, latencyColumns(rp.rr_hist.results()), mark)
+	}
+
+	if test.bidir || test.streamNum > 1 {
+		test.printRRSums(sumTrans, sumLost, sumHist, displayStartTime, displayEndTime, displayEndTime-displayStartTime, mark)
+
+		fmt.Printf(REPORT_SEPERATOR)
+	}
+}
+
+func (test *IperfTest) printRRResults() {
+	fmt.Printf(SUMMARY_SEPERATOR)
+	fmt.Printf(RR_RESULT_HEADER)
+
+	var displayEndTime float64
+
+	sumTrans := make(map[int]uint64)
+	sumLost := make(map[int]uint64)
+	sumHist := map[int]*latency_histogram{SENDER_STREAM: {}, RECEIVER_STREAM: {}}
+
+	for i, sp := range test.streams {
+		displayEndTime = float64(sp.result.end_time.Sub(sp.result.start_time).Nanoseconds()) / S_TO_NS
+
+		trans := sp.rrTransactions()
+
+		sumTrans[sp.role] += trans
+		sumLost[sp.role] += sp.rrLost()
+		sumHist[sp.role].merge(sp.rrHistogram())
+
+		role := "REQUESTER"
+		if sp.role == RECEIVER_STREAM {
+			role = "RESPONDER"
+		}
+
+		fmt.Printf(RR_REPORT_SINGLE_RESULT, test.streamLabel(i, sp), 0.0, displayEndTime, trans,
+			float64(trans)/displayEndTime, sp.rrLost(), latencyColumns(sp.rrLatency()), role)
+	}
+
+	test.printRRSums(sumTrans, sumLost, sumHist, 0, displayEndTime, displayEndTime, "")
+}
+
+// printRRSums prints the [SUM] lines of a request/response test like printSums does, "-" for the losses of a
+// role missing in lost
+func (test *IperfTest) printRRSums(trans, lost map[int]uint64, hists map[int]*latency_histogram, start, end, dur float64,
+	mark string) {
+	printSum := func(label string, role int) {
+		var roleLost interface{} = "-"
+		if l, ok := lost[role]; ok {
+			roleLost = l
+		}
+
+		fmt.Printf(RR_REPORT_SUM, label, start, end, trans[role], float64(trans[role])/dur, roleLost,
+			latencyColumns(hists[role].results()), mark)
+	}
+
+	if test.bidir {
+		for _, role := range []int{SENDER_STREAM, RECEIVER_STREAM} {
+			printSum("[SUM]["+test.directionLabel(role)+"]", role)
+		}
+	} else if test.streamNum > 1 {
+		printSum("[SUM]", test.streamRole(0))
+	}
+}
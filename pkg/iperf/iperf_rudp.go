@@ -5,8 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
-	"time"
 
 	RUDP "github.com/damao33/rudp-go"
 	"github.com/op/go-logging"
@@ -15,11 +13,11 @@ import (
 type rudpProto struct {
 }
 
-func (r *rudpProto) name() string {
+func (r *rudpProto) Name() string {
 	return RUDP_NAME
 }
 
-func (r *rudpProto) accept(test *IperfTest) (net.Conn, error) {
+func (r *rudpProto) Accept(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter RUDP accept")
 
 	conn, err := test.protoListener.Accept()
@@ -41,12 +39,29 @@ func (r *rudpProto) accept(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (r *rudpProto) listen(test *IperfTest) (net.Listener, error) {
-	listener, err := RUDP.ListenWithOptions("0.0.0.0:"+strconv.Itoa(int(test.port)), nil, int(test.setting.dataShards), int(test.setting.parityShards))
+func (r *rudpProto) Listen(test *IperfTest) (net.Listener, error) {
+	conn, err := test.listenUDP(false)
 	if err != nil {
 		return nil, err
 	}
 
+	pc, err := test.markPacketConn(conn)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	listener, err := RUDP.ServeConn(nil, int(test.setting.dataShards), int(test.setting.parityShards),
+		test.countSessions(pc, nil, false))
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	test.packetConns = append(test.packetConns, pc)
+
 	err = listener.SetReadBuffer(int(test.setting.readBufSize))
 	if err != nil {
 		return nil, err
@@ -57,12 +72,22 @@ func (r *rudpProto) listen(test *IperfTest) (net.Listener, error) {
 		return nil, err
 	}
 
-	return listener, nil
+	return &packetListener{Listener: listener, conn: conn}, nil
 }
 
-func (r *rudpProto) connect(test *IperfTest) (net.Conn, error) {
-	conn, err := RUDP.DialWithOptions(test.addr+":"+strconv.Itoa(int(test.port)), nil, int(test.setting.dataShards), int(test.setting.parityShards))
+func (r *rudpProto) Connect(test *IperfTest) (net.Conn, error) {
+	udpAddr, err := test.resolveUDPAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := test.sessionConn()
+	if err != nil {
+		return nil, err
+	}
 
+	conn, err := RUDP.NewConn2(udpAddr, nil, int(test.setting.dataShards), int(test.setting.parityShards),
+		test.countSessions(pc, nil, false))
 	if err != nil {
 		return nil, err
 	}
@@ -81,7 +106,7 @@ func (r *rudpProto) connect(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (r *rudpProto) send(sp *iperfStream) int {
+func (r *rudpProto) Send(sp *iperfStream) int {
 	n, err := sp.conn.(*RUDP.UDPSession).Write(sp.buffer)
 	if err != nil {
 		var serr *net.OpError
@@ -110,7 +135,7 @@ func (r *rudpProto) send(sp *iperfStream) int {
 	return n
 }
 
-func (r *rudpProto) recv(sp *iperfStream) int {
+func (r *rudpProto) Recv(sp *iperfStream) int {
 	// recv is blocking
 	n, err := sp.conn.(*RUDP.UDPSession).Read(sp.buffer)
 
@@ -139,109 +164,22 @@ func (r *rudpProto) recv(sp *iperfStream) int {
 	return n
 }
 
-func (r *rudpProto) init(test *IperfTest) int {
+func (r *rudpProto) Init(test *IperfTest) int {
 	for _, sp := range test.streams {
-		err := sp.conn.(*RUDP.UDPSession).SetReadBuffer(int(test.setting.readBufSize))
-		if err != nil {
-			Log.Errorf("r set read buffer failed. err = %v", err)
-			return 0
-		}
-
-		err = sp.conn.(*RUDP.UDPSession).SetWriteBuffer(int(test.setting.writeBufSize))
-		if err != nil {
-			Log.Errorf("r set write buffer failed. err = %v", err)
-			return 0
-		}
-
-		sp.conn.(*RUDP.UDPSession).SetWindowSize(int(test.setting.sndWnd), int(test.setting.rcvWnd))
-		sp.conn.(*RUDP.UDPSession).SetStreamMode(true)
-
-		err = sp.conn.(*RUDP.UDPSession).SetDSCP(46)
-		if err != nil {
-			Log.Errorf("r set dscp failed. err = %v", err)
-
-			return 0
-		}
-
-		sp.conn.(*RUDP.UDPSession).SetMtu(1400)
-		sp.conn.(*RUDP.UDPSession).SetACKNoDelay(false)
-
-		err = sp.conn.(*RUDP.UDPSession).SetDeadline(time.Now().Add(time.Minute))
-		if err != nil {
-			Log.Errorf("r set deadline failed. err = %v", err)
-
-			return 0
-		}
-
-		var noDelay, resend, nc int
+		if err := test.initSession(sp.conn.(*RUDP.UDPSession)); err != nil {
+			Log.Errorf("RUDP session init err = %v", err)
 
-		if test.noDelay {
-			noDelay = 1
-		} else {
-			noDelay = 0
-		}
-
-		if test.setting.noCong {
-			nc = 1
-		} else {
-			nc = 0
+			return -1
 		}
-
-		resend = int(test.setting.fastResend)
-
-		sp.conn.(*RUDP.UDPSession).SetNoDelay(noDelay, int(test.setting.flushInterval), resend, nc)
 	}
 
 	return 0
 }
 
-func (r *rudpProto) statsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
+func (r *rudpProto) StatsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
 	rp := sp.result
 
-	totalRetrans := uint(RUDP.DefaultSnmp.RetransSegs)
-	totalLost := uint(RUDP.DefaultSnmp.LostSegs)
-	totalEarlyRetrans := uint(RUDP.DefaultSnmp.EarlyRetransSegs)
-	totalFastRetrans := uint(RUDP.DefaultSnmp.FastRetransSegs)
-	totalRecovers := uint(RUDP.DefaultSnmp.FECRecovered)
-
-	totalInPkts := uint(RUDP.DefaultSnmp.InPkts)
-	totalInSegs := uint(RUDP.DefaultSnmp.InSegs)
-	totalOutPkts := uint(RUDP.DefaultSnmp.OutPkts)
-	totalOutSegs := uint(RUDP.DefaultSnmp.OutSegs)
-
-	repeatSegs := uint(RUDP.DefaultSnmp.RepeatSegs)
-
-	// retrans
-	tempResult.interval_retrans = totalRetrans - rp.stream_prev_total_retrans
-	rp.stream_retrans += tempResult.interval_retrans
-	rp.stream_prev_total_retrans = totalRetrans
-
-	// lost
-	tempResult.interval_lost = totalLost - rp.stream_prev_total_lost
-	rp.stream_lost += tempResult.interval_lost
-	rp.stream_prev_total_lost = totalLost
-
-	// early retrans
-	tempResult.interval_early_retrans = totalEarlyRetrans - rp.stream_prev_total_early_retrans
-	rp.stream_early_retrans += tempResult.interval_early_retrans
-	rp.stream_prev_total_early_retrans = totalEarlyRetrans
-
-	// fast retrans
-	tempResult.interval_fast_retrans = totalFastRetrans - rp.stream_prev_total_fast_retrans
-	rp.stream_fast_retrans += tempResult.interval_fast_retrans
-	rp.stream_prev_total_fast_retrans = totalFastRetrans
-
-	// recover
-	rp.stream_recovers = totalRecovers
-
-	// packets receive
-	rp.stream_in_pkts = totalInPkts
-	rp.stream_out_pkts = totalOutPkts
-
-	// segs receive
-	rp.stream_in_segs = totalInSegs
-	rp.stream_out_segs = totalOutSegs
-	rp.stream_repeat_segs = repeatSegs
+	sp.saveSessionStats(sp.sessionCounters(), tempResult)
 
 	tempResult.rto = uint(sp.conn.(*RUDP.UDPSession).GetRTO() * 1000)
 	tempResult.rtt = uint(sp.conn.(*RUDP.UDPSession).GetSRTTVar() * 1000) // ms to micro sec
@@ -260,7 +198,27 @@ func (r *rudpProto) statsCallback(test *IperfTest, sp *iperfStream, tempResult *
 	return 0
 }
 
-func (r *rudpProto) teardown(test *IperfTest) int {
+// rudpSnmp returns the counters rudp-go keeps for the whole process
+func rudpSnmp() session_counters {
+	snmp := RUDP.DefaultSnmp.Copy()
+
+	return session_counters{
+		retrans:       uint(snmp.RetransSegs),
+		lost:          uint(snmp.LostSegs),
+		early_retrans: uint(snmp.EarlyRetransSegs),
+		fast_retrans:  uint(snmp.FastRetransSegs),
+		recovered:     uint(snmp.FECRecovered),
+		in_pkts:       uint(snmp.InPkts),
+		out_pkts:      uint(snmp.OutPkts),
+		in_segs:       uint(snmp.InSegs),
+		out_segs:      uint(snmp.OutSegs),
+		repeat_segs:   uint(snmp.RepeatSegs),
+	}
+}
+
+func (r *rudpProto) Teardown(test *IperfTest) int {
+	test.closePacketConns()
+
 	if logging.GetLevel("r") == logging.INFO ||
 		logging.GetLevel("r") == logging.DEBUG {
 
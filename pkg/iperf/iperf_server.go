@@ -1,30 +1,69 @@
 package iperf
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"time"
 )
 
 func (test *IperfTest) serverListen() int {
-	listenAddr := ":"
-	listenAddr += strconv.Itoa(int(test.port))
+	listenAddr := test.listenAddr()
 
 	var err error
 
-	test.listener, err = net.Listen("tcp", listenAddr)
-
+	test.listener, err = test.listenTCP(false)
 	if err != nil {
+		Log.Errorf("Listen on %v failed. err = %v", listenAddr, err)
+
 		return -1
 	}
-	fmt.Printf("Server listening on %v\n", test.port)
+
+	if l, ok := test.listener.(*reusePortListener); ok && l.cpus != nil {
+		// the listeners take the sorted cpus in turn, the first round holds every one of them
+		cpus := l.cpus
+		for i := 1; i < len(cpus); i++ {
+			if cpus[i] == cpus[0] {
+				cpus = cpus[:i]
+
+				break
+			}
+		}
+
+		fmt.Printf("Server listening on %v with %v SO_REUSEPORT listeners, accept loops pinned to cpus %v\n", test.port,
+			test.listeners, formatCPUList(cpus))
+	} else if test.listeners > 1 {
+		fmt.Printf("Server listening on %v with %v SO_REUSEPORT listeners\n", test.port, test.listeners)
+	} else {
+		fmt.Printf("Server listening on %v\n", test.port)
+	}
 
 	return 0
 }
 
+// listenTCP opens the listener of the server port, an IPPROTO_MPTCP one if mptcp is set. With -listeners it
+// opens several SO_REUSEPORT listeners.
+func (test *IperfTest) listenTCP(mptcp bool) (net.Listener, error) {
+	if test.listeners > 1 {
+		l, err := test.listenReusePort(test.listeners, mptcp)
+		if err != nil {
+			return nil, err
+		}
+
+		return l, nil
+	}
+
+	if mptcp {
+		return mptcpListen(test.network("tcp"), test.listenAddr(), test.bindDevice)
+	}
+
+	lc := net.ListenConfig{Control: test.bindControl(nil)}
+
+	return lc.Listen(context.Background(), test.network("tcp"), test.listenAddr())
+}
+
 func (test *IperfTest) handleServerCtrlMsg() {
 	buf := make([]byte, 4) // only for ctrl state
 
@@ -107,7 +146,7 @@ func (test *IperfTest) handleServerCtrlMsg() {
 			Log.Debugf("Server reach IPERF_DONE")
 
 			test.ctrlChan <- IPERF_DONE
-			test.proto.teardown(test)
+			test.proto.Teardown(test)
 
 			return
 		case CLIENT_TERMINATE: //not used yet
@@ -137,14 +176,15 @@ func (test *IperfTest) createServerTimer() int {
 
 	cd := TimerClientData{p: test}
 
-	test.timer = timerCreate(now, serverTimerProc, cd, (test.duration+5)*1000) // convert sec to ms, add 5 sec to ensure client end first
-
-	times := test.duration * 1000 / test.interval
+	// without a duration the client decides when the test ends, after the bytes or blocks limit is reached
+	if test.duration != 0 {
+		test.timer = timerCreate(now, serverTimerProc, cd, (test.duration+test.omit+5)*1000) // convert sec to ms, add 5 sec to ensure client end first
+	}
 
-	test.statsTicker = tickerCreate(now, serverStatsTickerProc, cd, test.interval, times-1)
-	test.reportTicker = tickerCreate(now, serverReportTickerProc, cd, test.interval, times-1)
+	test.statsTicker = tickerCreate(now, serverStatsTickerProc, cd, test.interval, test.reportTimes())
+	test.reportTicker = tickerCreate(now, serverReportTickerProc, cd, test.interval, test.reportTimes())
 
-	if test.timer.timer == nil || test.statsTicker.ticker == nil || test.reportTicker.ticker == nil {
+	if (test.duration != 0 && test.timer.timer == nil) || test.statsTicker.ticker == nil || test.reportTicker.ticker == nil {
 		Log.Error("timer create failed.")
 	}
 
@@ -202,13 +242,17 @@ func serverReportTickerProc(data TimerClientData, now time.Time) {
 }
 
 func (test *IperfTest) createServerOmitTimer() int {
-	// undo, depend on which kind of timer
+	// no timer of its own, the stats callback ends the omit period at an interval boundary
+	test.omitting = test.omit != 0
+
 	return 0
 }
 
 func (test *IperfTest) runServer() int {
 	Log.Debugf("Enter run_server")
 
+	defer test.restoreAffinity() // the params may have pinned the process
+
 	if test.serverListen() < 0 {
 		Log.Error("Listen failed")
 
@@ -248,9 +292,12 @@ func (test *IperfTest) runServer() int {
 	go test.handleServerCtrlMsg() // coroutine handle control msg
 
 	if test.isServer == true {
-		listener, err := test.proto.listen(test)
+		test.snmpBase = test.snmpCounters()
+
+		listener, err := test.proto.Listen(test)
 		if err != nil {
 			Log.Error("proto listen error.")
+			test.sendServerError(err)
 
 			return -4
 		}
@@ -279,36 +326,50 @@ func (test *IperfTest) runServer() int {
 			} else if state == IPERF_CREATE_STREAM {
 				var streamNum uint = 0
 
-				for streamNum < test.streamNum {
-					protoConn, err := test.proto.accept(test)
+				// identified streams take the place of their index, whatever order they are accepted in
+				streams := make([]*iperfStream, test.streamCount())
+
+				for streamNum < test.streamCount() {
+					protoConn, err := test.proto.Accept(test)
 					if err != nil {
 						Log.Error("proto accept error.")
 
 						return -4
 					}
 
-					streamNum++
+					index := streamNum
+					if test.cookie != 0 {
+						if index, err = test.readStreamID(protoConn); err == nil && streams[index] != nil {
+							err = fmt.Errorf("stream %v connected twice", index)
+						}
 
-					var sp *iperfStream
+						if err != nil {
+							Log.Errorf("Refuse connection from %v. err = %v", protoConn.RemoteAddr(), err)
 
-					if test.mode == IPERF_SENDER {
-						sp = test.newStream(protoConn, SENDER_STREAM)
-					} else {
-						sp = test.newStream(protoConn, RECEIVER_STREAM)
+							protoConn.Close()
+
+							continue
+						}
 					}
 
+					sp := test.newStream(protoConn, test.streamRole(index))
+
+					streamNum++
+
 					if sp == nil {
 						Log.Error("Create new strema failed.")
 
 						return -4
 					}
 
-					test.streams = append(test.streams, sp)
+					streams[index] = sp
 
-					Log.Debugf("create new stream, stream_num = %v, target stream num = %v", streamNum, test.streamNum)
+					Log.Debugf("create new stream, stream_num = %v, target stream num = %v", streamNum, test.streamCount())
 				}
 
-				if streamNum == test.streamNum {
+				test.streams = streams
+
+				if streamNum == test.streamCount() {
 					if test.setSendState(TEST_START) != 0 {
 						Log.Errorf("set_send_state error")
 
@@ -335,7 +396,7 @@ func (test *IperfTest) runServer() int {
 						return -7
 					}
 
-					if test.mode == IPERF_SENDER {
+					if test.hasSender() {
 						if rtn := test.createSenderTicker(); rtn < 0 {
 							Log.Errorf("create_sender_ticker failed. rtn = %v", rtn)
 
@@ -353,13 +414,32 @@ func (test *IperfTest) runServer() int {
 				// Regular mode. Server receives.
 				Log.Info("Enter Test Running state...")
 
+				if test.crr {
+					// the client streams stay idle, new connections come in until the test ends
+					go test.crrAccept()
+
+					Log.Info("Server start accepting connections...")
+
+					continue
+				}
+
 				for i, sp := range test.streams {
 					if sp.role == SENDER_STREAM {
-						go sp.iperfSend(test)
+						if test.rr {
+							go sp.iperfRequest(test)
+						} else if test.setting.profile != "" {
+							go sp.iperfProfileSend(test)
+						} else {
+							go sp.iperfSend(test)
+						}
 
 						Log.Infof("Server Stream %v start sending.", i)
 					} else {
-						go sp.iperfRecv(test)
+						if test.rr {
+							go sp.iperfRespond(test)
+						} else {
+							go sp.iperfRecv(test)
+						}
 
 						Log.Infof("Server Stream %v start receiving.", i)
 					}
@@ -38,6 +38,9 @@ func (test *IperfTest) RunServerLoop() int {
 				return rtn
 			}
 
+			// 失败的测试同样要释放监听器和连接，否则下一次监听会失败
+			test.resetForNextTest()
+
 			// 根据错误类型决定等待时间
 			switch rtn {
 			case -1: // 监听失败
@@ -56,10 +59,12 @@ func (test *IperfTest) RunServerLoop() int {
 			fmt.Printf("[测试 #%d] 测试成功完成\n", testCount)
 
 			// 显示一些统计
-			if test.bytesReceived > 0 || test.bytesSent > 0 {
+			bytesReceived, _ := test.receivedTotals()
+			bytesSent, _ := test.sentTotals()
+			if bytesReceived > 0 || bytesSent > 0 {
 				fmt.Printf("  接收: %.2f MB, 发送: %.2f MB\n",
-					float64(test.bytesReceived)/1024/1024,
-					float64(test.bytesSent)/1024/1024)
+					float64(bytesReceived)/1024/1024,
+					float64(bytesSent)/1024/1024)
 			}
 
 			// 重置测试状态以准备下一次
@@ -86,6 +91,10 @@ func (test *IperfTest) resetForNextTest() {
 	test.bytesSent = 0
 	test.blocksReceived = 0
 	test.blocksSent = 0
+	test.bytesReceivedOmit = 0
+	test.bytesSentOmit = 0
+	test.blocksReceivedOmit = 0
+	test.blocksSentOmit = 0
 
 	// 重置状态
 	test.state = IPERF_START
@@ -103,6 +112,10 @@ func (test *IperfTest) resetForNextTest() {
 		test.protoListener = nil
 	}
 
+	// kcp / rudp 会话底层的连接
+	test.packetConns = nil
+	test.sessionConns = nil
+
 	// 关闭主监听器（如果有）
 	if test.listener != nil {
 		test.listener.Close()
@@ -127,9 +140,9 @@ func (test *IperfTest) resetForNextTest() {
 
 	// 重新初始化协议（保持原有协议设置）
 	if test.proto != nil {
-		protoName := test.proto.name()
+		protoName := test.proto.Name()
 		for _, p := range test.protocols {
-			if p.name() == protoName {
+			if p.Name() == protoName {
 				test.proto = p
 				break
 			}
@@ -0,0 +1,513 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"sync"
+
+	KCP "github.com/xtaci/kcp-go/v5"
+)
+
+// per session statistics: kcp-go and rudp-go count into one DefaultSnmp for the whole process, with several
+// sessions every stream would report the counters of all of them. With -session-stats a process running more than
+// one session reads and writes their sockets through a sessionStatsConn, which decodes the segment headers of the
+// packets and accounts them to the remote address of their session: packets, segments, retransmissions, repeated
+// segments and the data shards fec recovers. A retransmission counts as fast or early if the sender had seen acks
+// of later segments, fast from the -fr threshold on, as lost otherwise. With -crypt the conn decrypts a copy of
+// every packet. The conn costs the batched socket io of the library, so it is opt-in. Otherwise the first stream
+// reports DefaultSnmp and the others nothing, a single session gets its own counters that way, less what the
+// sessions of earlier tests of the process counted.
+
+const (
+	KCP_CRYPT_HEADER = 20 // nonce and crc32 of an encrypted packet
+	KCP_FEC_HEADER   = 8  // seqid, flag and size of a fec shard
+	KCP_FEC_DATA     = 0xf1
+	KCP_FEC_PARITY   = 0xf2
+	KCP_FEC_GROUPS   = 64      // fec groups of a session tracked for recoveries
+	KCP_RECV_WINDOW  = 1 << 16 // segments above the next expected one tracked for repeats
+)
+
+// session_counters are the totals of a kcp or rudp session, or of the process from DefaultSnmp
+type session_counters struct {
+	retrans       uint
+	lost          uint
+	early_retrans uint
+	fast_retrans  uint
+	recovered     uint
+	in_pkts       uint
+	out_pkts      uint
+	in_segs       uint
+	out_segs      uint
+	repeat_segs   uint
+}
+
+// sessionStats follows the segments of a session on the wire
+type sessionStats struct {
+	counters session_counters
+
+	/* sender */
+	inflight []inflightSegment // sent and not acked yet, by sn
+	sndNxt   uint32            // sn of the next new segment
+
+	/* receiver */
+	rcvNxt uint32                       // all segments below were received
+	rcvd   [KCP_RECV_WINDOW / 64]uint64 // segments received from rcvNxt on
+	fec    [KCP_FEC_GROUPS]fecGroup
+}
+
+type inflightSegment struct {
+	sn      uint32
+	ts      uint32 // of the last transmission
+	fastack uint32 // acks of later segments since
+}
+
+type fecGroup struct {
+	id     uint32
+	used   bool
+	done   bool // recovered or complete
+	shards uint
+	data   uint
+}
+
+// sessionStatsConn accounts the packets of the kcp or rudp sessions on a socket per remote address
+type sessionStatsConn struct {
+	net.PacketConn
+	block        KCP.BlockCrypt // -crypt, nil without
+	dataShards   uint           // 0 without fec
+	parityShards uint
+	fastResend   uint32 // -fr, 0 for no fast retransmissions
+
+	mu       sync.Mutex
+	plain    []byte // decrypted copy of a packet
+	sessions map[netip.AddrPort]*sessionStats
+}
+
+// countsSessions reports whether the kcp or rudp sessions are counted on the wire, with -session-stats if there
+// are several
+func (test *IperfTest) countsSessions() bool {
+	return test.setting.sessionStats && test.streamCount() > 1
+}
+
+// sessionStatsName describes how the sessions are counted for Print
+func (test *IperfTest) sessionStatsName() string {
+	if test.countsSessions() {
+		return "per session"
+	}
+
+	if test.streamCount() > 1 {
+		return "process on the first stream"
+	}
+
+	return "process"
+}
+
+// countSessions returns pc as the socket of kcp or rudp sessions, wrapped to count them if there are several.
+// fec tells if the sessions send fec shards, only kcp does.
+func (test *IperfTest) countSessions(pc net.PacketConn, block KCP.BlockCrypt, fec bool) net.PacketConn {
+	if !test.countsSessions() {
+		return pc
+	}
+
+	c := &sessionStatsConn{PacketConn: pc, block: block, fastResend: uint32(test.setting.fastResend),
+		sessions: make(map[netip.AddrPort]*sessionStats)}
+
+	if fec && test.setting.dataShards > 0 && test.setting.parityShards > 0 {
+		c.dataShards = test.setting.dataShards
+		c.parityShards = test.setting.parityShards
+	}
+
+	test.sessionConns = append(test.sessionConns, c)
+
+	return c
+}
+
+func (c *sessionStatsConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.account(addr, b[:n], false)
+	}
+
+	return n, addr, err
+}
+
+func (c *sessionStatsConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.account(addr, b, true)
+	}
+
+	return n, err
+}
+
+// SetReadBuffer and SetWriteBuffer reach the socket, the sessions and their listener size it with them
+func (c *sessionStatsConn) SetReadBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetReadBuffer(int) error }); ok {
+		return conn.SetReadBuffer(bytes)
+	}
+
+	return fmt.Errorf("set read buffer on %T", c.PacketConn)
+}
+
+func (c *sessionStatsConn) SetWriteBuffer(bytes int) error {
+	if conn, ok := c.PacketConn.(interface{ SetWriteBuffer(int) error }); ok {
+		return conn.SetWriteBuffer(bytes)
+	}
+
+	return fmt.Errorf("set write buffer on %T", c.PacketConn)
+}
+
+// counters returns the totals of the session with remote
+func (c *sessionStatsConn) counters(remote net.Addr) session_counters {
+	key, ok := sessionKey(remote)
+	if !ok {
+		return session_counters{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s := c.sessions[key]; s != nil {
+		return s.counters
+	}
+
+	return session_counters{}
+}
+
+func sessionKey(addr net.Addr) (netip.AddrPort, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.AddrPort{}, false
+	}
+
+	ap := udpAddr.AddrPort()
+
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// account decodes a packet sent to or received from addr
+func (c *sessionStatsConn) account(addr net.Addr, p []byte, out bool) {
+	key, ok := sessionKey(addr)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.sessions[key]
+	if s == nil {
+		s = new(sessionStats)
+		c.sessions[key] = s
+	}
+
+	if out {
+		s.counters.out_pkts++
+	} else {
+		s.counters.in_pkts++
+	}
+
+	data := p
+
+	if c.block != nil {
+		if len(data) < KCP_CRYPT_HEADER {
+			return
+		}
+
+		if cap(c.plain) < len(data) {
+			c.plain = make([]byte, len(data))
+		}
+
+		plain := c.plain[:len(data)]
+		c.block.Decrypt(plain, data)
+
+		if crc32.ChecksumIEEE(plain[KCP_CRYPT_HEADER:]) != binary.LittleEndian.Uint32(plain[KCP_CRYPT_HEADER-4:]) {
+			return
+		}
+
+		data = plain[KCP_CRYPT_HEADER:]
+	}
+
+	// kcp commands and fragments never make up the fec flags
+	if len(data) >= KCP_FEC_HEADER {
+		if flag := binary.LittleEndian.Uint16(data[4:]); flag == KCP_FEC_DATA || flag == KCP_FEC_PARITY {
+			if !out && c.dataShards > 0 {
+				s.fecShard(binary.LittleEndian.Uint32(data), flag == KCP_FEC_DATA, c.dataShards, c.parityShards)
+			}
+
+			if flag == KCP_FEC_PARITY {
+				return
+			}
+
+			data = data[KCP_FEC_HEADER:]
+		}
+	}
+
+	// conv, cmd, frg, wnd, ts, sn, una and len, rudp keeps the layout of kcp
+	for len(data) >= KCP.IKCP_OVERHEAD {
+		cmd := data[4]
+		ts := binary.LittleEndian.Uint32(data[8:])
+		sn := binary.LittleEndian.Uint32(data[12:])
+		una := binary.LittleEndian.Uint32(data[16:])
+		length := binary.LittleEndian.Uint32(data[20:])
+
+		data = data[KCP.IKCP_OVERHEAD:]
+		if uint32(len(data)) < length {
+			return
+		}
+
+		data = data[length:]
+
+		if out {
+			s.sent(cmd, ts, sn, c.fastResend)
+		} else {
+			s.received(cmd, ts, sn, una)
+		}
+	}
+}
+
+// snDiff compares sequence numbers and timestamps across their wrap around
+func snDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// sent accounts a segment the session sent, a push below sndNxt is a retransmission
+func (s *sessionStats) sent(cmd uint8, ts, sn, fastResend uint32) {
+	s.counters.out_segs++
+
+	if cmd != KCP.IKCP_CMD_PUSH {
+		return
+	}
+
+	if snDiff(sn, s.sndNxt) >= 0 {
+		s.inflight = append(s.inflight, inflightSegment{sn: sn, ts: ts})
+		s.sndNxt = sn + 1
+
+		return
+	}
+
+	s.counters.retrans++
+
+	for k := range s.inflight {
+		seg := &s.inflight[k]
+		if seg.sn != sn {
+			continue
+		}
+
+		switch {
+		case fastResend > 0 && seg.fastack >= fastResend:
+			s.counters.fast_retrans++
+		case seg.fastack > 0:
+			s.counters.early_retrans++
+		default:
+			s.counters.lost++
+		}
+
+		seg.fastack = 0
+		seg.ts = ts
+
+		return
+	}
+
+	// the ack crossed the retransmission
+	s.counters.lost++
+}
+
+// received accounts a segment the session received
+func (s *sessionStats) received(cmd uint8, ts, sn, una uint32) {
+	s.counters.in_segs++
+
+	// every segment acks what is below una
+	k := 0
+	for k < len(s.inflight) && snDiff(una, s.inflight[k].sn) > 0 {
+		k++
+	}
+
+	s.inflight = s.inflight[k:]
+
+	switch cmd {
+	case KCP.IKCP_CMD_ACK:
+		for k := 0; k < len(s.inflight); k++ {
+			seg := &s.inflight[k]
+
+			if seg.sn == sn {
+				s.inflight = append(s.inflight[:k], s.inflight[k+1:]...)
+				k--
+			} else if snDiff(sn, seg.sn) < 0 {
+				break
+			} else if snDiff(seg.ts, ts) <= 0 {
+				seg.fastack++
+			}
+		}
+	case KCP.IKCP_CMD_PUSH:
+		if s.push(sn) {
+			s.counters.repeat_segs++
+		}
+	}
+}
+
+// push marks sn received, it reports whether it was before
+func (s *sessionStats) push(sn uint32) bool {
+	if snDiff(sn, s.rcvNxt) < 0 {
+		return true
+	}
+
+	// a segment never seen, recovered by fec, holds the window, slide it
+	if snDiff(sn, s.rcvNxt) >= KCP_RECV_WINDOW {
+		if snDiff(sn, s.rcvNxt) >= 2*KCP_RECV_WINDOW {
+			s.rcvd = [KCP_RECV_WINDOW / 64]uint64{}
+			s.rcvNxt = sn - KCP_RECV_WINDOW + 1
+		}
+
+		for snDiff(sn, s.rcvNxt) >= KCP_RECV_WINDOW {
+			s.clearRcvd(s.rcvNxt)
+			s.rcvNxt++
+		}
+	}
+
+	i := sn % KCP_RECV_WINDOW
+	if s.rcvd[i/64]&(1<<(i%64)) != 0 {
+		return true
+	}
+
+	s.rcvd[i/64] |= 1 << (i % 64)
+
+	for s.rcvd[(s.rcvNxt%KCP_RECV_WINDOW)/64]&(1<<(s.rcvNxt%64)) != 0 {
+		s.clearRcvd(s.rcvNxt)
+		s.rcvNxt++
+	}
+
+	return false
+}
+
+func (s *sessionStats) clearRcvd(sn uint32) {
+	i := sn % KCP_RECV_WINDOW
+	s.rcvd[i/64] &^= 1 << (i % 64)
+}
+
+// fecShard accounts a received fec shard, a group recovers the data shards it misses once it holds as many
+// shards as it has data shards
+func (s *sessionStats) fecShard(seqid uint32, data bool, dataShards, parityShards uint) {
+	id := seqid / uint32(dataShards+parityShards)
+
+	g := &s.fec[id%KCP_FEC_GROUPS]
+	if !g.used || g.id != id {
+		if g.used && snDiff(id, g.id) < 0 {
+			return // too late
+		}
+
+		*g = fecGroup{id: id, used: true}
+	}
+
+	if g.done {
+		return
+	}
+
+	g.shards++
+	if data {
+		g.data++
+	}
+
+	if g.shards >= dataShards {
+		g.done = true
+		s.counters.recovered += dataShards - g.data
+	}
+}
+
+// sessionCounters returns the totals of the session of a kcp or rudp stream. Unless the sessions are counted on
+// the wire they are what DefaultSnmp added since the streams were created, it also counts the tests before. The
+// first stream takes them for all sessions then, so the sum holds.
+func (sp *iperfStream) sessionCounters() session_counters {
+	for _, c := range sp.test.sessionConns {
+		if c.LocalAddr().String() == sp.conn.LocalAddr().String() {
+			return c.counters(sp.conn.RemoteAddr())
+		}
+	}
+
+	if len(sp.test.streams) > 0 && sp != sp.test.streams[0] {
+		return session_counters{}
+	}
+
+	return sp.test.snmpCounters().since(sp.test.snmpBase)
+}
+
+// snmpCounters returns the DefaultSnmp of the library of the protocol, zero for the others
+func (test *IperfTest) snmpCounters() session_counters {
+	switch test.proto.Name() {
+	case KCP_NAME:
+		return kcpSnmp()
+	case RUDP_NAME:
+		return rudpSnmp()
+	}
+
+	return session_counters{}
+}
+
+// since returns what the counters added to base
+func (c session_counters) since(base session_counters) session_counters {
+	delta := func(cur, prev uint) uint {
+		return uint(counterDelta(uint64(cur), uint64(prev)))
+	}
+
+	return session_counters{
+		retrans:       delta(c.retrans, base.retrans),
+		lost:          delta(c.lost, base.lost),
+		early_retrans: delta(c.early_retrans, base.early_retrans),
+		fast_retrans:  delta(c.fast_retrans, base.fast_retrans),
+		recovered:     delta(c.recovered, base.recovered),
+		in_pkts:       delta(c.in_pkts, base.in_pkts),
+		out_pkts:      delta(c.out_pkts, base.out_pkts),
+		in_segs:       delta(c.in_segs, base.in_segs),
+		out_segs:      delta(c.out_segs, base.out_segs),
+		repeat_segs:   delta(c.repeat_segs, base.repeat_segs),
+	}
+}
+
+// saveSessionStats turns the totals of a kcp or rudp session into the interval and stream results
+func (sp *iperfStream) saveSessionStats(c session_counters, tempResult *iperf_interval_results) {
+	rp := sp.result
+
+	// retrans
+	tempResult.interval_retrans = c.retrans - rp.stream_prev_total_retrans
+	rp.stream_retrans += tempResult.interval_retrans
+	rp.stream_prev_total_retrans = c.retrans
+
+	// lost
+	tempResult.interval_lost = c.lost - rp.stream_prev_total_lost
+	rp.stream_lost += tempResult.interval_lost
+	rp.stream_prev_total_lost = c.lost
+
+	// early retrans
+	tempResult.interval_early_retrans = c.early_retrans - rp.stream_prev_total_early_retrans
+	rp.stream_early_retrans += tempResult.interval_early_retrans
+	rp.stream_prev_total_early_retrans = c.early_retrans
+
+	// fast retrans
+	tempResult.interval_fast_retrans = c.fast_retrans - rp.stream_prev_total_fast_retrans
+	rp.stream_fast_retrans += tempResult.interval_fast_retrans
+	rp.stream_prev_total_fast_retrans = c.fast_retrans
+
+	// counters are totals, leave out what was counted up to the end of the omit period
+	if tempResult.omitted != 0 {
+		rp.stream_omit_recovers = c.recovered
+		rp.stream_omit_in_pkts = c.in_pkts
+		rp.stream_omit_out_pkts = c.out_pkts
+		rp.stream_omit_in_segs = c.in_segs
+		rp.stream_omit_out_segs = c.out_segs
+		rp.stream_omit_repeat_segs = c.repeat_segs
+	}
+
+	// recover
+	rp.stream_recovers = c.recovered - rp.stream_omit_recovers
+
+	// packets receive
+	rp.stream_in_pkts = c.in_pkts - rp.stream_omit_in_pkts
+	rp.stream_out_pkts = c.out_pkts - rp.stream_omit_out_pkts
+
+	// segs receive
+	rp.stream_in_segs = c.in_segs - rp.stream_omit_in_segs
+	rp.stream_out_segs = c.out_segs - rp.stream_omit_out_segs
+	rp.stream_repeat_segs = c.repeat_segs - rp.stream_omit_repeat_segs
+}
@@ -0,0 +1,257 @@
+package iperf
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	KCP "github.com/xtaci/kcp-go/v5"
+)
+
+// kcpSegment encodes a kcp segment with a payload of size bytes
+func kcpSegment(cmd uint8, ts, sn, una uint32, size int) []byte {
+	b := make([]byte, KCP.IKCP_OVERHEAD+size)
+	binary.LittleEndian.PutUint32(b[0:], 1) // conv
+	b[4] = cmd
+	binary.LittleEndian.PutUint16(b[6:], 128) // wnd
+	binary.LittleEndian.PutUint32(b[8:], ts)
+	binary.LittleEndian.PutUint32(b[12:], sn)
+	binary.LittleEndian.PutUint32(b[16:], una)
+	binary.LittleEndian.PutUint32(b[20:], uint32(size))
+
+	return b
+}
+
+// fecShard puts a fec header in front of the segments
+func fecShard(seqid uint32, flag uint16, segs ...[]byte) []byte {
+	b := make([]byte, KCP_FEC_HEADER)
+	binary.LittleEndian.PutUint32(b[0:], seqid)
+	binary.LittleEndian.PutUint16(b[4:], flag)
+
+	for _, s := range segs {
+		b = append(b, s...)
+	}
+
+	binary.LittleEndian.PutUint16(b[6:], uint16(len(b)-6))
+
+	return b
+}
+
+// sessionPacket is a packet a sessionStatsConn accounts
+type sessionPacket struct {
+	out  bool
+	data []byte
+}
+
+func TestSessionStatsAccount(t *testing.T) {
+	push := func(ts, sn, una uint32) []byte {
+		return kcpSegment(KCP.IKCP_CMD_PUSH, ts, sn, una, 100)
+	}
+
+	ack := func(ts, sn, una uint32) []byte {
+		return kcpSegment(KCP.IKCP_CMD_ACK, ts, sn, una, 0)
+	}
+
+	concat := func(segs ...[]byte) []byte {
+		var b []byte
+		for _, s := range segs {
+			b = append(b, s...)
+		}
+
+		return b
+	}
+
+	cases := []struct {
+		name       string
+		fastResend uint32
+		fec        bool
+		packets    []sessionPacket
+		want       session_counters
+	}{
+		{
+			name: "sent and acked",
+			packets: []sessionPacket{
+				{true, concat(push(10, 0, 0), push(10, 1, 0))},
+				{false, concat(ack(10, 0, 0), ack(10, 1, 1))},
+			},
+			want: session_counters{in_pkts: 1, out_pkts: 1, in_segs: 2, out_segs: 2},
+		},
+		{
+			name:       "retransmissions",
+			fastResend: 2,
+			packets: []sessionPacket{
+				{true, concat(push(10, 0, 0), push(10, 1, 0), push(10, 2, 0), push(10, 3, 0))},
+				{false, ack(10, 2, 0)},
+				{false, ack(10, 3, 0)},
+				{true, push(20, 0, 0)}, // two acks of later segments
+				{true, push(20, 1, 0)}, // the same
+				{false, ack(20, 0, 0)},
+				{true, push(30, 0, 0)}, // acked already
+				{false, ack(30, 1, 2)},
+			},
+			want: session_counters{retrans: 3, lost: 1, fast_retrans: 2, in_pkts: 4, out_pkts: 4, in_segs: 4, out_segs: 7},
+		},
+		{
+			name:       "early and lost retransmissions",
+			fastResend: 3,
+			packets: []sessionPacket{
+				{true, concat(push(10, 0, 0), push(10, 1, 0), push(10, 2, 0))},
+				{false, ack(10, 1, 0)},
+				{true, push(20, 0, 0)}, // one ack of a later segment
+				{true, push(30, 2, 0)}, // none
+			},
+			want: session_counters{retrans: 2, lost: 1, early_retrans: 1, in_pkts: 1, out_pkts: 3, in_segs: 1, out_segs: 5},
+		},
+		{
+			name: "repeated segments",
+			packets: []sessionPacket{
+				{false, push(10, 0, 0)},
+				{false, push(10, 2, 0)},
+				{false, push(10, 2, 0)},
+				{false, push(10, 1, 0)},
+				{false, push(10, 0, 0)},
+			},
+			want: session_counters{in_pkts: 5, in_segs: 5, repeat_segs: 2},
+		},
+		{
+			name: "fec recovers",
+			fec:  true,
+			packets: []sessionPacket{
+				// group 0 misses its second data shard, the parity one recovers it
+				{false, fecShard(0, KCP_FEC_DATA, push(10, 0, 0))},
+				{false, fecShard(2, KCP_FEC_PARITY)},
+				// group 1 is complete, its parity shard comes too late to matter
+				{false, fecShard(3, KCP_FEC_DATA, push(10, 2, 0))},
+				{false, fecShard(4, KCP_FEC_DATA, push(10, 3, 0))},
+				{false, fecShard(5, KCP_FEC_PARITY)},
+				// the data shards sent
+				{true, fecShard(6, KCP_FEC_DATA, ack(10, 3, 4))},
+			},
+			want: session_counters{recovered: 1, in_pkts: 5, out_pkts: 1, in_segs: 3, out_segs: 1},
+		},
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5201}
+
+	for _, c := range cases {
+		conn := &sessionStatsConn{fastResend: c.fastResend, sessions: make(map[netip.AddrPort]*sessionStats)}
+		if c.fec {
+			conn.dataShards, conn.parityShards = 2, 1
+		}
+
+		for _, p := range c.packets {
+			conn.account(addr, p.data, p.out)
+		}
+
+		if got := conn.counters(addr); got != c.want {
+			t.Errorf("%v: counters = %+v, want %+v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSessionStatsCrypt(t *testing.T) {
+	block, err := newBlockCrypt("aes", cryptKey("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nonce, crc32 of the rest and the segments, encrypted as a whole the way kcp-go sends them
+	encrypt := func(segs []byte) []byte {
+		plain := make([]byte, KCP_CRYPT_HEADER+len(segs))
+		copy(plain[KCP_CRYPT_HEADER:], segs)
+		binary.LittleEndian.PutUint32(plain[KCP_CRYPT_HEADER-4:], crc32.ChecksumIEEE(segs))
+
+		b := make([]byte, len(plain))
+		block.Encrypt(b, plain)
+
+		return b
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5201}
+	conn := &sessionStatsConn{block: block, sessions: make(map[netip.AddrPort]*sessionStats)}
+
+	conn.account(addr, encrypt(kcpSegment(KCP.IKCP_CMD_PUSH, 10, 0, 0, 100)), false)
+	conn.account(addr, encrypt(kcpSegment(KCP.IKCP_CMD_PUSH, 10, 0, 0, 100)), false)
+	conn.account(addr, encrypt(kcpSegment(KCP.IKCP_CMD_ACK, 10, 0, 1, 0)), true)
+
+	// another key fails the checksum, the packet counts without its segments
+	conn.account(addr, kcpSegment(KCP.IKCP_CMD_PUSH, 10, 1, 0, 100), false)
+	conn.account(addr, make([]byte, KCP_CRYPT_HEADER-1), false)
+
+	want := session_counters{in_pkts: 4, out_pkts: 1, in_segs: 2, out_segs: 1, repeat_segs: 1}
+	if got := conn.counters(addr); got != want {
+		t.Errorf("counters = %+v, want %+v", got, want)
+	}
+}
+
+func TestSessionCountersSince(t *testing.T) {
+	base := session_counters{retrans: 5, in_pkts: 100, out_pkts: 80, in_segs: 120, out_segs: 90}
+	cur := session_counters{retrans: 7, in_pkts: 150, out_pkts: 80, in_segs: 170, out_segs: 4}
+
+	// out_segs started over
+	want := session_counters{retrans: 2, in_pkts: 50, in_segs: 50, out_segs: 4}
+	if got := cur.since(base); got != want {
+		t.Errorf("since = %+v, want %+v", got, want)
+	}
+}
+
+func TestCountSessions(t *testing.T) {
+	cases := []struct {
+		name         string
+		streams      uint
+		bidir        bool
+		sessionStats bool
+		counts       bool
+	}{
+		{name: "single", streams: 1},
+		{name: "single -session-stats", streams: 1, sessionStats: true},
+		{name: "-P", streams: 2},
+		{name: "-P -session-stats", streams: 2, sessionStats: true, counts: true},
+		{name: "--bidir -session-stats", streams: 1, bidir: true, sessionStats: true, counts: true},
+	}
+
+	for _, c := range cases {
+		test := NewIperfTest()
+		test.Init()
+		test.setProtocol(KCP_NAME)
+		test.streamNum = c.streams
+		test.bidir = c.bidir
+		test.setting.sessionStats = c.sessionStats
+
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, wrapped := test.countSessions(pc, nil, true).(*sessionStatsConn)
+		pc.Close()
+
+		if test.countsSessions() != c.counts || wrapped != c.counts {
+			t.Errorf("%v: countsSessions = %v, socket wrapped %v, want %v", c.name, test.countsSessions(), wrapped,
+				c.counts)
+		}
+	}
+
+	// the counters of the library go to the first stream only, the sum holds
+	test := NewIperfTest()
+	test.Init()
+	test.setProtocol(KCP_NAME)
+	test.streamNum = 2
+	test.snmpBase = test.snmpCounters()
+	atomic.AddUint64(&KCP.DefaultSnmp.OutPkts, 10)
+
+	first := &iperfStream{test: test}
+	second := &iperfStream{test: test}
+	test.streams = []*iperfStream{first, second}
+
+	if got := first.sessionCounters(); got.out_pkts < 10 {
+		t.Errorf("first stream: %+v, want the counters of the process", got)
+	}
+
+	if got := second.sessionCounters(); got != (session_counters{}) {
+		t.Errorf("second stream: %+v, want none", got)
+	}
+}
@@ -2,19 +2,20 @@ package iperf
 
 import (
 	"errors"
+	"fmt"
 	"net"
-	"strconv"
-	"time"
+	"net/netip"
+	"strings"
 )
 
 type TCPProto struct {
 }
 
-func (t *TCPProto) name() string {
+func (t *TCPProto) Name() string {
 	return TCP_NAME
 }
 
-func (t *TCPProto) accept(test *IperfTest) (net.Conn, error) {
+func (t *TCPProto) Accept(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter TCP accept")
 
 	conn, err := test.protoListener.Accept()
@@ -25,26 +26,54 @@ func (t *TCPProto) accept(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (t *TCPProto) listen(test *IperfTest) (net.Listener, error) {
+func (t *TCPProto) Listen(test *IperfTest) (net.Listener, error) {
 	Log.Debugf("Enter TCP listen")
 
+	if test.setting.congestion != "" {
+		if err := checkCongestion(test.setting.congestion); err != nil {
+			Log.Errorf("%v", err)
+
+			return nil, err
+		}
+	}
+
+	if test.tcpSockopts() {
+		// the data streams are accepted from the control listener and inherit its options. It is opened
+		// again for every test, so the options do not outlive this one.
+		if err := test.setListenerSockopts(); err != nil {
+			Log.Errorf("Set -w / -M / -C / -S on the listener failed. err = %v", err)
+
+			return nil, err
+		}
+	}
+
 	return test.listener, nil
 }
 
-func (t *TCPProto) connect(test *IperfTest) (net.Conn, error) {
+func (t *TCPProto) Connect(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter TCP connect")
 
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", test.addr+":"+strconv.Itoa(int(test.port)))
+	laddr, err := test.localAddr(true)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	return t.dial(test, laddr)
+}
+
+// dial connects a data stream from laddr
+func (t *TCPProto) dial(test *IperfTest, laddr netip.AddrPort) (net.Conn, error) {
+	dialAddr := laddr
+	if test.setting.flowLabel != 0 {
+		dialAddr = netip.AddrPort{} // the hook binds the socket before it connects with the flow label
+	}
+
+	conn, err := test.dialTCP(dialAddr, test.tcpSockoptControl(laddr))
 	if err != nil {
 		return nil, err
 	}
 
-	err = conn.SetDeadline(time.Now().Add(time.Duration(test.duration+5) * time.Second))
+	err = conn.SetDeadline(test.streamDeadline())
 	if err != nil {
 		Log.Errorf("SetDeadline err: %v", err)
 
@@ -54,8 +83,15 @@ func (t *TCPProto) connect(test *IperfTest) (net.Conn, error) {
 	return conn, nil
 }
 
-func (t *TCPProto) send(sp *iperfStream) int {
-	n, err := sp.conn.(*net.TCPConn).Write(sp.buffer)
+func (t *TCPProto) Send(sp *iperfStream) int {
+	var n int
+	var err error
+
+	if sp.zc != nil {
+		n, err = sp.zc.send(sp.conn, len(sp.buffer))
+	} else {
+		n, err = sp.conn.(*net.TCPConn).Write(sp.buffer)
+	}
 	if err != nil {
 		var serr *net.OpError
 
@@ -82,7 +118,7 @@ func (t *TCPProto) send(sp *iperfStream) int {
 	return n
 }
 
-func (t *TCPProto) recv(sp *iperfStream) int {
+func (t *TCPProto) Recv(sp *iperfStream) int {
 	n, err := sp.conn.(*net.TCPConn).Read(sp.buffer)
 	if err != nil {
 		var serr *net.OpError
@@ -109,7 +145,26 @@ func (t *TCPProto) recv(sp *iperfStream) int {
 	return n
 }
 
-func (t *TCPProto) init(test *IperfTest) int {
+func (t *TCPProto) Init(test *IperfTest) int {
+	test.setPacing()
+
+	if test.setting.zeroCopy {
+		for i, sp := range test.streams {
+			if sp.role != SENDER_STREAM {
+				continue
+			}
+
+			zc, err := newZeroCopy(sp, test.setting.zeroCopyMsg)
+			if err != nil {
+				Log.Warningf("Stream %v zero copy unavailable, send with copy. err = %v", i, err)
+
+				continue
+			}
+
+			sp.zc = zc
+		}
+	}
+
 	if test.noDelay {
 		for _, sp := range test.streams {
 			err := sp.conn.(*net.TCPConn).SetNoDelay(test.noDelay)
@@ -121,36 +176,142 @@ func (t *TCPProto) init(test *IperfTest) int {
 		}
 	}
 
-	return 0
-}
+	for i, sp := range test.streams {
+		name, err := tcpCongestion(sp.conn)
+		if err != nil {
+			Log.Debugf("Stream %v congestion control unavailable. err = %v", i, err)
 
-func (t *TCPProto) statsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
-	if test.proto.name() == TCP_NAME {
-		rp := sp.result
+			continue
+		}
 
-		saveTCPInfo(sp, tempResult)
+		sp.result.congestion = name
 
-		totalRetrans := tempResult.interval_retrans // get the temporarily stored result
-		tempResult.interval_retrans = totalRetrans - rp.stream_prev_total_retrans
+		if test.setting.congestion != "" {
+			fmt.Printf(CONGESTION_REPORT, test.streamLabel(i, sp), name, test.setting.congestion)
+		}
+	}
 
-		rp.stream_retrans += tempResult.interval_retrans
-		rp.stream_prev_total_retrans = totalRetrans
+	if test.setting.window != 0 || test.setting.mss != 0 {
+		printWindowMSS(test)
+	}
 
-		if rp.stream_min_rtt == 0 || tempResult.rtt < rp.stream_min_rtt {
-			rp.stream_min_rtt = tempResult.rtt
+	if test.checkTOS() {
+		// the receiver streams check the tos. The streams are marked again, those accepted from an mptcp
+		// listener do not inherit the ipv6 traffic class.
+		for i, sp := range test.streams {
+			err := controlFd(sp.conn, func(fd int) error {
+				if err := setTOS(uintptr(fd), test.setting.tos); err != nil || sp.role != RECEIVER_STREAM {
+					return err
+				}
+
+				return enableRecvTOS(uintptr(fd))
+			})
+			if err != nil {
+				Log.Warningf("Stream %v can not set or check the tos. err = %v", i, err)
+			}
 		}
+	}
 
-		if rp.stream_max_rtt == 0 || tempResult.rtt > rp.stream_max_rtt {
-			rp.stream_max_rtt = tempResult.rtt
+	return 0
+}
+
+// printWindowMSS prints the socket buffers and the MSS the kernel granted each stream next to the requested ones
+func printWindowMSS(test *IperfTest) {
+	requested := func(v uint) interface{} {
+		if v == 0 {
+			return "default"
 		}
 
-		rp.stream_sum_rtt += tempResult.rtt
-		rp.stream_cnt_rtt++
+		return v
+	}
+
+	for i, sp := range test.streams {
+		snd, rcv, mss, err := tcpWindowMSS(sp.conn)
+		if err != nil {
+			Log.Warningf("Stream %v socket buffer and mss unavailable. err = %v", i, err)
+
+			continue
+		}
+
+		fmt.Printf(WINDOW_REPORT, test.streamLabel(i, sp), snd, rcv, requested(test.setting.window), mss,
+			requested(test.setting.mss))
+	}
+}
+
+func (t *TCPProto) StatsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
+	if test.proto.Name() == TCP_NAME {
+		saveTCPInfo(sp, tempResult)
+		updateTCPStats(sp, tempResult)
+	}
+
+	if test.checkTOS() && sp.role == RECEIVER_STREAM {
+		sp.tosSample()
 	}
 
 	return 0
 }
 
-func (t *TCPProto) teardown(test *IperfTest) int {
+// updateTCPStats turns the total retrans and TCP_INFO counters stored in tempResult into the interval values
+// and accumulates rtt.
+func updateTCPStats(sp *iperfStream, tempResult *iperf_interval_results) {
+	rp := sp.result
+
+	sp.tcpInfoInterval(tempResult)
+
+	totalRetrans := tempResult.interval_retrans // get the temporarily stored result
+	tempResult.interval_retrans = totalRetrans - rp.stream_prev_total_retrans
+
+	rp.stream_retrans += tempResult.interval_retrans
+	rp.stream_prev_total_retrans = totalRetrans
+
+	if rp.stream_min_rtt == 0 || tempResult.rtt < rp.stream_min_rtt {
+		rp.stream_min_rtt = tempResult.rtt
+	}
+
+	if rp.stream_max_rtt == 0 || tempResult.rtt > rp.stream_max_rtt {
+		rp.stream_max_rtt = tempResult.rtt
+	}
+
+	rp.stream_sum_rtt += tempResult.rtt
+	rp.stream_cnt_rtt++
+}
+
+func (t *TCPProto) Teardown(test *IperfTest) int {
+	for _, sp := range test.streams {
+		if sp.zc != nil {
+			sp.zc.close()
+		}
+	}
+
 	return 0
 }
+
+// checkCongestion tells whether the kernel offers the congestion control algorithm name
+func checkCongestion(name string) error {
+	available, err := availableCongestion()
+	if err != nil {
+		return fmt.Errorf("congestion control %v can not be checked. err = %v", name, err)
+	}
+
+	for _, a := range available {
+		if a == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("congestion control %v not available, the kernel offers: %v", name, strings.Join(available, " "))
+}
+
+// printCongestion prints the congestion control both ends of a stream ran, the sender's one drives the transfer
+func (test *IperfTest) printCongestion(i int, sp *iperfStream) {
+	if test.setting.congestion == "" {
+		return
+	}
+
+	sender, receiver := sp.result.congestion, sp.result.peer_congestion
+	if sp.role == RECEIVER_STREAM {
+		sender, receiver = receiver, sender
+	}
+
+	fmt.Printf(CONGESTION_RESULT_REPORT, test.streamLabel(i, sp), sender, receiver)
+}
@@ -0,0 +1,266 @@
+package iperf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	fn()
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+	r.Close()
+
+	return string(out)
+}
+
+// tcpPair connects a data stream of client to one accepted by server on the loopback, with the options of each end
+func tcpPair(t *testing.T, client, server *IperfTest) (net.Conn, net.Conn) {
+	for _, test := range []*IperfTest{client, server} {
+		test.Init()
+		if test.setProtocol(TCP_NAME) < 0 {
+			t.Fatalf("setProtocol failed for tcp")
+		}
+	}
+
+	server.isServer = true
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { ln.Close() })
+
+	server.listener = ln
+	if server.protoListener, err = server.proto.Listen(server); err != nil {
+		t.Fatal(err)
+	}
+
+	client.addr = "127.0.0.1"
+	client.port = uint(ln.Addr().(*net.TCPAddr).Port)
+	client.ipVersion = 4
+
+	cconn, err := client.proto.Connect(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { cconn.Close() })
+
+	sconn, err := server.proto.Accept(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { sconn.Close() })
+
+	return cconn, sconn
+}
+
+func TestWindowMSS(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("-w and -M are read back on linux only")
+	}
+
+	const window, mss = 64 * 1024, 1000
+
+	// the mss is announced in the syn and the window scale chosen from the receive buffer at syn time. The
+	// end without the options ends up with the mss the other end announced.
+	cases := []struct {
+		name           string
+		client, server bool // the end with -w and -M
+	}{
+		{name: "client", client: true},
+		{name: "server", server: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := NewIperfTest(), NewIperfTest()
+			withOpts, withoutOpts := client, server
+			if c.server {
+				withOpts, withoutOpts = server, client
+			}
+
+			withOpts.setting.window = window
+			withOpts.setting.mss = mss
+
+			cconn, sconn := tcpPair(t, client, server)
+
+			conns := map[*IperfTest]net.Conn{client: cconn, server: sconn}
+
+			// linux doubles the buffer sizes it grants
+			snd, rcv, got, err := tcpWindowMSS(conns[withOpts])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if snd != 2*window || rcv != 2*window || got > mss {
+				t.Errorf("with the options: snd %v, rcv %v, mss %v, want %v, %v and at most %v", snd, rcv, got,
+					2*window, 2*window, mss)
+			}
+
+			if _, _, got, err = tcpWindowMSS(conns[withoutOpts]); err != nil || got > mss {
+				t.Errorf("the other end: mss %v, %v, want at most %v", got, err, mss)
+			}
+
+			// what is printed is what the kernel reports
+			snd, rcv, got, _ = tcpWindowMSS(conns[withOpts])
+			want := fmt.Sprintf(WINDOW_REPORT, 0, snd, rcv, window, got, mss)
+
+			withOpts.streams = []*iperfStream{withOpts.newStream(conns[withOpts], SENDER_STREAM)}
+			if out := captureStdout(t, func() { printWindowMSS(withOpts) }); out != want {
+				t.Errorf("printed %q, want %q", out, want)
+			}
+		})
+	}
+}
+
+func TestCongestion(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TCP_CONGESTION is linux only")
+	}
+
+	available, err := availableCongestion()
+	if err != nil || len(available) == 0 {
+		t.Fatalf("availableCongestion() = %v, %v", available, err)
+	}
+
+	// both ends take the algorithm, the server from the listener its streams are accepted from
+	for _, name := range available {
+		client, server := NewIperfTest(), NewIperfTest()
+		client.setting.congestion = name
+		server.setting.congestion = name
+
+		cconn, sconn := tcpPair(t, client, server)
+
+		for end, conn := range map[string]net.Conn{"client": cconn, "server": sconn} {
+			if got, err := tcpCongestion(conn); err != nil || got != name {
+				t.Errorf("%v: %v runs %q, %v", name, end, got, err)
+			}
+		}
+	}
+
+	// an unknown name is refused by the listener and by the dial
+	if err := checkCongestion("no-such-cc"); err == nil || !strings.Contains(err.Error(), available[0]) {
+		t.Errorf("checkCongestion of an unknown name = %v, want the available ones", err)
+	}
+
+	server := NewIperfTest()
+	server.Init()
+	server.setProtocol(TCP_NAME)
+	server.setting.congestion = "no-such-cc"
+
+	if _, err := server.proto.Listen(server); err == nil {
+		t.Errorf("Listen with an unknown congestion control should fail")
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	client := NewIperfTest()
+	client.Init()
+	client.setProtocol(TCP_NAME)
+	client.setting.congestion = "no-such-cc"
+	client.addr = "127.0.0.1"
+	client.port = uint(ln.Addr().(*net.TCPAddr).Port)
+	client.ipVersion = 4
+
+	if conn, err := client.proto.Connect(client); err == nil {
+		conn.Close()
+		t.Errorf("Connect with an unknown congestion control should fail")
+	}
+}
+
+func TestZeroCopyLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("-Z is linux only")
+	}
+
+	const blocks, blksize = 20, 128 * 1024
+
+	cases := []struct {
+		name string
+		msg  bool
+	}{
+		{name: "sendfile"},
+		{name: "MSG_ZEROCOPY", msg: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := NewIperfTest(), NewIperfTest()
+			client.setting.zeroCopy = true
+			client.setting.zeroCopyMsg = c.msg
+			client.setting.blksize = blksize
+
+			cconn, sconn := tcpPair(t, client, server)
+
+			received := make(chan []byte, 1)
+			go func() {
+				data, _ := io.ReadAll(sconn)
+				received <- data
+			}()
+
+			sp := client.newStream(cconn, SENDER_STREAM)
+			client.streams = []*iperfStream{sp}
+
+			if rtn := client.proto.Init(client); rtn < 0 || sp.zc == nil || sp.zc.msg != c.msg {
+				t.Fatalf("Init() = %v, zero copy %v", rtn, sp.zc)
+			}
+
+			defer sp.zc.close()
+
+			for i := 0; i < blocks; i++ {
+				if n := client.proto.Send(sp); n != blksize {
+					t.Fatalf("Send() = %v, want %v", n, blksize)
+				}
+			}
+
+			if sp.result.bytes_sent != blocks*blksize || sp.result.bytes_sent_this_interval != blocks*blksize {
+				t.Errorf("%v bytes counted, want %v", sp.result.bytes_sent, blocks*blksize)
+			}
+
+			cconn.Close()
+
+			// the peer gets the blocks as they were, not what the stream buffer holds later
+			data := <-received
+			if len(data) != blocks*blksize {
+				t.Fatalf("%v bytes received, want %v", len(data), blocks*blksize)
+			}
+
+			for i := 0; i < blocks; i++ {
+				if !bytes.Equal(data[i*blksize:(i+1)*blksize], sp.buffer) {
+					t.Fatalf("block %v received changed", i)
+				}
+			}
+
+			if c.msg && (sp.zc.sent < blocks || !strings.HasPrefix(sp.zc.String(), "MSG_ZEROCOPY")) {
+				t.Errorf("%v", sp.zc)
+			}
+		})
+	}
+}
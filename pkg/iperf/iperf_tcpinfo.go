@@ -0,0 +1,81 @@
+package iperf
+
+import (
+	"fmt"
+	"time"
+)
+
+// tcp telemetry: every interval the tcp streams keep the TCP_INFO fields that tell what limits the throughput.
+// Gauges such as cwnd hold their value at the end of the interval, the cumulative counters of the kernel what
+// the interval added to them. -V prints the key ones after every interval, the API hands out all of them.
+// Negotiated MPTCP connections have no TCP_INFO of their own, they report their subflows instead.
+
+const TCP_INFINITE_SSTHRESH = 0x7fffffff // ssthresh before the first loss
+
+// TCPInfo holds the TCP_INFO of a tcp stream for one interval, linux only
+type TCPInfo struct {
+	Cwnd          uint32        // congestion window (segs)
+	Ssthresh      uint32        // slow start threshold (segs), TCP_INFINITE_SSTHRESH before the first loss
+	SndWnd        uint32        // receive window the peer announced (bytes)
+	RcvSpace      uint32        // receive buffer the stack autotunes to (bytes)
+	Unacked       uint32        // segs in flight
+	NotsentBytes  uint32        // bytes in the send buffer not sent yet
+	MinRTT        time.Duration // lowest rtt seen on the connection
+	PacingRate    uint64        // bytes/s
+	DeliveryRate  uint64        // bytes/s, of the last acked segments
+	BusyTime      time.Duration // the interval's time with data in flight
+	RwndLimited   time.Duration // the interval's time limited by the receive window of the peer
+	SndbufLimited time.Duration // the interval's time limited by the send buffer
+	BytesAcked    uint64        // bytes the interval got acked
+}
+
+// tcpInfoInterval turns the cumulative counters saveTCPInfo stored in rp into what the interval added
+func (sp *iperfStream) tcpInfoInterval(rp *iperf_interval_results) {
+	r := sp.result
+	info := &rp.tcp_info
+
+	busy, rwnd, sndbuf, acked := info.BusyTime, info.RwndLimited, info.SndbufLimited, info.BytesAcked
+
+	info.BusyTime = time.Duration(counterDelta(uint64(busy), uint64(r.tcp_prev_busy_time)))
+	info.RwndLimited = time.Duration(counterDelta(uint64(rwnd), uint64(r.tcp_prev_rwnd_limited)))
+	info.SndbufLimited = time.Duration(counterDelta(uint64(sndbuf), uint64(r.tcp_prev_sndbuf_limited)))
+	info.BytesAcked = counterDelta(acked, r.tcp_prev_bytes_acked)
+
+	r.tcp_prev_busy_time = busy
+	r.tcp_prev_rwnd_limited = rwnd
+	r.tcp_prev_sndbuf_limited = sndbuf
+	r.tcp_prev_bytes_acked = acked
+}
+
+// counterDelta returns what a kernel counter added since prev, all of it if the counter started over
+func counterDelta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return cur
+	}
+
+	return cur - prev
+}
+
+// printTCPInfo prints the key TCP_INFO fields of a tcp stream with -V
+func (test *IperfTest) printTCPInfo(i int, sp *iperfStream, info *TCPInfo, mark string) {
+	if !test.verbose || !test.tcpStyleReport() || sp.result.mptcp_negotiated {
+		return
+	}
+
+	ssthresh := "inf"
+	if info.Ssthresh != TCP_INFINITE_SSTHRESH {
+		ssthresh = fmt.Sprint(info.Ssthresh)
+	}
+
+	percent := func(d time.Duration) float64 {
+		if info.BusyTime == 0 {
+			return 0
+		}
+
+		return float64(d) / float64(info.BusyTime) * 100
+	}
+
+	fmt.Printf(TCP_INFO_REPORT, test.streamLabel(i, sp), info.Cwnd, ssthresh, info.Unacked, info.SndWnd/KB_TO_B,
+		info.RcvSpace/KB_TO_B, float64(info.MinRTT.Microseconds())/1000, float64(info.DeliveryRate)*8/MB_TO_B,
+		float64(info.BusyTime.Microseconds())/1000, percent(info.RwndLimited), percent(info.SndbufLimited), mark)
+}
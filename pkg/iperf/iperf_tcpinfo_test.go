@@ -0,0 +1,69 @@
+package iperf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterDelta(t *testing.T) {
+	cases := []struct {
+		cur, prev uint64
+		want      uint64
+	}{
+		{cur: 0, prev: 0, want: 0},
+		{cur: 100, prev: 40, want: 60},
+		{cur: 40, prev: 40, want: 0},
+		{cur: 10, prev: 40, want: 10}, // started over
+		{cur: 1 << 63, prev: 1, want: 1<<63 - 1},
+	}
+
+	for _, c := range cases {
+		if got := counterDelta(c.cur, c.prev); got != c.want {
+			t.Errorf("counterDelta(%v, %v) = %v, want %v", c.cur, c.prev, got, c.want)
+		}
+	}
+}
+
+func TestTCPInfoInterval(t *testing.T) {
+	ms := time.Millisecond
+
+	// the cumulative counters saveTCPInfo stores, interval after interval
+	cases := []struct {
+		name string
+		info TCPInfo
+		want TCPInfo
+	}{
+		{
+			name: "first",
+			info: TCPInfo{Cwnd: 10, BusyTime: 900 * ms, RwndLimited: 100 * ms, SndbufLimited: 0, BytesAcked: 5000},
+			want: TCPInfo{Cwnd: 10, BusyTime: 900 * ms, RwndLimited: 100 * ms, SndbufLimited: 0, BytesAcked: 5000},
+		},
+		{
+			name: "second",
+			info: TCPInfo{Cwnd: 20, BusyTime: 1900 * ms, RwndLimited: 150 * ms, SndbufLimited: 300 * ms, BytesAcked: 12000},
+			want: TCPInfo{Cwnd: 20, BusyTime: 1000 * ms, RwndLimited: 50 * ms, SndbufLimited: 300 * ms, BytesAcked: 7000},
+		},
+		{
+			name: "idle",
+			info: TCPInfo{Cwnd: 20, BusyTime: 1900 * ms, RwndLimited: 150 * ms, SndbufLimited: 300 * ms, BytesAcked: 12000},
+			want: TCPInfo{Cwnd: 20},
+		},
+		{
+			// a new connection of the stream counts from 0 again
+			name: "started over",
+			info: TCPInfo{Cwnd: 5, BusyTime: 200 * ms, RwndLimited: 0, SndbufLimited: 10 * ms, BytesAcked: 800},
+			want: TCPInfo{Cwnd: 5, BusyTime: 200 * ms, RwndLimited: 0, SndbufLimited: 10 * ms, BytesAcked: 800},
+		},
+	}
+
+	sp := &iperfStream{result: new(iperf_stream_results)}
+
+	for _, c := range cases {
+		rp := iperf_interval_results{tcp_info: c.info}
+		sp.tcpInfoInterval(&rp)
+
+		if rp.tcp_info != c.want {
+			t.Errorf("%v: tcp_info = %+v, want %+v", c.name, rp.tcp_info, c.want)
+		}
+	}
+}
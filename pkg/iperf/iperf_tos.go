@@ -0,0 +1,308 @@
+package iperf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// type of service marking: -S sets the TOS byte (traffic class with ipv6) of the data sockets on both ends, -L
+// the ipv6 flow label of the tcp and udp streams. The receiver checks the DSCP bits of what arrives, the ECN bits
+// are left out as the kernel and the path may change them on their own.
+
+const (
+	TOS_DEFAULT     = -1      // keep the default marking of the protocol
+	KCP_DEFAULT_TOS = 46 << 2 // EF, kcp and rudp mark their packets unless -S is given
+	TOS_DSCP_MASK   = 0xfc
+	FLOW_LABEL_MAX  = 0xfffff
+	TOS_OOB_SIZE    = 64 // room for the IP_TOS and IPV6_TCLASS control messages
+)
+
+// DSCPNames maps the DSCP names -S accepts to their code points, RFC 4594, 5865 and 8622
+var DSCPNames = map[string]int{
+	"DF": 0, "BE": 0, "LE": 1,
+	"CS0": 0, "CS1": 8, "CS2": 16, "CS3": 24, "CS4": 32, "CS5": 40, "CS6": 48, "CS7": 56,
+	"AF11": 10, "AF12": 12, "AF13": 14,
+	"AF21": 18, "AF22": 20, "AF23": 22,
+	"AF31": 26, "AF32": 28, "AF33": 30,
+	"AF41": 34, "AF42": 36, "AF43": 38,
+	"VA": 44, "EF": 46,
+}
+
+// ParseTOS parses the -S value, a TOS byte (decimal, 0x hex or 0 octal) or a DSCP name such as EF or AF41
+func ParseTOS(s string) (int, error) {
+	if dscp, ok := DSCPNames[strings.ToUpper(s)]; ok {
+		return dscp << 2, nil
+	}
+
+	tos, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tos %v, expect a number up to 255 or a DSCP name", s)
+	}
+
+	return int(tos), nil
+}
+
+// tosName returns the TOS byte with the name of its DSCP bits, e.g. 0xb8 (EF)
+func tosName(tos int) string {
+	for name, dscp := range DSCPNames {
+		if dscp == tos>>2 && name != "DF" && name != "BE" {
+			return fmt.Sprintf("0x%02x (%v)", tos, name)
+		}
+	}
+
+	return fmt.Sprintf("0x%02x", tos)
+}
+
+// type of service marking seen by the receiver of a stream
+// tips: exchanged with the results, all the members should be visible
+type tos_results struct {
+	Samples uint64 // packets, tcp streams take one sample per interval
+	Kept    uint64 // samples carrying the DSCP bits the sender set
+	Changed int    // TOS byte of the last sample that did not, -1 for none
+}
+
+func (r *tos_results) add(sent, seen int) {
+	if r.Samples == 0 {
+		r.Changed = -1
+	}
+
+	r.Samples++
+
+	if seen&TOS_DSCP_MASK == sent&TOS_DSCP_MASK {
+		r.Kept++
+	} else {
+		r.Changed = seen
+	}
+}
+
+// streamTOS returns the marking of the data sockets, TOS_DEFAULT if they keep the default of the protocol
+func (test *IperfTest) streamTOS() int {
+	if test.setting.tos == TOS_DEFAULT && (test.proto.Name() == KCP_NAME || test.proto.Name() == RUDP_NAME) {
+		return KCP_DEFAULT_TOS
+	}
+
+	return test.setting.tos
+}
+
+// checkTOS reports whether the receiver streams check the marking, only if -S is given
+func (test *IperfTest) checkTOS() bool {
+	return test.setting.tos != TOS_DEFAULT
+}
+
+// receivesData reports whether this end has receiver streams
+func (test *IperfTest) receivesData() bool {
+	return test.bidir || test.reverse != test.isServer
+}
+
+// setUDPSockopts marks a connected udp stream socket with -S and -L, and asks for the TOS of the received packets
+func (test *IperfTest) setUDPSockopts(conn *net.UDPConn) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+
+	err = rc.Control(func(fd uintptr) {
+		if tos := test.streamTOS(); tos != TOS_DEFAULT {
+			if serr = setTOS(fd, tos); serr != nil {
+				return
+			}
+		}
+
+		if test.checkTOS() {
+			if serr = enableRecvTOS(fd); serr != nil {
+				return
+			}
+		}
+
+		if test.setting.flowLabel != 0 {
+			// udp sockets can connect again, this time with the flow label
+			serr = connectFlowLabel(fd, conn.RemoteAddr().(*net.UDPAddr).AddrPort(), uint32(test.setting.flowLabel))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return serr
+}
+
+// sessionConn opens the socket a kcp or rudp client session sends over, marked with -S. The session does not own
+// it, it is closed at Teardown.
+func (test *IperfTest) sessionConn() (net.PacketConn, error) {
+	conn, err := test.openUDP()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := test.markPacketConn(conn)
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	test.packetConns = append(test.packetConns, pc)
+
+	return pc, nil
+}
+
+// markPacketConn marks the socket of kcp or rudp sessions with -S. A receiving end reads it through a
+// tosPacketConn to check the marking, which costs the batched reads of the session.
+func (test *IperfTest) markPacketConn(conn *net.UDPConn) (net.PacketConn, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	check := test.checkTOS() && test.receivesData()
+
+	var serr error
+
+	err = rc.Control(func(fd uintptr) {
+		if serr = setTOS(fd, test.streamTOS()); serr != nil || !check {
+			return
+		}
+
+		serr = enableRecvTOS(fd)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if serr != nil {
+		return nil, serr
+	}
+
+	if !check {
+		return conn, nil
+	}
+
+	return &tosPacketConn{UDPConn: conn, tos: test.setting.tos, oob: make([]byte, TOS_OOB_SIZE),
+		seen: make(map[netip.AddrPort]*tos_results)}, nil
+}
+
+// closePacketConns closes the sockets under the kcp or rudp sessions
+func (test *IperfTest) closePacketConns() {
+	for _, pc := range test.packetConns {
+		pc.Close()
+	}
+
+	test.packetConns = nil
+	test.sessionConns = nil
+}
+
+// tosPacketConn reads the packets of kcp or rudp sessions together with their TOS, accounted per sender
+type tosPacketConn struct {
+	*net.UDPConn
+	tos int
+	oob []byte // only the read loop of the session reads
+
+	mu   sync.Mutex
+	seen map[netip.AddrPort]*tos_results
+}
+
+func (c *tosPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, oobn, _, addr, err := c.UDPConn.ReadMsgUDPAddrPort(b, c.oob)
+	if err != nil {
+		return n, nil, err
+	}
+
+	if tos, ok := receivedTOS(c.oob[:oobn]); ok {
+		key := netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		c.mu.Lock()
+
+		r := c.seen[key]
+		if r == nil {
+			r = new(tos_results)
+			c.seen[key] = r
+		}
+
+		r.add(c.tos, tos)
+
+		c.mu.Unlock()
+	}
+
+	return n, net.UDPAddrFromAddrPort(addr), nil
+}
+
+// results returns the marking seen from remote
+func (c *tosPacketConn) results(remote net.Addr) tos_results {
+	addr, ok := remote.(*net.UDPAddr)
+	if !ok {
+		return tos_results{}
+	}
+
+	ap := addr.AddrPort()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r := c.seen[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())]; r != nil {
+		return *r
+	}
+
+	return tos_results{}
+}
+
+// tosPacket accounts the TOS of a packet received by a udp stream
+func (sp *iperfStream) tosPacket(oob []byte) {
+	if tos, ok := receivedTOS(oob); ok {
+		sp.result.tos.add(sp.test.setting.tos, tos)
+	}
+}
+
+// tosSample accounts the TOS the kernel saw last on a tcp stream, once per interval
+func (sp *iperfStream) tosSample() {
+	if tos, ok := tcpReceivedTOS(sp.conn); ok {
+		sp.result.tos.add(sp.test.setting.tos, tos)
+	}
+}
+
+// tosResults returns the marking the receiver saw. The sender side shows what the receiver reported in the
+// results exchange, the receiver of a kcp or rudp stream asks the socket under its session.
+func (sp *iperfStream) tosResults() tos_results {
+	if sp.role == SENDER_STREAM {
+		return sp.result.tos
+	}
+
+	for _, pc := range sp.test.packetConns {
+		if c, ok := pc.(*tosPacketConn); ok && c.LocalAddr().String() == sp.conn.LocalAddr().String() {
+			return c.results(sp.conn.RemoteAddr())
+		}
+	}
+
+	return sp.result.tos
+}
+
+// printTOS prints whether the marking of a stream survived the path
+func (test *IperfTest) printTOS(i int, sp *iperfStream) {
+	if !test.checkTOS() {
+		return
+	}
+
+	r := sp.tosResults()
+	if r.Samples == 0 {
+		fmt.Printf(TOS_UNSEEN_REPORT, test.streamLabel(i, sp), tosName(test.setting.tos))
+
+		return
+	}
+
+	changed := ""
+	if r.Changed >= 0 {
+		changed = fmt.Sprintf(", changed to %v on the path", tosName(r.Changed))
+	}
+
+	unit := "packets"
+	if test.tcpStyleReport() {
+		unit = "samples"
+	}
+
+	fmt.Printf(TOS_REPORT, test.streamLabel(i, sp), tosName(test.setting.tos), r.Kept, r.Samples, unit, changed)
+}
@@ -0,0 +1,81 @@
+package iperf
+
+import (
+	"testing"
+)
+
+func TestParseTOS(t *testing.T) {
+	cases := []struct {
+		s     string
+		want  int
+		fails bool
+	}{
+		{s: "0", want: 0},
+		{s: "184", want: 184},
+		{s: "0xb8", want: 0xb8},
+		{s: "0270", want: 0xb8},
+		{s: "255", want: 255},
+		{s: "EF", want: 46 << 2},
+		{s: "ef", want: 46 << 2},
+		{s: "AF41", want: 34 << 2},
+		{s: "cs1", want: 8 << 2},
+		{s: "LE", want: 1 << 2},
+		{s: "BE", want: 0},
+		{s: "256", fails: true},
+		{s: "-1", fails: true},
+		{s: "AF44", fails: true},
+		{s: "0x", fails: true},
+		{s: "", fails: true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseTOS(c.s)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParseTOS(%q) should fail", c.s)
+			}
+
+			continue
+		}
+
+		if err != nil || got != c.want {
+			t.Errorf("ParseTOS(%q) = %v, %v, want %v", c.s, got, err, c.want)
+		}
+	}
+}
+
+func TestTOSName(t *testing.T) {
+	cases := []struct {
+		tos  int
+		want string
+	}{
+		{tos: 0, want: "0x00 (CS0)"},
+		{tos: 0xb8, want: "0xb8 (EF)"},
+		{tos: 0xb9, want: "0xb9 (EF)"}, // the ECN bits are not part of the DSCP name
+		{tos: 0x88, want: "0x88 (AF41)"},
+		{tos: 0x04, want: "0x04 (LE)"},
+		{tos: 0x0c, want: "0x0c"},
+	}
+
+	for _, c := range cases {
+		if got := tosName(c.tos); got != c.want {
+			t.Errorf("tosName(%#x) = %q, want %q", c.tos, got, c.want)
+		}
+	}
+}
+
+func TestTOSResults(t *testing.T) {
+	var r tos_results
+
+	r.add(0xb8, 0xb8)
+	r.add(0xb8, 0xbb) // ECN set on the path
+	if r != (tos_results{Samples: 2, Kept: 2, Changed: -1}) {
+		t.Errorf("kept = %+v", r)
+	}
+
+	r.add(0xb8, 0x00) // bleached
+	r.add(0xb8, 0xb8)
+	if r != (tos_results{Samples: 4, Kept: 3, Changed: 0}) {
+		t.Errorf("changed = %+v", r)
+	}
+}
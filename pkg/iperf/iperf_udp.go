@@ -1,57 +1,147 @@
 package iperf
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
-	"strconv"
+	"os"
+	"syscall"
 	"time"
 )
 
 type UDPProto struct {
 }
 
-func (u *UDPProto) name() string {
+func (u *UDPProto) Name() string {
 	return UDP_NAME
 }
 
-func (u *UDPProto) accept(test *IperfTest) (net.Conn, error) {
+func (u *UDPProto) Accept(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter UDP accept")
 
-	// UDP 不需要 accept，直接返回已创建的连接
-	// 这里简单返回错误，实际使用中需要根据具体需求实现
-	return nil, errors.New("UDP accept not implemented")
+	conn, err := test.protoListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = test.setUDPSockopts(conn.(*net.UDPConn)); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	go echoAcceptSignals(conn.(*net.UDPConn))
+
+	return conn, nil
 }
 
-func (u *UDPProto) listen(test *IperfTest) (net.Listener, error) {
+func (u *UDPProto) Listen(test *IperfTest) (net.Listener, error) {
 	Log.Debugf("Enter UDP listen")
 
-	// UDP 不使用 net.Listener，返回 nil
-	return nil, nil
+	conn, err := test.listenUDP(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return &udpListener{conn: conn, control: test.bindControl(reusePortControl)}, nil
 }
 
-func (u *UDPProto) connect(test *IperfTest) (net.Conn, error) {
+func (u *UDPProto) Connect(test *IperfTest) (net.Conn, error) {
 	Log.Debugf("Enter UDP connect")
 
-	udpAddr, err := net.ResolveUDPAddr("udp4", test.addr+":"+strconv.Itoa(int(test.port)))
+	udpAddr, err := test.resolveUDPAddr()
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
+	conn, err := test.dialUDP(udpAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	err = conn.SetDeadline(time.Now().Add(time.Duration(test.duration+5) * time.Second))
+	if err = test.setUDPSockopts(conn); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	// the server connects a socket of its own to this stream after receiving the accept signal, the signal is
+	// sent again until the echo comes, either of them may be lost
+	if err = acceptUDPStream(conn); err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	err = conn.SetDeadline(test.streamDeadline())
 	if err != nil {
 		Log.Errorf("SetDeadline err: %v", err)
+		conn.Close()
+
 		return nil, err
 	}
 
 	return conn, nil
 }
 
-func (u *UDPProto) send(sp *iperfStream) int {
+// acceptUDPStream sends the accept signal every UDP_ACCEPT_RETRY ms until the server echoes it
+func acceptUDPStream(conn *net.UDPConn) error {
+	signal := udpAcceptSignal()
+	buf := make([]byte, len(signal)+1) // a longer datagram is no echo
+	timeout := time.Now().Add(UDP_ACCEPT_TIMEOUT * time.Second)
+
+	for time.Now().Before(timeout) {
+		if _, err := conn.Write(signal); err != nil {
+			return err
+		}
+
+		deadline := time.Now().Add(UDP_ACCEPT_RETRY * time.Millisecond)
+		if deadline.After(timeout) {
+			deadline = timeout
+		}
+
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return err
+		}
+
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+
+			if err != nil {
+				return fmt.Errorf("udp accept signal not acknowledged. err = %w", err)
+			}
+
+			if isAcceptSignal(buf[:n]) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("udp accept signal not acknowledged in %v s, a server older than the echo does not answer it",
+		UDP_ACCEPT_TIMEOUT)
+}
+
+// udpAcceptSignal returns the accept signal of a udp stream
+func udpAcceptSignal() []byte {
+	signal := make([]byte, 8)
+	binary.LittleEndian.PutUint32(signal[0:4], ACCEPT_SIGNAL)
+	binary.LittleEndian.PutUint32(signal[4:8], UDP_ACCEPT_MAGIC)
+
+	return signal
+}
+
+// isAcceptSignal reports whether a datagram is the accept signal of a udp stream or its echo. The client repeats
+// the signal until an echo comes, a late repeat or echo reaches the stream and is not counted.
+func isAcceptSignal(data []byte) bool {
+	return len(data) == 8 && binary.LittleEndian.Uint32(data[0:4]) == ACCEPT_SIGNAL &&
+		binary.LittleEndian.Uint32(data[4:8]) == UDP_ACCEPT_MAGIC
+}
+
+func (u *UDPProto) Send(sp *iperfStream) int {
 	n, err := sp.conn.(*net.UDPConn).Write(sp.buffer)
 	if err != nil {
 		Log.Errorf("udp write err = %T %v", err, err)
@@ -70,11 +160,33 @@ func (u *UDPProto) send(sp *iperfStream) int {
 	return n
 }
 
-func (u *UDPProto) recv(sp *iperfStream) int {
-	n, err := sp.conn.(*net.UDPConn).Read(sp.buffer)
-	if err != nil {
-		Log.Errorf("udp recv err = %T %v", err, err)
-		return -2
+func (u *UDPProto) Recv(sp *iperfStream) int {
+	if sp.batch != nil {
+		return sp.recvBatch()
+	}
+
+	var n int
+	var err error
+
+	for {
+		if sp.tosOOB != nil {
+			var oobn int
+
+			n, oobn, _, _, err = sp.conn.(*net.UDPConn).ReadMsgUDP(sp.buffer, sp.tosOOB)
+			if err == nil && !isAcceptSignal(sp.buffer[:n]) {
+				sp.tosPacket(sp.tosOOB[:oobn])
+			}
+		} else {
+			n, err = sp.conn.(*net.UDPConn).Read(sp.buffer)
+		}
+
+		if err != nil {
+			return udpRecvError(err)
+		}
+
+		if !isAcceptSignal(sp.buffer[:n]) {
+			break
+		}
 	}
 
 	if n < 0 {
@@ -89,16 +201,51 @@ func (u *UDPProto) recv(sp *iperfStream) int {
 	return n
 }
 
-func (u *UDPProto) init(test *IperfTest) int {
+// udpRecvError returns -1 for a closed stream, UDP_RECV_TIMEOUT after the read deadline and -2 for other
+// receive errors
+func udpRecvError(err error) int {
+	if errors.Is(err, net.ErrClosed) {
+		Log.Debugf("udp conn already closed = %v", err)
+
+		return -1
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return UDP_RECV_TIMEOUT
+	}
+
+	Log.Errorf("udp recv err = %T %v", err, err)
+	return -2
+}
+
+func (u *UDPProto) Init(test *IperfTest) int {
 	Log.Debugf("Enter UDP init")
 
 	// UDP 特定的初始化
 	// 可以在这里设置 UDP 特定的参数
+	test.setPacing()
+
+	for i, sp := range test.streams {
+		if test.udpBatching() {
+			if err := sp.initBatch(); err != nil {
+				Log.Errorf("Stream %v set up udp batching failed. err = %v", i, err)
+
+				return -1
+			}
+
+			// the batched reads leave the marking unchecked
+			continue
+		}
+
+		if test.checkTOS() && sp.role == RECEIVER_STREAM {
+			sp.tosOOB = make([]byte, TOS_OOB_SIZE)
+		}
+	}
 
 	return 0
 }
 
-func (u *UDPProto) teardown(test *IperfTest) int {
+func (u *UDPProto) Teardown(test *IperfTest) int {
 	Log.Debugf("Enter UDP teardown")
 
 	// UDP 清理工作
@@ -106,9 +253,84 @@ func (u *UDPProto) teardown(test *IperfTest) int {
 	return 0
 }
 
-func (u *UDPProto) statsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
+func (u *UDPProto) StatsCallback(test *IperfTest, sp *iperfStream, tempResult *iperf_interval_results) int {
 	// UDP 统计回调
 	// 可以在这里收集 UDP 特定的统计信息，如丢包率等
+	sp.savePacing(tempResult)
+
+	if sp.batch != nil {
+		sp.saveBatch(tempResult)
+	}
 
 	return 0
 }
+
+// udpListener accepts udp streams. Every stream starts with an accept signal, the listener answers it from a
+// new socket bound to the listening port and connected to the sender, which then carries the stream.
+type udpListener struct {
+	conn     *net.UDPConn
+	control  func(network, address string, c syscall.RawConn) error // of the connected sockets
+	accepted map[string]time.Time                                   // remotes given a connected socket lately
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	buf := make([]byte, 9) // a longer datagram is no signal
+
+	for {
+		n, remote, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if !isAcceptSignal(buf[:n]) {
+			Log.Errorf("UDP Receive Unexpected signal from %v", remote)
+
+			continue
+		}
+
+		// a repeat queued before the stream had its socket, the connected socket answers the later ones. A client
+		// may start another stream from the same port once its accept timed out.
+		if at, ok := l.accepted[remote.String()]; ok && time.Since(at) < UDP_ACCEPT_TIMEOUT*time.Second {
+			Log.Debugf("UDP accept signal repeated. remote = %v", remote)
+
+			continue
+		}
+
+		dialer := net.Dialer{LocalAddr: l.conn.LocalAddr(), Control: l.control}
+
+		conn, err := dialer.Dial(l.conn.LocalAddr().Network(), remote.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = conn.Write(buf[:n]); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		if l.accepted == nil {
+			l.accepted = make(map[string]time.Time)
+		}
+
+		for addr, at := range l.accepted {
+			if time.Since(at) >= UDP_ACCEPT_TIMEOUT*time.Second {
+				delete(l.accepted, addr)
+			}
+		}
+
+		l.accepted[remote.String()] = time.Now()
+
+		Log.Debugf("UDP accept succeed. remote = %v", remote)
+
+		return conn, nil
+	}
+}
+
+func (l *udpListener) Close() error {
+	return l.conn.Close()
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
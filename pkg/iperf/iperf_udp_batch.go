@@ -0,0 +1,320 @@
+package iperf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// udp batching: -udp-batch sends and receives up to that many messages of a udp stream with one sendmmsg or
+// recvmmsg. -gso packs several blocks into a message the kernel splits into datagrams (UDP_SEGMENT), -gro lets
+// the kernel of the receiver coalesce the datagrams it receives (UDP_GRO). Linux only. The report counts the
+// datagrams of every stream together with the syscalls they took.
+
+const (
+	UDP_MAX_BATCH    = 1024  // UIO_MAXIOV, most messages a sendmmsg or recvmmsg takes
+	UDP_MAX_SEGMENTS = 64    // most datagrams the kernel splits a gso message into
+	UDP_MAX_PAYLOAD  = 65507 // of a udp datagram over ipv4, a gso message holds no more
+	UDP_GRO_BUFSIZE  = 65536 // a coalesced message is at most 64 KB
+)
+
+// udpBatch holds the buffers of a batched udp stream
+type udpBatch struct {
+	msgs   *mmsg
+	rc     syscall.RawConn
+	blk    int      // block size
+	perMsg int      // blocks in a message, more than one with gso
+	gro    bool     // the receiving socket coalesces
+	buf    []byte   // the blocks of a batch back to back
+	bufs   [][]byte // messages of the last sendmmsg or recvmmsg
+	sizes  []int    // received sizes
+	segs   []int    // received gro segment sizes
+	blocks [][]byte // received blocks, split from the coalesced messages
+}
+
+// udpBatching reports whether the udp streams send and receive in batches
+func (test *IperfTest) udpBatching() bool {
+	return test.setting.udpBatch != 0 || test.setting.gso || test.setting.gro
+}
+
+// gsoSegments returns the blocks a gso message holds
+func gsoSegments(blksize uint) int {
+	n := UDP_MAX_PAYLOAD / int(blksize)
+	if n > UDP_MAX_SEGMENTS {
+		n = UDP_MAX_SEGMENTS
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// initBatch sets up the batch of a udp stream, the receiver socket asks for gro
+func (sp *iperfStream) initBatch() error {
+	test := sp.test
+
+	conn, ok := sp.conn.(*net.UDPConn)
+	if !ok {
+		return fmt.Errorf("udp batching needs a udp socket, got %T", sp.conn)
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	size := int(test.setting.udpBatch)
+	if size == 0 {
+		size = 1
+	}
+
+	b := &udpBatch{msgs: newMmsg(size), rc: rc, blk: len(sp.buffer), perMsg: 1, bufs: make([][]byte, size)}
+
+	if sp.role == SENDER_STREAM {
+		if test.setting.gso {
+			b.perMsg = gsoSegments(test.setting.blksize)
+		}
+
+		// every block starts as a copy of the buffer, the pattern and the stamps are written in place
+		b.buf = make([]byte, size*b.perMsg*b.blk)
+		for off := 0; off < len(b.buf); off += b.blk {
+			copy(b.buf[off:], sp.buffer)
+		}
+	} else {
+		msgSize := b.blk
+		if test.setting.gro {
+			msgSize = UDP_GRO_BUFSIZE
+
+			var serr error
+
+			err = rc.Control(func(fd uintptr) {
+				serr = enableGRO(fd)
+			})
+			if err == nil {
+				err = serr
+			}
+
+			if err != nil {
+				return err
+			}
+
+			b.gro = true
+		}
+
+		b.buf = make([]byte, size*msgSize)
+		for i := range b.bufs {
+			b.bufs[i] = b.buf[i*msgSize : (i+1)*msgSize]
+		}
+
+		b.sizes = make([]int, size)
+		b.segs = make([]int, size)
+	}
+
+	sp.batch = b
+
+	return nil
+}
+
+// batchBlocks returns how many blocks the next batch sends, fewer close to -n or -k
+func (sp *iperfStream) batchBlocks() int {
+	test := sp.test
+	b := sp.batch
+
+	n := len(b.bufs) * b.perMsg
+
+	if test.isServer {
+		return n
+	}
+
+	bytesSent, blocksSent := test.sentTotals()
+
+	if test.setting.blocks != 0 && blocksSent < test.setting.blocks && test.setting.blocks-blocksSent < uint64(n) {
+		n = int(test.setting.blocks - blocksSent)
+	}
+
+	if test.setting.bytes != 0 && bytesSent < test.setting.bytes {
+		left := (test.setting.bytes - bytesSent + uint64(b.blk) - 1) / uint64(b.blk)
+		if left < uint64(n) {
+			n = int(left)
+		}
+	}
+
+	return n
+}
+
+// sendBatch sends a batch of blocks, it returns the bytes and the blocks sent or a negative size on error
+func (sp *iperfStream) sendBatch() (int, int) {
+	test := sp.test
+	b := sp.batch
+
+	count := sp.batchBlocks()
+
+	for i := 0; i < count; i++ {
+		block := b.buf[i*b.blk : (i+1)*b.blk]
+
+		if test.patternPerBlock() {
+			sp.nextBlock(block)
+		}
+
+		if test.setting.owd {
+			sp.stampBlock(block)
+		}
+	}
+
+	msgs := (count + b.perMsg - 1) / b.perMsg
+	for i := 0; i < msgs; i++ {
+		end := (i + 1) * b.perMsg
+		if end > count {
+			end = count
+		}
+
+		b.bufs[i] = b.buf[i*b.perMsg*b.blk : end*b.blk]
+	}
+
+	gso := 0
+	if b.perMsg > 1 {
+		gso = b.blk
+	}
+
+	syscalls, err := b.msgs.send(b.rc, b.bufs[:msgs], gso)
+
+	sp.result.udp_syscalls_this_interval += syscalls
+
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			Log.Debugf("udp conn already closed = %v", err)
+
+			return -1, 0
+		}
+
+		Log.Errorf("udp batch send err = %v", err)
+
+		return -2, 0
+	}
+
+	n := count * b.blk
+
+	sp.result.bytes_sent += uint64(n)
+	sp.result.bytes_sent_this_interval += uint64(n)
+	sp.result.udp_packets_this_interval += uint64(count)
+
+	Log.Debugf("UDP sent %d blocks in %d messages, total sent: %d", count, msgs, sp.result.bytes_sent)
+
+	return n, count
+}
+
+// recvBatch receives a batch of messages into blocks, it returns the bytes received or a negative size on error
+func (sp *iperfStream) recvBatch() int {
+	b := sp.batch
+
+	msgs, syscalls, err := b.msgs.recv(b.rc, b.bufs, b.sizes, b.segs, b.gro)
+
+	sp.result.udp_syscalls_this_interval += syscalls
+
+	if err != nil {
+		return udpRecvError(err)
+	}
+
+	n := 0
+	b.blocks = b.blocks[:0]
+
+	for i := 0; i < msgs; i++ {
+		data := b.bufs[i][:b.sizes[i]]
+		if isAcceptSignal(data) {
+			continue
+		}
+
+		n += len(data)
+
+		seg := b.segs[i]
+		if seg <= 0 {
+			seg = len(data)
+		}
+
+		for off := 0; off < len(data); off += seg {
+			end := off + seg
+			if end > len(data) {
+				end = len(data)
+			}
+
+			b.blocks = append(b.blocks, data[off:end])
+		}
+	}
+
+	sp.result.bytes_received += uint64(n)
+	sp.result.bytes_received_this_interval += uint64(n)
+	sp.result.udp_packets_this_interval += uint64(len(b.blocks))
+
+	Log.Debugf("UDP recv %d blocks in %d messages, total recv: %d", len(b.blocks), msgs, sp.result.bytes_received)
+
+	return n
+}
+
+// receivedBlocks returns the blocks of the last receive of n bytes, more than one from a batch
+func (sp *iperfStream) receivedBlocks(n int) [][]byte {
+	if sp.batch != nil {
+		return sp.batch.blocks
+	}
+
+	sp.received[0] = sp.buffer[:n]
+
+	return sp.received[:]
+}
+
+// saveBatch moves the datagrams and syscalls of a udp stream into the interval
+func (sp *iperfStream) saveBatch(rp *iperf_interval_results) {
+	r := sp.result
+
+	rp.interval_packet_cnt = uint(r.udp_packets_this_interval)
+	rp.interval_syscall_cnt = uint(r.udp_syscalls_this_interval)
+
+	r.udp_packets += r.udp_packets_this_interval
+	r.udp_syscalls += r.udp_syscalls_this_interval
+	r.udp_packets_this_interval = 0
+	r.udp_syscalls_this_interval = 0
+}
+
+// batchName describes the batching of the udp streams for the banner
+func (test *IperfTest) batchName() string {
+	if !test.udpBatching() {
+		return "off"
+	}
+
+	size := test.setting.udpBatch
+	if size == 0 {
+		size = 1
+	}
+
+	s := fmt.Sprintf("%v messages", size)
+	if test.setting.gso {
+		s += fmt.Sprintf(", gso %v x %v B", gsoSegments(test.setting.blksize), test.setting.blksize)
+	}
+
+	if test.setting.gro {
+		s += ", gro"
+	}
+
+	return s
+}
+
+// printBatch prints the datagrams of a udp stream and the syscalls they took
+func (test *IperfTest) printBatch(i int, sp *iperfStream, packets, syscalls uint, sec float64, mark string) {
+	if !test.udpBatching() || test.proto.Name() != UDP_NAME {
+		return
+	}
+
+	pps := 0.0
+	if sec > 0 {
+		pps = float64(packets) / sec
+	}
+
+	perSyscall := 0.0
+	if syscalls > 0 {
+		perSyscall = float64(packets) / float64(syscalls)
+	}
+
+	fmt.Printf(UDP_BATCH_REPORT, test.streamLabel(i, sp), packets, pps, syscalls, perSyscall, mark)
+}
@@ -0,0 +1,165 @@
+package iperf
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestBatchBlocks(t *testing.T) {
+	cases := []struct {
+		name       string
+		server     bool
+		batch      int
+		perMsg     int
+		bytes      uint64
+		blocks     uint64
+		bytesSent  uint64
+		blocksSent uint64
+		want       int
+	}{
+		{name: "no limit", batch: 8, perMsg: 1, want: 8},
+		{name: "gso", batch: 4, perMsg: 64, want: 256},
+		{name: "blocks left", batch: 8, perMsg: 1, blocks: 10, blocksSent: 4, want: 6},
+		{name: "blocks left over a full batch", batch: 8, perMsg: 1, blocks: 100, blocksSent: 4, want: 8},
+		{name: "bytes left round up", batch: 8, perMsg: 1, bytes: 2500, want: 3},
+		{name: "bytes left", batch: 8, perMsg: 1, bytes: 2500, bytesSent: 2000, want: 1},
+		{name: "gso blocks left", batch: 4, perMsg: 64, blocks: 1000, blocksSent: 900, want: 100},
+		{name: "both limits", batch: 8, perMsg: 1, bytes: 5000, blocks: 3, want: 3},
+		{name: "server", server: true, batch: 8, perMsg: 1, blocks: 3, want: 8},
+	}
+
+	for _, c := range cases {
+		test := NewIperfTest()
+		test.isServer = c.server
+		test.setting.bytes = c.bytes
+		test.setting.blocks = c.blocks
+		test.bytesSent = c.bytesSent
+		test.blocksSent = c.blocksSent
+
+		sp := &iperfStream{test: test, batch: &udpBatch{blk: 1000, perMsg: c.perMsg, bufs: make([][]byte, c.batch)}}
+
+		if got := sp.batchBlocks(); got != c.want {
+			t.Errorf("%v: batchBlocks() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// batchStreams returns a batched udp sender and receiver on the loopback
+func batchStreams(t *testing.T, batch uint, gso, gro bool, blocks uint64) (*iperfStream, *iperfStream) {
+	test := NewIperfTest()
+	test.Init()
+
+	if test.setProtocol(UDP_NAME) < 0 {
+		t.Fatalf("setProtocol failed for udp")
+	}
+
+	test.setting.blksize = 1000
+	test.setting.udpBatch = batch
+	test.setting.gso = gso
+	test.setting.gro = gro
+	test.setting.blocks = blocks
+
+	rconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { rconn.Close() })
+
+	sconn, err := net.DialUDP("udp4", nil, rconn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { sconn.Close() })
+
+	if err = rconn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	snd := test.newStream(sconn, SENDER_STREAM)
+	rcv := test.newStream(rconn, RECEIVER_STREAM)
+
+	for _, sp := range []*iperfStream{snd, rcv} {
+		if err = sp.initBatch(); err != nil {
+			t.Skipf("udp batching: %v", err)
+		}
+	}
+
+	return snd, rcv
+}
+
+func TestBatchLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("udp batching is linux only")
+	}
+
+	cases := []struct {
+		name     string
+		batch    uint
+		gso, gro bool
+		blocks   uint64 // -k
+		want     int    // blocks sent and received
+	}{
+		{name: "batch", batch: 8, want: 8},
+		{name: "batch -k", batch: 8, blocks: 5, want: 5},
+		{name: "gso", batch: 4, gso: true, blocks: 20, want: 20},
+		{name: "gso gro", batch: 4, gso: true, gro: true, blocks: 20, want: 20},
+		{name: "gso gro of several messages", batch: 4, gso: true, gro: true, blocks: 70, want: 70},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			snd, rcv := batchStreams(t, c.batch, c.gso, c.gro, c.blocks)
+
+			n, count := snd.sendBatch()
+			if n < 0 {
+				t.Skipf("udp batch send failed, %v", n)
+			}
+
+			if count != c.want || n != c.want*1000 {
+				t.Fatalf("sendBatch() = %v, %v, want %v blocks", n, count, c.want)
+			}
+
+			// every message takes one sendmmsg on the loopback
+			if snd.result.udp_packets_this_interval != uint64(c.want) || snd.result.udp_syscalls_this_interval != 1 {
+				t.Errorf("sender: %v packets in %v syscalls, want %v in 1", snd.result.udp_packets_this_interval,
+					snd.result.udp_syscalls_this_interval, c.want)
+			}
+
+			blocks := 0
+			for blocks < c.want {
+				if n := rcv.recvBatch(); n < 0 {
+					t.Fatalf("recvBatch() = %v after %v blocks", n, blocks)
+				}
+
+				for _, b := range rcv.receivedBlocks(0) {
+					if len(b) != 1000 {
+						t.Fatalf("received a block of %v bytes", len(b))
+					}
+				}
+
+				blocks += len(rcv.receivedBlocks(0))
+			}
+
+			syscalls := rcv.result.udp_syscalls_this_interval
+			if blocks != c.want || rcv.result.udp_packets_this_interval != uint64(c.want) ||
+				rcv.result.bytes_received != uint64(c.want*1000) {
+				t.Errorf("receiver: %v blocks, %v packets, %v bytes, want %v blocks", blocks,
+					rcv.result.udp_packets_this_interval, rcv.result.bytes_received, c.want)
+			}
+
+			// a recvmmsg takes c.batch datagrams, with gro a message holds the blocks of a gso message
+			limit := uint64((c.want + int(c.batch) - 1) / int(c.batch))
+			if c.gro {
+				limit = uint64((c.want + gsoSegments(1000) - 1) / gsoSegments(1000))
+			}
+
+			if syscalls < 1 || syscalls > limit {
+				t.Errorf("receiver: %v syscalls, want 1 to %v", syscalls, limit)
+			}
+		})
+	}
+}
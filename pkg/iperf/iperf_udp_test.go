@@ -0,0 +1,146 @@
+package iperf
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestAcceptUDPStream(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	// a server whose first echo is lost
+	go func() {
+		buf := make([]byte, 16)
+		for i := 0; ; i++ {
+			n, remote, err := server.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if i > 0 {
+				server.WriteToUDP(buf[:n], remote)
+			}
+		}
+	}()
+
+	conn, err := net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	start := time.Now()
+	if err = acceptUDPStream(conn); err != nil {
+		t.Fatalf("acceptUDPStream: %v", err)
+	}
+
+	if d := time.Since(start); d < UDP_ACCEPT_RETRY*time.Millisecond || d > UDP_ACCEPT_TIMEOUT*time.Second {
+		t.Errorf("the signal was acknowledged after %v, want one retry", d)
+	}
+
+	// a small block is no signal
+	for _, data := range [][]byte{udpAcceptSignal()[:4], append(udpAcceptSignal(), 0), {1, 0, 0, 0, 0, 0, 0, 0}} {
+		if isAcceptSignal(data) {
+			t.Errorf("isAcceptSignal(%v) = true", data)
+		}
+	}
+}
+
+func TestUDPListenerRepeats(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the repeats reaching a connected socket are not echoed on windows")
+	}
+
+	test := NewIperfTest()
+	test.Init()
+	test.isServer = true
+	test.port = freePort(t)
+	test.ipVersion = 4
+
+	if test.setProtocol(UDP_NAME) < 0 {
+		t.Fatalf("setProtocol failed for udp")
+	}
+
+	ln, err := test.proto.Listen(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	test.protoListener = ln
+
+	dial := func() *net.UDPConn {
+		conn, err := net.DialUDP("udp4", nil, ln.(*udpListener).conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { conn.Close() })
+
+		if err = conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		return conn
+	}
+
+	echo := func(conn *net.UDPConn) {
+		buf := make([]byte, 16)
+		if n, err := conn.Read(buf); err != nil || !isAcceptSignal(buf[:n]) {
+			t.Fatalf("echo = %v, %v", buf[:n], err)
+		}
+	}
+
+	// the client repeats the signal before the listener answered
+	client := dial()
+	client.Write(udpAcceptSignal())
+	client.Write(udpAcceptSignal())
+
+	conn, err := test.proto.Accept(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	echo(client)
+
+	// the repeat queued on the listener opens no stream, the next client gets the next one
+	other := dial()
+	other.Write(udpAcceptSignal())
+
+	next, err := test.proto.Accept(test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer next.Close()
+
+	if next.RemoteAddr().String() != other.LocalAddr().String() {
+		t.Errorf("second stream from %v, want %v", next.RemoteAddr(), other.LocalAddr())
+	}
+
+	echo(other)
+
+	// a later repeat reaches the stream socket, which echoes it and leaves the data to the stream
+	client.Write(udpAcceptSignal())
+	echo(client)
+
+	client.Write([]byte("block"))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	buf := make([]byte, 16)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "block" {
+		t.Errorf("stream read %q, %v, want the block", buf[:n], err)
+	}
+}
@@ -0,0 +1,308 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	MPTCP_INFO         = 1 // getsockopt(SOL_MPTCP) struct mptcp_info
+	MPTCP_TCPINFO      = 2 // getsockopt(SOL_MPTCP) struct mptcp_subflow_data + tcp_info per subflow
+	MPTCP_MAX_SUBFLOWS = 8
+)
+
+// mptcpInfo mirrors the head of struct mptcp_info in linux/mptcp.h
+type mptcpInfo struct {
+	Subflows              uint8
+	Add_addr_signal       uint8
+	Add_addr_accepted     uint8
+	Subflows_max          uint8
+	Add_addr_signal_max   uint8
+	Add_addr_accepted_max uint8
+	Flags                 uint32
+	Token                 uint32
+	Write_seq             uint64
+	Snd_una               uint64
+	Rcv_nxt               uint64
+	Local_addr_used       uint8
+	Local_addr_max        uint8
+	Csum_enabled          uint8
+	Retransmits           uint32
+	Bytes_retrans         uint64
+	Bytes_sent            uint64
+	Bytes_received        uint64
+	Bytes_acked           uint64
+}
+
+// mptcpSubflowData mirrors struct mptcp_subflow_data, the header of MPTCP_TCPINFO
+type mptcpSubflowData struct {
+	Size_subflow_data uint32
+	Num_subflows      uint32
+	Size_kernel       uint32
+	Size_user         uint32
+}
+
+type mptcpSubflowTCPInfo struct {
+	mptcpSubflowData
+	Subflows [MPTCP_MAX_SUBFLOWS]unix.TCPInfo
+}
+
+// mptcpListen opens an IPPROTO_MPTCP listening socket. Plain TCP clients are still accepted, the kernel
+// falls back to TCP for them transparently. setup, if not nil, sets socket options before the bind.
+func mptcpListen(network, address string, setup func(fd uintptr) error) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	family, sa := tcpSockaddr(addr)
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if err != nil && addr.IP == nil && family == unix.AF_INET6 && network == "tcp" {
+		// no ipv6 on this host, listen on ipv4 wildcard instead
+		family, sa = tcpSockaddr(&net.TCPAddr{IP: net.IPv4zero, Port: addr.Port})
+		fd, err = unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMPTCPUnavailable, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "mptcp-listener")
+	defer file.Close()
+
+	if family == unix.AF_INET6 && (addr.IP == nil || addr.IP.IsUnspecified()) {
+		// dual stack for the wildcard address as net.Listen does, unless ipv6 is forced
+		v6only := 0
+		if network == "tcp6" {
+			v6only = 1
+		}
+
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6only); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, err
+	}
+
+	if setup != nil {
+		if err = setup(uintptr(fd)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = unix.Bind(fd, sa); err != nil {
+		return nil, err
+	}
+
+	if err = unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, err
+	}
+
+	return net.FileListener(file)
+}
+
+// mptcpDial connects to address with an IPPROTO_MPTCP socket, bound to laddr unless it is the zero AddrPort.
+// errMPTCPUnavailable is returned when the kernel cannot create MPTCP sockets. setup, if not nil, sets socket
+// options before the bind.
+func mptcpDial(network, address string, laddr netip.AddrPort, setup func(fd uintptr) error) (net.Conn, error) {
+	addr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	family, sa := tcpSockaddr(addr)
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMPTCPUnavailable, err)
+	}
+
+	file := os.NewFile(uintptr(fd), "mptcp")
+	defer file.Close()
+
+	if setup != nil {
+		if err = setup(uintptr(fd)); err != nil {
+			return nil, err
+		}
+	}
+
+	if laddr != (netip.AddrPort{}) {
+		if err = bindFd(uintptr(fd), laddr); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = connectFd(fd, sa); err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "mptcp", Addr: addr, Err: os.NewSyscallError("connect", err)}
+	}
+
+	return net.FileConn(file)
+}
+
+// connectFd connects a non-blocking socket and waits for the handshake to complete.
+func connectFd(fd int, sa unix.Sockaddr) error {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return err
+	}
+
+	err := unix.Connect(fd, sa)
+	if err == nil {
+		return nil
+	} else if err != unix.EINPROGRESS && err != unix.EINTR {
+		return err
+	}
+
+	for {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+
+		_, err = unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		break
+	}
+
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+
+	if soErr != 0 {
+		return unix.Errno(soErr)
+	}
+
+	return nil
+}
+
+func tcpSockaddr(addr *net.TCPAddr) (int, unix.Sockaddr) {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip4)
+
+		return unix.AF_INET, sa
+	}
+
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16()) // nil ip is the wildcard address
+
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		}
+	}
+
+	return unix.AF_INET6, sa
+}
+
+// mptcpNegotiated reports whether conn is an MPTCP socket which did not fall back to plain TCP.
+func mptcpNegotiated(conn net.Conn) bool {
+	negotiated := false
+
+	_ = controlFd(conn, func(fd int) error {
+		proto, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+		if err != nil || proto != unix.IPPROTO_MPTCP {
+			return err
+		}
+
+		// MPTCP_INFO fails with EOPNOTSUPP / ENOPROTOOPT after a fallback to TCP
+		var info mptcpInfo
+
+		_, err = getsockoptRaw(fd, unix.SOL_MPTCP, MPTCP_INFO, unsafe.Pointer(&info), unsafe.Sizeof(info))
+		negotiated = err == nil
+
+		return nil
+	})
+
+	return negotiated
+}
+
+// saveMPTCPInfo collects the TCP_INFO of every subflow. rtt is averaged over the subflows,
+// interval_retrans holds the sum of the subflow total_retrans counters.
+func saveMPTCPInfo(sp *iperfStream, rp *iperf_interval_results) int {
+	var subflows mptcpSubflowTCPInfo
+
+	err := controlFd(sp.conn, func(fd int) error {
+		subflows.Size_subflow_data = uint32(unsafe.Sizeof(subflows.mptcpSubflowData))
+		subflows.Size_user = uint32(unsafe.Sizeof(subflows.Subflows[0]))
+
+		_, err := getsockoptRaw(fd, unix.SOL_MPTCP, MPTCP_TCPINFO, unsafe.Pointer(&subflows), unsafe.Sizeof(subflows))
+
+		return err
+	})
+	if err != nil {
+		Log.Debugf("Get MPTCP info failed, use TCP_INFO instead. err = %v", err)
+
+		return saveTCPInfo(sp, rp)
+	}
+
+	num := int(subflows.Num_subflows)
+	if num > MPTCP_MAX_SUBFLOWS {
+		num = MPTCP_MAX_SUBFLOWS
+	}
+
+	var sumRtt, totalRetrans uint
+
+	rp.subflow_results = make([]mptcp_subflow_results, 0, num)
+
+	prev := sp.result.subflow_prev_total_retrans
+	sp.result.subflow_prev_total_retrans = make([]uint, num)
+
+	for i := 0; i < num; i++ {
+		tcpInfo := &subflows.Subflows[i]
+
+		// a subflow that took the index of a closed one starts over with its own counter
+		var prevRetrans uint
+		if i < len(prev) {
+			prevRetrans = prev[i]
+		}
+
+		rp.subflow_results = append(rp.subflow_results, mptcp_subflow_results{
+			rtt:              uint(tcpInfo.Rtt),
+			rto:              uint(tcpInfo.Rto),
+			snd_cwnd:         uint(tcpInfo.Snd_cwnd),
+			total_retrans:    uint(tcpInfo.Total_retrans),
+			interval_retrans: uint(counterDelta(uint64(tcpInfo.Total_retrans), uint64(prevRetrans))),
+		})
+
+		sp.result.subflow_prev_total_retrans[i] = uint(tcpInfo.Total_retrans)
+
+		sumRtt += uint(tcpInfo.Rtt)
+		totalRetrans += uint(tcpInfo.Total_retrans)
+	}
+
+	rp.mptcp_subflows = uint(subflows.Num_subflows)
+	if num > 0 {
+		rp.rtt = sumRtt / uint(num)
+		rp.rto = uint(subflows.Subflows[0].Rto)
+	}
+
+	rp.interval_retrans = totalRetrans
+
+	return 0
+}
+
+func getsockoptRaw(fd, level, opt int, val unsafe.Pointer, size uintptr) (uintptr, error) {
+	vallen := uint32(size)
+
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(val), uintptr(unsafe.Pointer(&vallen)), 0)
+	if e != 0 {
+		return 0, e
+	}
+
+	return uintptr(vallen), nil
+}
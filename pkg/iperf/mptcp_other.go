@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"net"
+	"net/netip"
+)
+
+func mptcpListen(network, address string, setup func(fd uintptr) error) (net.Listener, error) {
+	return nil, errMPTCPUnavailable
+}
+
+func mptcpDial(network, address string, laddr netip.AddrPort, setup func(fd uintptr) error) (net.Conn, error) {
+	return nil, errMPTCPUnavailable
+}
+
+func mptcpNegotiated(conn net.Conn) bool {
+	return false
+}
+
+func saveMPTCPInfo(sp *iperfStream, rp *iperf_interval_results) int {
+	return saveTCPInfo(sp, rp)
+}
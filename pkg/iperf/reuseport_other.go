@@ -0,0 +1,19 @@
+//go:build !unix || solaris
+// +build !unix solaris
+
+package iperf
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	Log.Warning("SO_REUSEPORT not supported on this platform")
+
+	return nil
+}
+
+func setReusePort(fd uintptr) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
@@ -0,0 +1,39 @@
+//go:build unix && !solaris
+// +build unix,!solaris
+
+package iperf
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEADDR and SO_REUSEPORT, so that a connected udp socket can share the port
+// of the listening one. The kernel delivers datagrams of the connected peer to the connected socket.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+
+	cerr := c.Control(func(fd uintptr) {
+		err = setReusePort(fd)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// setReusePort sets SO_REUSEADDR and SO_REUSEPORT of a socket before the bind
+func setReusePort(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+	}
+
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+		return os.NewSyscallError("setsockopt SO_REUSEPORT", err)
+	}
+
+	return nil
+}
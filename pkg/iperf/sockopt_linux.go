@@ -0,0 +1,154 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// setTCPWindowMSS sets SO_SNDBUF, SO_RCVBUF and TCP_MAXSEG of a tcp socket, a value of 0 leaves the option alone.
+// The window scale is chosen from the receive buffer at SYN time and the MSS is announced in the SYN, so both
+// take effect only when set before connect or on the listening socket the stream is accepted from.
+func setTCPWindowMSS(fd uintptr, window, mss int) error {
+	if window > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, window); err != nil {
+			return fmt.Errorf("SO_SNDBUF: %w", err)
+		}
+
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, window); err != nil {
+			return fmt.Errorf("SO_RCVBUF: %w", err)
+		}
+	}
+
+	if mss > 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss); err != nil {
+			return fmt.Errorf("TCP_MAXSEG: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// tcpWindowMSS reads back the socket buffers and the MSS the kernel granted a connected stream. Linux doubles
+// the requested buffer sizes to leave room for its bookkeeping and caps them at net.core.wmem_max / rmem_max.
+func tcpWindowMSS(conn net.Conn) (snd, rcv, mss int, err error) {
+	err = controlFd(conn, func(fd int) error {
+		var err error
+
+		if snd, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+			return err
+		}
+
+		if rcv, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+			return err
+		}
+
+		mss, err = unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+
+		return err
+	})
+
+	return snd, rcv, mss, err
+}
+
+// bindToDevice binds a socket to an interface with SO_BINDTODEVICE, streams accepted from a listener inherit it
+func bindToDevice(fd uintptr, dev string) error {
+	if err := unix.BindToDevice(int(fd), dev); err != nil {
+		return os.NewSyscallError("setsockopt SO_BINDTODEVICE "+dev, err)
+	}
+
+	return nil
+}
+
+// bindFd binds a socket to a local address, the wildcard address of the socket family if addr has none
+func bindFd(fd uintptr, addr netip.AddrPort) error {
+	var sa unix.Sockaddr
+
+	if addr.Addr().Is4() {
+		sa = &unix.SockaddrInet4{Port: int(addr.Port()), Addr: addr.Addr().As4()}
+	} else if addr.Addr().IsValid() || socketFamily(fd) == unix.AF_INET6 {
+		sa6 := &unix.SockaddrInet6{Port: int(addr.Port()), Addr: addr.Addr().As16()}
+
+		if zone := addr.Addr().Zone(); zone != "" {
+			if ifi, err := net.InterfaceByName(zone); err == nil {
+				sa6.ZoneId = uint32(ifi.Index)
+			}
+		}
+
+		sa = sa6
+	} else {
+		sa = &unix.SockaddrInet4{Port: int(addr.Port())}
+	}
+
+	if err := unix.Bind(int(fd), sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	return nil
+}
+
+// setMaxPacingRate sets SO_MAX_PACING_RATE (bytes/s) of a socket
+func setMaxPacingRate(fd uintptr, rate uint64) error {
+	if err := unix.SetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, rate); err != nil {
+		return os.NewSyscallError("setsockopt SO_MAX_PACING_RATE", err)
+	}
+
+	return nil
+}
+
+// maxPacingRate reads back SO_MAX_PACING_RATE (bytes/s) of a connected socket
+func maxPacingRate(conn net.Conn) (uint64, error) {
+	var rate uint64
+
+	err := controlFd(conn, func(fd int) error {
+		var err error
+
+		rate, err = unix.GetsockoptUint64(fd, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE)
+
+		return err
+	})
+
+	return rate, err
+}
+
+// setTCPCongestion sets TCP_CONGESTION of a tcp socket. Streams accepted from a listener inherit its algorithm.
+func setTCPCongestion(fd uintptr, name string) error {
+	if err := unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, name); err != nil {
+		return fmt.Errorf("TCP_CONGESTION %v: %w", name, err)
+	}
+
+	return nil
+}
+
+// tcpCongestion reads back the congestion control algorithm a stream runs
+func tcpCongestion(conn net.Conn) (string, error) {
+	var name string
+
+	err := controlFd(conn, func(fd int) error {
+		var err error
+
+		name, err = unix.GetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+
+		return err
+	})
+
+	// the name comes back padded to TCP_CA_NAME_MAX
+	return strings.TrimRight(name, "\x00"), err
+}
+
+// availableCongestion lists the congestion control algorithms the kernel has loaded
+func availableCongestion() ([]string, error) {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(data)), nil
+}
@@ -0,0 +1,50 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func setTCPWindowMSS(fd uintptr, window, mss int) error {
+	Log.Warning("-w and -M not supported on this platform")
+
+	return nil
+}
+
+func tcpWindowMSS(conn net.Conn) (snd, rcv, mss int, err error) {
+	return 0, 0, 0, errors.New("not supported on this platform")
+}
+
+func bindToDevice(fd uintptr, dev string) error {
+	return errors.New("--bind-dev not supported on this platform")
+}
+
+func bindFd(fd uintptr, addr netip.AddrPort) error {
+	return errors.New("bind not supported on this platform")
+}
+
+func setMaxPacingRate(fd uintptr, rate uint64) error {
+	Log.Warning("-fq-rate not supported on this platform")
+
+	return nil
+}
+
+func maxPacingRate(conn net.Conn) (uint64, error) {
+	return 0, errors.New("not supported on this platform")
+}
+
+func setTCPCongestion(fd uintptr, name string) error {
+	return errors.New("TCP_CONGESTION not supported on this platform")
+}
+
+func tcpCongestion(conn net.Conn) (string, error) {
+	return "", errors.New("not supported on this platform")
+}
+
+func availableCongestion() ([]string, error) {
+	return nil, errors.New("not supported on this platform")
+}
@@ -6,6 +6,7 @@ package iperf
 import (
 	"fmt"
 	"net"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -16,23 +17,41 @@ func saveTCPInfo(sp *iperfStream, rp *iperf_interval_results) int {
 	rp.rtt = uint(info.Rtt)
 	rp.rto = uint(info.Rto)
 	rp.interval_retrans = uint(info.Total_retrans)
+	rp.pacing_rate = info.Pacing_rate
+	rp.max_pacing_rate = info.Max_pacing_rate
+
+	// the counters are totals here, updateTCPStats turns them into the interval values
+	rp.tcp_info = TCPInfo{
+		Cwnd:          info.Snd_cwnd,
+		Ssthresh:      info.Snd_ssthresh,
+		SndWnd:        info.Snd_wnd,
+		RcvSpace:      info.Rcv_space,
+		Unacked:       info.Unacked,
+		NotsentBytes:  info.Notsent_bytes,
+		MinRTT:        time.Duration(info.Min_rtt) * time.Microsecond,
+		PacingRate:    info.Pacing_rate,
+		DeliveryRate:  info.Delivery_rate,
+		BusyTime:      time.Duration(info.Busy_time) * time.Microsecond,
+		RwndLimited:   time.Duration(info.Rwnd_limited) * time.Microsecond,
+		SndbufLimited: time.Duration(info.Sndbuf_limited) * time.Microsecond,
+		BytesAcked:    info.Bytes_acked,
+	}
 
 	return 0
 }
 
 func getTCPInfo(conn net.Conn) *unix.TCPInfo {
-	file, err := conn.(*net.TCPConn).File()
-	if err != nil {
-		fmt.Printf("File err: %v\n", err)
-
-		return &unix.TCPInfo{}
-	}
+	var info *unix.TCPInfo
 
-	defer file.Close()
+	// use the raw fd instead of conn.File(): File().Fd() switches the socket to blocking mode,
+	// which makes a pending Read unable to be interrupted by Close.
+	err := controlFd(conn, func(fd int) error {
+		var err error
 
-	fd := file.Fd()
+		info, err = unix.GetsockoptTCPInfo(fd, unix.SOL_TCP, unix.TCP_INFO)
 
-	info, err := unix.GetsockoptTCPInfo(int(fd), unix.SOL_TCP, unix.TCP_INFO)
+		return err
+	})
 	if err != nil {
 		fmt.Printf("GetsockoptTCPInfo err: %v\n", err)
 
@@ -0,0 +1,203 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	IPV6_FLOWLABEL_MGR = 32 // setsockopt(IPPROTO_IPV6) struct in6_flowlabel_req, linux/in6.h
+	IPV6_FLOWINFO_SEND = 33
+	IPV6_FL_A_GET      = 0
+	IPV6_FL_F_CREATE   = 1
+	IPV6_FL_F_REFLECT  = 4
+	IPV6_FL_S_ANY      = 255
+)
+
+// in6FlowlabelReq mirrors struct in6_flowlabel_req in linux/in6.h
+type in6FlowlabelReq struct {
+	Dst     [16]byte
+	Label   [4]byte // network byte order
+	Action  uint8
+	Share   uint8
+	Flags   uint16
+	Expires uint16
+	Linger  uint16
+	_       uint32
+}
+
+// socketFamily returns AF_INET or AF_INET6
+func socketFamily(fd uintptr) int {
+	family, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return unix.AF_INET
+	}
+
+	return family
+}
+
+// setTOS sets the TOS byte of a socket. An ipv6 socket gets the traffic class as well, IP_TOS still marks the
+// ipv4 packets it sends to v4-mapped addresses.
+func setTOS(fd uintptr, tos int) error {
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+		return os.NewSyscallError("setsockopt IP_TOS", err)
+	}
+
+	if socketFamily(fd) == unix.AF_INET6 {
+		err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		if err == unix.EOPNOTSUPP && isMPTCPSocket(fd) {
+			// mptcp sockets only take IP_TOS
+			Log.Debugf("IPV6_TCLASS not supported by the mptcp socket, only IP_TOS set")
+		} else if err != nil {
+			return os.NewSyscallError("setsockopt IPV6_TCLASS", err)
+		}
+	}
+
+	return nil
+}
+
+// isMPTCPSocket reports whether fd is an IPPROTO_MPTCP socket
+func isMPTCPSocket(fd uintptr) bool {
+	proto, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PROTOCOL)
+
+	return err == nil && proto == unix.IPPROTO_MPTCP
+}
+
+// enableRecvTOS asks for the TOS (traffic class) of the received packets
+func enableRecvTOS(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1); err != nil {
+		return os.NewSyscallError("setsockopt IP_RECVTOS", err)
+	}
+
+	if socketFamily(fd) == unix.AF_INET6 {
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1); err != nil {
+			return os.NewSyscallError("setsockopt IPV6_RECVTCLASS", err)
+		}
+	}
+
+	return nil
+}
+
+// receivedTOS finds the TOS in the control messages of a received packet. IP_TOS comes as a byte with udp and
+// as an int in the tcp packet options, IPV6_TCLASS always as an int.
+func receivedTOS(oob []byte) (int, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range msgs {
+		if len(m.Data) == 0 {
+			continue
+		}
+
+		if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS {
+			return int(m.Data[0]), true
+		}
+
+		if m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0]))), true
+		}
+	}
+
+	return 0, false
+}
+
+// tcpReceivedTOS returns the traffic class of the last segment an ipv6 tcp stream with IPV6_RECVTCLASS set
+// received. The kernel keeps nothing alike for ipv4, not even for v4-mapped addresses.
+func tcpReceivedTOS(conn net.Conn) (int, bool) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || addr.IP.To4() != nil {
+		return 0, false
+	}
+
+	var tos int
+	var ok bool
+
+	_ = controlFd(conn, func(fd int) error {
+		tos, ok = receivedTOS(packetOptions(fd, unix.IPPROTO_IPV6, unix.IPV6_2292PKTOPTIONS))
+
+		return nil
+	})
+
+	return tos, ok
+}
+
+// packetOptions reads the control messages a tcp socket keeps of the received segments
+func packetOptions(fd, level, opt int) []byte {
+	buf := make([]byte, TOS_OOB_SIZE)
+	size := uint32(len(buf))
+
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return nil
+	}
+
+	return buf[:size]
+}
+
+// connectFlowLabel leases the flow label for the destination and connects the socket with it, the kernel only
+// takes a flow label from the address given to connect. A non-blocking tcp socket is left connecting, the
+// caller waits for it. The label does not apply to ipv4 destinations, they are left alone.
+func connectFlowLabel(fd uintptr, addr netip.AddrPort, label uint32) error {
+	ip := addr.Addr()
+	if !ip.Is6() || ip.Is4In6() {
+		return nil
+	}
+
+	req := in6FlowlabelReq{Dst: ip.As16(), Action: IPV6_FL_A_GET, Share: IPV6_FL_S_ANY, Flags: IPV6_FL_F_CREATE}
+	binary.BigEndian.PutUint32(req.Label[:], label)
+
+	if err := setFlowlabelMgr(fd, &req); err != nil {
+		return err
+	}
+
+	if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, IPV6_FLOWINFO_SEND, 1); err != nil {
+		return os.NewSyscallError("setsockopt IPV6_FLOWINFO_SEND", err)
+	}
+
+	sa := unix.RawSockaddrInet6{Family: unix.AF_INET6, Addr: ip.As16()}
+	binary.BigEndian.PutUint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:], addr.Port())
+	binary.BigEndian.PutUint32((*[4]byte)(unsafe.Pointer(&sa.Flowinfo))[:], label)
+
+	if ip.Zone() != "" {
+		if ifi, err := net.InterfaceByName(ip.Zone()); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		}
+	}
+
+	_, _, errno := unix.Syscall(unix.SYS_CONNECT, fd, uintptr(unsafe.Pointer(&sa)), unsafe.Sizeof(sa))
+	if errno != 0 && errno != unix.EINPROGRESS {
+		return os.NewSyscallError("connect", errno)
+	}
+
+	return nil
+}
+
+// reflectFlowLabel makes the tcp streams accepted from a listener send with the flow label of their peer. The
+// kernel refuses it unless net.ipv6.flowlabel_consistency is 0.
+func reflectFlowLabel(fd uintptr) error {
+	if socketFamily(fd) != unix.AF_INET6 {
+		return nil
+	}
+
+	return setFlowlabelMgr(fd, &in6FlowlabelReq{Action: IPV6_FL_A_GET, Flags: IPV6_FL_F_REFLECT})
+}
+
+func setFlowlabelMgr(fd uintptr, req *in6FlowlabelReq) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, fd, unix.IPPROTO_IPV6, IPV6_FLOWLABEL_MGR,
+		uintptr(unsafe.Pointer(req)), unsafe.Sizeof(*req), 0)
+	if errno != 0 {
+		return os.NewSyscallError("setsockopt IPV6_FLOWLABEL_MGR", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+func setTOS(fd uintptr, tos int) error {
+	Log.Debugf("TOS %v not set, not supported on this platform", tos)
+
+	return nil
+}
+
+func enableRecvTOS(fd uintptr) error {
+	return nil
+}
+
+func receivedTOS(oob []byte) (int, bool) {
+	return 0, false
+}
+
+func tcpReceivedTOS(conn net.Conn) (int, bool) {
+	return 0, false
+}
+
+func connectFlowLabel(fd uintptr, addr netip.AddrPort, label uint32) error {
+	return errors.New("-L not supported on this platform")
+}
+
+func reflectFlowLabel(fd uintptr) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build unix
+// +build unix
+
+package iperf
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// echoAcceptSignals answers the accept signals a client repeats after the echo of the listener got lost, they
+// reach the connected socket of the stream. It holds the read side of the socket until another datagram comes,
+// which it leaves to the stream, or until the socket is closed or its read deadline passes.
+func echoAcceptSignals(conn *net.UDPConn) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	buf := make([]byte, 9) // a longer datagram is no signal
+
+	for {
+		signal := false
+
+		err = rc.Read(func(fd uintptr) bool {
+			n, _, err := unix.Recvfrom(int(fd), buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+			if err == unix.EAGAIN || err == unix.EINTR {
+				return false
+			}
+
+			if err == nil && isAcceptSignal(buf[:n]) {
+				_, _, err = unix.Recvfrom(int(fd), buf, unix.MSG_DONTWAIT)
+				signal = err == nil
+			}
+
+			return true
+		})
+
+		if err != nil || !signal {
+			return
+		}
+
+		Log.Debugf("UDP accept signal repeated, echo it again. remote = %v", conn.RemoteAddr())
+
+		if _, err = conn.Write(buf[:8]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const UDP_OOB_SIZE = 32 // room for the UDP_SEGMENT or UDP_GRO control message
+
+// mmsghdr mirrors struct mmsghdr in sys/socket.h
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsg holds the headers sendmmsg and recvmmsg take, allocated once for a stream
+type mmsg struct {
+	hdrs []mmsghdr
+	iovs []unix.Iovec
+	oobs []byte // a control message for every header
+}
+
+func newMmsg(n int) *mmsg {
+	return &mmsg{hdrs: make([]mmsghdr, n), iovs: make([]unix.Iovec, n), oobs: make([]byte, n*UDP_OOB_SIZE)}
+}
+
+// setup points the headers at bufs
+func (m *mmsg) setup(bufs [][]byte) {
+	for i, b := range bufs {
+		m.iovs[i].Base = &b[0]
+		m.iovs[i].SetLen(len(b))
+
+		m.hdrs[i] = mmsghdr{}
+		m.hdrs[i].hdr.Iov = &m.iovs[i]
+		m.hdrs[i].hdr.SetIovlen(1)
+	}
+}
+
+// send sends bufs with sendmmsg, the kernel splits a buffer longer than gso into datagrams of gso bytes. It
+// returns the syscalls it took, a full socket buffer may need more than one.
+func (m *mmsg) send(rc syscall.RawConn, bufs [][]byte, gso int) (uint64, error) {
+	m.setup(bufs)
+
+	for i, b := range bufs {
+		if gso == 0 || len(b) <= gso {
+			continue
+		}
+
+		oob := m.oobs[i*UDP_OOB_SIZE : i*UDP_OOB_SIZE+unix.CmsgSpace(2)]
+
+		cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		cmsg.Level = unix.SOL_UDP
+		cmsg.Type = unix.UDP_SEGMENT
+		cmsg.SetLen(unix.CmsgLen(2))
+		*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(gso)
+
+		m.hdrs[i].hdr.Control = &oob[0]
+		m.hdrs[i].hdr.SetControllen(len(oob))
+	}
+
+	var syscalls uint64
+	var serr error
+
+	sent := 0
+
+	err := rc.Write(func(fd uintptr) bool {
+		for sent < len(bufs) {
+			n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&m.hdrs[sent])),
+				uintptr(len(bufs)-sent), 0, 0, 0)
+			syscalls++
+
+			if errno == unix.EAGAIN {
+				return false
+			}
+
+			if errno != 0 {
+				serr = os.NewSyscallError("sendmmsg", errno)
+
+				return true
+			}
+
+			sent += int(n)
+		}
+
+		return true
+	})
+	if err != nil {
+		return syscalls, err
+	}
+
+	return syscalls, serr
+}
+
+// recv reads up to len(bufs) datagrams with one recvmmsg, their sizes go to sizes. With gro a datagram may hold
+// several coalesced ones, segs gets the size they had, 0 for a single one.
+func (m *mmsg) recv(rc syscall.RawConn, bufs [][]byte, sizes, segs []int, gro bool) (int, uint64, error) {
+	m.setup(bufs)
+
+	if gro {
+		for i := range bufs {
+			m.hdrs[i].hdr.Control = &m.oobs[i*UDP_OOB_SIZE]
+			m.hdrs[i].hdr.SetControllen(UDP_OOB_SIZE)
+		}
+	}
+
+	var syscalls uint64
+	var serr error
+
+	received := 0
+
+	err := rc.Read(func(fd uintptr) bool {
+		n, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&m.hdrs[0])), uintptr(len(bufs)),
+			0, 0, 0)
+		syscalls++
+
+		if errno == unix.EAGAIN {
+			return false
+		}
+
+		if errno != 0 {
+			serr = os.NewSyscallError("recvmmsg", errno)
+		} else {
+			received = int(n)
+		}
+
+		return true
+	})
+	if err != nil {
+		return 0, syscalls, err
+	}
+
+	if serr != nil {
+		return 0, syscalls, serr
+	}
+
+	for i := 0; i < received; i++ {
+		sizes[i] = int(m.hdrs[i].len)
+		segs[i] = 0
+
+		if gro {
+			segs[i] = groSegment(m.oobs[i*UDP_OOB_SIZE : i*UDP_OOB_SIZE+int(m.hdrs[i].hdr.Controllen)])
+		}
+	}
+
+	return received, syscalls, nil
+}
+
+// groSegment finds the size of the coalesced datagrams in the control messages
+func groSegment(oob []byte) int {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == unix.SOL_UDP && m.Header.Type == unix.UDP_GRO && len(m.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&m.Data[0])))
+		}
+	}
+
+	return 0
+}
+
+// enableGRO lets the kernel coalesce the received datagrams of a udp socket
+func enableGRO(fd uintptr) error {
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_UDP, unix.UDP_GRO, 1); err != nil {
+		return os.NewSyscallError("setsockopt UDP_GRO", err)
+	}
+
+	return nil
+}
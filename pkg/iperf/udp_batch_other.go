@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"errors"
+	"syscall"
+)
+
+type mmsg struct{}
+
+func newMmsg(n int) *mmsg {
+	return nil
+}
+
+func (m *mmsg) send(rc syscall.RawConn, bufs [][]byte, gso int) (uint64, error) {
+	return 0, errors.New("udp batching not supported on this platform")
+}
+
+func (m *mmsg) recv(rc syscall.RawConn, bufs [][]byte, sizes, segs []int, gro bool) (int, uint64, error) {
+	return 0, 0, errors.New("udp batching not supported on this platform")
+}
+
+func enableGRO(fd uintptr) error {
+	return errors.New("-gro not supported on this platform")
+}
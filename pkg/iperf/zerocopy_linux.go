@@ -0,0 +1,213 @@
+//go:build linux
+// +build linux
+
+package iperf
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const ZEROCOPY_WAIT = 10 // ms, wait for completions when the pending MSG_ZEROCOPY sends use up the socket memory
+
+// zeroCopy sends the blocks of a tcp stream without copying them from user space. By default the block is put
+// in a memfd once and sent with sendfile. With MSG_ZEROCOPY the kernel pins the block instead and reports on the
+// socket error queue when it has been sent, the notifications are drained after every send.
+type zeroCopy struct {
+	memfd  int
+	buf    []byte // the block, must not change while MSG_ZEROCOPY sends are in flight
+	msg    bool
+	oob    []byte // completion notifications read from the error queue
+	sent   uint64 // MSG_ZEROCOPY sends issued
+	done   uint64 // sends the kernel reported complete
+	copied uint64 // completed sends the kernel copied after all, e.g. on loopback
+}
+
+func newZeroCopy(sp *iperfStream, msg bool) (*zeroCopy, error) {
+	z := &zeroCopy{memfd: -1, msg: msg}
+
+	z.buf = make([]byte, len(sp.buffer))
+	copy(z.buf, sp.buffer)
+
+	if msg {
+		err := controlFd(sp.conn, func(fd int) error {
+			return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("enable SO_ZEROCOPY: %w", err)
+		}
+
+		z.oob = make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.SockExtendedErr{}))+unix.SizeofSockaddrInet6))
+
+		return z, nil
+	}
+
+	fd, err := unix.MemfdCreate("iperf-payload", unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("memfd_create: %w", err)
+	}
+
+	if _, err = unix.Pwrite(fd, z.buf, 0); err != nil {
+		unix.Close(fd)
+
+		return nil, fmt.Errorf("write memfd: %w", err)
+	}
+
+	z.memfd = fd
+
+	return z, nil
+}
+
+// send sends size bytes of the block on conn, it returns like net.Conn.Write
+func (z *zeroCopy) send(conn net.Conn, size int) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("conn %T does not expose its file descriptor", conn)
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+
+	var opErr error
+
+	err = rc.Write(func(fd uintptr) bool {
+		for sent < size {
+			var n int
+
+			if z.msg {
+				n, opErr = unix.SendmsgN(int(fd), z.buf[sent:size], nil, nil, unix.MSG_ZEROCOPY)
+			} else {
+				off := int64(sent)
+				n, opErr = unix.Sendfile(int(fd), z.memfd, &off, size-sent)
+			}
+
+			if opErr == unix.ENOBUFS && z.msg {
+				// the pending MSG_ZEROCOPY sends use up the option memory of the socket, their completions free
+				// it. The socket may be writable meanwhile, so wait on the error queue instead
+				if !z.waitCompletion(int(fd)) {
+					return true
+				}
+
+				opErr = nil
+
+				continue
+			} else if opErr == unix.EAGAIN {
+				// socket buffer full, wait for the socket to be ready
+				if z.msg {
+					z.drain(int(fd))
+				}
+
+				opErr = nil
+
+				return false
+			} else if opErr != nil {
+				return true
+			}
+
+			sent += n
+
+			if z.msg {
+				z.sent++
+				z.drain(int(fd))
+			}
+		}
+
+		return true
+	})
+	if err == nil {
+		err = opErr
+	}
+
+	if err != nil {
+		return sent, &net.OpError{Op: "write", Net: "tcp", Addr: conn.RemoteAddr(), Err: err}
+	}
+
+	return sent, nil
+}
+
+// waitCompletion drains the completion notifications, and if there are none waits up to ZEROCOPY_WAIT ms for the
+// error queue. It reports false if no MSG_ZEROCOPY send is in flight, there is nothing to wait for then.
+func (z *zeroCopy) waitCompletion(fd int) bool {
+	done := z.done
+
+	z.drain(fd)
+
+	if z.done != done {
+		return true
+	} else if z.done == z.sent {
+		return false
+	}
+
+	// POLLERR is always reported, it signals the error queue
+	fds := []unix.PollFd{{Fd: int32(fd)}}
+	unix.Poll(fds, ZEROCOPY_WAIT)
+
+	z.drain(fd)
+
+	return true
+}
+
+// drain reads the MSG_ZEROCOPY completion notifications from the socket error queue without blocking
+func (z *zeroCopy) drain(fd int) {
+	for {
+		_, oobn, _, _, err := unix.Recvmsg(fd, nil, z.oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil {
+			return
+		}
+
+		msgs, err := unix.ParseSocketControlMessage(z.oob[:oobn])
+		if err != nil {
+			return
+		}
+
+		for _, m := range msgs {
+			isRecvErr := (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+				(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+			if !isRecvErr || len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+				continue
+			}
+
+			ee := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if ee.Origin != unix.SO_EE_ORIGIN_ZEROCOPY {
+				continue
+			}
+
+			// the notification covers the sends numbered from Info to Data
+			completed := uint64(ee.Data-ee.Info) + 1
+
+			z.done += completed
+			if ee.Code&unix.SO_EE_CODE_ZEROCOPY_COPIED != 0 {
+				z.copied += completed
+			}
+		}
+	}
+}
+
+func (z *zeroCopy) close() {
+	if z.memfd >= 0 {
+		unix.Close(z.memfd)
+		z.memfd = -1
+	}
+}
+
+// String describes how the blocks were sent, for the summary
+func (z *zeroCopy) String() string {
+	if !z.msg {
+		return "sendfile from memfd"
+	}
+
+	copied := 0.0
+	if z.done > 0 {
+		copied = float64(z.copied) / float64(z.done) * 100
+	}
+
+	return fmt.Sprintf("MSG_ZEROCOPY %v sends, %v completed, %.1f%% copied by the kernel", z.sent, z.done, copied)
+}
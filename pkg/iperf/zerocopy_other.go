@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package iperf
+
+import (
+	"errors"
+	"net"
+)
+
+type zeroCopy struct{}
+
+func newZeroCopy(sp *iperfStream, msg bool) (*zeroCopy, error) {
+	return nil, errors.New("zero copy not supported on this platform")
+}
+
+func (z *zeroCopy) send(conn net.Conn, size int) (int, error) {
+	return 0, errors.New("zero copy not supported on this platform")
+}
+
+func (z *zeroCopy) close() {
+}
+
+func (z *zeroCopy) String() string {
+	return ""
+}